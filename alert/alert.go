@@ -0,0 +1,243 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/diag_backend/notify"
+	"github.com/zhongzc/diag_backend/storage/query"
+
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+const (
+	StatePending   = "pending"
+	StateFiring    = "firing"
+	StateResolving = "resolving"
+)
+
+var (
+	evalInterval = pflag.Duration("alert.eval-interval", time.Minute, "Interval between evaluations of the alert rules")
+)
+
+type Alert struct {
+	Rule   string            `json:"rule"`
+	Labels map[string]string `json:"labels"`
+	State  string            `json:"state"`
+	Value  float64           `json:"value"`
+	// SinceSecs is when the alert entered its current state.
+	SinceSecs int64 `json:"since_secs"`
+	FiredSecs int64 `json:"fired_secs,omitempty"`
+}
+
+var (
+	mu     sync.Mutex
+	rules  = make(map[string]Rule)
+	alerts = make(map[string]*Alert) // rule name + labels -> alert
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+)
+
+func Init() {
+	stopCh = make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(*evalInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				evaluate(time.Now())
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func Stop() {
+	if stopCh == nil {
+		return
+	}
+	close(stopCh)
+	wg.Wait()
+}
+
+// AddRule adds a rule or replaces the one with the same name.
+func AddRule(r Rule) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	rules[r.Name] = r
+	// The replaced rule may have a different meaning, start over.
+	dropAlertsOf(r.Name)
+	return nil
+}
+
+func RemoveRule(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	delete(rules, name)
+	dropAlertsOf(name)
+}
+
+func Rules() []Rule {
+	mu.Lock()
+	defer mu.Unlock()
+
+	res := make([]Rule, 0, len(rules))
+	for _, r := range rules {
+		res = append(res, r)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
+
+// ActiveAlerts returns the pending, firing and resolving alerts.
+func ActiveAlerts() []Alert {
+	mu.Lock()
+	defer mu.Unlock()
+
+	res := make([]Alert, 0, len(alerts))
+	for _, a := range alerts {
+		res = append(res, *a)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Rule != res[j].Rule {
+			return res[i].Rule < res[j].Rule
+		}
+		return res[i].SinceSecs < res[j].SinceSecs
+	})
+	return res
+}
+
+func dropAlertsOf(rule string) {
+	for key, a := range alerts {
+		if a.Rule == rule {
+			delete(alerts, key)
+		}
+	}
+}
+
+func evaluate(now time.Time) {
+	windowSecs := int((*evalInterval).Seconds())
+	if windowSecs <= 0 {
+		windowSecs = 1
+	}
+
+	for _, r := range Rules() {
+		var samples []query.InstantSample
+		if err := query.InstantQuery(context.Background(), r.promQL(windowSecs), int(now.Unix()), &samples); err != nil {
+			// Keep the states as they are, a failed query says nothing about the data.
+			log.Warn("failed to evaluate alert rule", zap.String("rule", r.Name), zap.Error(err))
+			continue
+		}
+		apply(r, samples, now)
+	}
+}
+
+// apply advances the alert states of rule r with the samples of one evaluation.
+func apply(r Rule, samples []query.InstantSample, now time.Time) {
+	nowSecs := now.Unix()
+	met := make(map[string]struct{})
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The rule was removed or replaced during the query.
+	if current, ok := rules[r.Name]; !ok || !sameRule(current, r) {
+		return
+	}
+
+	for _, sample := range samples {
+		if !r.matches(sample.Value) {
+			continue
+		}
+
+		key := alertKey(r.Name, sample.Labels)
+		met[key] = struct{}{}
+
+		a, ok := alerts[key]
+		if !ok {
+			a = &Alert{Rule: r.Name, Labels: sample.Labels, State: StatePending, SinceSecs: nowSecs}
+			alerts[key] = a
+		}
+		a.Value = sample.Value
+
+		switch a.State {
+		case StatePending:
+			if nowSecs-a.SinceSecs >= int64(r.ForSecs) {
+				a.State = StateFiring
+				a.SinceSecs = nowSecs
+				a.FiredSecs = nowSecs
+				notifyAlert(notify.EventAlertFiring, a)
+			}
+		case StateResolving:
+			a.State = StateFiring
+			a.SinceSecs = nowSecs
+		}
+	}
+
+	// Missing series are treated the same as series below the threshold.
+	for key, a := range alerts {
+		if _, ok := met[key]; ok || a.Rule != r.Name {
+			continue
+		}
+
+		switch a.State {
+		case StatePending:
+			delete(alerts, key)
+		case StateFiring:
+			a.State = StateResolving
+			a.SinceSecs = nowSecs
+			fallthrough
+		case StateResolving:
+			if nowSecs-a.SinceSecs >= int64(r.ResolveDelaySecs) {
+				delete(alerts, key)
+				notifyAlert(notify.EventAlertResolved, a)
+			}
+		}
+	}
+}
+
+func sameRule(a, b Rule) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
+
+func alertKey(rule string, labels map[string]string) string {
+	// json.Marshal sorts map keys, giving a stable representation.
+	l, _ := json.Marshal(labels)
+	return fmt.Sprintf("%s/%s", rule, l)
+}
+
+func notifyAlert(eventType string, a *Alert) {
+	notify.Notify(notify.Event{
+		Type:      eventType,
+		Instance:  a.Labels["instance"],
+		Digest:    a.Labels["sql_digest"],
+		FirstSeen: a.FiredSecs,
+		Rule:      a.Rule,
+		Labels:    a.Labels,
+		Value:     a.Value,
+	})
+}
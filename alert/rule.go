@@ -0,0 +1,73 @@
+package alert
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type Comparison string
+
+const (
+	GreaterThan    Comparison = ">"
+	GreaterOrEqual Comparison = ">="
+	LessThan       Comparison = "<"
+	LessOrEqual    Comparison = "<="
+)
+
+var identRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Rule fires when the sum of Metric over the evaluation interval, grouped by the
+// GroupBy labels, matches the comparison with Threshold for at least ForSecs.
+type Rule struct {
+	Name       string     `json:"name"`
+	Metric     string     `json:"metric"`
+	GroupBy    []string   `json:"group_by"`
+	Comparison Comparison `json:"comparison"`
+	Threshold  float64    `json:"threshold"`
+	ForSecs    int        `json:"for_secs"`
+	// ResolveDelaySecs is how long a firing alert must stay below the threshold
+	// before being resolved, to dampen flapping.
+	ResolveDelaySecs int `json:"resolve_delay_secs"`
+}
+
+func (r *Rule) validate() error {
+	if len(r.Name) == 0 {
+		return fmt.Errorf("empty rule name")
+	}
+	if !identRegexp.MatchString(r.Metric) {
+		return fmt.Errorf("invalid metric name %q", r.Metric)
+	}
+	for _, label := range r.GroupBy {
+		if !identRegexp.MatchString(label) {
+			return fmt.Errorf("invalid group by label %q", label)
+		}
+	}
+	switch r.Comparison {
+	case GreaterThan, GreaterOrEqual, LessThan, LessOrEqual:
+	default:
+		return fmt.Errorf("unsupported comparison %q", r.Comparison)
+	}
+	if r.ForSecs < 0 || r.ResolveDelaySecs < 0 {
+		return fmt.Errorf("negative duration")
+	}
+	return nil
+}
+
+func (r *Rule) promQL(windowSecs int) string {
+	return fmt.Sprintf("sum by (%s) (sum_over_time(%s[%ds]))", strings.Join(r.GroupBy, ", "), r.Metric, windowSecs)
+}
+
+func (r *Rule) matches(value float64) bool {
+	switch r.Comparison {
+	case GreaterThan:
+		return value > r.Threshold
+	case GreaterOrEqual:
+		return value >= r.Threshold
+	case LessThan:
+		return value < r.Threshold
+	case LessOrEqual:
+		return value <= r.Threshold
+	}
+	return false
+}
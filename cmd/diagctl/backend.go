@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+	"github.com/zhongzc/diag_backend/storage/query"
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/storage/textcrypt"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/engine/badgerengine"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+var errOfflineUnsupported = errors.New("not available in offline mode, the series live in the timeseries db")
+var errOnlineUnsupported = errors.New("only available in offline mode, pass --data-dir")
+var errMergeOffline = errors.New("not available in offline mode, the instances are normalized by the options of the server")
+
+// backend is what the subcommands run against, either the HTTP API of a running
+// server or a copied data directory.
+type backend interface {
+	instances() ([]query.InstanceItem, error)
+	mergeInstances() (int, error)
+	digest(digest string, includeDeleted bool) (query.DigestItem, error)
+	searchSQL(pattern string, opts query.SearchOptions) ([]query.SQLMetaItem, error)
+	topSQL(instance string, startSecs, endSecs, windowSecs, top int) ([]query.TopSQLItem, error)
+	metaStats() (query.MetaStatsItem, error)
+	deleteDigest(digest string) error
+	undeleteDigest(digest string) error
+	reencryptTexts() error
+	export(w io.Writer) error
+	backfill(r io.Reader) (int, error)
+	auditEvents(filter audit.Filter) ([]audit.Event, error)
+	close() error
+}
+
+type httpBackend struct {
+	client  *http.Client
+	baseURL *url.URL
+	apiKey  string
+}
+
+func newHTTPBackend(server, apiKey string) (*httpBackend, error) {
+	if !strings.Contains(server, "://") {
+		server = "http://" + server
+	}
+	u, err := url.Parse(server)
+	if err != nil {
+		return nil, err
+	}
+	return &httpBackend{client: &http.Client{Timeout: time.Minute}, baseURL: u, apiKey: apiKey}, nil
+}
+
+// call sends a request to the API and decodes the `data` of the response into target.
+func (b *httpBackend) call(method, apiPath string, params url.Values, target interface{}) error {
+	u := *b.baseURL
+	u.Path = path.Join(u.Path, apiPath)
+	u.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(context.Background(), method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if len(b.apiKey) != 0 {
+		req.Header.Set("Authorization", "Bearer "+b.apiKey)
+	}
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}{}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("unexpected response of %s, code: %d: %w", apiPath, resp.StatusCode, err)
+	}
+	if body.Status != "ok" {
+		return fmt.Errorf("%s, code: %d", body.Message, resp.StatusCode)
+	}
+	if target == nil || len(body.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(body.Data, target)
+}
+
+func (b *httpBackend) instances() ([]query.InstanceItem, error) {
+	var items []query.InstanceItem
+	err := b.call("GET", "/topsql/v1/instances", nil, &items)
+	return items, err
+}
+
+func (b *httpBackend) digest(digest string, includeDeleted bool) (query.DigestItem, error) {
+	var item query.DigestItem
+	err := b.call("GET", "/topsql/v1/digests/"+url.PathEscape(digest), url.Values{
+		"include_deleted": {strconv.FormatBool(includeDeleted)},
+	}, &item)
+	return item, err
+}
+
+func (b *httpBackend) searchSQL(pattern string, opts query.SearchOptions) ([]query.SQLMetaItem, error) {
+	var items []query.SQLMetaItem
+	params := url.Values{
+		"pattern":         {pattern},
+		"limit":           {strconv.Itoa(opts.Limit)},
+		"include_deleted": {strconv.FormatBool(opts.IncludeDeleted)},
+	}
+	if opts.Internal != nil {
+		params.Set("internal", strconv.FormatBool(*opts.Internal))
+	}
+	err := b.call("GET", "/topsql/v1/sql", params, &items)
+	return items, err
+}
+
+func (b *httpBackend) topSQL(instance string, startSecs, endSecs, windowSecs, top int) ([]query.TopSQLItem, error) {
+	var items []query.TopSQLItem
+	err := b.call("GET", "/topsql/v1/cpu_time", url.Values{
+		"instance": {instance},
+		"start":    {strconv.Itoa(startSecs)},
+		"end":      {strconv.Itoa(endSecs)},
+		"window":   {strconv.Itoa(windowSecs) + "s"},
+		"top":      {strconv.Itoa(top)},
+	}, &items)
+	return items, err
+}
+
+func (b *httpBackend) metaStats() (query.MetaStatsItem, error) {
+	var stats query.MetaStatsItem
+	err := b.call("GET", "/topsql/v1/meta_stats", nil, &stats)
+	return stats, err
+}
+
+func (b *httpBackend) deleteDigest(digest string) error {
+	return b.call("DELETE", "/topsql/v1/digests/"+url.PathEscape(digest), nil, nil)
+}
+
+func (b *httpBackend) undeleteDigest(digest string) error {
+	return b.call("POST", "/topsql/v1/digests/"+url.PathEscape(digest)+"/undelete", nil, nil)
+}
+
+func (b *httpBackend) mergeInstances() (int, error) {
+	var res struct {
+		Merged int `json:"merged"`
+	}
+	err := b.call("POST", "/topsql/v1/instances/merge", nil, &res)
+	return res.Merged, err
+}
+
+func (b *httpBackend) reencryptTexts() error {
+	return b.call("POST", "/topsql/v1/texts/reencrypt", nil, nil)
+}
+
+func (b *httpBackend) export(io.Writer) error {
+	return errOnlineUnsupported
+}
+
+func (b *httpBackend) backfill(io.Reader) (int, error) {
+	return 0, errOnlineUnsupported
+}
+
+func (b *httpBackend) auditEvents(filter audit.Filter) ([]audit.Event, error) {
+	var events []audit.Event
+	err := b.call("GET", "/audit/v1/events", url.Values{
+		"operation": {filter.Operation},
+		"caller":    {filter.Caller},
+		"start":     {strconv.FormatInt(filter.StartSecs, 10)},
+		"end":       {strconv.FormatInt(filter.EndSecs, 10)},
+		"limit":     {strconv.Itoa(filter.Limit)},
+	}, &events)
+	return events, err
+}
+
+func (b *httpBackend) close() error {
+	b.client.CloseIdleConnections()
+	return nil
+}
+
+// offlineBackend opens the document db of a data directory directly, which
+// must not be in use by a running server.
+type offlineBackend struct {
+	db *genji.DB
+}
+
+func newOfflineBackend(dataDir, keyringEnv string) (*offlineBackend, error) {
+	if err := textcrypt.InitFromEnv(keyringEnv); err != nil {
+		return nil, err
+	}
+
+	db, err := openDocumentDB(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	audit.Init(db)
+	store.Init(nil, db, nil)
+	query.Init(nil, db)
+	return &offlineBackend{db: db}, nil
+}
+
+// openDocumentDB opens the document db of a data directory.
+func openDocumentDB(dataDir string) (*genji.DB, error) {
+	option := badger.DefaultOptions(path.Join(dataDir, "docdb")).WithLogger(nil)
+	engine, err := badgerengine.NewEngine(option)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the document db of %s: %w", dataDir, err)
+	}
+	return genji.New(context.Background(), engine)
+}
+
+func (b *offlineBackend) instances() ([]query.InstanceItem, error) {
+	var items []query.InstanceItem
+	err := query.AllInstances(context.Background(), &items)
+	return items, err
+}
+
+func (b *offlineBackend) digest(digest string, includeDeleted bool) (query.DigestItem, error) {
+	item, err := query.Digest(context.Background(), digest, includeDeleted)
+	if err == nil && item.SQL == nil && item.Plan == nil {
+		err = errors.New("unknown digest")
+	}
+	return item, err
+}
+
+func (b *offlineBackend) searchSQL(pattern string, opts query.SearchOptions) ([]query.SQLMetaItem, error) {
+	var items []query.SQLMetaItem
+	err := query.SearchSQL(context.Background(), pattern, opts, &items)
+	return items, err
+}
+
+func (b *offlineBackend) topSQL(string, int, int, int, int) ([]query.TopSQLItem, error) {
+	return nil, errOfflineUnsupported
+}
+
+func (b *offlineBackend) metaStats() (query.MetaStatsItem, error) {
+	return query.MetaStats(context.Background())
+}
+
+func (b *offlineBackend) deleteDigest(digest string) error {
+	return store.DeleteDigest(offlineCaller(), store.DefaultTenant, digest)
+}
+
+func (b *offlineBackend) undeleteDigest(digest string) error {
+	return store.UndeleteDigest(offlineCaller(), store.DefaultTenant, digest)
+}
+
+func (b *offlineBackend) mergeInstances() (int, error) {
+	return 0, errMergeOffline
+}
+
+func (b *offlineBackend) reencryptTexts() error {
+	return store.ReencryptTexts(offlineCaller())
+}
+
+// exportItem is a line of the NDJSON produced by export and consumed by backfill.
+type exportItem struct {
+	Type       string `json:"type"` // sql or plan
+	Digest     string `json:"digest"`
+	SQLText    string `json:"sql_text,omitempty"`
+	IsInternal bool   `json:"is_internal,omitempty"`
+	PlanText   string `json:"plan_text,omitempty"`
+}
+
+func (b *offlineBackend) export(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	err := query.AllSQLMetas(context.Background(), func(item query.SQLMetaItem) error {
+		return encoder.Encode(exportItem{Type: "sql", Digest: item.Digest, SQLText: item.SQLText, IsInternal: item.IsInternal})
+	})
+	if err != nil {
+		return err
+	}
+	return query.AllPlanMetas(context.Background(), func(item query.PlanMetaItem) error {
+		return encoder.Encode(exportItem{Type: "plan", Digest: item.Digest, PlanText: item.PlanText})
+	})
+}
+
+const backfillBatchSize = 256
+
+func (b *offlineBackend) backfill(r io.Reader) (int, error) {
+	var sqlMetas []*tipb.SQLMeta
+	var planMetas []*tipb.PlanMeta
+	count := 0
+
+	flush := func() error {
+		err := store.WithTx(func(tx *store.Tx) error {
+			if err := tx.SQLMetas(sqlMetas); err != nil {
+				return err
+			}
+			return tx.PlanMetas(planMetas)
+		})
+		if err != nil {
+			return err
+		}
+		count += len(sqlMetas) + len(planMetas)
+		sqlMetas, planMetas = sqlMetas[:0], planMetas[:0]
+		return nil
+	}
+
+	decoder := json.NewDecoder(r)
+	for {
+		item := exportItem{}
+		err := decoder.Decode(&item)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+
+		digest, err := decodeDigest(item.Digest)
+		if err != nil {
+			return count, err
+		}
+		switch item.Type {
+		case "sql":
+			sqlMetas = append(sqlMetas, &tipb.SQLMeta{SqlDigest: digest, NormalizedSql: item.SQLText, IsInternalSql: item.IsInternal})
+		case "plan":
+			planMetas = append(planMetas, &tipb.PlanMeta{PlanDigest: digest, NormalizedPlan: item.PlanText})
+		default:
+			return count, fmt.Errorf("unknown item type %q", item.Type)
+		}
+
+		if len(sqlMetas)+len(planMetas) >= backfillBatchSize {
+			if err = flush(); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, flush()
+}
+
+func (b *offlineBackend) auditEvents(filter audit.Filter) ([]audit.Event, error) {
+	var events []audit.Event
+	err := audit.ListAuditEvents(filter, &events)
+	return events, err
+}
+
+func (b *offlineBackend) close() error {
+	store.Stop()
+	audit.Stop()
+	return b.db.Close()
+}
+
+// offlineCaller identifies the operator in the audit log of an offline data directory.
+func offlineCaller() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return "diagctl:" + name
+}
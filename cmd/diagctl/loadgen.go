@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/storage/store/loadgen"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/genjidb/genji"
+	"github.com/spf13/pflag"
+)
+
+// runLoadgen ingests a synthetic workload through the store, into the
+// VictoriaMetrics of --import-url and the document db of dataDir, or in memory.
+func runLoadgen(dataDir string, p printer, args []string) error {
+	cfg := loadgen.DefaultConfig()
+	fs := pflag.NewFlagSet("loadgen", pflag.ContinueOnError)
+	importURL := fs.String("import-url", "", "VictoriaMetrics import endpoint to write to, e.g. http://127.0.0.1:8428/api/v1/import, in memory by default")
+	kind := fs.String("kind", "topsql", "Records to generate, topsql, rsmetering or both")
+	batches := fs.Int("batches", 10, "Number of batches per kind")
+	interval := fs.Duration("interval", 0, "Interval between batches, 0 means as fast as possible")
+	fs.Int64Var(&cfg.Seed, "seed", cfg.Seed, "Seed of the workload, the same seed generating the same workload")
+	fs.IntVar(&cfg.Instances, "instances", cfg.Instances, "Number of instances")
+	fs.IntVar(&cfg.Statements, "statements", cfg.Statements, "Number of SQL digests")
+	fs.Float64Var(&cfg.ZipfS, "zipf", cfg.ZipfS, "Zipf exponent of the SQL digests drawn, greater than 1")
+	fs.IntVar(&cfg.PlansPerStatement, "plans", cfg.PlansPerStatement, "Number of plan digests per SQL digest")
+	fs.IntVar(&cfg.RecordsPerInstance, "records", cfg.RecordsPerInstance, "Number of records per instance and batch")
+	fs.IntVar(&cfg.SamplesPerRecord, "samples", cfg.SamplesPerRecord, "Number of samples per record")
+	fs.IntVar(&cfg.SQLLength, "sql-length", cfg.SQLLength, "Length of the normalized SQLs")
+	fs.IntVar(&cfg.PlanLength, "plan-length", cfg.PlanLength, "Length of the normalized plans")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	topSQL := *kind == "topsql" || *kind == "both"
+	rsMetering := *kind == "rsmetering" || *kind == "both"
+	if !topSQL && !rsMetering {
+		return fmt.Errorf("unknown kind %q", *kind)
+	}
+	gen, err := loadgen.New(cfg)
+	if err != nil {
+		return err
+	}
+
+	writer, closeStore, err := initStore(dataDir, *importURL)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	start := time.Now()
+	if err = store.SQLMetas(gen.SQLMetas()); err != nil {
+		return err
+	}
+	if err = store.PlanMetas(gen.PlanMetas()); err != nil {
+		return err
+	}
+	records := 0
+	for i := 0; i < *batches; i++ {
+		if i > 0 && *interval > 0 {
+			time.Sleep(*interval)
+		}
+		if topSQL {
+			batch := gen.TopSQLBatch()
+			if err = store.TopSQLRecords(batch); err != nil {
+				return fmt.Errorf("batch %d: %w", i, err)
+			}
+			records += len(batch)
+		}
+		if rsMetering {
+			batch := gen.ResourceMeteringBatch()
+			if err = store.ResourceMeteringRecords(batch); err != nil {
+				return fmt.Errorf("batch %d: %w", i, err)
+			}
+			records += len(batch)
+		}
+	}
+	elapsed := time.Since(start)
+
+	result := map[string]interface{}{
+		"batches":        *batches,
+		"records":        records,
+		"series":         writer.series,
+		"samples":        writer.samples,
+		"elapsed_ms":     elapsed.Milliseconds(),
+		"series_per_sec": float64(writer.series) / elapsed.Seconds(),
+	}
+	return p.print(result, [][]string{
+		{"BATCHES", "RECORDS", "SERIES", "SAMPLES", "ELAPSED", "SERIES/SEC"},
+		{strconv.Itoa(*batches), strconv.Itoa(records), strconv.Itoa(writer.series), strconv.Itoa(writer.samples),
+			elapsed.String(), strconv.FormatFloat(result["series_per_sec"].(float64), 'f', 0, 64)},
+	})
+}
+
+// initStore initializes the store on the VictoriaMetrics of importURL and the
+// document db of dataDir, each in memory if empty.
+func initStore(dataDir, importURL string) (*countingWriter, func(), error) {
+	var inner store.MetricWriter = testutil.NewMemTSDB()
+	if len(importURL) != 0 {
+		inner = store.NewHandlerWriter(forwardTo(importURL))
+	}
+	var db *genji.DB
+	var err error
+	if len(dataDir) != 0 {
+		db, err = openDocumentDB(dataDir)
+	} else {
+		db, err = genji.Open(":memory:")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	writer := &countingWriter{inner: inner}
+	store.Init(writer, db, nil)
+	return writer, func() {
+		store.Stop()
+		_ = db.Close()
+	}, nil
+}
+
+// countingWriter counts the series and samples written through it.
+type countingWriter struct {
+	inner   store.MetricWriter
+	series  int
+	samples int
+}
+
+func (w *countingWriter) WriteMetrics(metrics []store.Metric) error {
+	if err := w.inner.WriteMetrics(metrics); err != nil {
+		return err
+	}
+	w.series += len(metrics)
+	for i := range metrics {
+		w.samples += len(metrics[i].Timestamps)
+	}
+	return nil
+}
+
+// forwardTo sends the imports of the store to importURL.
+func forwardTo(importURL string) http.HandlerFunc {
+	client := &http.Client{Timeout: time.Minute}
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := http.NewRequestWithContext(r.Context(), r.Method, importURL, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req.Header = r.Header.Clone()
+		req.ContentLength = r.ContentLength
+		resp, err := client.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+	}
+}
@@ -0,0 +1,408 @@
+// diagctl inspects and administers a diag backend, either through the HTTP API
+// of a running server or offline on a copied data directory.
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+	"github.com/zhongzc/diag_backend/storage/query"
+
+	"github.com/spf13/pflag"
+)
+
+const usage = `Usage: diagctl (--server ADDR [--api-key KEY] | --data-dir DIR [--text-keyring-env VAR]) [-o table|json] COMMAND
+       diagctl [--data-dir DIR] [-o table|json] loadgen [--import-url URL] [--kind KIND] [--batches N] [--seed N] ...
+       diagctl [--data-dir DIR] [-o table|json] replay [--import-url URL] [--speed X] CAPTURE_DIR
+
+Commands:
+  instances list
+  instances merge           (online only)
+  digest get HEX [--include-deleted]
+  sql search PATTERN [--limit N] [--include-deleted] [--internal[=false]]
+  topsql --instance INSTANCE [--from TIME] [--to TIME] [--top N] [--window DURATION]
+  meta stats
+  delete digest HEX
+  undelete digest HEX
+  reencrypt texts
+  audit list [--operation OP] [--caller CALLER] [--from TIME] [--to TIME] [--limit N]
+  export [--file FILE]      (offline only)
+  schema check              (offline only) lists the tables and indexes to repair or migrate on start
+  backfill [--file FILE]    (offline only)
+  loadgen                   ingests a synthetic workload, see loadgen --help
+  replay CAPTURE_DIR        ingests a traffic capture, see replay --help
+
+TIME is either unix seconds or RFC3339.
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	fs := pflag.NewFlagSet("diagctl", pflag.ContinueOnError)
+	fs.SetInterspersed(false)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	server := fs.String("server", "", "Address of a running server, e.g. 127.0.0.1:8428")
+	apiKey := fs.String("api-key", os.Getenv("DIAG_API_KEY"), "API key sent to the server, $DIAG_API_KEY by default")
+	dataDir := fs.String("data-dir", "", "Storage path of a stopped server to open offline")
+	keyringEnv := fs.String("text-keyring-env", "", "Environment variable holding the keyring of the texts encrypted at rest, offline only")
+	output := fs.StringP("output", "o", "table", "Output format, table or json")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *output != "table" && *output != "json" {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return fmt.Errorf("no command")
+	}
+
+	p := printer{w: stdout, json: *output == "json"}
+	if args[0] == "schema" {
+		if len(*server) != 0 {
+			return fmt.Errorf("schema check reads --data-dir, not --server")
+		}
+		return runSchemaCheck(*dataDir, p, args[1:])
+	}
+	if args[0] == "loadgen" || args[0] == "replay" {
+		if len(*server) != 0 {
+			return fmt.Errorf("%s writes to --data-dir and its --import-url, not to --server", args[0])
+		}
+		if args[0] == "replay" {
+			return runReplay(*dataDir, p, args[1:])
+		}
+		return runLoadgen(*dataDir, p, args[1:])
+	}
+
+	var b backend
+	var err error
+	switch {
+	case len(*server) != 0 && len(*dataDir) != 0:
+		return fmt.Errorf("--server and --data-dir are exclusive")
+	case len(*server) != 0:
+		b, err = newHTTPBackend(*server, *apiKey)
+	case len(*dataDir) != 0:
+		b, err = newOfflineBackend(*dataDir, *keyringEnv)
+	default:
+		return fmt.Errorf("either --server or --data-dir is required")
+	}
+	if err != nil {
+		return err
+	}
+	defer b.close()
+
+	return dispatch(b, p, args)
+}
+
+func dispatch(b backend, p printer, args []string) error {
+	cmd := args[0]
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		switch cmd {
+		case "instances", "digest", "sql", "meta", "delete", "undelete", "reencrypt", "audit":
+			cmd += " " + args[1]
+			args = args[1:]
+		}
+	}
+	args = args[1:]
+
+	switch cmd {
+	case "instances list":
+		items, err := b.instances()
+		if err != nil {
+			return err
+		}
+		rows := [][]string{{"INSTANCE", "JOB"}}
+		for _, item := range items {
+			rows = append(rows, []string{item.Instance, item.Job})
+		}
+		return p.print(items, rows)
+
+	case "instances merge":
+		merged, err := b.mergeInstances()
+		if err != nil {
+			return err
+		}
+		return p.print(map[string]int{"merged": merged}, [][]string{{"MERGED"}, {strconv.Itoa(merged)}})
+
+	case "digest get":
+		fs := pflag.NewFlagSet("digest get", pflag.ContinueOnError)
+		includeDeleted := fs.Bool("include-deleted", false, "Also show a deleted digest")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		digest, err := digestArg(fs.Args())
+		if err != nil {
+			return err
+		}
+		item, err := b.digest(digest, *includeDeleted)
+		if err != nil {
+			return err
+		}
+		rows := [][]string{{"FIELD", "VALUE"}, {"digest", item.Digest}}
+		if item.DeletedAt != 0 {
+			rows = append(rows, []string{"deleted_at", time.Unix(item.DeletedAt, 0).Format(time.RFC3339)})
+		}
+		if item.SQL != nil {
+			rows = append(rows, []string{"sql_text", item.SQL.SQLText}, []string{"is_internal", strconv.FormatBool(item.SQL.IsInternal)})
+			if item.SQL.DigestMismatch {
+				rows = append(rows, []string{"digest_mismatch", "true"})
+			}
+		}
+		if item.Plan != nil {
+			rows = append(rows, []string{"plan_text", item.Plan.PlanText})
+		}
+		return p.print(item, rows)
+
+	case "sql search":
+		fs := pflag.NewFlagSet("sql search", pflag.ContinueOnError)
+		limit := fs.Int("limit", 100, "Maximum number of results, 0 means unlimited")
+		includeDeleted := fs.Bool("include-deleted", false, "Also match deleted digests")
+		internal := fs.Bool("internal", false, "Match only the internal SQLs, or only the others with --internal=false")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return fmt.Errorf("expect exactly one pattern")
+		}
+		opts := query.SearchOptions{Limit: *limit, IncludeDeleted: *includeDeleted}
+		if fs.Changed("internal") {
+			opts.Internal = internal
+		}
+		items, err := b.searchSQL(fs.Arg(0), opts)
+		if err != nil {
+			return err
+		}
+		rows := [][]string{{"DIGEST", "INTERNAL", "SQL_TEXT"}}
+		for _, item := range items {
+			rows = append(rows, []string{item.Digest, strconv.FormatBool(item.IsInternal), item.SQLText})
+		}
+		return p.print(items, rows)
+
+	case "topsql":
+		fs := pflag.NewFlagSet("topsql", pflag.ContinueOnError)
+		instance := fs.String("instance", "", "Instance to query")
+		from := fs.String("from", "", "Start of the range, 1 hour ago by default")
+		to := fs.String("to", "", "End of the range, now by default")
+		top := fs.Int("top", 10, "Number of SQLs, -1 means all")
+		window := fs.Duration("window", time.Minute, "Aggregation window")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if len(*instance) == 0 {
+			return fmt.Errorf("--instance is required")
+		}
+		now := time.Now()
+		startSecs, err := parseTime(*from, now.Add(-time.Hour))
+		if err != nil {
+			return err
+		}
+		endSecs, err := parseTime(*to, now)
+		if err != nil {
+			return err
+		}
+
+		items, err := b.topSQL(*instance, startSecs, endSecs, int(window.Seconds()), *top)
+		if err != nil {
+			return err
+		}
+		rows := [][]string{{"SQL_DIGEST", "PLANS", "CPU_TIME_MS", "SHARE", "SQL_TEXT"}}
+		for _, item := range items {
+			rows = append(rows, []string{
+				item.SQLDigest, strconv.Itoa(len(item.Plans)), strconv.FormatUint(item.CPUTimeMillis, 10),
+				strconv.FormatFloat(item.Share*100, 'f', 1, 64) + "%", item.SQLText,
+			})
+		}
+		return p.print(items, rows)
+
+	case "meta stats":
+		stats, err := b.metaStats()
+		if err != nil {
+			return err
+		}
+		return p.print(stats, [][]string{
+			{"TABLE", "ROWS"},
+			{"sql_digest", strconv.Itoa(stats.SQLDigests)},
+			{"sql_digest (internal)", strconv.Itoa(stats.InternalSQLDigests)},
+			{"sql_digest (multiple plans)", strconv.Itoa(stats.MultiPlanSQLDigests)},
+			{"plan_digest", strconv.Itoa(stats.PlanDigests)},
+			{"instance", strconv.Itoa(stats.Instances)},
+			{"digest_tombstone", strconv.Itoa(stats.Deleted)},
+		})
+
+	case "delete digest":
+		digest, err := digestArg(args)
+		if err != nil {
+			return err
+		}
+		if err = b.deleteDigest(digest); err != nil {
+			return err
+		}
+		return p.print(map[string]string{"deleted": digest}, [][]string{{"DELETED"}, {digest}})
+
+	case "undelete digest":
+		digest, err := digestArg(args)
+		if err != nil {
+			return err
+		}
+		if err = b.undeleteDigest(digest); err != nil {
+			return err
+		}
+		return p.print(map[string]string{"undeleted": digest}, [][]string{{"UNDELETED"}, {digest}})
+
+	case "reencrypt texts":
+		if err := b.reencryptTexts(); err != nil {
+			return err
+		}
+		return p.print(map[string]bool{"reencrypted": true}, [][]string{{"REENCRYPTED"}, {"true"}})
+
+	case "audit list":
+		fs := pflag.NewFlagSet("audit list", pflag.ContinueOnError)
+		operation := fs.String("operation", "", "Only list events of this operation")
+		caller := fs.String("caller", "", "Only list events of this caller")
+		from := fs.String("from", "", "Start of the range, the beginning by default")
+		to := fs.String("to", "", "End of the range, now by default")
+		limit := fs.Int("limit", 100, "Maximum number of events, 0 means unlimited")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		startSecs, err := parseTime(*from, time.Unix(0, 0))
+		if err != nil {
+			return err
+		}
+		endSecs, err := parseTime(*to, time.Now())
+		if err != nil {
+			return err
+		}
+
+		events, err := b.auditEvents(audit.Filter{
+			Operation: *operation,
+			Caller:    *caller,
+			StartSecs: int64(startSecs),
+			EndSecs:   int64(endSecs),
+			Limit:     *limit,
+		})
+		if err != nil {
+			return err
+		}
+		rows := [][]string{{"TIME", "OPERATION", "CALLER", "AFFECTED", "OUTCOME", "PARAMS"}}
+		for _, e := range events {
+			params, _ := json.Marshal(e.Params)
+			outcome := e.Outcome
+			if len(e.Error) != 0 {
+				outcome += ": " + e.Error
+			}
+			rows = append(rows, []string{
+				time.Unix(e.TimestampSecs, 0).Format(time.RFC3339), e.Operation, e.Caller,
+				strconv.Itoa(e.Affected), outcome, string(params),
+			})
+		}
+		return p.print(events, rows)
+
+	case "export":
+		fs := pflag.NewFlagSet("export", pflag.ContinueOnError)
+		file := fs.String("file", "", "File to write to, stdout by default")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		w := p.w
+		if len(*file) != 0 {
+			f, err := os.Create(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		return b.export(w)
+
+	case "backfill":
+		fs := pflag.NewFlagSet("backfill", pflag.ContinueOnError)
+		file := fs.String("file", "", "File produced by export to read from, stdin by default")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		var r io.Reader = os.Stdin
+		if len(*file) != 0 {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		count, err := b.backfill(r)
+		if err != nil {
+			return fmt.Errorf("backfilled %d metas before failing: %w", count, err)
+		}
+		return p.print(map[string]int{"backfilled": count}, [][]string{{"BACKFILLED"}, {strconv.Itoa(count)}})
+	}
+
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func digestArg(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expect exactly one digest")
+	}
+	if _, err := decodeDigest(args[0]); err != nil {
+		return "", err
+	}
+	return strings.ToLower(args[0]), nil
+}
+
+func decodeDigest(digest string) ([]byte, error) {
+	b, err := hex.DecodeString(digest)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid hex digest %q", digest)
+	}
+	return b, nil
+}
+
+func parseTime(raw string, def time.Time) (int, error) {
+	if len(raw) == 0 {
+		return int(def.Unix()), nil
+	}
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return int(secs), nil
+	}
+	t, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expect unix seconds or RFC3339", raw)
+	}
+	return int(t.Unix()), nil
+}
+
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+// print writes v as JSON or rows as an aligned table, the first row being the header.
+func (p printer) print(v interface{}, rows [][]string) error {
+	if p.json {
+		encoder := json.NewEncoder(p.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
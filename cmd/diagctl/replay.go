@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store/replay"
+
+	"github.com/spf13/pflag"
+)
+
+// runReplay ingests a traffic capture through the store, into the
+// VictoriaMetrics of --import-url and the document db of dataDir, or in memory.
+func runReplay(dataDir string, p printer, args []string) error {
+	fs := pflag.NewFlagSet("replay", pflag.ContinueOnError)
+	importURL := fs.String("import-url", "", "VictoriaMetrics import endpoint to write to, e.g. http://127.0.0.1:8428/api/v1/import, in memory by default")
+	speed := fs.Float64("speed", 1, "Multiplier of the captured pace, 0 means as fast as possible")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expect exactly one capture directory, the --store.traffic-capture-dir of the server")
+	}
+	if *speed < 0 {
+		return fmt.Errorf("negative speed %v", *speed)
+	}
+
+	writer, closeStore, err := initStore(dataDir, *importURL)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	start := time.Now()
+	stats, err := replay.Replay(context.Background(), fs.Arg(0), replay.Options{Speed: *speed})
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+
+	result := map[string]interface{}{
+		"replay":     stats,
+		"series":     writer.series,
+		"samples":    writer.samples,
+		"elapsed_ms": elapsed.Milliseconds(),
+	}
+	return p.print(result, [][]string{
+		{"BATCHES", "RECORDS", "FAILED", "SERIES", "SAMPLES", "ELAPSED", "LAST_ERROR"},
+		{strconv.Itoa(stats.Batches), strconv.Itoa(stats.Records), strconv.Itoa(stats.Failed),
+			strconv.Itoa(writer.series), strconv.Itoa(writer.samples), elapsed.String(), stats.LastError},
+	})
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+)
+
+// runSchemaCheck reports the changes the server would make to the tables and
+// indexes of the document db of dataDir on start, without making them.
+func runSchemaCheck(dataDir string, p printer, args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return fmt.Errorf("expect schema check")
+	}
+	if len(dataDir) == 0 {
+		return fmt.Errorf("schema check reads --data-dir")
+	}
+	db, err := openDocumentDB(dataDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	changes, err := store.CheckSchema(db)
+	if err != nil {
+		return err
+	}
+	if changes == nil {
+		changes = []store.SchemaChange{}
+	}
+	rows := [][]string{{"TABLE", "INDEX", "REPAIRABLE", "CHANGE", "STATEMENTS"}}
+	for _, c := range changes {
+		rows = append(rows, []string{c.Table, c.Index, strconv.FormatBool(c.Repairable()), c.String(), strings.Join(c.Statements, "; ")})
+	}
+	return p.print(changes, rows)
+}
@@ -4,6 +4,7 @@ go 1.16
 
 require (
 	github.com/VictoriaMetrics/VictoriaMetrics v1.65.0
+	github.com/VictoriaMetrics/metrics v1.17.3
 	github.com/dgraph-io/badger/v3 v3.2103.1
 	github.com/genjidb/genji v0.13.0
 	github.com/genjidb/genji/engine/badgerengine v0.13.0
@@ -17,9 +18,11 @@ require (
 	github.com/pingcap/log v0.0.0-20210906054005-afc726e70354
 	github.com/pingcap/tipb v0.0.0-20210917081614-311f2369c5f7
 	github.com/soheilhy/cmux v0.1.5
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/spf13/pflag v1.0.5
 	github.com/ugorji/go v1.2.6 // indirect
 	github.com/wangjohn/quickselect v0.0.0-20161129230411-ed8402a42d5f
+	go.opentelemetry.io/proto/otlp v0.9.0
+	go.uber.org/goleak v1.1.10
 	go.uber.org/zap v1.19.0
 	golang.org/x/crypto v0.0.0-20210915214749-c084706c2272 // indirect
 	golang.org/x/net v0.0.0-20210924151903-3ad01bbaa167 // indirect
@@ -6,6 +6,9 @@ import (
 	"path"
 	"strings"
 
+	"github.com/zhongzc/diag_backend/alert"
+	"github.com/zhongzc/diag_backend/notify"
+	"github.com/zhongzc/diag_backend/report"
 	"github.com/zhongzc/diag_backend/service"
 	"github.com/zhongzc/diag_backend/storage"
 
@@ -35,9 +38,18 @@ func main() {
 
 	logConfig()
 
+	notify.Init()
+	defer notify.Stop()
+
 	storage.Init(*logPath, logLevel, *dataPath)
 	defer storage.Stop()
 
+	alert.Init()
+	defer alert.Stop()
+
+	report.Init()
+	defer report.Stop()
+
 	service.Init(*logPath, logLevel, *listenAddr)
 	defer service.Stop()
 
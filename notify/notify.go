@@ -0,0 +1,59 @@
+package notify
+
+import (
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	webhookURL         = pflag.String("notify.webhook-url", "", "URL receiving JSON event notifications, disabled if empty")
+	webhookSecret      = pflag.String("notify.webhook-secret", "", "Secret used to sign webhook payloads with HMAC-SHA256")
+	webhookQueueSize   = pflag.Int("notify.webhook-queue-size", 1024, "Max number of pending webhook notifications, new ones are dropped when full")
+	webhookDedupWindow = pflag.Duration("notify.webhook-dedup-window", time.Hour, "Suppress notifications about the same subject within this window")
+)
+
+var defaultWebhook *Webhook
+
+func Init() {
+	if len(*webhookURL) == 0 {
+		return
+	}
+
+	w, err := NewWebhook(WebhookConfig{
+		URL:         *webhookURL,
+		Secret:      *webhookSecret,
+		QueueSize:   *webhookQueueSize,
+		DedupWindow: *webhookDedupWindow,
+	})
+	if err != nil {
+		log.Fatal("failed to init the webhook notifier", zap.String("url", *webhookURL), zap.Error(err))
+	}
+	defaultWebhook = w
+
+	log.Info("sending notifications to webhook", zap.String("url", *webhookURL))
+}
+
+// Enabled reports whether notifications are delivered anywhere, so callers can
+// skip the work of detecting events otherwise.
+func Enabled() bool {
+	return defaultWebhook != nil
+}
+
+// Notify delivers the event asynchronously. It's a no-op if no notifier is configured.
+func Notify(e Event) {
+	if defaultWebhook == nil {
+		return
+	}
+	defaultWebhook.Notify(e)
+}
+
+func Stop() {
+	if defaultWebhook == nil {
+		return
+	}
+	defaultWebhook.Close()
+	defaultWebhook = nil
+}
@@ -0,0 +1,242 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	EventNewInstance   = "new_instance"
+	EventNewSQLDigest  = "new_sql_digest"
+	EventNewPlanDigest = "new_plan_digest"
+	EventAlertFiring   = "alert_firing"
+	EventAlertResolved = "alert_resolved"
+	EventDailyReport   = "daily_report"
+
+	// SignatureHeader carries the hex encoded HMAC-SHA256 of the body.
+	SignatureHeader = "X-Diag-Signature"
+)
+
+var (
+	webhookSentCounter       = metrics.NewCounter(`diag_notify_webhook_events_total{result="sent"}`)
+	webhookDroppedCounter    = metrics.NewCounter(`diag_notify_webhook_events_total{result="dropped"}`)
+	webhookFailedCounter     = metrics.NewCounter(`diag_notify_webhook_events_total{result="failed"}`)
+	webhookSuppressedCounter = metrics.NewCounter(`diag_notify_webhook_events_total{result="suppressed"}`)
+)
+
+type Event struct {
+	Type       string `json:"type"`
+	Instance   string `json:"instance,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	FirstSeen  int64  `json:"first_seen"`
+	SQLPreview string `json:"sql_preview,omitempty"`
+	// Tenant is the tenant of the digest, empty for the default one.
+	Tenant string `json:"tenant,omitempty"`
+
+	// Alert events only
+	Rule   string            `json:"rule,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value,omitempty"`
+
+	// Report events only
+	Report interface{} `json:"report,omitempty"`
+}
+
+func (e *Event) subject() string {
+	subject := e.Type + "/" + e.Instance + "/" + e.Digest + "/" + e.Rule
+	if len(e.Tenant) != 0 {
+		subject += "@" + e.Tenant
+	}
+	if len(e.Labels) != 0 {
+		// json.Marshal sorts map keys, giving a stable representation.
+		labels, _ := json.Marshal(e.Labels)
+		subject += "/" + string(labels)
+	}
+	return subject
+}
+
+type WebhookConfig struct {
+	URL string
+	// Secret signs the payloads if not empty.
+	Secret    string
+	QueueSize int
+	// DedupWindow suppresses events about the same subject within the window.
+	DedupWindow  time.Duration
+	MaxRetries   int
+	RetryBackoff time.Duration
+	Timeout      time.Duration
+}
+
+// Webhook posts events as JSON to a URL from a background goroutine.
+type Webhook struct {
+	cfg    WebhookConfig
+	client *http.Client
+
+	queue   chan Event
+	closeMu sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+
+	dedupMu  sync.Mutex
+	lastSent map[string]time.Time
+}
+
+func NewWebhook(cfg WebhookConfig) (*Webhook, error) {
+	if len(cfg.URL) == 0 {
+		return nil, errors.New("empty webhook url")
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 1024
+	}
+	if cfg.MaxRetries <= 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+
+	w := &Webhook{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		queue:    make(chan Event, cfg.QueueSize),
+		lastSent: make(map[string]time.Time),
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// Notify enqueues the event unless the same subject was notified within the dedup window.
+func (w *Webhook) Notify(e Event) {
+	if w.suppressed(e) {
+		webhookSuppressedCounter.Inc()
+		return
+	}
+
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+	if w.closed {
+		return
+	}
+
+	select {
+	case w.queue <- e:
+	default:
+		webhookDroppedCounter.Inc()
+	}
+}
+
+// Close stops accepting events and waits for the pending ones to be delivered.
+func (w *Webhook) Close() {
+	w.closeMu.Lock()
+	if w.closed {
+		w.closeMu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.closeMu.Unlock()
+
+	w.wg.Wait()
+}
+
+func (w *Webhook) suppressed(e Event) bool {
+	// Only discovery events are deduplicated, alerts are dampened by the rule
+	// evaluator and reports are requested explicitly.
+	discovery := e.Type == EventNewInstance || e.Type == EventNewSQLDigest || e.Type == EventNewPlanDigest
+	if w.cfg.DedupWindow <= 0 || !discovery {
+		return false
+	}
+
+	now := time.Now()
+	subject := e.subject()
+
+	w.dedupMu.Lock()
+	defer w.dedupMu.Unlock()
+
+	if last, ok := w.lastSent[subject]; ok && now.Sub(last) < w.cfg.DedupWindow {
+		return true
+	}
+	w.lastSent[subject] = now
+
+	// Keep the map from growing with subjects that can no longer be suppressed.
+	if len(w.lastSent) > 2*w.cfg.QueueSize {
+		for s, last := range w.lastSent {
+			if now.Sub(last) >= w.cfg.DedupWindow {
+				delete(w.lastSent, s)
+			}
+		}
+	}
+	return false
+}
+
+func (w *Webhook) run() {
+	defer w.wg.Done()
+
+	for e := range w.queue {
+		if err := w.send(e); err != nil {
+			webhookFailedCounter.Inc()
+			log.Warn("failed to send webhook notification", zap.String("type", e.Type), zap.Error(err))
+			continue
+		}
+		webhookSentCounter.Inc()
+	}
+}
+
+func (w *Webhook) send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; ; i++ {
+		if err = w.post(body); err == nil || i >= w.cfg.MaxRetries {
+			return err
+		}
+		time.Sleep(w.cfg.RetryBackoff)
+	}
+}
+
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.cfg.Secret) != 0 {
+		req.Header.Set(SignatureHeader, Sign(w.cfg.Secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the value of SignatureHeader for body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
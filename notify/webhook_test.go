@@ -0,0 +1,147 @@
+package notify_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/notify"
+)
+
+// receiver records the events posted to it, answering 503 to the first
+// failures posts.
+type receiver struct {
+	*httptest.Server
+	events   chan notify.Event
+	bodies   chan []byte
+	posts    int32
+	failures int32
+}
+
+func newReceiver(t *testing.T, secret string, failures int32) *receiver {
+	r := &receiver{events: make(chan notify.Event, 16), bodies: make(chan []byte, 16), failures: failures}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if atomic.AddInt32(&r.posts, 1) <= r.failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if len(secret) != 0 {
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(body)
+			want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+			if got := req.Header.Get(notify.SignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+				t.Errorf("got signature %q, want %q", got, want)
+			}
+		}
+		var e notify.Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		r.bodies <- body
+		r.events <- e
+	}))
+	return r
+}
+
+func (r *receiver) next(t *testing.T) notify.Event {
+	select {
+	case e := <-r.events:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event received")
+		return notify.Event{}
+	}
+}
+
+func TestWebhookSignsPayloads(t *testing.T) {
+	r := newReceiver(t, "s3cret", 0)
+	defer r.Close()
+	w, err := notify.NewWebhook(notify.WebhookConfig{URL: r.URL, Secret: "s3cret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Notify(notify.Event{Type: notify.EventNewSQLDigest, Digest: "5e4c", FirstSeen: 1632700800})
+	if e := r.next(t); e.Type != notify.EventNewSQLDigest || e.Digest != "5e4c" {
+		t.Fatalf("got event %+v", e)
+	}
+	body := <-r.bodies
+	if got, want := notify.Sign("other", body), notify.Sign("s3cret", body); got == want {
+		t.Fatal("the signature does not depend on the secret")
+	}
+}
+
+func TestWebhookSuppressesDuplicates(t *testing.T) {
+	r := newReceiver(t, "", 0)
+	defer r.Close()
+	w, err := notify.NewWebhook(notify.WebhookConfig{URL: r.URL, DedupWindow: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As notified by the ingestion of two batches
+	for i := 0; i < 2; i++ {
+		w.Notify(notify.Event{Type: notify.EventNewSQLDigest, Digest: "5e4c", FirstSeen: int64(i)})
+		w.Notify(notify.Event{Type: notify.EventNewSQLDigest, Digest: "5e4c", Tenant: "b", FirstSeen: int64(i)})
+		w.Notify(notify.Event{Type: notify.EventNewInstance, Instance: "tidb-0:10080", FirstSeen: int64(i)})
+	}
+	// Alerts are not deduplicated
+	w.Notify(notify.Event{Type: notify.EventAlertFiring, Rule: "cpu"})
+	w.Notify(notify.Event{Type: notify.EventAlertFiring, Rule: "cpu"})
+	w.Close()
+
+	if got := len(r.events); got != 5 {
+		t.Fatalf("got %d events, want 5", got)
+	}
+	for len(r.events) != 0 {
+		if e := <-r.events; e.FirstSeen != 0 {
+			t.Fatalf("got event %+v of the second batch", e)
+		}
+	}
+}
+
+func TestWebhookRetriesFailedDeliveries(t *testing.T) {
+	r := newReceiver(t, "", 2)
+	defer r.Close()
+	w, err := notify.NewWebhook(notify.WebhookConfig{URL: r.URL, MaxRetries: 3, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Notify(notify.Event{Type: notify.EventNewInstance, Instance: "tidb-0:10080"})
+	if e := r.next(t); e.Instance != "tidb-0:10080" {
+		t.Fatalf("got event %+v", e)
+	}
+	if got := atomic.LoadInt32(&r.posts); got != 3 {
+		t.Fatalf("got %d posts, want 3", got)
+	}
+}
+
+func TestWebhookGivesUpAfterMaxRetries(t *testing.T) {
+	r := newReceiver(t, "", 100)
+	defer r.Close()
+	w, err := notify.NewWebhook(notify.WebhookConfig{URL: r.URL, MaxRetries: 2, RetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w.Notify(notify.Event{Type: notify.EventNewInstance, Instance: "tidb-0:10080"})
+	w.Close()
+	if got := atomic.LoadInt32(&r.posts); got != 3 {
+		t.Fatalf("got %d posts, want 3", got)
+	}
+}
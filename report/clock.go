@@ -0,0 +1,16 @@
+package report
+
+import "github.com/zhongzc/diag_backend/utils"
+
+// clock is the time source of the schedule, overridable for deterministic
+// tests.
+var clock = utils.RealClock
+
+// SetClock replaces the clock of the schedule, the real one if c is nil. It
+// is a test hook to call before Init.
+func SetClock(c utils.Clock) {
+	if c == nil {
+		c = utils.RealClock
+	}
+	clock = c
+}
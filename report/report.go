@@ -0,0 +1,239 @@
+package report
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/query"
+	"github.com/zhongzc/diag_backend/storage/store"
+)
+
+const (
+	topStatements = 20
+	topMovers     = 20
+)
+
+type Report struct {
+	Date           string          `json:"date"`
+	Timezone       string          `json:"timezone"`
+	StartSecs      int64           `json:"start_secs"`
+	EndSecs        int64           `json:"end_secs"`
+	TotalCPUTimeMs float64         `json:"total_cpu_time_ms"`
+	TopStatements  []StatementItem `json:"top_statements"`
+	Movers         []MoverItem     `json:"movers"`
+	NewStatements  []StatementItem `json:"new_statements"`
+	Instances      []InstanceItem  `json:"instances"`
+}
+
+type StatementItem struct {
+	SQLDigest string  `json:"sql_digest"`
+	SQLText   string  `json:"sql_text"`
+	CPUTimeMs float64 `json:"cpu_time_ms"`
+}
+
+type MoverItem struct {
+	SQLDigest         string  `json:"sql_digest"`
+	SQLText           string  `json:"sql_text"`
+	CPUTimeMs         float64 `json:"cpu_time_ms"`
+	PreviousCPUTimeMs float64 `json:"previous_cpu_time_ms"`
+	DeltaCPUTimeMs    float64 `json:"delta_cpu_time_ms"`
+}
+
+type InstanceItem struct {
+	Instance  string  `json:"instance"`
+	CPUTimeMs float64 `json:"cpu_time_ms"`
+}
+
+// dayBounds returns the start and end of the calendar day containing t in loc.
+// Days around DST transitions are 23 or 25 hours long.
+func dayBounds(t time.Time, loc *time.Location) (time.Time, time.Time) {
+	t = t.In(loc)
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	end := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+	return start, end
+}
+
+// Generate computes the report of the calendar day containing day in loc.
+func Generate(ctx context.Context, day time.Time, loc *time.Location) (*Report, error) {
+	start, end := dayBounds(day, loc)
+	prevStart, _ := dayBounds(start.Add(-time.Hour), loc)
+
+	current, err := sumBy(ctx, "sql_digest", start, end)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := sumBy(ctx, "sql_digest", prevStart, start)
+	if err != nil {
+		return nil, err
+	}
+	instances, err := sumBy(ctx, "instance", start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Report{
+		Date:      start.Format("2006-01-02"),
+		Timezone:  loc.String(),
+		StartSecs: start.Unix(),
+		EndSecs:   end.Unix(),
+	}
+
+	for digest, cpu := range current {
+		r.TotalCPUTimeMs += cpu
+		r.TopStatements = append(r.TopStatements, StatementItem{SQLDigest: digest, CPUTimeMs: cpu})
+		if _, ok := previous[digest]; !ok {
+			r.NewStatements = append(r.NewStatements, StatementItem{SQLDigest: digest, CPUTimeMs: cpu})
+		}
+	}
+	sortStatements(r.TopStatements)
+	if len(r.TopStatements) > topStatements {
+		r.TopStatements = r.TopStatements[:topStatements]
+	}
+	sortStatements(r.NewStatements)
+
+	for digest := range unionKeys(current, previous) {
+		delta := current[digest] - previous[digest]
+		if delta == 0 {
+			continue
+		}
+		r.Movers = append(r.Movers, MoverItem{
+			SQLDigest:         digest,
+			CPUTimeMs:         current[digest],
+			PreviousCPUTimeMs: previous[digest],
+			DeltaCPUTimeMs:    delta,
+		})
+	}
+	sort.Slice(r.Movers, func(i, j int) bool {
+		di, dj := abs(r.Movers[i].DeltaCPUTimeMs), abs(r.Movers[j].DeltaCPUTimeMs)
+		if di != dj {
+			return di > dj
+		}
+		return r.Movers[i].SQLDigest < r.Movers[j].SQLDigest
+	})
+	if len(r.Movers) > topMovers {
+		r.Movers = r.Movers[:topMovers]
+	}
+
+	for instance, cpu := range instances {
+		r.Instances = append(r.Instances, InstanceItem{Instance: instance, CPUTimeMs: cpu})
+	}
+	sort.Slice(r.Instances, func(i, j int) bool {
+		return r.Instances[i].Instance < r.Instances[j].Instance
+	})
+
+	if err = fillTexts(ctx, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// sumBy returns the total cpu time within [start, end) grouped by label.
+func sumBy(ctx context.Context, label string, start, end time.Time) (map[string]float64, error) {
+	// The range selector covers (t - d, t], so evaluate right before end.
+	durSecs := int(end.Sub(start).Seconds())
+	promQL := fmt.Sprintf("sum by (%s) (sum_over_time(%s[%ds]))", label, store.MetricName(store.MetricCPUTime), durSecs)
+
+	var samples []query.InstantSample
+	if err := query.InstantQuery(ctx, promQL, int(end.Unix())-1, &samples); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]float64, len(samples))
+	for _, s := range samples {
+		res[s.Labels[label]] += s.Value
+	}
+	return res, nil
+}
+
+func fillTexts(ctx context.Context, r *Report) error {
+	var digests []string
+	for _, item := range r.TopStatements {
+		digests = append(digests, item.SQLDigest)
+	}
+	for _, item := range r.NewStatements {
+		digests = append(digests, item.SQLDigest)
+	}
+	for _, item := range r.Movers {
+		digests = append(digests, item.SQLDigest)
+	}
+
+	texts, err := query.SQLTexts(ctx, digests)
+	if err != nil {
+		return err
+	}
+	for i := range r.TopStatements {
+		r.TopStatements[i].SQLText = texts[r.TopStatements[i].SQLDigest]
+	}
+	for i := range r.NewStatements {
+		r.NewStatements[i].SQLText = texts[r.NewStatements[i].SQLDigest]
+	}
+	for i := range r.Movers {
+		r.Movers[i].SQLText = texts[r.Movers[i].SQLDigest]
+	}
+	return nil
+}
+
+func sortStatements(items []StatementItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].CPUTimeMs != items[j].CPUTimeMs {
+			return items[i].CPUTimeMs > items[j].CPUTimeMs
+		}
+		return items[i].SQLDigest < items[j].SQLDigest
+	})
+}
+
+func unionKeys(a, b map[string]float64) map[string]struct{} {
+	res := make(map[string]struct{}, len(a)+len(b))
+	for k := range a {
+		res[k] = struct{}{}
+	}
+	for k := range b {
+		res[k] = struct{}{}
+	}
+	return res
+}
+
+func abs(v float64) float64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+var htmlTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Top SQL daily report {{.Date}}</title></head>
+<body>
+<h1>Top SQL daily report {{.Date}} ({{.Timezone}})</h1>
+<p>Total CPU time: {{printf "%.0f" .TotalCPUTimeMs}} ms</p>
+<h2>Top statements</h2>
+{{if .TopStatements}}<table border="1">
+<tr><th>SQL digest</th><th>SQL</th><th>CPU time (ms)</th></tr>
+{{range .TopStatements}}<tr><td>{{.SQLDigest}}</td><td>{{.SQLText}}</td><td>{{printf "%.0f" .CPUTimeMs}}</td></tr>
+{{end}}</table>{{else}}<p>No data</p>{{end}}
+<h2>Biggest movers</h2>
+{{if .Movers}}<table border="1">
+<tr><th>SQL digest</th><th>SQL</th><th>CPU time (ms)</th><th>Previous day (ms)</th><th>Delta (ms)</th></tr>
+{{range .Movers}}<tr><td>{{.SQLDigest}}</td><td>{{.SQLText}}</td><td>{{printf "%.0f" .CPUTimeMs}}</td><td>{{printf "%.0f" .PreviousCPUTimeMs}}</td><td>{{printf "%+.0f" .DeltaCPUTimeMs}}</td></tr>
+{{end}}</table>{{else}}<p>No data</p>{{end}}
+<h2>New statements</h2>
+{{if .NewStatements}}<table border="1">
+<tr><th>SQL digest</th><th>SQL</th><th>CPU time (ms)</th></tr>
+{{range .NewStatements}}<tr><td>{{.SQLDigest}}</td><td>{{.SQLText}}</td><td>{{printf "%.0f" .CPUTimeMs}}</td></tr>
+{{end}}</table>{{else}}<p>No data</p>{{end}}
+<h2>Instances</h2>
+{{if .Instances}}<table border="1">
+<tr><th>Instance</th><th>CPU time (ms)</th></tr>
+{{range .Instances}}<tr><td>{{.Instance}}</td><td>{{printf "%.0f" .CPUTimeMs}}</td></tr>
+{{end}}</table>{{else}}<p>No data</p>{{end}}
+</body>
+</html>
+`))
+
+func (r *Report) RenderHTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, r)
+}
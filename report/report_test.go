@@ -0,0 +1,145 @@
+package report_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/report"
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files of testdata with the rendered reports")
+
+// dayStart is the start of 2021-09-26 in Asia/Shanghai.
+const dayStart = 1632585600
+
+// seedDays stores the cpu time of 2021-09-26 and the day before: 5e4c grows,
+// a10b is new, c0ff is gone and tidb-1 appears mid-day.
+func seedDays(t *testing.T, s *testutil.MemStore) {
+	t.Helper()
+	for digest, text := range map[string]string{
+		"\x5e\x4c": "select * from t where id = ?",
+		"\xa1\x0b": "update t set v = ? where id = ?",
+		"\xc0\xff": "delete from t where v < ?",
+	} {
+		if err := s.SeedSQLMeta([]byte(digest), text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	record := func(digest []byte, instance string, secs []uint64, ms []uint32) *tipb.CPUTimeRecord {
+		return &tipb.CPUTimeRecord{
+			SqlDigest:              digest,
+			Instance:               instance,
+			Job:                    "tidb",
+			RecordListTimestampSec: secs,
+			RecordListCpuTimeMs:    ms,
+		}
+	}
+	const prevStart = dayStart - 86400
+	err := store.TopSQLRecords([]*tipb.CPUTimeRecord{
+		record([]byte{0x5e, 0x4c}, "tidb-0:10080", []uint64{prevStart + 3600}, []uint32{100}),
+		record([]byte{0xc0, 0xff}, "tidb-0:10080", []uint64{prevStart + 7200}, []uint32{40}),
+		record([]byte{0x5e, 0x4c}, "tidb-0:10080", []uint64{dayStart + 3600, dayStart + 7200}, []uint32{150, 100}),
+		record([]byte{0xa1, 0x0b}, "tidb-0:10080", []uint64{dayStart + 10000}, []uint32{30}),
+		record([]byte{0xa1, 0x0b}, "tidb-1:10080", []uint64{dayStart + 43200}, []uint32{20}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkGolden compares got to testdata/name, rewriting it with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("unexpected %s, run with -update if intended\n got: %s\nwant: %s", name, got, want)
+	}
+}
+
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := pflag.Lookup(name).Value.String()
+	if err := pflag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pflag.Set(name, old) })
+}
+
+func TestScheduledReport(t *testing.T) {
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	seedDays(t, s)
+
+	// 00:30 of 2021-09-27 in Asia/Shanghai, half an hour before the run
+	clock := testutil.NewFakeClock(time.Unix(dayStart+86400+1800, 0))
+	report.SetClock(clock)
+	defer report.SetClock(nil)
+	dir := t.TempDir()
+	setFlag(t, "report.at", "01:00")
+	setFlag(t, "report.timezone", "Asia/Shanghai")
+	setFlag(t, "report.dir", dir)
+	report.Init()
+	defer report.Stop()
+
+	clock.BlockUntil(1)
+	clock.Advance(30 * time.Minute)
+	// The timer of the next day is armed once the report is written
+	clock.BlockUntil(1)
+
+	for _, name := range []string{"report-2021-09-26.json", "report-2021-09-26.html"} {
+		got, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkGolden(t, name, got)
+	}
+}
+
+func TestEmptyDayReport(t *testing.T) {
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r, err := report.Generate(context.Background(), time.Unix(dayStart, 0), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "empty.json", got)
+
+	var html bytes.Buffer
+	if err := r.RenderHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+	checkGolden(t, "empty.html", html.Bytes())
+}
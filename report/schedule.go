@@ -0,0 +1,160 @@
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/zhongzc/diag_backend/notify"
+	"github.com/zhongzc/diag_backend/utils"
+
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	scheduleAt = pflag.String("report.at", "", "Local time of day in the form HH:MM to generate the report of the previous day, disabled if empty")
+	timezone   = pflag.String("report.timezone", "UTC", "IANA timezone defining the day boundaries of reports")
+	reportDir  = pflag.String("report.dir", "", "Directory to write the rendered reports to, skipped if empty")
+)
+
+var (
+	location *time.Location
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+
+	bytesP = utils.BytesBufferPool{}
+)
+
+func Init() {
+	loc, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Fatal("unknown report timezone", zap.String("timezone", *timezone), zap.Error(err))
+	}
+	location = loc
+
+	if len(*scheduleAt) == 0 {
+		return
+	}
+	hour, minute, err := parseTimeOfDay(*scheduleAt)
+	if err != nil {
+		log.Fatal("invalid report schedule", zap.String("at", *scheduleAt), zap.Error(err))
+	}
+	if len(*reportDir) != 0 {
+		if err = os.MkdirAll(*reportDir, os.ModePerm); err != nil {
+			log.Fatal("failed to init report dir", zap.String("dir", *reportDir), zap.Error(err))
+		}
+	}
+
+	stopCh = make(chan struct{})
+	doneCh = make(chan struct{})
+	go loop(hour, minute)
+
+	log.Info("scheduled daily reports", zap.String("at", *scheduleAt), zap.String("timezone", *timezone))
+}
+
+func Stop() {
+	if stopCh == nil {
+		return
+	}
+	close(stopCh)
+	<-doneCh
+}
+
+// Location returns the timezone defining the day boundaries.
+func Location() *time.Location {
+	if location == nil {
+		return time.UTC
+	}
+	return location
+}
+
+// Run generates the report of the day containing day and delivers it to the
+// configured directory and webhook.
+func Run(day time.Time) (*Report, error) {
+	r, err := Generate(context.Background(), day, Location())
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*reportDir) != 0 {
+		if err = writeFiles(*reportDir, r); err != nil {
+			return nil, err
+		}
+	}
+	notify.Notify(notify.Event{
+		Type:      notify.EventDailyReport,
+		FirstSeen: r.StartSecs,
+		Report:    r,
+	})
+	return r, nil
+}
+
+func loop(hour, minute int) {
+	defer close(doneCh)
+
+	for {
+		now := clock.Now()
+		next := nextRun(now, hour, minute, location)
+		timer := clock.NewTimer(next.Sub(now))
+
+		select {
+		case <-timer.C():
+			if _, err := Run(next.AddDate(0, 0, -1)); err != nil {
+				log.Warn("failed to generate the daily report", zap.Error(err))
+			}
+		case <-stopCh:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// nextRun returns the first hour:minute in loc strictly after now.
+func nextRun(now time.Time, hour, minute int, loc *time.Location) time.Time {
+	now = now.In(loc)
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, loc)
+	if !next.After(now) {
+		next = time.Date(now.Year(), now.Month(), now.Day()+1, hour, minute, 0, 0, loc)
+	}
+	return next
+}
+
+func parseTimeOfDay(s string) (int, int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("expect HH:MM: %w", err)
+	}
+	return t.Hour(), t.Minute(), nil
+}
+
+func writeFiles(dir string, r *Report) error {
+	jsonBody, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := "report-" + r.Date
+	if err = writeFileAtomic(filepath.Join(dir, name+".json"), jsonBody); err != nil {
+		return err
+	}
+
+	buf := bytesP.Get()
+	defer bytesP.Put(buf)
+	if err = r.RenderHTML(buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, name+".html"), buf.Bytes())
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/zhongzc/diag_backend/alert"
+
+	"github.com/gin-gonic/gin"
+)
+
+func alertRules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   alert.Rules(),
+	})
+}
+
+func alertAddRule(c *gin.Context) {
+	rule := alert.Rule{}
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if err := alert.AddRule(rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+func alertRemoveRule(c *gin.Context) {
+	alert.RemoveRule(c.Param("name"))
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+func alertActiveAlerts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   alert.ActiveAlerts(),
+	})
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+
+	"github.com/gin-gonic/gin"
+)
+
+// auditEvents lists the audit events filtered by `operation`, `caller`, `start`, `end` and `limit`.
+func auditEvents(c *gin.Context) {
+	filter := audit.Filter{
+		Operation: c.Query("operation"),
+		Caller:    c.Query("caller"),
+	}
+	for _, p := range []struct {
+		name   string
+		target *int64
+	}{
+		{"start", &filter.StartSecs},
+		{"end", &filter.EndSecs},
+	} {
+		raw := c.Query(p.name)
+		if len(raw) == 0 {
+			continue
+		}
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "failed to parse " + p.name + ": " + err.Error(),
+			})
+			return
+		}
+		*p.target = v
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "failed to parse limit: " + err.Error(),
+		})
+		return
+	}
+	filter.Limit = limit
+
+	events := []audit.Event{}
+	if err = audit.ListAuditEvents(filter, &events); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   events,
+	})
+}
@@ -0,0 +1,248 @@
+package service
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/pflag"
+)
+
+var (
+	apiKeys       = pflag.StringArray("http.api-key", nil, "API key in the form role[@tenant]:key with role reader or admin, scoped to the default tenant unless @tenant, can be repeated to rotate keys. The HTTP API is open if neither keys nor client certs are configured")
+	tlsCert       = pflag.String("http.tls-cert", "", "Certificate file to serve HTTPS with")
+	tlsKey        = pflag.String("http.tls-key", "", "Private key file of --http.tls-cert")
+	clientCA      = pflag.String("http.client-ca", "", "CA file to verify client certificates with, enabling mTLS. Requires --http.tls-cert")
+	clientCNRoles = pflag.StringArray("http.client-cert-role", nil, "Role of the client certificates with a common name in the form cn:role[@tenant], can be repeated")
+)
+
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleReader
+	RoleAdmin
+)
+
+func parseRole(s string) (Role, error) {
+	switch s {
+	case "reader":
+		return RoleReader, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+	return RoleNone, fmt.Errorf("unknown role %q", s)
+}
+
+// parseGrant parses a role[@tenant], the role of a caller within a tenant.
+func parseGrant(s string) (grant, error) {
+	var g grant
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		s, g.tenant = s[:i], s[i+1:]
+		if len(g.tenant) == 0 {
+			return grant{}, errors.New("empty tenant, expect role@tenant")
+		}
+		if err := store.CheckTenant(g.tenant); err != nil {
+			return grant{}, err
+		}
+	}
+	role, err := parseRole(s)
+	if err != nil {
+		return grant{}, err
+	}
+	g.role = role
+	return g, nil
+}
+
+func (r Role) String() string {
+	switch r {
+	case RoleReader:
+		return "reader"
+	case RoleAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+const callerKey = "diag.caller"
+
+// grant is a role within a tenant.
+type grant struct {
+	role   Role
+	tenant string
+}
+
+type apiKey struct {
+	hash [sha256.Size]byte
+	grant
+}
+
+// Authenticator grants roles within a tenant to the requests presenting an API
+// key or a verified client certificate. A zero Authenticator lets everything
+// through, within the default tenant.
+type Authenticator struct {
+	keys    []apiKey
+	cnRoles map[string]grant
+}
+
+// NewAuthenticator parses keys in the form role[@tenant]:key and cnRoles in
+// the form cn:role[@tenant].
+func NewAuthenticator(keys []string, cnRoles []string) (*Authenticator, error) {
+	a := &Authenticator{}
+	for _, raw := range keys {
+		i := strings.IndexByte(raw, ':')
+		if i < 0 || i == len(raw)-1 {
+			return nil, errors.New("invalid api key, expect role[@tenant]:key")
+		}
+		g, err := parseGrant(raw[:i])
+		if err != nil {
+			return nil, err
+		}
+		a.keys = append(a.keys, apiKey{hash: sha256.Sum256([]byte(raw[i+1:])), grant: g})
+	}
+
+	for _, raw := range cnRoles {
+		i := strings.LastIndexByte(raw, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid client cert role %q, expect cn:role[@tenant]", raw)
+		}
+		g, err := parseGrant(raw[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if a.cnRoles == nil {
+			a.cnRoles = make(map[string]grant)
+		}
+		a.cnRoles[raw[:i]] = g
+	}
+	return a, nil
+}
+
+func (a *Authenticator) enabled() bool {
+	return len(a.keys) != 0 || len(a.cnRoles) != 0
+}
+
+// authenticate returns the grant of the request and an identity of the caller.
+func (a *Authenticator) authenticate(r *http.Request) (grant, string) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 && len(r.TLS.VerifiedChains[0]) != 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if g, ok := a.cnRoles[cn]; ok {
+			return g, "cert:" + cn
+		}
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); len(key) == 0 && strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if len(key) == 0 {
+		return grant{}, ""
+	}
+
+	// Compare fixed-size hashes against every key so the timing tells nothing.
+	hash := sha256.Sum256([]byte(key))
+	var g grant
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash[:]) == 1 {
+			g = k.grant
+		}
+	}
+	if g.role == RoleNone {
+		return grant{}, ""
+	}
+	return g, "key:" + hex.EncodeToString(hash[:4])
+}
+
+// Require returns a middleware rejecting requests without at least role, with
+// 401 for missing or invalid credentials and 403 for an insufficient role. The
+// requests let through are scoped to the tenant of their credentials, never to
+// one they name.
+func (a *Authenticator) Require(role Role) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if a == nil || !a.enabled() {
+			c.Set(callerKey, c.ClientIP())
+			c.Next()
+			return
+		}
+
+		granted, caller := a.authenticate(c.Request)
+		if granted.role == RoleNone {
+			a.deny(c, role, c.ClientIP(), http.StatusUnauthorized, "unauthenticated")
+			return
+		}
+		if granted.role < role {
+			a.deny(c, role, caller, http.StatusForbidden, "requires the "+role.String()+" role")
+			return
+		}
+
+		c.Set(callerKey, caller)
+		c.Request = c.Request.WithContext(store.WithTenant(c.Request.Context(), granted.tenant))
+		c.Next()
+	}
+}
+
+func (a *Authenticator) deny(c *gin.Context, role Role, caller string, code int, reason string) {
+	if role == RoleAdmin {
+		params := map[string]string{"method": c.Request.Method, "path": c.Request.URL.Path}
+		_ = audit.Do("admin_denied", caller, params, func() (int, error) {
+			return 0, errors.New(reason)
+		})
+	}
+	if code == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", "Bearer")
+	}
+	c.AbortWithStatusJSON(code, gin.H{
+		"status":  "error",
+		"message": reason,
+	})
+}
+
+// callerOf identifies the caller of an administrative request for the audit log.
+func callerOf(c *gin.Context) string {
+	if caller := c.GetString(callerKey); len(caller) != 0 {
+		return caller
+	}
+	return c.ClientIP()
+}
+
+// serverTLSConfig returns the TLS config from the flags, nil to serve plain HTTP.
+func serverTLSConfig() (*tls.Config, error) {
+	if len(*tlsCert) == 0 {
+		if len(*clientCA) != 0 {
+			return nil, errors.New("--http.client-ca requires --http.tls-cert")
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if len(*clientCA) != 0 {
+		pem, err := ioutil.ReadFile(*clientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", *clientCA)
+		}
+		cfg.ClientCAs = pool
+		// API keys remain usable by clients without a certificate.
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
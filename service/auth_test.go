@@ -0,0 +1,305 @@
+package service
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/spf13/pflag"
+)
+
+// routeRoles is the role required by each route of newRouter.
+var routeRoles = map[string]Role{
+	"GET /health": RoleNone,
+
+	"GET /topsql/v1/cpu_time":          RoleReader,
+	"GET /topsql/v1/cpu_time/stream":   RoleReader,
+	"GET /topsql/v1/cpu_time/buckets":  RoleReader,
+	"GET /topsql/v1/instances":         RoleReader,
+	"GET /topsql/v1/summary":           RoleReader,
+	"GET /topsql/v1/digests/:digest":   RoleReader,
+	"GET /topsql/v1/sql":               RoleReader,
+	"GET /topsql/v1/meta_stats":        RoleReader,
+	"GET /topsql/v1/meta_counts":       RoleReader,
+	"GET /topsql/v1/freshness":         RoleReader,
+	"GET /alert/v1/rules":              RoleReader,
+	"GET /alert/v1/alerts":             RoleReader,
+	"GET /report/v1/daily":             RoleReader,
+	"GET /profile/v1/profiles":         RoleReader,
+	"GET /profile/v1/profiles/:id/raw": RoleReader,
+	"GET /api/v1/query":                RoleReader,
+	"POST /api/v1/query":               RoleReader,
+	"GET /api/v1/query_range":          RoleReader,
+	"POST /api/v1/query_range":         RoleReader,
+	"GET /metrics":                     RoleReader,
+
+	"DELETE /topsql/v1/digests/:digest":        RoleAdmin,
+	"POST /topsql/v1/digests/:digest/undelete": RoleAdmin,
+	"POST /topsql/v1/texts/reencrypt":          RoleAdmin,
+	"POST /topsql/v1/instances/merge":          RoleAdmin,
+	"POST /alert/v1/rules":                     RoleAdmin,
+	"DELETE /alert/v1/rules/:name":             RoleAdmin,
+	"POST /profile/v1/profiles":                RoleAdmin,
+	"GET /audit/v1/events":                     RoleAdmin,
+	"GET /debug/vars":                          RoleAdmin,
+}
+
+var routeParams = strings.NewReplacer(":digest", "5e4c", ":id", "1", ":name", "cpu")
+
+// checkCode fails unless code is the one of a caller of role on a route
+// requiring required.
+func checkCode(t *testing.T, route string, role, required Role, code int) {
+	t.Helper()
+	switch {
+	case required == RoleNone || role >= required:
+		if code == http.StatusUnauthorized || code == http.StatusForbidden {
+			t.Errorf("got code %d of %s as %s, want it let through", code, route, role)
+		}
+	case role == RoleNone:
+		if code != http.StatusUnauthorized {
+			t.Errorf("got code %d of %s as %s, want 401", code, route, role)
+		}
+	default:
+		if code != http.StatusForbidden {
+			t.Errorf("got code %d of %s as %s, want 403", code, route, role)
+		}
+	}
+}
+
+// newMemStore runs the handlers in memory, auditing the admin requests.
+func newMemStore(t *testing.T) *testutil.MemStore {
+	t.Helper()
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Init(s.DB)
+	t.Cleanup(func() {
+		audit.Stop()
+		_ = s.Close()
+	})
+	return s
+}
+
+func TestRouteRoles(t *testing.T) {
+	newMemStore(t)
+	auth, err := NewAuthenticator([]string{"reader:rkey", "admin:akey"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ng := newRouter(ioutil.Discard, auth)
+
+	// Every route is listed, new ones must be given a role here
+	routes := ng.Routes()
+	if len(routes) != len(routeRoles) {
+		t.Errorf("got %d routes, want %d", len(routes), len(routeRoles))
+	}
+	deniedAdmin := 0
+	for _, r := range routes {
+		route := r.Method + " " + r.Path
+		required, ok := routeRoles[route]
+		if !ok {
+			t.Errorf("got route %s without a role", route)
+			continue
+		}
+
+		for _, caller := range []struct {
+			role   Role
+			header string
+		}{
+			{role: RoleNone},
+			{role: RoleNone, header: "Bearer wrong"},
+			{role: RoleReader, header: "Bearer rkey"},
+			{role: RoleAdmin, header: "Bearer akey"},
+		} {
+			req := httptest.NewRequest(r.Method, routeParams.Replace(r.Path), nil)
+			if len(caller.header) != 0 {
+				req.Header.Set("Authorization", caller.header)
+			}
+			rec := httptest.NewRecorder()
+			ng.ServeHTTP(rec, req)
+			checkCode(t, route, caller.role, required, rec.Code)
+			if required == RoleAdmin && caller.role < RoleAdmin {
+				deniedAdmin++
+			}
+		}
+	}
+
+	// The denied admin requests are audited
+	var events []audit.Event
+	if err := audit.ListAuditEvents(audit.Filter{Operation: "admin_denied"}, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != deniedAdmin {
+		t.Fatalf("got %d admin_denied events, want %d", len(events), deniedAdmin)
+	}
+}
+
+// certPair is a certificate and its key.
+type certPair struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newCert issues a certificate of cn signed by parent, self-signed if nil.
+func newCert(t *testing.T, cn string, parent *certPair) *certPair {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certPair{cert: cert, key: key, tls: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}}
+}
+
+// writePEM writes the certificate and the key of p to dir, returning their
+// paths.
+func writePEM(t *testing.T, dir, name string, p *certPair) (string, string) {
+	t.Helper()
+	certPath, keyPath := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := pflag.Lookup(name).Value.String()
+	if err := pflag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = pflag.Set(name, old) })
+}
+
+func TestClientCertRoles(t *testing.T) {
+	newMemStore(t)
+
+	dir := t.TempDir()
+	ca := newCert(t, "diag ca", nil)
+	caPath, _ := writePEM(t, dir, "ca", ca)
+	certPath, keyPath := writePEM(t, dir, "server", newCert(t, "localhost", ca))
+	setFlag(t, "http.tls-cert", certPath)
+	setFlag(t, "http.tls-key", keyPath)
+	setFlag(t, "http.client-ca", caPath)
+	cfg, err := serverTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth, err := NewAuthenticator([]string{"reader:rkey"}, []string{"ops:admin", "dashboard:reader"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(newRouter(ioutil.Discard, auth))
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	client := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: certs,
+			ServerName:   "localhost",
+		}}}
+	}
+
+	for _, tt := range []struct {
+		name   string
+		client *http.Client
+		header string
+		role   Role
+	}{
+		{name: "no cert", client: client()},
+		{name: "admin cert", client: client(newCert(t, "ops", ca).tls), role: RoleAdmin},
+		{name: "reader cert", client: client(newCert(t, "dashboard", ca).tls), role: RoleReader},
+		// A verified cert of an unknown cn grants nothing, the key still does
+		{name: "unknown cert", client: client(newCert(t, "intruder", ca).tls)},
+		{name: "unknown cert with key", client: client(newCert(t, "intruder", ca).tls), header: "Bearer rkey", role: RoleReader},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, route := range []string{"GET /topsql/v1/freshness", "GET /debug/vars"} {
+				path := strings.TrimPrefix(route, "GET ")
+				req, err := http.NewRequest("GET", srv.URL+path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tt.header) != 0 {
+					req.Header.Set("Authorization", tt.header)
+				}
+				resp, err := tt.client.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				checkCode(t, route, tt.role, routeRoles[route], resp.StatusCode)
+			}
+		})
+	}
+
+	// A cert of another CA fails the handshake rather than falling back to keys,
+	// sent even though the server does not ask for its CA
+	untrusted := newCert(t, "ops", newCert(t, "other ca", nil)).tls
+	c := client()
+	c.Transport.(*http.Transport).TLSClientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &untrusted, nil
+	}
+	req, err := http.NewRequest("GET", srv.URL+"/health", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer rkey")
+	if resp, err := c.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("got code %d of a cert of an untrusted CA, want the handshake failed", resp.StatusCode)
+	}
+}
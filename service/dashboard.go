@@ -0,0 +1,33 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/zhongzc/diag_backend/storage/query"
+
+	"github.com/gin-gonic/gin"
+)
+
+// topSQLSummary serves the summary of the Top SQL page of TiDB Dashboard: the top
+// SQLs with their plans and an `is_other` item for the rest.
+func topSQLSummary(c *gin.Context) {
+	params, ok := parseTopSQLParams(c)
+	if !ok {
+		return
+	}
+
+	items := []query.SummaryItem{}
+	err := query.Summary(c.Request.Context(), params.startSecs, params.endSecs, params.windowSecs, params.top, params.instance, &items)
+	if err != nil {
+		c.JSON(queryErrorCode(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   items,
+	})
+}
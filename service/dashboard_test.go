@@ -0,0 +1,166 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// The responses as read by the Top SQL page of TiDB Dashboard, the fields
+// it does not read left out.
+type (
+	dashboardResponse struct {
+		Status  string          `json:"status"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+	dashboardInstance struct {
+		Instance     string `json:"instance"`
+		InstanceType string `json:"instance_type"`
+	}
+	dashboardSummary struct {
+		SQLDigest string                 `json:"sql_digest"`
+		SQLText   string                 `json:"sql_text"`
+		IsOther   bool                   `json:"is_other"`
+		Plans     []dashboardSummaryPlan `json:"plans"`
+	}
+	dashboardSummaryPlan struct {
+		PlanDigest   string   `json:"plan_digest"`
+		PlanText     string   `json:"plan_text"`
+		TimestampSec []uint64 `json:"timestamp_sec"`
+		CPUTimeMs    []uint64 `json:"cpu_time_ms"`
+	}
+)
+
+// dashboardFixture is a request of TiDB Dashboard and the response it expects.
+type dashboardFixture struct {
+	Request  string          `json:"request"`
+	Code     int             `json:"code"`
+	Response json.RawMessage `json:"response"`
+}
+
+// decodeDashboard decodes a response of path as TiDB Dashboard does, failing
+// on the fields it does not read if strict.
+func decodeDashboard(t *testing.T, path string, raw []byte, strict bool) (string, string, interface{}) {
+	t.Helper()
+	decode := func(raw []byte, v interface{}) {
+		t.Helper()
+		d := json.NewDecoder(bytes.NewReader(raw))
+		if strict {
+			d.DisallowUnknownFields()
+		}
+		if err := d.Decode(v); err != nil {
+			t.Fatalf("failed to decode the response of %s: %v", path, err)
+		}
+	}
+
+	var resp dashboardResponse
+	decode(raw, &resp)
+	if len(resp.Data) == 0 {
+		return resp.Status, resp.Message, nil
+	}
+	switch path {
+	case "/topsql/v1/instances":
+		var data []dashboardInstance
+		decode(resp.Data, &data)
+		return resp.Status, resp.Message, data
+	case "/topsql/v1/summary":
+		var data []dashboardSummary
+		decode(resp.Data, &data)
+		return resp.Status, resp.Message, data
+	}
+	t.Fatalf("got a fixture of %s, not a dashboard route", path)
+	return "", "", nil
+}
+
+func TestDashboardContract(t *testing.T) {
+	s := newMemStore(t)
+	// The digests are of this test only, the seen caches outliving the stores
+	// of the other ones
+	for digest, text := range map[string]string{
+		"\xd5\xa1": "select * from t where id = ?",
+		"\xd5\xa2": "update t set v = ? where id = ?",
+	} {
+		if err := s.SeedSQLMeta([]byte(digest), text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for digest, text := range map[string]string{
+		"\xd5\xb1": "Point_Get",
+		"\xd5\xb2": "TableReader",
+	} {
+		if err := s.SeedPlanMeta([]byte(digest), text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Two plans of d5a1, d5a2 without a plan, the others reported by TiDB and
+	// a TiKV instance
+	record := func(sqlDigest, planDigest []byte, instance, job string, secs []uint64, ms []uint32) *tipb.CPUTimeRecord {
+		return &tipb.CPUTimeRecord{
+			SqlDigest:              sqlDigest,
+			PlanDigest:             planDigest,
+			Instance:               instance,
+			Job:                    job,
+			RecordListTimestampSec: secs,
+			RecordListCpuTimeMs:    ms,
+		}
+	}
+	err := store.TopSQLRecords([]*tipb.CPUTimeRecord{
+		record([]byte{0xd5, 0xa1}, []byte{0xd5, 0xb1}, "tidb-0:10080", "tidb", []uint64{1632700800, 1632700830, 1632700860}, []uint32{35, 40, 60}),
+		record([]byte{0xd5, 0xa1}, []byte{0xd5, 0xb2}, "tidb-0:10080", "tidb", []uint64{1632700860}, []uint32{200}),
+		record([]byte{0xd5, 0xa2}, nil, "tidb-0:10080", "tidb", []uint64{1632700800}, []uint32{20}),
+		record(nil, nil, "tidb-0:10080", "tidb", []uint64{1632700860}, []uint32{5}),
+		record([]byte{0xd5, 0xa1}, nil, "tikv-0:20180", "tikv", []uint64{1632700800}, []uint32{7}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := filepath.Glob(filepath.Join("testdata", "dashboard", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("got no dashboard fixtures")
+	}
+	ng := newRouter(ioutil.Discard, nil)
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".json"), func(t *testing.T) {
+			raw, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var fixture dashboardFixture
+			if err := json.Unmarshal(raw, &fixture); err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodGet, fixture.Request, nil)
+
+			// The fixture only has what the dashboard reads, while the
+			// dashboard ignores the extra fields of the responses
+			wantStatus, wantMessage, want := decodeDashboard(t, req.URL.Path, fixture.Response, true)
+			rec := httptest.NewRecorder()
+			ng.ServeHTTP(rec, req)
+			if rec.Code != fixture.Code {
+				t.Fatalf("got code %d, want %d: %s", rec.Code, fixture.Code, rec.Body.String())
+			}
+			status, message, got := decodeDashboard(t, req.URL.Path, rec.Body.Bytes(), false)
+			if status != wantStatus || message != wantMessage {
+				t.Fatalf("got status %q and message %q, want %q and %q", status, message, wantStatus, wantMessage)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got data %+v, want %+v", got, want)
+			}
+		})
+	}
+}
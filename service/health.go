@@ -0,0 +1,45 @@
+package service
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/spf13/pflag"
+)
+
+var healthStaleAfter = pflag.Duration("http.health-stale-after", 5*time.Minute, "Time without a write of an instance after which /health reports it stale")
+
+// health reports the instances not written for `stale_after`, --http.health-stale-after by default.
+func health(c *gin.Context) {
+	staleAfter := *healthStaleAfter
+	if raw := c.Query("stale_after"); len(raw) != 0 {
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "stale_after must be a positive duration, e.g. 5m",
+			})
+			return
+		}
+		staleAfter = d
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data": gin.H{
+			"instances":        len(store.DataFreshness()),
+			"stale_instances":  store.StaleInstances(staleAfter),
+			"stale_after_secs": staleAfter.Seconds(),
+		},
+	})
+}
+
+func dataFreshness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   store.DataFreshness(),
+	})
+}
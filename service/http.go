@@ -1,6 +1,11 @@
 package service
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -8,7 +13,9 @@ import (
 	"time"
 
 	"github.com/zhongzc/diag_backend/storage/query"
+	"github.com/zhongzc/diag_backend/storage/textcrypt"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-contrib/gzip"
 	"github.com/gin-gonic/gin"
@@ -24,15 +31,29 @@ var (
 )
 
 func ServeHTTP(logFileName string, listener net.Listener) {
-	gin.SetMode(gin.ReleaseMode)
-	ng := gin.New()
-	ng.Use(gin.Logger(), gin.Recovery())
-
 	file, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
 		log.Fatal("Failed to open the log file", zap.String("filename", logFileName))
 	}
-	ng.Use(gin.LoggerWithWriter(file))
+
+	auth, err := NewAuthenticator(*apiKeys, *clientCNRoles)
+	if err != nil {
+		log.Fatal("invalid http auth config", zap.Error(err))
+	}
+	ng := newRouter(file, auth)
+
+	httpServer = &http.Server{Handler: ng}
+	if err = httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+		log.Warn("failed to serve http service", zap.Error(err))
+	}
+}
+
+// newRouter builds the HTTP API with the routes guarded by auth.
+func newRouter(logWriter io.Writer, auth *Authenticator) *gin.Engine {
+	gin.SetMode(gin.ReleaseMode)
+	ng := gin.New()
+	ng.Use(gin.Logger(), gin.Recovery())
+	ng.Use(gin.LoggerWithWriter(logWriter))
 
 	// recovery
 	ng.Use(gin.Recovery())
@@ -40,19 +61,51 @@ func ServeHTTP(logFileName string, listener net.Listener) {
 	// cors
 	config := cors.DefaultConfig()
 	config.AllowAllOrigins = true
+	config.AddAllowHeaders("Authorization", "X-API-Key")
 	ng.Use(cors.New(config))
 
 	// gzip
 	ng.Use(gzip.Gzip(gzip.DefaultCompression))
 
 	// route
-	ng.GET("/topsql/v1/cpu_time", topSQLCPUTime)
-	ng.GET("/topsql/v1/instances", topSQLAllInstances)
+	ng.GET("/health", health)
+	reader := ng.Group("/", auth.Require(RoleReader))
+	reader.GET("/topsql/v1/cpu_time", topSQLCPUTime)
+	reader.GET("/topsql/v1/cpu_time/stream", topSQLCPUTimeStream)
+	reader.GET("/topsql/v1/cpu_time/buckets", cpuTimeBuckets)
+	reader.GET("/topsql/v1/instances", topSQLAllInstances)
+	reader.GET("/topsql/v1/summary", topSQLSummary)
+	reader.GET("/topsql/v1/digests/:digest", getDigest)
+	reader.GET("/topsql/v1/sql", searchSQL)
+	reader.GET("/topsql/v1/meta_stats", metaStats)
+	reader.GET("/topsql/v1/meta_counts", metaCounts)
+	reader.GET("/topsql/v1/freshness", dataFreshness)
+	reader.GET("/alert/v1/rules", alertRules)
+	reader.GET("/alert/v1/alerts", alertActiveAlerts)
+	reader.GET("/report/v1/daily", dailyReport)
+	reader.GET("/profile/v1/profiles", listProfiles)
+	reader.GET("/profile/v1/profiles/:id/raw", downloadProfile)
+	reader.GET("/api/v1/query", promQuery)
+	reader.POST("/api/v1/query", promQuery)
+	reader.GET("/api/v1/query_range", promQuery)
+	reader.POST("/api/v1/query_range", promQuery)
+	reader.GET("/metrics", func(c *gin.Context) {
+		metrics.WritePrometheus(c.Writer, true)
+	})
 
-	httpServer = &http.Server{Handler: ng}
-	if err = httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
-		log.Warn("failed to serve http service", zap.Error(err))
-	}
+	admin := ng.Group("/", auth.Require(RoleAdmin))
+	admin.DELETE("/topsql/v1/digests/:digest", deleteDigest)
+	admin.POST("/topsql/v1/digests/:digest/undelete", undeleteDigest)
+	admin.POST("/topsql/v1/texts/reencrypt", reencryptTexts)
+	admin.POST("/topsql/v1/instances/merge", mergeInstances)
+	admin.POST("/alert/v1/rules", alertAddRule)
+	admin.DELETE("/alert/v1/rules/:name", alertRemoveRule)
+	admin.POST("/profile/v1/profiles", uploadProfile)
+	admin.GET("/audit/v1/events", auditEvents)
+	// expvar snapshots, e.g. the `store` one of storage/store.Diagnose
+	admin.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+
+	return ng
 }
 
 func StopHTTP() {
@@ -65,13 +118,180 @@ func StopHTTP() {
 }
 
 func topSQLCPUTime(c *gin.Context) {
+	params, ok := parseTopSQLParams(c)
+	if !ok {
+		return
+	}
+
+	if len(c.Query("page_size")) != 0 {
+		topSQLCPUTimePage(c, params)
+		return
+	}
+	shape, shaped, ok := parseShapeOptions(c)
+	if !ok {
+		return
+	}
+
+	items := topSQLItemsP.Get()
+	defer topSQLItemsP.Put(items)
+
+	total, err := query.TopSQL(c.Request.Context(), params.startSecs, params.endSecs, params.windowSecs, params.top, params.instance, items)
+	if err != nil {
+		c.JSON(queryErrorCode(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if shaped {
+		start, end, step := query.ShapeGrid(params.startSecs, params.endSecs, params.windowSecs)
+		data, meta := query.ShapeTopSQL(*items, start, end, step, shape)
+		c.JSON(http.StatusOK, gin.H{
+			"status":      "ok",
+			"data":        data,
+			"shape":       meta,
+			"cpu_time_ms": total,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "ok",
+		"data":        items,
+		"cpu_time_ms": total,
+	})
+}
+
+// parseShapeOptions parses `fill` (none, zero or null) and `smooth` (points),
+// aligning the series to the window grid if any is given.
+func parseShapeOptions(c *gin.Context) (query.ShapeOptions, bool, bool) {
+	rawFill, rawSmooth := c.Query("fill"), c.Query("smooth")
+	if len(rawFill) == 0 && len(rawSmooth) == 0 {
+		return query.ShapeOptions{}, false, true
+	}
+
+	fill, err := query.ParseFillPolicy(rawFill)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return query.ShapeOptions{}, false, false
+	}
+	smooth := 0
+	if len(rawSmooth) != 0 {
+		if smooth, err = strconv.Atoi(rawSmooth); err != nil || smooth < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "smooth must be a non-negative integer",
+			})
+			return query.ShapeOptions{}, false, false
+		}
+	}
+	return query.ShapeOptions{Fill: fill, Smooth: smooth}, true, true
+}
+
+// topSQLCPUTimePage serves a page of at most `page_size` items after `cursor`,
+// with `next_cursor` to fetch the next page if any. `restarted` tells the data
+// changed since the cursor was issued and the first page is served instead.
+func topSQLCPUTimePage(c *gin.Context, params topSQLParams) {
+	pageSize, err := strconv.Atoi(c.Query("page_size"))
+	if err != nil || pageSize <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "page_size must be a positive integer",
+		})
+		return
+	}
+
+	page, err := query.TopSQLPage(c.Request.Context(), params.startSecs, params.endSecs, params.windowSecs, params.top, params.instance, c.Query("cursor"), pageSize)
+	if err != nil {
+		code := queryErrorCode(err)
+		if errors.Is(err, query.ErrInvalidCursor) {
+			code = http.StatusBadRequest
+		}
+		c.JSON(code, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":      "ok",
+		"data":        page.Items,
+		"cpu_time_ms": page.CPUTimeMillis,
+		"next_cursor": page.NextCursor,
+		"restarted":   page.Restarted,
+	})
+}
+
+// topSQLCPUTimeStream streams the items of topSQLCPUTime as NDJSON ordered by
+// total cpu time descending. A failure after the first item cuts the stream.
+func topSQLCPUTimeStream(c *gin.Context) {
+	params, ok := parseTopSQLParams(c)
+	if !ok {
+		return
+	}
+
+	var encoder *json.Encoder
+	err := query.TopSQLStream(c.Request.Context(), params.startSecs, params.endSecs, params.windowSecs, params.top, params.instance, func(item query.TopSQLItem) error {
+		if encoder == nil {
+			c.Header("Content-Type", "application/x-ndjson")
+			c.Status(http.StatusOK)
+			encoder = json.NewEncoder(c.Writer)
+		}
+		if err := encoder.Encode(item); err != nil {
+			return err
+		}
+		c.Writer.Flush()
+		return nil
+	})
+
+	switch {
+	case err != nil && encoder == nil:
+		c.JSON(queryErrorCode(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+	case err != nil:
+		log.Warn("failed to stream top sql", zap.Error(err))
+	case encoder == nil:
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+	}
+}
+
+// queryErrorCode is the status code of a failed query.
+func queryErrorCode(err error) int {
+	switch {
+	case errors.Is(err, query.ErrQueryTooLarge), errors.Is(err, textcrypt.ErrSearchEncrypted):
+		return http.StatusBadRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusServiceUnavailable
+}
+
+type topSQLParams struct {
+	instance   string
+	startSecs  int
+	endSecs    int
+	windowSecs int
+	top        int
+}
+
+// parseTopSQLParams parses the query parameters shared by the Top SQL endpoints,
+// responding with an error if any is invalid.
+func parseTopSQLParams(c *gin.Context) (topSQLParams, bool) {
 	instance := c.Query("instance")
 	if len(instance) == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
 			"message": "no instance",
 		})
-		return
+		return topSQLParams{}, false
 	}
 
 	var err error
@@ -98,7 +318,7 @@ func topSQLCPUTime(c *gin.Context) {
 			"status":  "error",
 			"message": err.Error(),
 		})
-		return
+		return topSQLParams{}, false
 	}
 
 	raw = c.DefaultQuery("end", strconv.Itoa(int(now)))
@@ -111,7 +331,7 @@ func topSQLCPUTime(c *gin.Context) {
 			"status":  "error",
 			"message": err.Error(),
 		})
-		return
+		return topSQLParams{}, false
 	}
 
 	raw = c.DefaultQuery("top", "-1")
@@ -124,7 +344,7 @@ func topSQLCPUTime(c *gin.Context) {
 			"status":  "error",
 			"message": err.Error(),
 		})
-		return
+		return topSQLParams{}, false
 	}
 
 	raw = c.DefaultQuery("window", "1m")
@@ -137,33 +357,31 @@ func topSQLCPUTime(c *gin.Context) {
 			"status":  "error",
 			"message": err.Error(),
 		})
-		return
+		return topSQLParams{}, false
 	}
 	windowSecs = int64(duration.Seconds())
-
-	items := topSQLItemsP.Get()
-	defer topSQLItemsP.Put(items)
-
-	err = query.TopSQL(int(startSecs), int(endSecs), int(windowSecs), int(top), instance, items)
-	if err != nil {
-		c.JSON(http.StatusServiceUnavailable, gin.H{
+	if windowSecs <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
 			"status":  "error",
-			"message": err.Error(),
+			"message": "window should be at least 1s",
 		})
-		return
+		return topSQLParams{}, false
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"status": "ok",
-		"data":   items,
-	})
+	return topSQLParams{
+		instance:   instance,
+		startSecs:  int(startSecs),
+		endSecs:    int(endSecs),
+		windowSecs: int(windowSecs),
+		top:        int(top),
+	}, true
 }
 
 func topSQLAllInstances(c *gin.Context) {
 	instances := instanceItemsP.Get()
 	defer instanceItemsP.Put(instances)
 
-	if err := query.AllInstances(instances); err != nil {
+	if err := query.AllInstances(c.Request.Context(), instances); err != nil {
 		c.JSON(http.StatusServiceUnavailable, gin.H{
 			"status":  "error",
 			"message": err.Error(),
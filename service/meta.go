@@ -0,0 +1,219 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/zhongzc/diag_backend/storage/query"
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// getDigest returns the metas of `digest`, with `include_deleted=true` even if deleted.
+func getDigest(c *gin.Context) {
+	item, err := query.Digest(c.Request.Context(), c.Param("digest"), c.Query("include_deleted") == "true")
+	if err != nil {
+		c.JSON(metaErrorCode(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	if item.SQL == nil && item.Plan == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"status":  "error",
+			"message": "unknown digest",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   item,
+	})
+}
+
+// metaErrorCode is the status of the failures of the digest endpoints.
+func metaErrorCode(err error) int {
+	if errors.Is(err, store.ErrInvalidDigest) {
+		return http.StatusBadRequest
+	}
+	return http.StatusServiceUnavailable
+}
+
+func deleteDigest(c *gin.Context) {
+	if err := store.DeleteDigest(callerOf(c), store.TenantFrom(c.Request.Context()), c.Param("digest")); err != nil {
+		c.JSON(metaErrorCode(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+func undeleteDigest(c *gin.Context) {
+	if err := store.UndeleteDigest(callerOf(c), store.TenantFrom(c.Request.Context()), c.Param("digest")); err != nil {
+		c.JSON(metaErrorCode(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// reencryptTexts rewrites the texts not encrypted with the active key, e.g. after a key rotation.
+func reencryptTexts(c *gin.Context) {
+	if err := store.ReencryptTexts(callerOf(c)); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+	})
+}
+
+// mergeInstances rewrites the instance rows under their normalized instances.
+func mergeInstances(c *gin.Context) {
+	merged, err := store.MergeInstances(callerOf(c))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   gin.H{"merged": merged},
+	})
+}
+
+// searchSQL lists the SQL metas whose normalized text contains `pattern`, at most `limit` of them,
+// including the deleted ones with `include_deleted=true`, of the internal SQLs only with
+// `internal=true` or of the others with `internal=false`.
+func searchSQL(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "failed to parse limit: " + err.Error(),
+		})
+		return
+	}
+
+	internal, ok := parseInternal(c)
+	if !ok {
+		return
+	}
+
+	items := []query.SQLMetaItem{}
+	opts := query.SearchOptions{Limit: limit, IncludeDeleted: c.Query("include_deleted") == "true", Internal: internal}
+	if err = query.SearchSQL(c.Request.Context(), c.Query("pattern"), opts, &items); err != nil {
+		c.JSON(queryErrorCode(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   items,
+	})
+}
+
+func metaStats(c *gin.Context) {
+	stats, err := query.MetaStats(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   stats,
+	})
+}
+
+// metaCounts counts the digests, of the internal SQLs only with `internal=true`
+// or of the others with `internal=false`, first seen within `first_seen_from`
+// and `first_seen_to` in unix seconds if set.
+func metaCounts(c *gin.Context) {
+	internal, ok := parseInternal(c)
+	if !ok {
+		return
+	}
+
+	filter := query.CountFilter{Internal: internal}
+	for _, p := range []struct {
+		name   string
+		target *int64
+	}{
+		{"first_seen_from", &filter.FirstSeenFrom},
+		{"first_seen_to", &filter.FirstSeenTo},
+	} {
+		raw := c.Query(p.name)
+		if len(raw) == 0 {
+			continue
+		}
+		v, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": "failed to parse " + p.name + ": " + err.Error(),
+			})
+			return
+		}
+		*p.target = v
+	}
+
+	counts, err := query.Counts(c.Request.Context(), filter)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   counts,
+	})
+}
+
+// parseInternal parses the `internal` filter, nil if unset, responding with
+// the error if invalid.
+func parseInternal(c *gin.Context) (*bool, bool) {
+	raw := c.Query("internal")
+	if len(raw) == 0 {
+		return nil, true
+	}
+	internal, err := strconv.ParseBool(raw)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "failed to parse internal: " + err.Error(),
+		})
+		return nil, false
+	}
+	return &internal, true
+}
@@ -0,0 +1,109 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/profile"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadProfile stores the request body as a profile of `instance` of `kind` started at `start_ts`.
+func uploadProfile(c *gin.Context) {
+	instance := c.Query("instance")
+	kind := c.Query("kind")
+	startTs, err := strconv.ParseInt(c.DefaultQuery("start_ts", strconv.FormatInt(time.Now().Unix(), 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "failed to parse start_ts: " + err.Error(),
+		})
+		return
+	}
+
+	// One more byte than the cap lets StoreProfile tell oversized bodies apart.
+	data, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, int64(profile.MaxSize())+1))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	id, err := profile.StoreProfile(instance, kind, startTs, data)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, profile.ErrProfileTooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		c.JSON(code, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   gin.H{"id": id},
+	})
+}
+
+func listProfiles(c *gin.Context) {
+	startTs, err := strconv.ParseInt(c.DefaultQuery("start", "0"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "failed to parse start: " + err.Error(),
+		})
+		return
+	}
+	endTs, err := strconv.ParseInt(c.DefaultQuery("end", strconv.FormatInt(time.Now().Unix(), 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "failed to parse end: " + err.Error(),
+		})
+		return
+	}
+
+	items := []profile.ProfileItem{}
+	if err = profile.ListProfiles(c.Query("instance"), startTs, endTs, &items); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   items,
+	})
+}
+
+// downloadProfile serves the raw content of a profile, gzipped pprof protobuf as produced by agents.
+func downloadProfile(c *gin.Context) {
+	item, data, err := profile.GetProfile(c.Param("id"))
+	if err != nil {
+		code := http.StatusServiceUnavailable
+		if errors.Is(err, profile.ErrProfileNotFound) {
+			code = http.StatusNotFound
+		}
+		c.JSON(code, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%d.pb.gz"`, item.Kind, item.StartTs))
+	c.Header("X-Content-Checksum", "sha256="+item.Checksum)
+	c.Data(http.StatusOK, "application/octet-stream", data)
+}
@@ -0,0 +1,24 @@
+package service
+
+import (
+	"net/http"
+
+	"github.com/zhongzc/diag_backend/storage/query"
+
+	"github.com/gin-gonic/gin"
+)
+
+// promQuery serves the Prometheus query API so that Grafana can use this backend
+// as a Prometheus data source. Both GET and form encoded POST requests are accepted.
+func promQuery(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":    "error",
+			"errorType": "bad_data",
+			"error":     err.Error(),
+		})
+		return
+	}
+
+	query.ProxyPromQL(c.Request.Context(), c.Request.URL.Path, c.Request.Form, c.Writer)
+}
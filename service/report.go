@@ -0,0 +1,115 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zhongzc/diag_backend/report"
+	"github.com/zhongzc/diag_backend/storage/query"
+
+	"github.com/gin-gonic/gin"
+)
+
+// dailyReport generates the report of `date` (YYYY-MM-DD, default yesterday) on demand,
+// the day bounded in `timezone` (IANA name, default --report.timezone).
+func dailyReport(c *gin.Context) {
+	loc := report.Location()
+	if raw := c.Query("timezone"); len(raw) != 0 {
+		var err error
+		if loc, err = query.LoadTimezone(raw); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+	day := time.Now().In(loc).AddDate(0, 0, -1)
+	if raw := c.Query("date"); len(raw) != 0 {
+		var err error
+		day, err = time.ParseInLocation("2006-01-02", raw, loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+			return
+		}
+	}
+
+	r, err := report.Generate(c.Request.Context(), day, loc)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	if c.Query("format") == "html" {
+		c.Status(http.StatusOK)
+		c.Header("Content-Type", "text/html; charset=utf-8")
+		_ = r.RenderHTML(c.Writer)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"data":   r,
+	})
+}
+
+// cpuTimeBuckets serves the total cpu time of `instance` (all if empty) per calendar
+// `unit` (hour or day) in `timezone` (IANA name, default UTC) within [`start`, `end`).
+func cpuTimeBuckets(c *gin.Context) {
+	unit, err := query.ParseBucketUnit(c.DefaultQuery("unit", "hour"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+	loc, err := query.LoadTimezone(c.Query("timezone"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	now := time.Now().Unix()
+	startSecs, err := strconv.ParseInt(c.DefaultQuery("start", strconv.FormatInt(now-24*60*60, 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "failed to parse start: " + err.Error(),
+		})
+		return
+	}
+	endSecs, err := strconv.ParseInt(c.DefaultQuery("end", strconv.FormatInt(now, 10)), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"status":  "error",
+			"message": "failed to parse end: " + err.Error(),
+		})
+		return
+	}
+
+	items, err := query.CPUTimeBuckets(c.Request.Context(), c.Query("instance"), startSecs, endSecs, unit, loc)
+	if err != nil {
+		c.JSON(queryErrorCode(err), gin.H{
+			"status":  "error",
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":   "ok",
+		"data":     items,
+		"timezone": loc.String(),
+	})
+}
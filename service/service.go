@@ -1,6 +1,7 @@
 package service
 
 import (
+	"crypto/tls"
 	"net"
 	"path"
 
@@ -17,6 +18,14 @@ func Init(logPath string, _logLevel string, listenAddr string) {
 		)
 	}
 
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatal("invalid http tls config", zap.Error(err))
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
 	go ServeHTTP(path.Join(logPath, "service.log"), l)
 
 	log.Info(
@@ -0,0 +1,233 @@
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	auditFile = pflag.String("audit.file", "", "JSONL file audit events are also appended to, skipped if empty")
+	retention = pflag.Duration("audit.retention", 365*24*time.Hour, "Audit events older than this are deleted")
+)
+
+const (
+	OutcomeOK    = "ok"
+	OutcomeError = "error"
+
+	// CallerSystem is the caller of operations run by the backend itself, like retention GC.
+	CallerSystem = "system"
+
+	gcInterval = 24 * time.Hour
+)
+
+type Event struct {
+	TimestampSecs int64             `json:"timestamp_secs"`
+	Operation     string            `json:"operation"`
+	Params        map[string]string `json:"params,omitempty"`
+	Caller        string            `json:"caller"`
+	Affected      int               `json:"affected"`
+	Outcome       string            `json:"outcome"`
+	Error         string            `json:"error,omitempty"`
+}
+
+// Filter selects audit events, zero fields match everything.
+type Filter struct {
+	Operation string
+	Caller    string
+	StartSecs int64
+	EndSecs   int64
+	Limit     int
+}
+
+var (
+	documentDB *genji.DB
+
+	fileMu sync.Mutex
+	file   *os.File
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+)
+
+func Init(db *genji.DB) {
+	documentDB = db
+
+	createStmts := []string{
+		"CREATE TABLE IF NOT EXISTS audit_event",
+		"CREATE INDEX IF NOT EXISTS audit_event_ts ON audit_event(ts)",
+	}
+	for _, stmt := range createStmts {
+		if err := db.Exec(stmt); err != nil {
+			log.Fatal("cannot init the audit table", zap.Error(err))
+		}
+	}
+
+	if len(*auditFile) != 0 {
+		f, err := os.OpenFile(*auditFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatal("cannot open the audit file", zap.String("path", *auditFile), zap.Error(err))
+		}
+		file = f
+	}
+
+	stopCh = make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(gcInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := gc(time.Now().Add(-*retention).Unix()); err != nil {
+					log.Warn("failed to delete expired audit events", zap.Error(err))
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func Stop() {
+	if stopCh != nil {
+		close(stopCh)
+		wg.Wait()
+	}
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	if file != nil {
+		_ = file.Close()
+		file = nil
+	}
+}
+
+// Do runs a destructive operation and records its outcome. fn returns the
+// number of affected rows. Destructive operations call it from the single
+// function implementing them, so that no caller can skip the record.
+func Do(operation, caller string, params map[string]string, fn func() (int, error)) error {
+	affected, err := fn()
+
+	e := Event{
+		TimestampSecs: time.Now().Unix(),
+		Operation:     operation,
+		Params:        params,
+		Caller:        caller,
+		Affected:      affected,
+		Outcome:       OutcomeOK,
+	}
+	if err != nil {
+		e.Outcome = OutcomeError
+		e.Error = err.Error()
+	}
+
+	if recordErr := record(e); recordErr != nil {
+		log.Error("failed to record audit event", zap.String("operation", operation), zap.String("caller", caller), zap.Error(recordErr))
+		if err == nil {
+			err = fmt.Errorf("failed to record audit event: %w", recordErr)
+		}
+	}
+	return err
+}
+
+func record(e Event) error {
+	if documentDB == nil {
+		return errors.New("audit is not initialized")
+	}
+
+	params, err := json.Marshal(e.Params)
+	if err != nil {
+		return err
+	}
+	err = documentDB.Exec(
+		"INSERT INTO audit_event(ts, operation, params, caller, affected, outcome, error) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		e.TimestampSecs, e.Operation, string(params), e.Caller, e.Affected, e.Outcome, e.Error,
+	)
+	if err != nil {
+		return err
+	}
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	if file == nil {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// ListAuditEvents fills the events matching filter, oldest first.
+func ListAuditEvents(filter Filter, fill *[]Event) error {
+	q := "SELECT ts, operation, params, caller, affected, outcome, error FROM audit_event WHERE ts >= ?"
+	args := []interface{}{filter.StartSecs}
+	if filter.EndSecs > 0 {
+		q += " AND ts <= ?"
+		args = append(args, filter.EndSecs)
+	}
+	if len(filter.Operation) != 0 {
+		q += " AND operation = ?"
+		args = append(args, filter.Operation)
+	}
+	if len(filter.Caller) != 0 {
+		q += " AND caller = ?"
+		args = append(args, filter.Caller)
+	}
+	q += " ORDER BY ts"
+	if filter.Limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	res, err := documentDB.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return res.Iterate(func(d types.Document) error {
+		e := Event{}
+		var params string
+		if err := document.Scan(d, &e.TimestampSecs, &e.Operation, &params, &e.Caller, &e.Affected, &e.Outcome, &e.Error); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(params), &e.Params); err != nil {
+			return err
+		}
+		*fill = append(*fill, e)
+		return nil
+	})
+}
+
+func gc(beforeTs int64) error {
+	return Do("audit_gc", CallerSystem, map[string]string{"before_ts": fmt.Sprint(beforeTs)}, func() (int, error) {
+		var affected int
+		err := documentDB.Update(func(tx *genji.Tx) error {
+			d, err := tx.QueryDocument("SELECT COUNT(*) FROM audit_event WHERE ts < ?", beforeTs)
+			if err != nil {
+				return err
+			}
+			if err = document.Scan(d, &affected); err != nil {
+				return err
+			}
+			return tx.Exec("DELETE FROM audit_event WHERE ts < ?", beforeTs)
+		})
+		return affected, err
+	})
+}
@@ -0,0 +1,123 @@
+package document
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/diag_backend/utils"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	compactionInterval = pflag.Duration("document.compaction-interval", 0, "Interval between the compactions of the document database reclaiming the space of updated and deleted metadata. 0 disables them")
+	compactionDiscard  = pflag.Float64("document.compaction-discard-ratio", 0.5, "Min fraction of discardable data for a value log file of the document database to be rewritten by a compaction")
+	compactionReindex  = pflag.Bool("document.compaction-reindex", false, "Also rebuild the indexes of the document database on compaction, which blocks its writes meanwhile")
+)
+
+var (
+	compactionHistogram      = metrics.NewHistogram(`diag_docdb_compaction_duration_seconds`)
+	compactionFailedCounter  = metrics.NewCounter(`diag_docdb_compactions_total{result="failed"}`)
+	compactionSuccessCounter = metrics.NewCounter(`diag_docdb_compactions_total{result="succeeded"}`)
+	compactionReclaimed      = metrics.NewCounter(`diag_docdb_compaction_reclaimed_bytes_total`)
+
+	compactor *compaction
+	// clock times the compactions, overridable for deterministic tests.
+	clock = utils.RealClock
+)
+
+type compaction struct {
+	db      *badger.DB
+	dataDir string
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func startCompaction(db *badger.DB, dataDir string, interval time.Duration) *compaction {
+	c := &compaction{db: db, dataDir: dataDir, stop: make(chan struct{})}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				c.run()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+	return c
+}
+
+func (c *compaction) close() {
+	close(c.stop)
+	c.wg.Wait()
+}
+
+// run flattens the LSM tree, dropping the overwritten and deleted keys, and
+// rewrites the value log files mostly discardable.
+func (c *compaction) run() {
+	start := clock.Now()
+	before := dirSize(c.dataDir)
+
+	err := c.compact()
+	elapsed := clock.Now().Sub(start)
+	compactionHistogram.Update(elapsed.Seconds())
+	if err != nil {
+		compactionFailedCounter.Inc()
+		log.Warn("failed to compact the document database", zap.Error(err))
+		return
+	}
+	compactionSuccessCounter.Inc()
+
+	after := dirSize(c.dataDir)
+	if reclaimed := before - after; reclaimed > 0 {
+		compactionReclaimed.Add(int(reclaimed))
+	}
+	log.Info("compacted the document database",
+		zap.Duration("duration", elapsed),
+		zap.Int64("before_bytes", before),
+		zap.Int64("after_bytes", after))
+}
+
+func (c *compaction) compact() error {
+	if *compactionReindex {
+		if err := documentDB.Exec("REINDEX"); err != nil {
+			return err
+		}
+	}
+	if err := c.db.Flatten(1); err != nil {
+		return err
+	}
+	for {
+		err := c.db.RunValueLogGC(*compactionDiscard)
+		if err == badger.ErrNoRewrite {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// dirSize returns the total size of the files under dir, 0 if unknown.
+func dirSize(dir string) int64 {
+	var size int64
+	_ = filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
@@ -34,6 +34,10 @@ func Init(logFileName string, logLevel string, dataPath string) {
 		l.Fatalf("Failed to open a document database, path: %s, err: %v", dataPath, err)
 	}
 	documentDB = db
+
+	if *compactionInterval > 0 {
+		compactor = startCompaction(engine.DB, dataPath, *compactionInterval)
+	}
 }
 
 func Get() *genji.DB {
@@ -41,6 +45,9 @@ func Get() *genji.DB {
 }
 
 func Stop() {
+	if compactor != nil {
+		compactor.close()
+	}
 	if err := documentDB.Close(); err != nil {
 		l.Fatalf("cannot close the document database, err: %v", err)
 	}
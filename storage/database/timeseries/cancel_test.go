@@ -0,0 +1,95 @@
+package timeseries
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/query"
+
+	"github.com/genjidb/genji"
+	"github.com/spf13/pflag"
+	"go.uber.org/goleak"
+)
+
+// slowUpstream starts a response of a range query and stalls until the
+// request is cancelled, signalling started once the body is flushed.
+func slowUpstream(started chan<- struct{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[`))
+		w.(http.Flusher).Flush()
+		started <- struct{}{}
+		<-r.Context().Done()
+	}))
+}
+
+func TestQueryCancelledAgainstSlowUpstream(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	started := make(chan struct{}, 1)
+	srv := slowUpstream(started)
+	defer srv.Close()
+	target, err := initImportURL(srv.URL, "/select/0/prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.close()
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	query.Init(target.handle, db)
+
+	for _, tt := range []struct {
+		name string
+		// run queries, cancelling it mid-flight or not.
+		run  func(q func(ctx context.Context) error) error
+		want error
+	}{
+		{
+			name: "cancelled",
+			run: func(q func(ctx context.Context) error) error {
+				ctx, cancel := context.WithCancel(context.Background())
+				go func() {
+					<-started
+					cancel()
+				}()
+				return q(ctx)
+			},
+			want: context.Canceled,
+		},
+		{
+			name: "default timeout",
+			run: func(q func(ctx context.Context) error) error {
+				defer func() { <-started }()
+				return q(context.Background())
+			},
+			want: context.DeadlineExceeded,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := pflag.Set("query.timeout", "100ms"); err != nil {
+				t.Fatal(err)
+			}
+			defer pflag.Set("query.timeout", "30s")
+
+			begin := time.Now()
+			err := tt.run(func(ctx context.Context) error {
+				var items []query.TopSQLItem
+				_, err := query.TopSQL(ctx, 1632700800, 1632704400, 60, 10, "tidb-0:10080", &items)
+				return err
+			})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("got error %v, want %v", err, tt.want)
+			}
+			if elapsed := time.Since(begin); elapsed > 5*time.Second {
+				t.Fatalf("returned after %s", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package timeseries
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	remoteURL        = pflag.String("timeseries.url", "", "URL of an external VictoriaMetrics used instead of the embedded one, e.g. http://127.0.0.1:8428 or unix:///path/to/vm.sock")
+	remotePathPrefix = pflag.String("timeseries.path-prefix", "", "HTTP path prefix prepended to API paths of the external VictoriaMetrics, e.g. /insert/0/prometheus")
+
+	readURL        = pflag.String("timeseries.read-url", "", "URL of a read replica of the external VictoriaMetrics the queries are sent to, defaults to --timeseries.url")
+	readPathPrefix = pflag.String("timeseries.read-path-prefix", "", "HTTP path prefix prepended to API paths of the read replica, e.g. /select/0/prometheus, defaults to --timeseries.path-prefix")
+)
+
+var (
+	remote *remoteTarget
+	// remoteRead serves the queries, remote if no read replica is configured.
+	remoteRead *remoteTarget
+)
+
+// remoteTarget forwards in-process API requests to an external VictoriaMetrics,
+// either over TCP or over a unix domain socket.
+type remoteTarget struct {
+	client     *http.Client
+	baseURL    url.URL
+	socketPath string
+}
+
+// RemoteHandler returns a handler forwarding requests to the external VictoriaMetrics,
+// or nil if the embedded one is in use.
+func RemoteHandler() http.HandlerFunc {
+	if remote == nil {
+		return nil
+	}
+	return remote.handle
+}
+
+// RemoteReadHandler returns a handler forwarding queries to the read replica of
+// the external VictoriaMetrics, the one of RemoteHandler if none is configured.
+func RemoteReadHandler() http.HandlerFunc {
+	if remoteRead == nil {
+		return RemoteHandler()
+	}
+	return remoteRead.handle
+}
+
+func initImportURL(rawURL string, pathPrefix string) (*remoteTarget, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	target := &remoteTarget{client: &http.Client{Transport: transport}}
+
+	switch u.Scheme {
+	case "http", "https":
+		if len(u.Host) == 0 {
+			return nil, fmt.Errorf("missing host in timeseries url %q", rawURL)
+		}
+		target.baseURL = url.URL{Scheme: u.Scheme, Host: u.Host, Path: path.Join("/", u.Path, pathPrefix)}
+	case "unix":
+		// unix:///path/to/vm.sock, the socket path is carried by the url path
+		socketPath := u.Host + u.Path
+		if !path.IsAbs(socketPath) {
+			return nil, fmt.Errorf("unix socket path must be absolute, got %q", rawURL)
+		}
+		target.socketPath = socketPath
+		// The host is never resolved since the dialer below always connects to the socket.
+		target.baseURL = url.URL{Scheme: "http", Host: "unix", Path: path.Join("/", pathPrefix)}
+		transport.DialContext = target.dialUnix
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q in timeseries url, expect http, https or unix", u.Scheme)
+	}
+
+	return target, nil
+}
+
+// dialUnix checks the existence of the socket file lazily because the
+// VictoriaMetrics process may create it after we start.
+func (t *remoteTarget) dialUnix(ctx context.Context, _, _ string) (net.Conn, error) {
+	if _, err := os.Stat(t.socketPath); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unix socket %s does not exist yet", t.socketPath)
+		}
+		return nil, err
+	}
+
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", t.socketPath)
+}
+
+func (t *remoteTarget) handle(w http.ResponseWriter, r *http.Request) {
+	u := t.baseURL
+	u.Path = path.Join(t.baseURL.Path, r.URL.Path)
+	if strings.HasSuffix(r.URL.Path, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawQuery = r.URL.RawQuery
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, u.String(), r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	}
+	req.Header = r.Header.Clone()
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	body := io.Reader(resp.Body)
+	if decodeGzip(r, resp) {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = io.WriteString(w, "failed to decode gzip response: "+err.Error())
+			return
+		}
+		defer zr.Close()
+		body = zr
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+	}
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, body)
+}
+
+// decodeGzip tells whether resp is gzip-encoded while r did not ask for it,
+// e.g. the in-process queries parsing the response as is. The transport only
+// decodes transparently the responses to the requests without Accept-Encoding.
+func decodeGzip(r *http.Request, resp *http.Response) bool {
+	if resp.Uncompressed || !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return false
+	}
+	return !strings.Contains(strings.ToLower(r.Header.Get("Accept-Encoding")), "gzip")
+}
+
+func (t *remoteTarget) close() {
+	t.client.CloseIdleConnections()
+}
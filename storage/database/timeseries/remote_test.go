@@ -0,0 +1,176 @@
+package timeseries
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// recordingServer answers the requests with 204, sending them to requests
+// along with their body.
+func recordingServer(requests chan<- *http.Request, bodies chan<- string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- r
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func serveUnix(t *testing.T, socketPath string, handler http.Handler) *httptest.Server {
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Listener = l
+	srv.Start()
+	return srv
+}
+
+func TestRemoteTargetOverUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "vm.sock")
+	target, err := initImportURL("unix://"+socketPath, "/insert/0/prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.close()
+
+	// The socket is checked once dialed, VictoriaMetrics may create it later
+	rec := httptest.NewRecorder()
+	target.handle(rec, httptest.NewRequest("POST", "/api/v1/import", strings.NewReader("{}\n")))
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "does not exist yet") {
+		t.Fatalf("got code %d, body %q, want 503 of a missing socket", rec.Code, rec.Body.String())
+	}
+
+	requests, bodies := make(chan *http.Request, 1), make(chan string, 1)
+	srv := serveUnix(t, socketPath, recordingServer(requests, bodies))
+	defer srv.Close()
+
+	rec = httptest.NewRecorder()
+	target.handle(rec, httptest.NewRequest("POST", "/api/v1/import?extra_label=a", strings.NewReader("{}\n")))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got code %d, body %q, want 204", rec.Code, rec.Body.String())
+	}
+	r := <-requests
+	if got, want := r.URL.String(), "/insert/0/prometheus/api/v1/import?extra_label=a"; got != want {
+		t.Fatalf("got url %q, want %q", got, want)
+	}
+	if got := <-bodies; got != "{}\n" {
+		t.Fatalf("got body %q", got)
+	}
+}
+
+func TestStoreWritesOverUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "vm.sock")
+	requests, bodies := make(chan *http.Request, 1), make(chan string, 1)
+	srv := serveUnix(t, socketPath, recordingServer(requests, bodies))
+	defer srv.Close()
+	// unix:/path as well as unix:///path
+	target, err := initImportURL("unix:"+socketPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.close()
+
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store.Init(store.NewHandlerWriter(target.handle), db, nil)
+	defer store.Stop()
+
+	err = store.TopSQLRecords([]*tipb.CPUTimeRecord{{
+		SqlDigest:              []byte{0x5e, 0x4c},
+		Instance:               "tidb-0:10080",
+		Job:                    "tidb",
+		RecordListTimestampSec: []uint64{1632700800},
+		RecordListCpuTimeMs:    []uint32{35},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := (<-requests).URL.Path; got != "/api/v1/import" {
+		t.Fatalf("got path %q, want /api/v1/import", got)
+	}
+	if got := <-bodies; !strings.Contains(got, `"sql_digest":"5e4c"`) || !strings.Contains(got, "1632700800000") {
+		t.Fatalf("got body %q, want the sample of 5e4c", got)
+	}
+}
+
+func TestRemoteTargetOverTCP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/vm/select/0/prometheus/api/v1/query" || r.URL.Query().Get("query") != "up" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write([]byte(`{"status":"success"}`))
+		_ = zw.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		_, _ = w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+	target, err := initImportURL(srv.URL+"/vm", "/select/0/prometheus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.close()
+
+	// Asked gzip for the transport to leave it encoded
+	req := httptest.NewRequest("GET", "/api/v1/query?query=up", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	target.handle(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got code %d, body %q, want 200", rec.Code, rec.Body.String())
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, err := ioutil.ReadAll(zr); err != nil || string(body) != `{"status":"success"}` {
+		t.Fatalf("got body %q, error %v", body, err)
+	}
+
+	// Decoded for the in-process queries not asking for gzip
+	req = httptest.NewRequest("GET", "/api/v1/query?query=up", nil)
+	req.Header.Set("Accept-Encoding", "identity")
+	rec = httptest.NewRecorder()
+	target.handle(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != `{"status":"success"}` || len(rec.Header().Get("Content-Encoding")) != 0 {
+		t.Fatalf("got code %d, body %q, headers %v, want the decoded body", rec.Code, rec.Body.String(), rec.Header())
+	}
+
+	srv.Close()
+	rec = httptest.NewRecorder()
+	target.handle(rec, httptest.NewRequest("GET", "/api/v1/query?query=up", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got code %d of a stopped server, want 503", rec.Code)
+	}
+}
+
+func TestInitImportURLRejectsInvalidURLs(t *testing.T) {
+	for _, rawURL := range []string{
+		"unix://vm.sock",
+		"http://",
+		"ftp://127.0.0.1:8428",
+	} {
+		if _, err := initImportURL(rawURL, ""); err == nil {
+			t.Errorf("got no error of %q", rawURL)
+		}
+	}
+}
@@ -26,6 +26,33 @@ func Init(logFileName string, logLevel string, dataPath string) {
 	if err := initLogger(logFileName, logLevel); err != nil {
 		log.Fatal("Failed to open log file", zap.Error(err))
 	}
+
+	if len(*readURL) != 0 && len(*remoteURL) == 0 {
+		log.Fatal("--timeseries.read-url requires --timeseries.url", zap.String("read-url", *readURL))
+	}
+	if len(*remoteURL) != 0 {
+		target, err := initImportURL(*remoteURL, *remotePathPrefix)
+		if err != nil {
+			log.Fatal("Failed to parse timeseries url", zap.String("url", *remoteURL), zap.Error(err))
+		}
+		remote = target
+		logger.Infof("using the external VictoriaMetrics at %s", *remoteURL)
+
+		if len(*readURL) != 0 {
+			prefix := *readPathPrefix
+			if len(prefix) == 0 {
+				prefix = *remotePathPrefix
+			}
+			target, err = initImportURL(*readURL, prefix)
+			if err != nil {
+				log.Fatal("Failed to parse timeseries read url", zap.String("url", *readURL), zap.Error(err))
+			}
+			remoteRead = target
+			logger.Infof("querying the read replica of VictoriaMetrics at %s", *readURL)
+		}
+		return
+	}
+
 	initDataDir(dataPath)
 
 	_ = flag.Set("retentionPeriod", *retentionPeriod)
@@ -43,6 +70,14 @@ func Init(logFileName string, logLevel string, dataPath string) {
 }
 
 func Stop() {
+	if remote != nil {
+		remote.close()
+		if remoteRead != nil {
+			remoteRead.close()
+		}
+		return
+	}
+
 	startTime := time.Now()
 	vminsert.Stop()
 	logger.Infof("successfully shut down the webservice in %.3f seconds", time.Since(startTime).Seconds())
@@ -0,0 +1,272 @@
+package profile
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	errs "github.com/genjidb/genji/errors"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	maxProfileSize = pflag.Int("profile.max-size", 32*1024*1024, "Maximum size in bytes of a stored profile")
+	retention      = pflag.Duration("profile.retention", 7*24*time.Hour, "Profiles older than this are deleted")
+	gcInterval     = pflag.Duration("profile.gc-interval", time.Hour, "Interval between deletions of expired profiles")
+)
+
+var (
+	ErrProfileNotFound = errors.New("profile not found")
+	ErrProfileTooLarge = errors.New("profile too large")
+)
+
+var kinds = map[string]struct{}{
+	"cpu":       {},
+	"heap":      {},
+	"mutex":     {},
+	"goroutine": {},
+	"block":     {},
+	"allocs":    {},
+}
+
+type ProfileItem struct {
+	ID       string `json:"id"`
+	Instance string `json:"instance"`
+	Kind     string `json:"kind"`
+	StartTs  int64  `json:"start_ts"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+var (
+	documentDB *genji.DB
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+)
+
+// MaxSize returns the maximum size in bytes of a stored profile.
+func MaxSize() int {
+	return *maxProfileSize
+}
+
+func Init(db *genji.DB) {
+	documentDB = db
+
+	createTableStmts := []string{
+		"CREATE TABLE IF NOT EXISTS profile (id VARCHAR(255) PRIMARY KEY)",
+		"CREATE TABLE IF NOT EXISTS profile_blob (checksum VARCHAR(255) PRIMARY KEY)",
+	}
+	for _, stmt := range createTableStmts {
+		if err := db.Exec(stmt); err != nil {
+			log.Fatal("cannot init profile tables", zap.Error(err))
+		}
+	}
+
+	stopCh = make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(*gcInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := GC(audit.CallerSystem, time.Now().Add(-*retention).Unix()); err != nil {
+					log.Warn("failed to delete expired profiles", zap.Error(err))
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func Stop() {
+	if stopCh == nil {
+		return
+	}
+	close(stopCh)
+	wg.Wait()
+}
+
+// StoreProfile persists a profile of instance started at startTs (in seconds).
+// Identical contents are stored once and storing the same profile twice is a no-op.
+func StoreProfile(instance, kind string, startTs int64, data []byte) (string, error) {
+	if len(instance) == 0 {
+		return "", errors.New("empty instance")
+	}
+	if _, ok := kinds[kind]; !ok {
+		return "", fmt.Errorf("unsupported profile kind %q", kind)
+	}
+	if len(data) > *maxProfileSize {
+		return "", fmt.Errorf("%w: %d bytes exceeds %d", ErrProfileTooLarge, len(data), *maxProfileSize)
+	}
+
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	id := profileID(instance, kind, startTs, checksum)
+
+	err := documentDB.Update(func(tx *genji.Tx) error {
+		err := tx.Exec("INSERT INTO profile_blob(checksum, data) VALUES (?, ?) ON CONFLICT DO NOTHING", checksum, data)
+		if err != nil {
+			return err
+		}
+		return tx.Exec(
+			"INSERT INTO profile(id, instance, kind, start_ts, size, checksum) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT DO NOTHING",
+			id, instance, kind, startTs, len(data), checksum,
+		)
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// ListProfiles fills the profiles of instance started within [startTs, endTs], all
+// instances if instance is empty.
+func ListProfiles(instance string, startTs, endTs int64, fill *[]ProfileItem) error {
+	q := "SELECT id, instance, kind, start_ts, size, checksum FROM profile WHERE start_ts >= ? AND start_ts <= ?"
+	args := []interface{}{startTs, endTs}
+	if len(instance) != 0 {
+		q += " AND instance = ?"
+		args = append(args, instance)
+	}
+	q += " ORDER BY start_ts"
+
+	res, err := documentDB.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return res.Iterate(func(d types.Document) error {
+		item := ProfileItem{}
+		if err := document.Scan(d, &item.ID, &item.Instance, &item.Kind, &item.StartTs, &item.Size, &item.Checksum); err != nil {
+			return err
+		}
+		*fill = append(*fill, item)
+		return nil
+	})
+}
+
+// GetProfile returns the metadata and the content of the profile with id.
+func GetProfile(id string) (ProfileItem, []byte, error) {
+	item := ProfileItem{}
+	var data []byte
+
+	err := documentDB.View(func(tx *genji.Tx) error {
+		d, err := tx.QueryDocument("SELECT id, instance, kind, start_ts, size, checksum FROM profile WHERE id = ?", id)
+		if errors.Is(err, errs.ErrDocumentNotFound) {
+			return ErrProfileNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err = document.Scan(d, &item.ID, &item.Instance, &item.Kind, &item.StartTs, &item.Size, &item.Checksum); err != nil {
+			return err
+		}
+
+		d, err = tx.QueryDocument("SELECT data FROM profile_blob WHERE checksum = ?", item.Checksum)
+		if errors.Is(err, errs.ErrDocumentNotFound) {
+			return ErrProfileNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return document.Scan(d, &data)
+	})
+	return item, data, err
+}
+
+// GC deletes on behalf of caller the profiles started before beforeTs and the
+// contents no longer referenced.
+func GC(caller string, beforeTs int64) error {
+	params := map[string]string{"before_ts": strconv.FormatInt(beforeTs, 10)}
+	return audit.Do("profile_gc", caller, params, func() (int, error) {
+		affected := 0
+		err := documentDB.Update(func(tx *genji.Tx) error {
+			d, err := tx.QueryDocument("SELECT COUNT(*) FROM profile WHERE start_ts < ?", beforeTs)
+			if err != nil {
+				return err
+			}
+			if err = document.Scan(d, &affected); err != nil {
+				return err
+			}
+			if err = tx.Exec("DELETE FROM profile WHERE start_ts < ?", beforeTs); err != nil {
+				return err
+			}
+			return deleteUnreferencedBlobs(tx)
+		})
+		return affected, err
+	})
+}
+
+func deleteUnreferencedBlobs(tx *genji.Tx) error {
+	referenced := make(map[string]struct{})
+	res, err := tx.Query("SELECT checksum FROM profile")
+	if err != nil {
+		return err
+	}
+	err = res.Iterate(func(d types.Document) error {
+		var checksum string
+		if err := document.Scan(d, &checksum); err != nil {
+			return err
+		}
+		referenced[checksum] = struct{}{}
+		return nil
+	})
+	_ = res.Close()
+	if err != nil {
+		return err
+	}
+
+	var unreferenced []string
+	res, err = tx.Query("SELECT checksum FROM profile_blob")
+	if err != nil {
+		return err
+	}
+	err = res.Iterate(func(d types.Document) error {
+		var checksum string
+		if err := document.Scan(d, &checksum); err != nil {
+			return err
+		}
+		if _, ok := referenced[checksum]; !ok {
+			unreferenced = append(unreferenced, checksum)
+		}
+		return nil
+	})
+	_ = res.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, checksum := range unreferenced {
+		if err = tx.Exec("DELETE FROM profile_blob WHERE checksum = ?", checksum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func profileID(instance, kind string, startTs int64, checksum string) string {
+	h := sha256.New()
+	for _, part := range []string{instance, kind, strconv.FormatInt(startTs, 10), checksum} {
+		_, _ = h.Write([]byte(part))
+		_, _ = h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
@@ -0,0 +1,176 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils"
+)
+
+// BucketUnit is the calendar unit of CPUTimeBuckets.
+type BucketUnit string
+
+const (
+	BucketHour BucketUnit = "hour"
+	BucketDay  BucketUnit = "day"
+)
+
+func ParseBucketUnit(s string) (BucketUnit, error) {
+	switch u := BucketUnit(s); u {
+	case BucketHour, BucketDay:
+		return u, nil
+	}
+	return "", fmt.Errorf("unknown bucket unit %q, expect hour or day", s)
+}
+
+// LoadTimezone loads an IANA timezone, UTC if name is empty.
+func LoadTimezone(name string) (*time.Location, error) {
+	if len(name) == 0 {
+		return time.UTC, nil
+	}
+	// LoadLocation resolves "Local" to the zone of the server, which is not IANA.
+	if name == "Local" {
+		return nil, fmt.Errorf("unknown timezone %q, expect an IANA name like Asia/Shanghai", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q, expect an IANA name like Asia/Shanghai", name)
+	}
+	return loc, nil
+}
+
+type BucketItem struct {
+	// Start is the local start of the bucket in RFC3339, e.g. 2021-03-28T00:00:00+01:00.
+	Start         string `json:"start"`
+	StartSecs     int64  `json:"start_secs"`
+	EndSecs       int64  `json:"end_secs"`
+	CPUTimeMillis uint64 `json:"cpu_time_ms"`
+}
+
+// bucketResolutionSecs divides every UTC offset in use, e.g. +05:45 of
+// Asia/Kathmandu, so the samples at this resolution never straddle a local hour.
+const bucketResolutionSecs = 15 * 60
+
+// CPUTimeBuckets returns the total cpu time of instance, all instances if empty,
+// per calendar hour or day in loc overlapping [startSecs, endSecs). The buckets
+// follow the wall clock, so days around DST transitions last 23 or 25 hours.
+func CPUTimeBuckets(ctx context.Context, instance string, startSecs, endSecs int64, unit BucketUnit, loc *time.Location) ([]BucketItem, error) {
+	if queryHandler == nil {
+		return nil, errors.New("empty query handler")
+	}
+	var buckets []BucketItem
+	for t := truncateTo(time.Unix(startSecs, 0), unit, loc); t.Unix() < endSecs; {
+		next := nextBucket(t, unit, loc)
+		buckets = append(buckets, BucketItem{Start: t.Format(time.RFC3339), StartSecs: t.Unix(), EndSecs: next.Unix()})
+		t = next
+	}
+	if len(buckets) == 0 {
+		return buckets, nil
+	}
+
+	// Fetch at the resolution over the whole buckets
+	from, to := buckets[0].StartSecs, buckets[len(buckets)-1].EndSecs
+	if err := checkRange(from, to, bucketResolutionSecs); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	selector := store.MetricName(store.MetricCPUTime)
+	if len(instance) != 0 {
+		selector = fmt.Sprintf("%s{instance=%q}", selector, store.NormalizeInstance(instance))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "/api/v1/query_range", nil)
+	if err != nil {
+		return nil, err
+	}
+	reqQuery := req.URL.Query()
+	// The point at t sums up (t - resolution, t]
+	reqQuery.Set("query", fmt.Sprintf("sum(sum_over_time(%s[%ds]))", selector, bucketResolutionSecs))
+	reqQuery.Set("start", strconv.FormatInt(from+bucketResolutionSecs, 10))
+	reqQuery.Set("end", strconv.FormatInt(to, 10))
+	reqQuery.Set("step", strconv.Itoa(bucketResolutionSecs))
+	req.URL.RawQuery = reqQuery.Encode()
+	req.Header.Set("Accept", "application/json")
+
+	respR := utils.NewRespWriter(bufResp, header)
+	if err = serveQuery(ctx, req, &respR); err != nil {
+		return nil, err
+	}
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		return nil, fmt.Errorf("failed to query timeseries db, code: %d, error: %s", respR.Code, respR.Body.String())
+	}
+
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	if err = json.Unmarshal(respR.Body.Bytes(), metricResponse); err != nil {
+		return nil, err
+	}
+
+	for _, r := range metricResponse.Data.Results {
+		for _, value := range r.Values {
+			if len(value) != 2 {
+				continue
+			}
+			ts, ok := value[0].(float64)
+			if !ok {
+				continue
+			}
+			raw, ok := value[1].(string)
+			if !ok {
+				continue
+			}
+			cpu, ok := parseSampleValue(raw)
+			if !ok {
+				continue
+			}
+			addToBucket(buckets, int64(ts)-bucketResolutionSecs, cpu)
+		}
+	}
+	return buckets, nil
+}
+
+// addToBucket adds cpu to the bucket containing the sample period starting at startSecs.
+func addToBucket(buckets []BucketItem, startSecs int64, cpu uint64) {
+	lo, hi := 0, len(buckets)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if buckets[mid].EndSecs <= startSecs {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < len(buckets) && buckets[lo].StartSecs <= startSecs {
+		buckets[lo].CPUTimeMillis = utils.AddSaturating(buckets[lo].CPUTimeMillis, cpu)
+	}
+}
+
+// truncateTo returns the start of the calendar hour or day containing t in loc.
+func truncateTo(t time.Time, unit BucketUnit, loc *time.Location) time.Time {
+	t = t.In(loc)
+	if unit == BucketDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	}
+	// Not time.Date with the hour, which is ambiguous when clocks fall back.
+	return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+}
+
+func nextBucket(t time.Time, unit BucketUnit, loc *time.Location) time.Time {
+	if unit == BucketDay {
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+	}
+	return t.Add(time.Hour)
+}
@@ -0,0 +1,226 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/spf13/pflag"
+)
+
+var countsCacheTTL = pflag.Duration("query.counts-cache-ttl", 10*time.Second, "How long the results of the digest counts are reused, 0 means not cached")
+
+var (
+	countsHitsCounter   = metrics.NewCounter(`diag_query_counts_cache_hits_total`)
+	countsMissesCounter = metrics.NewCounter(`diag_query_counts_cache_misses_total`)
+)
+
+// maxCachedCounts bounds the filters cached, the cache starting over beyond.
+const maxCachedCounts = 1024
+
+// CountFilter narrows the digests Counts counts.
+type CountFilter struct {
+	// Internal counts only the internal SQLs if true, and only the others if
+	// false.
+	Internal *bool
+	// FirstSeenFrom and FirstSeenTo bound the unix seconds the digests were
+	// first stored at, 0 meaning unbounded. The digests stored before their
+	// first_seen was recorded are only counted unbounded.
+	FirstSeenFrom, FirstSeenTo int64
+}
+
+type CountsItem struct {
+	SQLDigests         int `json:"sql_digests"`
+	InternalSQLDigests int `json:"internal_sql_digests"`
+	PlanDigests        int `json:"plan_digests"`
+	// MultiPlanSQLDigests are the SQL digests reported with several plans.
+	MultiPlanSQLDigests int `json:"multi_plan_sql_digests"`
+}
+
+type countsKey struct {
+	tenant string
+	filter string
+}
+
+type cachedCounts struct {
+	done  chan struct{}
+	at    time.Time
+	item  CountsItem
+	err   error
+	valid bool
+}
+
+var countsCache = struct {
+	sync.Mutex
+	entries map[countsKey]*cachedCounts
+}{entries: make(map[countsKey]*cachedCounts)}
+
+// Counts counts the digests of the tenant of ctx matching filter with COUNT
+// aggregates, reusing a result for --query.counts-cache-ttl. Concurrent calls
+// of a filter wait for one count.
+func Counts(ctx context.Context, filter CountFilter) (CountsItem, error) {
+	if *countsCacheTTL <= 0 {
+		return countDigests(ctx, filter)
+	}
+
+	key := countsKey{tenant: store.TenantFrom(ctx), filter: filter.String()}
+	countsCache.Lock()
+	e, ok := countsCache.entries[key]
+	if ok && (!e.valid || time.Since(e.at) < *countsCacheTTL) {
+		countsCache.Unlock()
+		countsHitsCounter.Inc()
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return CountsItem{}, ctx.Err()
+		}
+		if e.err == nil {
+			return e.item, nil
+		}
+		// The failure of another ctx is not reused
+		return countDigests(ctx, filter)
+	}
+	if len(countsCache.entries) >= maxCachedCounts {
+		countsCache.entries = make(map[countsKey]*cachedCounts)
+	}
+	e = &cachedCounts{done: make(chan struct{})}
+	countsCache.entries[key] = e
+	countsCache.Unlock()
+	countsMissesCounter.Inc()
+
+	item, err := countDigests(ctx, filter)
+	countsCache.Lock()
+	e.item, e.err, e.at, e.valid = item, err, time.Now(), true
+	if err != nil {
+		delete(countsCache.entries, key)
+	}
+	countsCache.Unlock()
+	close(e.done)
+	return item, err
+}
+
+func (f CountFilter) String() string {
+	internal := "any"
+	if f.Internal != nil {
+		internal = fmt.Sprint(*f.Internal)
+	}
+	return fmt.Sprintf("internal=%s,from=%d,to=%d", internal, f.FirstSeenFrom, f.FirstSeenTo)
+}
+
+// firstSeen returns the conditions of f on first_seen, with their args.
+func (f CountFilter) firstSeen() (string, []interface{}) {
+	var cond string
+	var args []interface{}
+	if f.FirstSeenFrom > 0 {
+		cond += " AND first_seen >= ?"
+		args = append(args, f.FirstSeenFrom)
+	}
+	if f.FirstSeenTo > 0 {
+		cond += " AND first_seen <= ?"
+		args = append(args, f.FirstSeenTo)
+	}
+	return cond, args
+}
+
+// filtered reports whether f narrows the SQL digests.
+func (f CountFilter) filtered() bool {
+	return f.Internal != nil || f.FirstSeenFrom > 0 || f.FirstSeenTo > 0
+}
+
+func countDigests(ctx context.Context, filter CountFilter) (CountsItem, error) {
+	tenant := store.TenantFrom(ctx)
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	sqlWhere := "sql_digest WHERE tenant = ?" + internalCond(filter.Internal)
+	sqlArgs := []interface{}{tenant}
+	firstSeen, firstSeenArgs := filter.firstSeen()
+	sqlWhere += firstSeen
+	sqlArgs = append(sqlArgs, firstSeenArgs...)
+
+	type count struct {
+		from   string
+		args   []interface{}
+		target *int
+	}
+	item := CountsItem{}
+	err := documentDB.WithContext(ctx).View(func(tx *genji.Tx) error {
+		counts := []count{
+			{sqlWhere, sqlArgs, &item.SQLDigests},
+			{"plan_digest WHERE tenant = ?" + firstSeen, append([]interface{}{tenant}, firstSeenArgs...), &item.PlanDigests},
+		}
+		switch {
+		case filter.Internal == nil:
+			counts = append(counts, count{sqlWhere + " AND is_internal = true", sqlArgs, &item.InternalSQLDigests})
+		case *filter.Internal:
+			counts = append(counts, count{sqlWhere, sqlArgs, &item.InternalSQLDigests})
+		}
+		for _, c := range counts {
+			r, err := tx.QueryDocument("SELECT COUNT(*) FROM "+c.from, c.args...)
+			if err != nil {
+				return err
+			}
+			if err = document.Scan(r, c.target); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		item.MultiPlanSQLDigests, err = countMultiPlan(tx, tenant, filter, sqlWhere, sqlArgs)
+		return err
+	})
+	return item, err
+}
+
+// countMultiPlan counts the SQL digests of several plans in the sql_plan
+// table, of those of sqlWhere if filter narrows them.
+func countMultiPlan(tx *genji.Tx, tenant string, filter CountFilter, sqlWhere string, sqlArgs []interface{}) (int, error) {
+	var matching map[string]struct{}
+	if filter.filtered() {
+		matching = make(map[string]struct{})
+		err := iterate(tx, "SELECT digest FROM "+sqlWhere, sqlArgs, func(d types.Document) error {
+			var digest string
+			if err := document.Scan(d, &digest); err != nil {
+				return err
+			}
+			matching[digest] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	count := 0
+	err := iterate(tx, "SELECT sql_digest, COUNT(*) FROM sql_plan WHERE tenant = ? GROUP BY sql_digest", []interface{}{tenant}, func(d types.Document) error {
+		var digest string
+		var plans int
+		if err := document.Scan(d, &digest, &plans); err != nil {
+			return err
+		}
+		if plans < 2 {
+			return nil
+		}
+		if _, ok := matching[digest]; matching == nil || ok {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+func iterate(tx *genji.Tx, q string, args []interface{}, fn func(d types.Document) error) error {
+	res, err := tx.Query(q, args...)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	return res.Iterate(fn)
+}
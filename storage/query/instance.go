@@ -0,0 +1,87 @@
+package query
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils"
+)
+
+// maxPointsPerSeries bounds the resolution of CPUByInstance over long ranges.
+const maxPointsPerSeries = 1000
+
+// CPUByInstance returns the cpu time of a SQL within [startMs, endMs] keyed by
+// instance, one metric per plan executed on the instance.
+func CPUByInstance(ctx context.Context, sqlDigest string, startMs, endMs int64) (map[string][]Metric, error) {
+	if queryHandler == nil {
+		return nil, errors.New("empty query handler")
+	}
+	if _, err := hex.DecodeString(sqlDigest); err != nil || len(sqlDigest) == 0 {
+		return nil, fmt.Errorf("invalid sql digest %q", sqlDigest)
+	}
+
+	startSecs := startMs / 1000
+	endSecs := (endMs + 999) / 1000
+	if err := checkRange(startSecs, endSecs, 0); err != nil {
+		return nil, err
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+	stepSecs := (endSecs - startSecs + maxPointsPerSeries - 1) / maxPointsPerSeries
+	if stepSecs < 1 {
+		stepSecs = 1
+	}
+
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "/api/v1/query_range", nil)
+	if err != nil {
+		return nil, err
+	}
+	reqQuery := req.URL.Query()
+	reqQuery.Set("query", fmt.Sprintf(
+		"sum by (instance, plan_digest) (sum_over_time(%s{sql_digest=\"%s\"}[%ds]))", store.MetricName(store.MetricCPUTime), sqlDigest, stepSecs,
+	))
+	reqQuery.Set("start", strconv.FormatInt(startSecs, 10))
+	reqQuery.Set("end", strconv.FormatInt(endSecs, 10))
+	reqQuery.Set("step", strconv.FormatInt(stepSecs, 10))
+	req.URL.RawQuery = reqQuery.Encode()
+	req.Header.Set("Accept", "application/json")
+
+	respR := utils.NewRespWriter(bufResp, header)
+	if err = serveQuery(ctx, req, &respR); err != nil {
+		return nil, err
+	}
+
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		return nil, fmt.Errorf("failed to query timeseries db, code: %d, error: %s", respR.Code, respR.Body.String())
+	}
+
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	if err = json.Unmarshal(respR.Body.Bytes(), metricResponse); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string][]Metric)
+	for _, r := range metricResponse.Data.Results {
+		m := Metric{
+			Instance:   r.Metric.Instance,
+			SQLDigest:  sqlDigest,
+			PlanDigest: r.Metric.PlanDigest,
+		}
+		appendPoints(&m, r.Values)
+		res[m.Instance] = append(res[m.Instance], m)
+	}
+	return res, nil
+}
@@ -0,0 +1,97 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/zhongzc/diag_backend/utils"
+)
+
+type InstantSample struct {
+	Labels        map[string]string `json:"labels"`
+	TimestampSecs float64           `json:"timestamp_secs"`
+	Value         float64           `json:"value"`
+}
+
+type instantResp struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string         `json:"metric"`
+			Value  metricRespDataResultValue `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// InstantQuery evaluates a PromQL expression at timeSecs and fills the resulting vector.
+func InstantQuery(ctx context.Context, promQL string, timeSecs int, fill *[]InstantSample) error {
+	if queryHandler == nil {
+		return errors.New("empty query handler")
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "/api/v1/query", nil)
+	if err != nil {
+		return err
+	}
+	reqQuery := req.URL.Query()
+	reqQuery.Set("query", promQL)
+	reqQuery.Set("time", strconv.Itoa(timeSecs))
+	req.URL.RawQuery = reqQuery.Encode()
+	req.Header.Set("Accept", "application/json")
+
+	respR := utils.NewRespWriter(bufResp, header)
+	if err = serveQuery(ctx, req, &respR); err != nil {
+		return err
+	}
+
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		return fmt.Errorf("failed to query timeseries db, code: %d, error: %s", respR.Code, respR.Body.String())
+	}
+
+	resp := instantResp{}
+	if err = json.Unmarshal(respR.Body.Bytes(), &resp); err != nil {
+		return err
+	}
+	if resp.Data.ResultType != "vector" {
+		return fmt.Errorf("unexpected result type %q", resp.Data.ResultType)
+	}
+
+	for _, r := range resp.Data.Result {
+		if len(r.Value) != 2 {
+			continue
+		}
+		ts, ok := r.Value[0].(float64)
+		if !ok {
+			continue
+		}
+		raw, ok := r.Value[1].(string)
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			continue
+		}
+
+		*fill = append(*fill, InstantSample{
+			Labels:        r.Metric,
+			TimestampSecs: ts,
+			Value:         value,
+		})
+	}
+	return nil
+}
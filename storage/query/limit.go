@@ -0,0 +1,84 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/spf13/pflag"
+)
+
+// labelTenant is the label of the series of a tenant other than store.DefaultTenant.
+const labelTenant = "tenant"
+
+var (
+	defaultTimeout = pflag.Duration("query.timeout", 30*time.Second, "Timeout of a query whose caller sets no deadline, 0 means none")
+	maxRange       = pflag.Duration("query.max-range", 31*24*time.Hour, "Maximum time range of a query, 0 means unlimited")
+	maxPoints      = pflag.Int("query.max-points", 30000, "Maximum number of points per series a range query may return, 0 means unlimited")
+)
+
+// ErrQueryTooLarge is returned for queries over a range or at a resolution beyond the limits.
+var ErrQueryTooLarge = errors.New("query too large")
+
+// withTimeout applies the default timeout to ctx unless ctx has a deadline already.
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || *defaultTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, *defaultTimeout)
+}
+
+// checkRange validates a query over [startSecs, endSecs] at stepSecs against the
+// limits, 0 stepSecs skipping the check of the number of points.
+func checkRange(startSecs, endSecs, stepSecs int64) error {
+	if endSecs < startSecs {
+		return fmt.Errorf("end %d before start %d", endSecs, startSecs)
+	}
+
+	rangeSecs := endSecs - startSecs
+	if limit := int64(maxRange.Seconds()); limit > 0 && rangeSecs > limit {
+		return fmt.Errorf("%w: the range of %s exceeds --query.max-range %s, narrow the range",
+			ErrQueryTooLarge, time.Duration(rangeSecs)*time.Second, *maxRange)
+	}
+	if stepSecs > 0 && *maxPoints > 0 {
+		if points := rangeSecs/stepSecs + 1; points > int64(*maxPoints) {
+			return fmt.Errorf("%w: the range of %s at a step of %ds yields %d points per series, over --query.max-points %d, widen the step",
+				ErrQueryTooLarge, time.Duration(rangeSecs)*time.Second, stepSecs, points, *maxPoints)
+		}
+	}
+	return nil
+}
+
+// serveQuery runs req against the timeseries db within ctx, over the series of
+// the tenant of ctx only. The deadline of ctx is also passed as the `timeout`
+// parameter VictoriaMetrics bounds searches with, since the embedded one does
+// not watch the request context.
+func serveQuery(ctx context.Context, req *http.Request, w http.ResponseWriter) error {
+	q := req.URL.Query()
+	if deadline, ok := ctx.Deadline(); ok && len(q.Get("timeout")) == 0 {
+		ms := time.Until(deadline).Milliseconds()
+		if ms < 1 {
+			ms = 1
+		}
+		q.Set("timeout", strconv.FormatInt(ms, 10)+"ms")
+	}
+	// A tenant a caller passes is overridden, the series of DefaultTenant have
+	// no tenant label, which "" matches
+	extraLabels := q["extra_label"][:0:0]
+	for _, l := range q["extra_label"] {
+		if !strings.HasPrefix(l, labelTenant+"=") {
+			extraLabels = append(extraLabels, l)
+		}
+	}
+	q["extra_label"] = append(extraLabels, labelTenant+"="+store.TenantFrom(ctx))
+	req.URL.RawQuery = q.Encode()
+
+	queryHandler(w, req.WithContext(ctx))
+	return ctx.Err()
+}
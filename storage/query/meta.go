@@ -0,0 +1,401 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/storage/textcrypt"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	errs "github.com/genjidb/genji/errors"
+	"github.com/genjidb/genji/types"
+)
+
+type SQLMetaItem struct {
+	Digest     string `json:"digest"`
+	SQLText    string `json:"sql_text"`
+	IsInternal bool   `json:"is_internal"`
+	// DigestMismatch tells the digest differs from the one recomputed from the
+	// text, so the agent may hash differently from this server.
+	DigestMismatch bool `json:"digest_mismatch,omitempty"`
+}
+
+type PlanMetaItem struct {
+	Digest   string `json:"digest"`
+	PlanText string `json:"plan_text"`
+}
+
+// DigestItem holds the metas known for a digest, which may be a SQL or a plan digest.
+type DigestItem struct {
+	Digest    string        `json:"digest"`
+	SQL       *SQLMetaItem  `json:"sql,omitempty"`
+	Plan      *PlanMetaItem `json:"plan,omitempty"`
+	DeletedAt int64         `json:"deleted_at,omitempty"` // unix seconds, set if deleted
+}
+
+type MetaStatsItem struct {
+	SQLDigests         int `json:"sql_digests"`
+	InternalSQLDigests int `json:"internal_sql_digests"`
+	PlanDigests        int `json:"plan_digests"`
+	Instances          int `json:"instances"`
+	Deleted            int `json:"deleted"`
+	// MultiPlanSQLDigests are the SQL digests reported with several plans, as
+	// counted by Counts.
+	MultiPlanSQLDigests int `json:"multi_plan_sql_digests"`
+
+	// Capture tells whether plan metas and internal SQLs are captured and what was dropped.
+	Capture store.CaptureStats `json:"capture"`
+}
+
+// SearchOptions tunes SearchSQL.
+type SearchOptions struct {
+	Limit          int  // no limit if <= 0
+	IncludeDeleted bool // also match deleted digests
+	// Internal matches only the internal SQLs if true, and only the others if
+	// false.
+	Internal *bool
+}
+
+// Digest returns the metas known for digest in the tenant of ctx, leaving SQL
+// and Plan nil if unknown. The metas of a deleted digest are only returned with
+// includeDeleted.
+func Digest(ctx context.Context, digest string, includeDeleted bool) (DigestItem, error) {
+	if err := store.CheckDigest(digest); err != nil {
+		return DigestItem{}, err
+	}
+	tenant := store.TenantFrom(ctx)
+	key := store.TenantKey(tenant, digest)
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	item := DigestItem{Digest: digest}
+	err := documentDB.WithContext(ctx).View(func(tx *genji.Tx) error {
+		deletedAt, deleted := deletedAt(tx, tenant, key)
+		if deleted && !includeDeleted {
+			return nil
+		}
+		item.DeletedAt = deletedAt
+
+		r, err := tx.QueryDocument("SELECT digest, sql_text, is_internal, digest_mismatch FROM sql_digest WHERE digest = ? AND tenant = ?", key, tenant)
+		if err == nil {
+			sql := SQLMetaItem{}
+			if err = scanSQLMeta(r, &sql); err != nil {
+				return err
+			}
+			item.SQL = &sql
+		} else if !errors.Is(err, errs.ErrDocumentNotFound) {
+			return err
+		}
+
+		r, err = tx.QueryDocument("SELECT digest, plan_text FROM plan_digest WHERE digest = ? AND tenant = ?", key, tenant)
+		if err == nil {
+			plan := PlanMetaItem{}
+			if err = scanPlanMeta(r, &plan); err != nil {
+				return err
+			}
+			item.Plan = &plan
+		} else if !errors.Is(err, errs.ErrDocumentNotFound) {
+			return err
+		}
+		return nil
+	})
+	return item, err
+}
+
+// HasSQLMeta tells whether the SQL meta of digest is stored in the tenant of
+// ctx, e.g. to decide whether to request it from upstream.
+func HasSQLMeta(ctx context.Context, digest string) (bool, error) {
+	return hasDigest(ctx, "sql_digest", digest)
+}
+
+// HasPlanMeta tells whether the plan meta of digest is stored.
+func HasPlanMeta(ctx context.Context, digest string) (bool, error) {
+	return hasDigest(ctx, "plan_digest", digest)
+}
+
+func hasDigest(ctx context.Context, table, digest string) (bool, error) {
+	if err := store.CheckDigest(digest); err != nil {
+		return false, err
+	}
+	tenant := store.TenantFrom(ctx)
+	key := store.TenantKey(tenant, digest)
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	_, err := documentDB.WithContext(ctx).QueryDocument("SELECT 1 FROM "+table+" WHERE digest = ? AND tenant = ? LIMIT 1", key, tenant)
+	if errors.Is(err, errs.ErrDocumentNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SearchSQL fills the SQL metas of the tenant of ctx whose normalized text
+// contains pattern.
+func SearchSQL(ctx context.Context, pattern string, opts SearchOptions, fill *[]SQLMetaItem) error {
+	if textcrypt.Enabled() {
+		return textcrypt.ErrSearchEncrypted
+	}
+
+	tenant := store.TenantFrom(ctx)
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	return documentDB.WithContext(ctx).View(func(tx *genji.Tx) error {
+		var deleted map[string]int64
+		q := "SELECT digest, sql_text, is_internal, digest_mismatch FROM sql_digest WHERE tenant = ? AND sql_text LIKE ?" + internalCond(opts.Internal)
+		if opts.IncludeDeleted {
+			if opts.Limit > 0 {
+				q += fmt.Sprintf(" LIMIT %d", opts.Limit)
+			}
+		} else {
+			var err error
+			if deleted, err = deletedDigests(tx, tenant); err != nil {
+				return err
+			}
+		}
+
+		res, err := tx.Query(q, tenant, "%"+pattern+"%")
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+
+		count := 0
+		err = res.Iterate(func(d types.Document) error {
+			item := SQLMetaItem{}
+			if err := scanSQLMeta(d, &item); err != nil {
+				return err
+			}
+			if _, ok := deleted[item.Digest]; ok {
+				return nil
+			}
+			*fill = append(*fill, item)
+			if count++; opts.Limit > 0 && count >= opts.Limit {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err == errStopIteration {
+			return nil
+		}
+		return err
+	})
+}
+
+// AllSQLMetas calls fn with every SQL meta of the tenant of ctx not deleted.
+func AllSQLMetas(ctx context.Context, fn func(item SQLMetaItem) error) error {
+	tenant := store.TenantFrom(ctx)
+	return documentDB.WithContext(ctx).View(func(tx *genji.Tx) error {
+		deleted, err := deletedDigests(tx, tenant)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Query("SELECT digest, sql_text, is_internal, digest_mismatch FROM sql_digest WHERE tenant = ?", tenant)
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+
+		return res.Iterate(func(d types.Document) error {
+			item := SQLMetaItem{}
+			if err := scanSQLMeta(d, &item); err != nil {
+				return err
+			}
+			if _, ok := deleted[item.Digest]; ok {
+				return nil
+			}
+			return fn(item)
+		})
+	})
+}
+
+// AllPlanMetas calls fn with every plan meta of the tenant of ctx not deleted.
+func AllPlanMetas(ctx context.Context, fn func(item PlanMetaItem) error) error {
+	tenant := store.TenantFrom(ctx)
+	return documentDB.WithContext(ctx).View(func(tx *genji.Tx) error {
+		deleted, err := deletedDigests(tx, tenant)
+		if err != nil {
+			return err
+		}
+
+		res, err := tx.Query("SELECT digest, plan_text FROM plan_digest WHERE tenant = ?", tenant)
+		if err != nil {
+			return err
+		}
+		defer res.Close()
+
+		return res.Iterate(func(d types.Document) error {
+			item := PlanMetaItem{}
+			if err := scanPlanMeta(d, &item); err != nil {
+				return err
+			}
+			if _, ok := deleted[item.Digest]; ok {
+				return nil
+			}
+			return fn(item)
+		})
+	})
+}
+
+// MetaStats counts the metas of the tenant of ctx and the instances of all.
+func MetaStats(ctx context.Context) (MetaStatsItem, error) {
+	tenant := store.TenantFrom(ctx)
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	stats := MetaStatsItem{Capture: store.Capture()}
+	err := documentDB.WithContext(ctx).View(func(tx *genji.Tx) error {
+		for _, c := range []struct {
+			from   string
+			args   []interface{}
+			target *int
+		}{
+			{"sql_digest WHERE tenant = ?", []interface{}{tenant}, &stats.SQLDigests},
+			{"sql_digest WHERE tenant = ? AND is_internal = true", []interface{}{tenant}, &stats.InternalSQLDigests},
+			{"plan_digest WHERE tenant = ?", []interface{}{tenant}, &stats.PlanDigests},
+			{"instance", nil, &stats.Instances},
+			{"digest_tombstone WHERE tenant = ?", []interface{}{tenant}, &stats.Deleted},
+		} {
+			r, err := tx.QueryDocument("SELECT COUNT(*) FROM "+c.from, c.args...)
+			if err != nil {
+				return err
+			}
+			if err = document.Scan(r, c.target); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	counts, err := Counts(ctx, CountFilter{})
+	stats.MultiPlanSQLDigests = counts.MultiPlanSQLDigests
+	return stats, err
+}
+
+// internalCond returns the condition of sql_digest matching the internal SQLs
+// if internal is true and the others if false, none if nil.
+func internalCond(internal *bool) string {
+	switch {
+	case internal == nil:
+		return ""
+	case *internal:
+		return " AND is_internal = true"
+	default:
+		// The rows missing it are backfilled by the index sql_digest_is_internal
+		return " AND is_internal = false"
+	}
+}
+
+// scanSQLMeta scans digest, sql_text, is_internal and digest_mismatch, the
+// latter ones missing in rows written before they were recorded. The digest
+// scanned is a TenantKey, of which item gets the digest.
+func scanSQLMeta(d types.Document, item *SQLMetaItem) error {
+	var isInternal, digestMismatch *bool
+	var stored string
+	if err := document.Scan(d, &item.Digest, &stored, &isInternal, &digestMismatch); err != nil {
+		return err
+	}
+	item.IsInternal = isInternal != nil && *isInternal
+	item.DigestMismatch = digestMismatch != nil && *digestMismatch
+
+	text, err := textcrypt.Decrypt(stored, item.Digest)
+	if err != nil {
+		return err
+	}
+	item.Digest = store.DigestOfKey(item.Digest)
+	item.SQLText = text
+	return nil
+}
+
+// scanPlanMeta scans digest, a TenantKey, and plan_text.
+func scanPlanMeta(d types.Document, item *PlanMetaItem) error {
+	var stored string
+	if err := document.Scan(d, &item.Digest, &stored); err != nil {
+		return err
+	}
+
+	text, err := textcrypt.Decrypt(stored, item.Digest)
+	if err != nil {
+		return err
+	}
+	item.Digest = store.DigestOfKey(item.Digest)
+	item.PlanText = text
+	return nil
+}
+
+// scanText scans the only field of d, a sql_text or plan_text of the
+// TenantKey key.
+func scanText(d types.Document, key string, text *string) error {
+	var stored string
+	if err := document.Scan(d, &stored); err != nil {
+		return err
+	}
+
+	plain, err := textcrypt.Decrypt(stored, key)
+	if err != nil {
+		return err
+	}
+	*text = plain
+	return nil
+}
+
+var errStopIteration = errors.New("stop iteration")
+
+// deletedAt returns when the digest of the TenantKey key was deleted by
+// store.DeleteDigest, if it was.
+func deletedAt(tx *genji.Tx, tenant, key string) (int64, bool) {
+	r, err := tx.QueryDocument("SELECT deleted_at FROM digest_tombstone WHERE digest = ? AND tenant = ?", key, tenant)
+	if err != nil {
+		return 0, false
+	}
+	var ts int64
+	if err = document.Scan(r, &ts); err != nil {
+		return 0, false
+	}
+	return ts, true
+}
+
+// metaKey returns the TenantKey of the digest of a series in the meta tables
+// of tenant, false if the digest cannot have metas, e.g. a key of another
+// tenant.
+func metaKey(tenant, digest string) (string, bool) {
+	if store.CheckDigest(digest) != nil {
+		return "", false
+	}
+	return store.TenantKey(tenant, digest), true
+}
+
+func isDeleted(tx *genji.Tx, tenant, key string) bool {
+	_, deleted := deletedAt(tx, tenant, key)
+	return deleted
+}
+
+// deletedDigests returns the deleted digests of tenant with when they were deleted.
+func deletedDigests(tx *genji.Tx, tenant string) (map[string]int64, error) {
+	res, err := tx.Query("SELECT digest, deleted_at FROM digest_tombstone WHERE tenant = ?", tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	deleted := make(map[string]int64)
+	err = res.Iterate(func(d types.Document) error {
+		var digest string
+		var ts int64
+		if err := document.Scan(d, &digest, &ts); err != nil {
+			return err
+		}
+		deleted[store.DigestOfKey(digest)] = ts
+		return nil
+	})
+	return deleted, err
+}
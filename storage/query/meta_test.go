@@ -0,0 +1,75 @@
+package query_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/query"
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+func TestMetaLookupsOfTenant(t *testing.T) {
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.SeedSQLMeta([]byte{0x0a}, "select 1"); err != nil {
+		t.Fatal(err)
+	}
+	ctxB := store.WithTenant(context.Background(), "b")
+	if err := store.Metas(ctxB, []*tipb.SQLMeta{{SqlDigest: []byte{0x0b}, NormalizedSql: "select 2"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		ctx    context.Context
+		digest string
+		want   string
+	}{
+		{context.Background(), "0a", "select 1"},
+		{context.Background(), "0b", ""},
+		{ctxB, "0a", ""},
+		{ctxB, "0b", "select 2"},
+	} {
+		item, err := query.Digest(c.ctx, c.digest, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		if item.SQL != nil {
+			got = item.SQL.SQLText
+		}
+		has, err := query.HasSQLMeta(c.ctx, c.digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		texts, err := query.SQLTexts(c.ctx, []string{c.digest})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want || has != (len(c.want) != 0) || texts[c.digest] != c.want {
+			t.Errorf("got %q, %v and %q of %s in tenant %q, want %q", got, has, texts[c.digest], c.digest, store.TenantFrom(c.ctx), c.want)
+		}
+	}
+
+	// The TenantKey of the digest of b is no digest of the default tenant
+	if _, err := query.Digest(context.Background(), "b/0b", false); !errors.Is(err, store.ErrInvalidDigest) {
+		t.Fatalf("got error %v, want %v", err, store.ErrInvalidDigest)
+	}
+	if _, err := query.HasSQLMeta(context.Background(), "b/0b"); !errors.Is(err, store.ErrInvalidDigest) {
+		t.Fatalf("got error %v, want %v", err, store.ErrInvalidDigest)
+	}
+	texts, err := query.SQLTexts(context.Background(), []string{"b/0b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(texts) != 0 {
+		t.Fatalf("got texts %v of the digest of another tenant", texts)
+	}
+}
@@ -1,21 +1,77 @@
 package query
 
+import (
+	"math"
+	"strconv"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+)
+
 type TopSQLItem struct {
 	SQLDigest string     `json:"sql_digest"`
 	SQLText   string     `json:"sql_text"`
 	Plans     []PlanItem `json:"plans"`
+	// CPUTimeMillis is the total cpu time of the SQL within the range.
+	CPUTimeMillis uint64 `json:"cpu_time_ms"`
+	// Share is CPUTimeMillis over the total of all SQLs of the instance, those
+	// beyond the top included. 0 if the total is.
+	Share float64 `json:"share"`
 }
 
 type PlanItem struct {
 	PlanDigest    string   `json:"plan_digest"`
 	PlanText      string   `json:"plan_text"`
 	TimestampSecs []uint64 `json:"timestamp_secs"`
-	CPUTimeMillis []uint32 `json:"cpu_time_millis"`
+	CPUTimeMillis []uint64 `json:"cpu_time_millis"`
+}
+
+type SummaryItem struct {
+	SQLDigest string            `json:"sql_digest"`
+	SQLText   string            `json:"sql_text"`
+	IsOther   bool              `json:"is_other"`
+	Plans     []SummaryPlanItem `json:"plans"`
+}
+
+type SummaryPlanItem struct {
+	PlanDigest    string   `json:"plan_digest"`
+	PlanText      string   `json:"plan_text"`
+	TimestampSecs []uint64 `json:"timestamp_sec"`
+	CPUTimeMillis []uint64 `json:"cpu_time_ms"`
+}
+
+// Metric is a cpu time series of a SQL plan on an instance.
+type Metric struct {
+	Instance      string   `json:"instance"`
+	SQLDigest     string   `json:"sql_digest"`
+	PlanDigest    string   `json:"plan_digest"`
+	TimestampsMs  []uint64 `json:"timestamps_ms"`
+	CPUTimeMillis []uint64 `json:"cpu_time_millis"`
 }
 
 type InstanceItem struct {
 	Instance string `json:"instance"`
 	Job      string `json:"job"`
+	// InstanceType is what TiDB Dashboard reads, the same as Job
+	InstanceType string `json:"instance_type"`
+	// LastSeen is when the instance last reported in unix seconds, to a minute.
+	LastSeen int64 `json:"last_seen,omitempty"`
+	// SourceAddr is the address of the agent last reporting the instance.
+	SourceAddr string `json:"source_addr,omitempty"`
+	// Zone, Host, Version and Status are those of the node in the topology of
+	// the cluster, if synced.
+	Zone    string `json:"zone,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Version string `json:"version,omitempty"`
+	Status  string `json:"status,omitempty"`
+	// MissingSince is when the instance was first found missing from the
+	// topology in unix seconds, possibly decommissioned.
+	MissingSince int64 `json:"missing_since,omitempty"`
+	// AgentVersion and Capabilities are those of the agent last reporting the
+	// instance, empty if unknown.
+	AgentVersion string   `json:"agent_version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// ClockSkew is the skew measured of the clock of the instance, if detected.
+	ClockSkew *store.ClockSkewStats `json:"clock_skew,omitempty"`
 }
 
 type metricResp struct {
@@ -41,3 +97,20 @@ type metricRespDataResultMetric struct {
 }
 
 type metricRespDataResultValue = []interface{}
+
+// parseSampleValue parses a sample value of the timeseries db as a count. Sums
+// beyond 1e6 or so come in exponent notation, e.g. "1.2345678e+07", exact up to
+// 2^53. Negative, NaN and fractional values are rejected or rounded down.
+func parseSampleValue(raw string) (uint64, bool) {
+	if v, err := strconv.ParseUint(raw, 10, 64); err == nil {
+		return v, true
+	}
+	f, err := strconv.ParseFloat(raw, 64)
+	if err != nil || math.IsNaN(f) || f < 0 {
+		return 0, false
+	}
+	if f >= math.MaxUint64 {
+		return math.MaxUint64, true
+	}
+	return uint64(f), true
+}
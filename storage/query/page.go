@@ -0,0 +1,181 @@
+package query
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// ErrInvalidCursor is returned for cursors not produced by TopSQLPage for the same request.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TopSQLPageItem is a page of the Top SQLs ordered by total cpu time descending.
+type TopSQLPageItem struct {
+	Items []TopSQLItem `json:"items"`
+	// CPUTimeMillis is the total cpu time the shares of the items are of.
+	CPUTimeMillis uint64 `json:"cpu_time_ms"`
+	// NextCursor fetches the next page, empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Restarted tells the data changed since the cursor was issued, so the page
+	// is the first one of a new snapshot.
+	Restarted bool `json:"restarted,omitempty"`
+}
+
+// pageCursor is the position after the last item of a page.
+type pageCursor struct {
+	Request   uint64 `json:"r"` // fingerprint of the request parameters
+	CPUTime   uint64 `json:"c"`
+	SQLDigest string `json:"d"`
+	Snapshot  uint64 `json:"s"` // fingerprint of the ranking up to the position
+}
+
+// TopSQLPage returns at most pageSize Top SQLs of instance after cursor, the
+// first page if cursor is empty. Paging identical requests visits every item
+// of TopSQL exactly once as long as the ranking does not change.
+func TopSQLPage(ctx context.Context, startSecs, endSecs, windowSecs, top int, instance, cursor string, pageSize int) (TopSQLPageItem, error) {
+	page := TopSQLPageItem{}
+	if pageSize <= 0 {
+		return page, fmt.Errorf("invalid page size %d", pageSize)
+	}
+	request := requestFingerprint(startSecs, endSecs, windowSecs, top, instance)
+
+	var after *pageCursor
+	if len(cursor) != 0 {
+		c, err := decodeCursor(cursor)
+		if err != nil {
+			return page, err
+		}
+		if c.Request != request {
+			return page, fmt.Errorf("%w: issued for another request", ErrInvalidCursor)
+		}
+		after = &c
+	}
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	groups, total, err := rankedGroups(ctx, startSecs, endSecs, windowSecs, top, instance)
+	if err != nil {
+		return page, err
+	}
+	page.CPUTimeMillis = total
+
+	offset := 0
+	if after != nil {
+		offset = sort.Search(len(groups), func(i int) bool {
+			return !rankedBefore(groups[i], after.CPUTime, after.SQLDigest)
+		})
+		// The item at the position must be there, ranked after the same items.
+		if offset == len(groups) || groups[offset].cpuTimeSum != after.CPUTime || groups[offset].sqlDigest != after.SQLDigest ||
+			snapshotFingerprint(groups[:offset+1]) != after.Snapshot {
+			offset, page.Restarted = 0, true
+		} else {
+			offset++
+		}
+	}
+
+	end := offset + pageSize
+	if end > len(groups) {
+		end = len(groups)
+	}
+	page.Items = make([]TopSQLItem, 0, end-offset)
+	pageGroups := groups[offset:end]
+	if err = fillText(ctx, &pageGroups, total, &page.Items); err != nil {
+		return page, err
+	}
+
+	if end < len(groups) {
+		last := groups[end-1]
+		page.NextCursor = encodeCursor(pageCursor{
+			Request:   request,
+			CPUTime:   last.cpuTimeSum,
+			SQLDigest: last.sqlDigest,
+			Snapshot:  snapshotFingerprint(groups[:end]),
+		})
+	}
+	return page, nil
+}
+
+// TopSQLStream calls fn with the Top SQLs of instance ordered by total cpu time
+// descending, without holding them all in memory with their texts.
+func TopSQLStream(ctx context.Context, startSecs, endSecs, windowSecs, top int, instance string, fn func(item TopSQLItem) error) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	groups, total, err := rankedGroups(ctx, startSecs, endSecs, windowSecs, top, instance)
+	if err != nil {
+		return err
+	}
+	return eachText(ctx, groups, total, fn)
+}
+
+// rankedGroups returns the top groups sorted by TopKSlice and the total cpu time of all groups.
+func rankedGroups(ctx context.Context, startSecs, endSecs, windowSecs, top int, instance string) ([]sqlGroup, uint64, error) {
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	if err := fetchTimeseriesDB(ctx, startSecs, endSecs, windowSecs, instance, metricResponse); err != nil {
+		return nil, 0, err
+	}
+
+	// Not pooled, the groups outlive the response.
+	var groups []sqlGroup
+	total, err := topK(metricResponse.Data.Results, top, &groups)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Sort(TopKSlice{s: groups})
+	return groups, total, nil
+}
+
+// rankedBefore tells whether g is ranked before the position (cpuTime, sqlDigest) by TopKSlice.
+func rankedBefore(g sqlGroup, cpuTime uint64, sqlDigest string) bool {
+	if g.cpuTimeSum != cpuTime {
+		return g.cpuTimeSum > cpuTime
+	}
+	return g.sqlDigest > sqlDigest
+}
+
+func requestFingerprint(startSecs, endSecs, windowSecs, top int, instance string) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, v := range []int{startSecs, endSecs, windowSecs, top} {
+		binary.BigEndian.PutUint64(buf[:], uint64(v))
+		_, _ = h.Write(buf[:])
+	}
+	_, _ = h.Write([]byte(instance))
+	return h.Sum64()
+}
+
+func snapshotFingerprint(groups []sqlGroup) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, g := range groups {
+		binary.BigEndian.PutUint64(buf[:], g.cpuTimeSum)
+		_, _ = h.Write(buf[:])
+		_, _ = h.Write([]byte(g.sqlDigest))
+		_, _ = h.Write([]byte{0})
+	}
+	return h.Sum64()
+}
+
+func encodeCursor(c pageCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(raw string) (pageCursor, error) {
+	c := pageCursor{}
+	b, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(b, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
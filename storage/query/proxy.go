@@ -0,0 +1,234 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"unicode/utf8"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils"
+
+	"github.com/genjidb/genji"
+	"github.com/spf13/pflag"
+)
+
+var (
+	previewLength  = pflag.Int("query.proxy-preview-length", 128, "Maximum length in bytes of sql_text_preview and plan_preview labels attached by the query proxy")
+	maxEnrichments = pflag.Int("query.proxy-max-enriched-series", 1000, "Maximum number of series per response the query proxy attaches previews to")
+)
+
+const (
+	labelSQLTextPreview = "sql_text_preview"
+	labelPlanPreview    = "plan_preview"
+	previewMarker       = "..."
+)
+
+// ProxyPromQL forwards a Prometheus query API request (`/api/v1/query` or
+// `/api/v1/query_range`) to the timeseries db and writes the response to w.
+// Series labeled by sql_digest or plan_digest get sql_text_preview and
+// plan_preview labels, other responses are written as they are.
+func ProxyPromQL(ctx context.Context, path string, params url.Values, w http.ResponseWriter) {
+	if queryHandler == nil {
+		http.Error(w, "empty query handler", http.StatusServiceUnavailable)
+		return
+	}
+	if err := checkRangeParams(params); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", path, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.URL.RawQuery = params.Encode()
+	req.Header.Set("Accept", "application/json")
+
+	respR := utils.NewRespWriter(bufResp, header)
+	if err = serveQuery(ctx, req, &respR); err != nil {
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	body := respR.Body.Bytes()
+	if respR.Code >= 200 && respR.Code < 300 {
+		if enriched, err := enrichPromResponse(ctx, body); err == nil && enriched != nil {
+			body = enriched
+		}
+	}
+
+	for key, values := range respR.Headers {
+		if key == "Content-Length" {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(respR.Code)
+	_, _ = w.Write(body)
+}
+
+// enrichPromResponse returns the response body with previews attached, or nil
+// if no series needs them. Fields other than the series labels are kept as they are.
+func enrichPromResponse(ctx context.Context, body []byte) ([]byte, error) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, err
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(resp["data"], &data); err != nil {
+		return nil, err
+	}
+	var resultType string
+	if err := json.Unmarshal(data["resultType"], &resultType); err != nil {
+		return nil, err
+	}
+	if resultType != "vector" && resultType != "matrix" {
+		return nil, nil
+	}
+	var results []map[string]json.RawMessage
+	if err := json.Unmarshal(data["result"], &results); err != nil {
+		return nil, err
+	}
+
+	metrics := make([]map[string]string, len(results))
+	sqlDigests := make(map[string]struct{})
+	planDigests := make(map[string]struct{})
+	for i, result := range results {
+		if err := json.Unmarshal(result["metric"], &metrics[i]); err != nil {
+			return nil, err
+		}
+		if i >= *maxEnrichments {
+			continue
+		}
+		if digest := metrics[i]["sql_digest"]; len(digest) != 0 {
+			sqlDigests[digest] = struct{}{}
+		}
+		if digest := metrics[i]["plan_digest"]; len(digest) != 0 {
+			planDigests[digest] = struct{}{}
+		}
+	}
+	if len(sqlDigests) == 0 && len(planDigests) == 0 {
+		return nil, nil
+	}
+
+	sqlTexts, planTexts, err := lookupTexts(ctx, sqlDigests, planDigests)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		if i >= *maxEnrichments {
+			break
+		}
+		m := metrics[i]
+		changed := false
+		if text, ok := sqlTexts[m["sql_digest"]]; ok {
+			m[labelSQLTextPreview] = preview(text, *previewLength)
+			changed = true
+		}
+		if text, ok := planTexts[m["plan_digest"]]; ok {
+			m[labelPlanPreview] = preview(text, *previewLength)
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		if results[i]["metric"], err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	}
+
+	if data["result"], err = json.Marshal(results); err != nil {
+		return nil, err
+	}
+	if resp["data"], err = json.Marshal(data); err != nil {
+		return nil, err
+	}
+	return json.Marshal(resp)
+}
+
+func lookupTexts(ctx context.Context, sqlDigests, planDigests map[string]struct{}) (map[string]string, map[string]string, error) {
+	if documentDB == nil {
+		return nil, nil, errors.New("empty document db")
+	}
+
+	tenant := store.TenantFrom(ctx)
+	sqlTexts := make(map[string]string, len(sqlDigests))
+	planTexts := make(map[string]string, len(planDigests))
+	err := documentDB.WithContext(ctx).View(func(tx *genji.Tx) error {
+		for digest := range sqlDigests {
+			key, ok := metaKey(tenant, digest)
+			if !ok || isDeleted(tx, tenant, key) {
+				continue
+			}
+			if r, err := tx.QueryDocument("SELECT sql_text FROM sql_digest WHERE digest = ? AND tenant = ?", key, tenant); err == nil {
+				var text string
+				if scanText(r, key, &text) == nil {
+					sqlTexts[digest] = text
+				}
+			}
+		}
+		for digest := range planDigests {
+			key, ok := metaKey(tenant, digest)
+			if !ok || isDeleted(tx, tenant, key) {
+				continue
+			}
+			if r, err := tx.QueryDocument("SELECT plan_text FROM plan_digest WHERE digest = ? AND tenant = ?", key, tenant); err == nil {
+				var text string
+				if scanText(r, key, &text) == nil {
+					planTexts[digest] = text
+				}
+			}
+		}
+		return nil
+	})
+	return sqlTexts, planTexts, err
+}
+
+// checkRangeParams validates the start, end and step of a range query against
+// the limits. Values other than unix seconds are left to the timeseries db.
+func checkRangeParams(params url.Values) error {
+	start, err := strconv.ParseFloat(params.Get("start"), 64)
+	if err != nil {
+		return nil
+	}
+	end, err := strconv.ParseFloat(params.Get("end"), 64)
+	if err != nil {
+		return nil
+	}
+	step, err := strconv.ParseFloat(params.Get("step"), 64)
+	if err != nil || step < 1 {
+		step = 0
+	}
+	return checkRange(int64(start), int64(end), int64(step))
+}
+
+// preview cuts text to at most maxLen bytes on a rune boundary, marking the cut.
+func preview(text string, maxLen int) string {
+	if maxLen <= 0 || len(text) <= maxLen {
+		return text
+	}
+	cut := maxLen - len(previewMarker)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + previewMarker
+}
@@ -1,12 +1,14 @@
 package query
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
 
+	"github.com/zhongzc/diag_backend/storage/store"
 	"github.com/zhongzc/diag_backend/utils"
 
 	"github.com/genjidb/genji"
@@ -33,24 +35,34 @@ func Init(handler http.HandlerFunc, db *genji.DB) {
 	documentDB = db
 }
 
-func TopSQL(startSecs, endSecs, windowSecs, top int, instance string, fill *[]TopSQLItem) error {
+// TopSQL fills the top SQLs of instance by cpu time with their shares of the
+// total cpu time of the instance, which is returned. The others reported by
+// TiDB are not ranked, only counted in the total.
+func TopSQL(ctx context.Context, startSecs, endSecs, windowSecs, top int, instance string, fill *[]TopSQLItem) (uint64, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
 	metricResponse := metricRespP.Get()
 	defer metricRespP.Put(metricResponse)
-	if err := fetchTimeseriesDB(startSecs, endSecs, windowSecs, instance, metricResponse); err != nil {
-		return err
+	if err := fetchTimeseriesDB(ctx, startSecs, endSecs, windowSecs, instance, metricResponse); err != nil {
+		return 0, err
 	}
 
 	sqlGroups := sqlGroupSliceP.Get()
 	defer sqlGroupSliceP.Put(sqlGroups)
-	if err := topK(metricResponse.Data.Results, top, sqlGroups); err != nil {
-		return err
+	total, err := topK(metricResponse.Data.Results, top, sqlGroups)
+	if err != nil {
+		return 0, err
 	}
 
-	return fillText(sqlGroups, fill)
+	return total, fillText(ctx, sqlGroups, total, fill)
 }
 
-func AllInstances(fill *[]InstanceItem) error {
-	doc, err := documentDB.Query("SELECT instance, job FROM instance")
+func AllInstances(ctx context.Context, fill *[]InstanceItem) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	doc, err := documentDB.WithContext(ctx).Query("SELECT instance, job, last_seen, source_addr, zone, host, version, status, missing_since, agent_version, capabilities FROM instance")
 	if err != nil {
 		return err
 	}
@@ -59,10 +71,46 @@ func AllInstances(fill *[]InstanceItem) error {
 	return doc.Iterate(func(d types.Document) error {
 		item := InstanceItem{}
 
-		err := document.Scan(d, &item.Instance, &item.Job)
+		// last_seen, source_addr and the agent fields are missing in rows
+		// written before they were recorded, the topology fields in rows never
+		// synced
+		var lastSeen, missingSince, capabilities *int64
+		var sourceAddr, zone, host, version, status, agentVersion *string
+		err := document.Scan(d, &item.Instance, &item.Job, &lastSeen, &sourceAddr, &zone, &host, &version, &status, &missingSince, &agentVersion, &capabilities)
 		if err != nil {
 			return err
 		}
+		item.InstanceType = item.Job
+		if lastSeen != nil {
+			item.LastSeen = *lastSeen
+		}
+		if sourceAddr != nil {
+			item.SourceAddr = *sourceAddr
+		}
+		if zone != nil {
+			item.Zone = *zone
+		}
+		if host != nil {
+			item.Host = *host
+		}
+		if version != nil {
+			item.Version = *version
+		}
+		if status != nil {
+			item.Status = *status
+		}
+		if missingSince != nil {
+			item.MissingSince = *missingSince
+		}
+		if agentVersion != nil {
+			item.AgentVersion = *agentVersion
+		}
+		if capabilities != nil {
+			item.Capabilities = store.Capabilities(*capabilities).Names()
+		}
+		if skew, ok := store.ClockSkew(item.Instance); ok {
+			item.ClockSkew = &skew
+		}
 
 		*fill = append(*fill, item)
 		return nil
@@ -72,19 +120,22 @@ func AllInstances(fill *[]InstanceItem) error {
 type planSeries struct {
 	planDigest    string
 	timestampSecs []uint64
-	cpuTimeMillis []uint32
+	cpuTimeMillis []uint64
 }
 
 type sqlGroup struct {
 	sqlDigest  string
 	planSeries []planSeries
-	cpuTimeSum uint32
+	cpuTimeSum uint64
 }
 
-func fetchTimeseriesDB(startSecs int, endSecs int, windowSecs int, instance string, metricResponse *metricResp) error {
+func fetchTimeseriesDB(ctx context.Context, startSecs int, endSecs int, windowSecs int, instance string, metricResponse *metricResp) error {
 	if queryHandler == nil {
 		return errors.New("empty query handler")
 	}
+	if err := checkRange(int64(startSecs), int64(endSecs), int64(windowSecs)); err != nil {
+		return err
+	}
 
 	bufResp := bytesP.Get()
 	header := headerP.Get()
@@ -92,11 +143,11 @@ func fetchTimeseriesDB(startSecs int, endSecs int, windowSecs int, instance stri
 	defer bytesP.Put(bufResp)
 	defer headerP.Put(header)
 
-	query := fmt.Sprintf("sum_over_time(cpu_time{instance=\"%s\"}[%d])", instance, windowSecs)
+	query := fmt.Sprintf("sum_over_time(%s{instance=\"%s\"}[%d])", store.MetricName(store.MetricCPUTime), store.NormalizeInstance(instance), windowSecs)
 	start := strconv.Itoa(startSecs - startSecs%windowSecs)
 	end := strconv.Itoa(endSecs - endSecs%windowSecs + windowSecs)
 
-	req, err := http.NewRequest("GET", "/api/v1/query_range", nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", "/api/v1/query_range", nil)
 	if err != nil {
 		return err
 	}
@@ -109,7 +160,9 @@ func fetchTimeseriesDB(startSecs int, endSecs int, windowSecs int, instance stri
 	req.Header.Set("Accept", "application/json")
 
 	respR := utils.NewRespWriter(bufResp, header)
-	queryHandler(&respR, req)
+	if err = serveQuery(ctx, req, &respR); err != nil {
+		return err
+	}
 
 	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
 		log.Warn("failed to fetch timeseries db", zap.String("error", respR.Body.String()))
@@ -118,12 +171,35 @@ func fetchTimeseriesDB(startSecs int, endSecs int, windowSecs int, instance stri
 	return json.Unmarshal(respR.Body.Bytes(), metricResponse)
 }
 
-func topK(results []metricRespDataResult, top int, sqlGroups *[]sqlGroup) error {
+// topK keeps the top groups of results and returns the total cpu time of all
+// of them, the others included though never ranked.
+func topK(results []metricRespDataResult, top int, sqlGroups *[]sqlGroup) (uint64, error) {
 	groupBySQLDigest(results, sqlGroups)
+	total := totalCPUTime(*sqlGroups)
+	dropOthers(sqlGroups)
 	if err := keepTopK(sqlGroups, top); err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return total, nil
+}
+
+// totalCPUTime sums up the series of groups, saturating at the max uint64.
+func totalCPUTime(groups []sqlGroup) uint64 {
+	var total uint64
+	for _, group := range groups {
+		total = utils.AddSaturating(total, groupCPUTime(group))
+	}
+	return total
+}
+
+func groupCPUTime(group sqlGroup) uint64 {
+	var total uint64
+	for _, series := range group.planSeries {
+		for _, v := range series.cpuTimeMillis {
+			total = utils.AddSaturating(total, v)
+		}
+	}
+	return total
 }
 
 func groupBySQLDigest(resp []metricRespDataResult, target *[]sqlGroup) {
@@ -156,14 +232,15 @@ func groupBySQLDigest(resp []metricRespDataResult, target *[]sqlGroup) {
 			}
 
 			ts := uint64(value[0].(float64))
-			cpu, err := strconv.ParseUint(value[1].(string), 10, 64)
-			if err != nil {
+			raw, _ := value[1].(string)
+			cpu, ok := parseSampleValue(raw)
+			if !ok {
 				continue
 			}
 
-			group.cpuTimeSum += uint32(cpu)
+			group.cpuTimeSum = utils.AddSaturating(group.cpuTimeSum, cpu)
 			ps.timestampSecs = append(ps.timestampSecs, ts)
-			ps.cpuTimeMillis = append(ps.cpuTimeMillis, uint32(cpu))
+			ps.cpuTimeMillis = append(ps.cpuTimeMillis, cpu)
 		}
 
 		m[r.Metric.SQLDigest] = group
@@ -178,6 +255,40 @@ func groupBySQLDigest(resp []metricRespDataResult, target *[]sqlGroup) {
 	}
 }
 
+// splitOthers moves the groups of the others out of groups, merged into one
+// of OthersDigest returned, so they are not ranked as a SQL.
+func splitOthers(groups *[]sqlGroup) []sqlGroup {
+	var others []sqlGroup
+	n := 0
+	for _, group := range *groups {
+		if store.IsOthersDigest(group.sqlDigest) {
+			if len(others) == 0 {
+				others = append(others, sqlGroup{sqlDigest: store.OthersDigest})
+			}
+			others[0].planSeries = append(others[0].planSeries, group.planSeries...)
+			others[0].cpuTimeSum = utils.AddSaturating(others[0].cpuTimeSum, group.cpuTimeSum)
+			continue
+		}
+		(*groups)[n] = group
+		n++
+	}
+	*groups = (*groups)[:n]
+	return others
+}
+
+// dropOthers removes the groups of the others from groups, counted in the
+// totals only.
+func dropOthers(groups *[]sqlGroup) {
+	n := 0
+	for _, group := range *groups {
+		if !store.IsOthersDigest(group.sqlDigest) {
+			(*groups)[n] = group
+			n++
+		}
+	}
+	*groups = (*groups)[:n]
+}
+
 func keepTopK(groups *[]sqlGroup, top int) error {
 	if top <= 0 || len(*groups) <= top {
 		return nil
@@ -192,38 +303,54 @@ func keepTopK(groups *[]sqlGroup, top int) error {
 	return nil
 }
 
-func fillText(sqlGroups *[]sqlGroup, fill *[]TopSQLItem) error {
-	return documentDB.View(func(tx *genji.Tx) error {
-		for _, group := range *sqlGroups {
+func fillText(ctx context.Context, sqlGroups *[]sqlGroup, total uint64, fill *[]TopSQLItem) error {
+	return eachText(ctx, *sqlGroups, total, func(item TopSQLItem) error {
+		*fill = append(*fill, item)
+		return nil
+	})
+}
+
+// eachText calls fn with the item of every group in order, texts and shares of total attached.
+func eachText(ctx context.Context, sqlGroups []sqlGroup, total uint64, fn func(item TopSQLItem) error) error {
+	tenant := store.TenantFrom(ctx)
+	return documentDB.WithContext(ctx).View(func(tx *genji.Tx) error {
+		for _, group := range sqlGroups {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			sqlDigest := group.sqlDigest
 			var sqlText string
 
-			if len(sqlDigest) != 0 {
+			if key, ok := metaKey(tenant, sqlDigest); ok && !store.IsOthersDigest(sqlDigest) && !isDeleted(tx, tenant, key) {
 				r, err := tx.QueryDocument(
-					"SELECT sql_text FROM sql_digest WHERE digest = ?",
-					sqlDigest,
+					"SELECT sql_text FROM sql_digest WHERE digest = ? AND tenant = ?",
+					key, tenant,
 				)
 				if err == nil {
-					_ = document.Scan(r, &sqlText)
+					_ = scanText(r, key, &sqlText)
 				}
 			}
 
 			item := TopSQLItem{
-				SQLDigest: sqlDigest,
-				SQLText:   sqlText,
+				SQLDigest:     sqlDigest,
+				SQLText:       sqlText,
+				CPUTimeMillis: groupCPUTime(group),
+			}
+			if total != 0 {
+				item.Share = float64(item.CPUTimeMillis) / float64(total)
 			}
 
 			for _, series := range group.planSeries {
 				planDigest := series.planDigest
 				var planText string
 
-				if len(planDigest) != 0 {
+				if key, ok := metaKey(tenant, planDigest); ok && len(planDigest) != 0 && !isDeleted(tx, tenant, key) {
 					r, err := tx.QueryDocument(
-						"SELECT plan_text FROM plan_digest WHERE digest = ?",
-						planDigest,
+						"SELECT plan_text FROM plan_digest WHERE digest = ? AND tenant = ?",
+						key, tenant,
 					)
 					if err == nil {
-						_ = document.Scan(r, &planText)
+						_ = scanText(r, key, &planText)
 					}
 				}
 
@@ -235,7 +362,9 @@ func fillText(sqlGroups *[]sqlGroup, fill *[]TopSQLItem) error {
 				})
 			}
 
-			*fill = append(*fill, item)
+			if err := fn(item); err != nil {
+				return err
+			}
 		}
 
 		return nil
@@ -264,3 +393,36 @@ func (s TopKSlice) Less(i, j int) bool {
 func (s TopKSlice) Swap(i, j int) {
 	s.s[i], s.s[j] = s.s[j], s.s[i]
 }
+
+// SQLTexts returns the normalized SQL texts of the known digests among
+// sqlDigests in the tenant of ctx.
+func SQLTexts(ctx context.Context, sqlDigests []string) (map[string]string, error) {
+	tenant := store.TenantFrom(ctx)
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	res := make(map[string]string, len(sqlDigests))
+	err := documentDB.WithContext(ctx).View(func(tx *genji.Tx) error {
+		for _, sqlDigest := range sqlDigests {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			key, ok := metaKey(tenant, sqlDigest)
+			if !ok || len(sqlDigest) == 0 || isDeleted(tx, tenant, key) {
+				continue
+			}
+
+			r, err := tx.QueryDocument("SELECT sql_text FROM sql_digest WHERE digest = ? AND tenant = ?", key, tenant)
+			if err != nil {
+				continue
+			}
+
+			var sqlText string
+			if err = scanText(r, key, &sqlText); err == nil {
+				res[sqlDigest] = sqlText
+			}
+		}
+		return nil
+	})
+	return res, err
+}
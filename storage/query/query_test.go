@@ -0,0 +1,57 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+)
+
+func cpuTimeResult(sqlDigest, planDigest string, values ...string) metricRespDataResult {
+	r := metricRespDataResult{Metric: metricRespDataResultMetric{
+		Instance:   "tidb-0:10080",
+		SQLDigest:  sqlDigest,
+		PlanDigest: planDigest,
+	}}
+	for i, v := range values {
+		r.Values = append(r.Values, metricRespDataResultValue{float64(1632700800 + i), v})
+	}
+	return r
+}
+
+func TestTopKCountsOthersInTotal(t *testing.T) {
+	results := []metricRespDataResult{
+		cpuTimeResult("a", "p1", "30", "20"),
+		cpuTimeResult("a", "p2", "0"),
+		cpuTimeResult("b", "p1", "25"),
+		cpuTimeResult("c", "", "5"),
+		cpuTimeResult(store.OthersDigest, "", "15"),
+		cpuTimeResult("", "", "5"),
+	}
+
+	var groups []sqlGroup
+	total, err := topK(results, 2, &groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 100 {
+		t.Fatalf("got total %d, want 100", total)
+	}
+	got := make(map[string]uint64)
+	for _, g := range groups {
+		got[g.sqlDigest] = groupCPUTime(g)
+	}
+	if len(got) != 2 || got["a"] != 50 || got["b"] != 25 {
+		t.Fatalf("got top groups %v, want a of 50 and b of 25", got)
+	}
+}
+
+func TestTopKOfOthersOnly(t *testing.T) {
+	var groups []sqlGroup
+	total, err := topK([]metricRespDataResult{cpuTimeResult(store.OthersDigest, "", "15")}, 10, &groups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 15 || len(groups) != 0 {
+		t.Fatalf("got total %d and groups %v, want 15 and none", total, groups)
+	}
+}
@@ -0,0 +1,150 @@
+package query
+
+import (
+	"fmt"
+)
+
+// FillPolicy tells how Shape fills the grid points a series has no sample at.
+type FillPolicy string
+
+const (
+	FillNone FillPolicy = "none" // keep the series sparse
+	FillZero FillPolicy = "zero"
+	FillNull FillPolicy = "null"
+)
+
+func ParseFillPolicy(s string) (FillPolicy, error) {
+	switch p := FillPolicy(s); p {
+	case "", FillNone:
+		return FillNone, nil
+	case FillZero, FillNull:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown fill policy %q, expect none, zero or null", s)
+}
+
+// ShapeOptions are the response shaping options of the range queries.
+type ShapeOptions struct {
+	Fill FillPolicy `json:"fill"`
+	// Smooth is the number of trailing points averaged into each point, 0 or 1 for none.
+	Smooth int `json:"smooth,omitempty"`
+}
+
+// ShapeItem echoes the grid and the options a response was shaped with.
+type ShapeItem struct {
+	StartSecs uint64     `json:"start_secs"`
+	EndSecs   uint64     `json:"end_secs"`
+	StepSecs  uint64     `json:"step_secs"`
+	Fill      FillPolicy `json:"fill"`
+	Smooth    int        `json:"smooth,omitempty"`
+}
+
+type ShapedTopSQLItem struct {
+	SQLDigest     string           `json:"sql_digest"`
+	SQLText       string           `json:"sql_text"`
+	Plans         []ShapedPlanItem `json:"plans"`
+	CPUTimeMillis uint64           `json:"cpu_time_ms"`
+	Share         float64          `json:"share"`
+}
+
+// ShapedPlanItem is a PlanItem aligned to the grid. A nil value is a gap filled with null.
+type ShapedPlanItem struct {
+	PlanDigest    string     `json:"plan_digest"`
+	PlanText      string     `json:"plan_text"`
+	TimestampSecs []uint64   `json:"timestamp_secs"`
+	CPUTimeMillis []*float64 `json:"cpu_time_millis"`
+}
+
+// ShapeGrid returns the grid TopSQL aggregates [startSecs, endSecs] on.
+func ShapeGrid(startSecs, endSecs, windowSecs int) (start, end, step uint64) {
+	return uint64(startSecs - startSecs%windowSecs), uint64(endSecs - endSecs%windowSecs + windowSecs), uint64(windowSecs)
+}
+
+// ShapeTopSQL aligns the series of items to the grid from start to end inclusive
+// at step, fills the gaps and smooths them as opts tells. Samples off the grid are
+// summed into the point before them, so the totals are kept unless smoothed.
+func ShapeTopSQL(items []TopSQLItem, start, end, step uint64, opts ShapeOptions) ([]ShapedTopSQLItem, ShapeItem) {
+	meta := ShapeItem{StartSecs: start, EndSecs: end, StepSecs: step, Fill: opts.Fill, Smooth: opts.Smooth}
+	if len(meta.Fill) == 0 {
+		meta.Fill = FillNone
+	}
+
+	res := make([]ShapedTopSQLItem, 0, len(items))
+	for _, item := range items {
+		shaped := ShapedTopSQLItem{
+			SQLDigest:     item.SQLDigest,
+			SQLText:       item.SQLText,
+			CPUTimeMillis: item.CPUTimeMillis,
+			Share:         item.Share,
+		}
+		for _, plan := range item.Plans {
+			ts, values := shapeSeries(plan.TimestampSecs, plan.CPUTimeMillis, start, end, step, meta.Fill)
+			shaped.Plans = append(shaped.Plans, ShapedPlanItem{
+				PlanDigest:    plan.PlanDigest,
+				PlanText:      plan.PlanText,
+				TimestampSecs: ts,
+				CPUTimeMillis: smooth(values, opts.Smooth),
+			})
+		}
+		res = append(res, shaped)
+	}
+	return res, meta
+}
+
+func shapeSeries(timestamps []uint64, values []uint64, start, end, step uint64, fill FillPolicy) ([]uint64, []*float64) {
+	if step == 0 || end < start {
+		return nil, nil
+	}
+	points := int((end-start)/step) + 1
+	sums := make([]*float64, points)
+	for i, ts := range timestamps {
+		if ts < start || ts > end || i >= len(values) {
+			continue
+		}
+		idx := int((ts - start) / step)
+		if sums[idx] == nil {
+			sums[idx] = new(float64)
+		}
+		*sums[idx] += float64(values[i])
+	}
+
+	resTs := make([]uint64, 0, points)
+	resValues := make([]*float64, 0, points)
+	for i, v := range sums {
+		if v == nil {
+			switch fill {
+			case FillNone:
+				continue
+			case FillZero:
+				v = new(float64)
+			}
+		}
+		resTs = append(resTs, start+uint64(i)*step)
+		resValues = append(resValues, v)
+	}
+	return resTs, resValues
+}
+
+// smooth replaces each value by the average of the non-null values among the
+// window values ending at it. A point stays null if all of them are.
+func smooth(values []*float64, window int) []*float64 {
+	if window <= 1 {
+		return values
+	}
+
+	res := make([]*float64, len(values))
+	for i := range values {
+		sum, n := 0.0, 0
+		for j := i - window + 1; j <= i; j++ {
+			if j >= 0 && values[j] != nil {
+				sum += *values[j]
+				n++
+			}
+		}
+		if n != 0 {
+			avg := sum / float64(n)
+			res[i] = &avg
+		}
+	}
+	return res
+}
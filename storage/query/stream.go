@@ -0,0 +1,225 @@
+package query
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+)
+
+// CPUTimeQuery selects the series of QueryCPUTimeStream.
+type CPUTimeQuery struct {
+	// Instance and SQLDigest filter the series if not empty.
+	Instance  string
+	SQLDigest string
+	StartSecs int64
+	EndSecs   int64
+	// StepSecs is the resolution, each point summing up the cpu time of the
+	// step up to it.
+	StepSecs int64
+}
+
+// QueryCPUTimeStream calls fn with each series of the cpu time of a plan on an
+// instance selected by q as it is decoded from the response of the timeseries
+// db, so the memory is bounded by the caller. It stops at the first error of
+// fn and returns it.
+func QueryCPUTimeStream(ctx context.Context, q CPUTimeQuery, fn func(Metric) error) error {
+	if queryHandler == nil {
+		return errors.New("empty query handler")
+	}
+	if len(q.SQLDigest) != 0 && q.SQLDigest != store.OthersDigest {
+		if _, err := hex.DecodeString(q.SQLDigest); err != nil {
+			return fmt.Errorf("invalid sql digest %q", q.SQLDigest)
+		}
+	}
+	if q.StepSecs <= 0 {
+		return fmt.Errorf("non-positive step %d", q.StepSecs)
+	}
+	if err := checkRange(q.StartSecs, q.EndSecs, q.StepSecs); err != nil {
+		return err
+	}
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	var matchers []string
+	if len(q.Instance) != 0 {
+		matchers = append(matchers, fmt.Sprintf("instance=%q", store.NormalizeInstance(q.Instance)))
+	}
+	if len(q.SQLDigest) != 0 {
+		matchers = append(matchers, fmt.Sprintf("sql_digest=%q", q.SQLDigest))
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "/api/v1/query_range", nil)
+	if err != nil {
+		return err
+	}
+	reqQuery := req.URL.Query()
+	reqQuery.Set("query", fmt.Sprintf(
+		"sum by (instance, sql_digest, plan_digest) (sum_over_time(%s{%s}[%ds]))",
+		store.MetricName(store.MetricCPUTime), strings.Join(matchers, ","), q.StepSecs,
+	))
+	reqQuery.Set("start", strconv.FormatInt(q.StartSecs, 10))
+	reqQuery.Set("end", strconv.FormatInt(q.EndSecs, 10))
+	reqQuery.Set("step", strconv.FormatInt(q.StepSecs, 10))
+	req.URL.RawQuery = reqQuery.Encode()
+	req.Header.Set("Accept", "application/json")
+
+	// The handler writes into the pipe as the decoder reads from it. Closing
+	// the reader fails the writes left, in case fn stops early.
+	pr, pw := io.Pipe()
+	w := &pipeResponseWriter{header: make(http.Header), w: pw}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		pw.CloseWithError(serveQuery(ctx, req, w))
+	}()
+	defer func() {
+		cancel()
+		_ = pr.Close()
+		<-served
+	}()
+
+	return decodeMatrixStream(pr, func(r *metricRespDataResult) error {
+		m := Metric{
+			Instance:   r.Metric.Instance,
+			SQLDigest:  r.Metric.SQLDigest,
+			PlanDigest: r.Metric.PlanDigest,
+		}
+		appendPoints(&m, r.Values)
+		return fn(m)
+	})
+}
+
+// decodeMatrixStream calls fn with each series of a range query response read
+// from r, returning the first error of fn as is.
+func decodeMatrixStream(r io.Reader, fn func(r *metricRespDataResult) error) error {
+	dec := json.NewDecoder(r)
+	var status, errMsg string
+	var sinkErr error
+	err := decodeObject(dec, func(key string) error {
+		switch key {
+		case "status":
+			return dec.Decode(&status)
+		case "error":
+			return dec.Decode(&errMsg)
+		case "data":
+			return decodeObject(dec, func(key string) error {
+				if key != "result" {
+					return skipValue(dec)
+				}
+				if err := expectDelim(dec, '['); err != nil {
+					return err
+				}
+				for dec.More() {
+					var result metricRespDataResult
+					if err := dec.Decode(&result); err != nil {
+						return err
+					}
+					if err := fn(&result); err != nil {
+						sinkErr = err
+						return err
+					}
+				}
+				_, err := dec.Token()
+				return err
+			})
+		default:
+			return skipValue(dec)
+		}
+	})
+	if sinkErr != nil {
+		return sinkErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode the response of the timeseries db: %w", err)
+	}
+	if status != "success" {
+		return fmt.Errorf("failed to query timeseries db, status: %q, error: %s", status, errMsg)
+	}
+	return nil
+}
+
+// decodeObject calls fn with each key of the object next in dec, fn decoding
+// its value.
+func decodeObject(dec *json.Decoder, fn func(key string) error) error {
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, ok := t.(string)
+		if !ok {
+			return fmt.Errorf("unexpected token %v", t)
+		}
+		if err = fn(key); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expect %v, got %v", delim, t)
+	}
+	return nil
+}
+
+func skipValue(dec *json.Decoder) error {
+	var raw json.RawMessage
+	return dec.Decode(&raw)
+}
+
+// appendPoints appends the valid points of values to m.
+func appendPoints(m *Metric, values []metricRespDataResultValue) {
+	for _, value := range values {
+		if len(value) != 2 {
+			continue
+		}
+		ts, ok := value[0].(float64)
+		if !ok {
+			continue
+		}
+		raw, ok := value[1].(string)
+		if !ok {
+			continue
+		}
+		cpu, ok := parseSampleValue(raw)
+		if !ok {
+			continue
+		}
+		m.TimestampsMs = append(m.TimestampsMs, store.SecsToMillis(uint64(ts)))
+		m.CPUTimeMillis = append(m.CPUTimeMillis, cpu)
+	}
+}
+
+// pipeResponseWriter is a http.ResponseWriter writing the body into a pipe.
+// The status is told by the body.
+type pipeResponseWriter struct {
+	header http.Header
+	w      *io.PipeWriter
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) Write(b []byte) (int, error) {
+	return w.w.Write(b)
+}
+
+func (w *pipeResponseWriter) WriteHeader(int) {}
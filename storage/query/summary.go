@@ -0,0 +1,90 @@
+package query
+
+import (
+	"context"
+	"sort"
+
+	"github.com/zhongzc/diag_backend/utils"
+
+	"github.com/wangjohn/quickselect"
+)
+
+// Summary fills the top SQLs of instance like TopSQL does, ranked by cpu
+// time, followed by an item with IsOther set summing up the cpu time of the
+// remaining SQLs and of the others reported by TiDB, if any. The items follow
+// the Top SQL API of TiDB Dashboard.
+func Summary(ctx context.Context, startSecs, endSecs, windowSecs, top int, instance string, fill *[]SummaryItem) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	metricResponse := metricRespP.Get()
+	defer metricRespP.Put(metricResponse)
+	if err := fetchTimeseriesDB(ctx, startSecs, endSecs, windowSecs, instance, metricResponse); err != nil {
+		return err
+	}
+
+	sqlGroups := sqlGroupSliceP.Get()
+	defer sqlGroupSliceP.Put(sqlGroups)
+	groupBySQLDigest(metricResponse.Data.Results, sqlGroups)
+
+	others := splitOthers(sqlGroups)
+	if top > 0 && len(*sqlGroups) > top {
+		if err := quickselect.QuickSelect(TopKSlice{s: *sqlGroups}, top); err != nil {
+			return err
+		}
+		others = append(others, (*sqlGroups)[top:]...)
+		*sqlGroups = (*sqlGroups)[:top]
+	}
+	// Ranked as the pages are, so the responses are stable
+	sort.Sort(TopKSlice{s: *sqlGroups})
+
+	var items []TopSQLItem
+	if err := fillText(ctx, sqlGroups, 0, &items); err != nil {
+		return err
+	}
+	for _, item := range items {
+		summary := SummaryItem{SQLDigest: item.SQLDigest, SQLText: item.SQLText}
+		for _, plan := range item.Plans {
+			summary.Plans = append(summary.Plans, SummaryPlanItem{
+				PlanDigest:    plan.PlanDigest,
+				PlanText:      plan.PlanText,
+				TimestampSecs: plan.TimestampSecs,
+				CPUTimeMillis: plan.CPUTimeMillis,
+			})
+		}
+		*fill = append(*fill, summary)
+	}
+
+	if len(others) != 0 {
+		*fill = append(*fill, othersItem(others))
+	}
+	return nil
+}
+
+// othersItem merges the series of groups into a single one.
+func othersItem(groups []sqlGroup) SummaryItem {
+	cpuByTs := make(map[uint64]uint64)
+	for _, group := range groups {
+		for _, series := range group.planSeries {
+			for i, ts := range series.timestampSecs {
+				cpuByTs[ts] = utils.AddSaturating(cpuByTs[ts], series.cpuTimeMillis[i])
+			}
+		}
+	}
+
+	plan := SummaryPlanItem{
+		TimestampSecs: make([]uint64, 0, len(cpuByTs)),
+		CPUTimeMillis: make([]uint64, 0, len(cpuByTs)),
+	}
+	for ts := range cpuByTs {
+		plan.TimestampSecs = append(plan.TimestampSecs, ts)
+	}
+	sort.Slice(plan.TimestampSecs, func(i, j int) bool {
+		return plan.TimestampSecs[i] < plan.TimestampSecs[j]
+	})
+	for _, ts := range plan.TimestampSecs {
+		plan.CPUTimeMillis = append(plan.CPUTimeMillis, cpuByTs[ts])
+	}
+
+	return SummaryItem{IsOther: true, Plans: []SummaryPlanItem{plan}}
+}
@@ -1,33 +1,177 @@
 package storage
 
 import (
+	"crypto/tls"
 	"github.com/pingcap/log"
 	"go.uber.org/zap"
+	"io"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/zhongzc/diag_backend/storage/audit"
 	"github.com/zhongzc/diag_backend/storage/database"
 	"github.com/zhongzc/diag_backend/storage/database/document"
+	"github.com/zhongzc/diag_backend/storage/database/timeseries"
+	"github.com/zhongzc/diag_backend/storage/profile"
 	"github.com/zhongzc/diag_backend/storage/query"
 	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/storage/textcrypt"
 
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vminsert"
 	"github.com/VictoriaMetrics/VictoriaMetrics/app/vmselect"
+	"github.com/spf13/pflag"
+)
+
+var (
+	fileSinkDir       = pflag.String("storage.file-sink.dir", "", "Write metrics to rotated files in this directory instead of the timeseries database")
+	fileSinkMaxSize   = pflag.Int64("storage.file-sink.max-file-size", 64*1024*1024, "Size in bytes at which a metric file is rotated")
+	fileSinkRetention = pflag.Int64("storage.file-sink.retention-bytes", 1024*1024*1024, "Total size in bytes of rotated metric files to keep, 0 means unlimited")
+	fileSinkGzip      = pflag.Bool("storage.file-sink.gzip", false, "Compress metric files with gzip")
+	fileSinkLabels    = pflag.String("storage.file-sink.label-policy", "none", "Sanitization of the labels written to metric files, one of none, prometheus and ascii")
+
+	writerSinkPath = pflag.String("storage.writer-sink.path", "", "Append metrics as NDJSON to this file instead of the timeseries database, - for stdout. For debugging")
+
+	otlpEndpoint = pflag.String("storage.otlp.endpoint", "", "Export metrics to this OTLP/gRPC receiver instead of the timeseries database, e.g. 127.0.0.1:4317")
+	otlpInsecure = pflag.Bool("storage.otlp.insecure", false, "Connect to the OTLP receiver without TLS")
+	otlpHeaders  = pflag.StringArray("storage.otlp.header", nil, "Header sent with every OTLP export in the form key=value, can be repeated")
+	otlpInterval = pflag.Duration("storage.otlp.interval", 10*time.Second, "Interval between OTLP exports")
+	otlpLabels   = pflag.String("storage.otlp.label-policy", "prometheus", "Sanitization of the labels exported via OTLP, one of none, prometheus and ascii")
+
+	writeChecksum    = pflag.Bool("storage.write-checksum", false, "Send the CRC32C of each import payload in the X-Payload-Checksum header")
+	writeVerifyRate  = pflag.Float64("storage.write-verify-rate", 0, "Fraction of imports whose metrics are sampled and read back from the timeseries database to detect corruption, 0 disables it")
+	writeVerifyDelay = pflag.Duration("storage.write-verify-delay", 0, "Delay of the read back of --storage.write-verify-rate, long enough for the timeseries database to make fresh samples searchable so a missing series is logged as lost, e.g. 30s. 0 reads back within the import and only counts the missing series")
+	maxImportBody    = pflag.Int("storage.max-import-body-size", 0, "Max size in bytes of an import body sent to the timeseries database, a larger batch is split into several imports. 0 means unlimited")
+	importLabels     = pflag.String("storage.import-label-policy", "none", "Sanitization of the labels imported to the timeseries database, one of none, prometheus and ascii")
+	importByInstance = pflag.Bool("storage.import-sort-by-instance", false, "Order the metrics of each import by instance, then by series, so the series of an instance are contiguous")
 )
 
 func Init(logPath string, logLevel, dataPath string) {
 	database.Init(logPath, logLevel, dataPath)
 
-	store.Init(func(writer http.ResponseWriter, request *http.Request) {
+	insertHandler := func(writer http.ResponseWriter, request *http.Request) {
 		vminsert.RequestHandler(writer, request)
-	}, document.Get())
-	query.Init(func(writer http.ResponseWriter, request *http.Request) {
+	}
+	selectHandler := func(writer http.ResponseWriter, request *http.Request) {
 		vmselect.RequestHandler(writer, request)
-	}, document.Get())
+	}
+	// The deletes go where the metrics are written, not to a read replica
+	deleteHandler := selectHandler
+	if remoteHandler := timeseries.RemoteHandler(); remoteHandler != nil {
+		insertHandler = remoteHandler
+		selectHandler = timeseries.RemoteReadHandler()
+		deleteHandler = remoteHandler
+	}
+
+	if err := textcrypt.InitFromFlags(); err != nil {
+		log.Fatal("failed to load the text keyring", zap.Error(err))
+	}
+	audit.Init(document.Get())
+	store.Init(metricWriter(insertHandler, selectHandler), document.Get(), nil)
+	if writesTimeseriesDB() {
+		store.SetDeleteHandler(deleteHandler)
+	}
+	query.Init(selectHandler, document.Get())
+	profile.Init(document.Get())
 
 	log.Info("initialize storage successfully", zap.String("path", dataPath))
 }
 
 func Stop() {
+	profile.Stop()
+	store.Stop()
+	audit.Stop()
 	database.Stop()
 	log.Info("initialize storage successfully")
 }
+
+// writesTimeseriesDB tells whether the metrics are written to the timeseries
+// database rather than a sink.
+func writesTimeseriesDB() bool {
+	return len(*otlpEndpoint) == 0 && len(*writerSinkPath) == 0 && len(*fileSinkDir) == 0
+}
+
+func metricWriter(insertHandler, selectHandler http.HandlerFunc) store.MetricWriter {
+	if len(*otlpEndpoint) != 0 {
+		return otlpSink()
+	}
+	if len(*writerSinkPath) != 0 {
+		return writerSink()
+	}
+	if len(*fileSinkDir) == 0 {
+		return store.NewHandlerWriterWithConfig(insertHandler, store.HandlerWriterConfig{
+			Checksum:       *writeChecksum,
+			VerifyRate:     *writeVerifyRate,
+			ReadHandler:    selectHandler,
+			VerifyDelay:    *writeVerifyDelay,
+			MaxBodySize:    *maxImportBody,
+			LabelPolicy:    labelPolicy("storage.import-label-policy", *importLabels),
+			SortByInstance: *importByInstance,
+		})
+	}
+
+	sink, err := store.NewFileSink(store.FileSinkConfig{
+		Dir:            *fileSinkDir,
+		MaxFileSize:    *fileSinkMaxSize,
+		RetentionBytes: *fileSinkRetention,
+		Compress:       *fileSinkGzip,
+		LabelPolicy:    labelPolicy("storage.file-sink.label-policy", *fileSinkLabels),
+	})
+	if err != nil {
+		log.Fatal("failed to init the file sink", zap.String("dir", *fileSinkDir), zap.Error(err))
+	}
+	log.Info("writing metrics to files", zap.String("dir", *fileSinkDir))
+	return sink
+}
+
+func writerSink() store.MetricWriter {
+	if *writerSinkPath == "-" {
+		log.Info("writing metrics to stdout")
+		// Not closed with the sink
+		return store.NewWriterSink(struct{ io.Writer }{os.Stdout})
+	}
+
+	file, err := os.OpenFile(*writerSinkPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Fatal("failed to open the writer sink", zap.String("path", *writerSinkPath), zap.Error(err))
+	}
+	log.Info("writing metrics to a file", zap.String("path", *writerSinkPath))
+	return store.NewWriterSink(file)
+}
+
+func otlpSink() store.MetricWriter {
+	headers := make(map[string]string)
+	for _, header := range *otlpHeaders {
+		kv := strings.SplitN(header, "=", 2)
+		if len(kv) != 2 {
+			log.Fatal("invalid otlp header, expect key=value", zap.String("header", header))
+		}
+		headers[kv[0]] = kv[1]
+	}
+
+	cfg := store.OTLPSinkConfig{
+		Endpoint:       *otlpEndpoint,
+		Headers:        headers,
+		ExportInterval: *otlpInterval,
+		LabelPolicy:    labelPolicy("storage.otlp.label-policy", *otlpLabels),
+	}
+	if !*otlpInsecure {
+		cfg.TLS = &tls.Config{}
+	}
+
+	sink, err := store.NewOTLPSink(cfg)
+	if err != nil {
+		log.Fatal("failed to init the otlp sink", zap.String("endpoint", *otlpEndpoint), zap.Error(err))
+	}
+	log.Info("exporting metrics via otlp", zap.String("endpoint", *otlpEndpoint))
+	return sink
+}
+
+func labelPolicy(flag, value string) store.LabelPolicy {
+	policy, err := store.ParseLabelPolicy(value)
+	if err != nil {
+		log.Fatal("invalid label policy", zap.String("flag", flag), zap.Error(err))
+	}
+	return policy
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// Durability is how the metrics of a resolved Ack are kept.
+type Durability string
+
+const (
+	// DurabilityWritten tells the metrics are written to the timeseries db or
+	// the sink.
+	DurabilityWritten Durability = "written"
+	// DurabilityLogged tells the metrics are appended to the wal, written from
+	// it at least once, a crash included.
+	DurabilityLogged Durability = "logged"
+)
+
+// Ack is the acknowledgement of a write, resolved once all its metrics are
+// durable or one of them failed for good. Without --store.async-buffer-size
+// it is resolved when returned, the metrics being written or appended to the
+// wal within the call. With it, the metrics are queued and lost on crash or
+// overflow until it resolves.
+//
+// The receiver maps a failure of a write or of its Ack to a gRPC code as
+// follows, IsRetryable telling the first ones apart:
+//
+//   - ErrRateLimited: ResourceExhausted, retried after a backoff;
+//   - ErrBackendUnavailable and ErrClosed: Unavailable, retried;
+//   - the ctx of Wait done: DeadlineExceeded, retried, since the outcome is
+//     unknown and the retry is deduplicated by the Source;
+//   - others, e.g. ErrInvalidMetric or an invalid tenant: InvalidArgument,
+//     not retried since they fail again.
+type Ack struct {
+	durability Durability
+
+	mu sync.Mutex
+	// pending is the number of metrics not written yet, and one for the write
+	// call until it returns.
+	pending   int
+	err       error
+	done      chan struct{}
+	callbacks []func(err error)
+}
+
+func newAck() *Ack {
+	a := &Ack{durability: DurabilityWritten, pending: 1, done: make(chan struct{})}
+	if walWriter != nil {
+		a.durability = DurabilityLogged
+	}
+	return a
+}
+
+// Durability returns how the metrics are kept once a resolves without error.
+func (a *Ack) Durability() Durability {
+	return a.durability
+}
+
+// Done is closed once a is resolved.
+func (a *Ack) Done() <-chan struct{} {
+	return a.done
+}
+
+// Err returns the first failure of the metrics of a, nil until resolved.
+func (a *Ack) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	select {
+	case <-a.done:
+		return a.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits until a is resolved, returning Err, or ctx is done, returning
+// its error while the metrics may still be written.
+func (a *Ack) Wait(ctx context.Context) error {
+	select {
+	case <-a.done:
+		return a.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// OnDone calls fn with Err once a is resolved, at once if it is already. fn
+// runs on the goroutine resolving a and must not block.
+func (a *Ack) OnDone(fn func(err error)) {
+	a.mu.Lock()
+	select {
+	case <-a.done:
+		err := a.err
+		a.mu.Unlock()
+		fn(err)
+	default:
+		a.callbacks = append(a.callbacks, fn)
+		a.mu.Unlock()
+	}
+}
+
+func (a *Ack) add(n int) {
+	a.mu.Lock()
+	a.pending += n
+	a.mu.Unlock()
+}
+
+// complete resolves n of the pending of a, failed with err unless nil.
+func (a *Ack) complete(n int, err error) {
+	a.mu.Lock()
+	if err != nil && a.err == nil {
+		a.err = err
+	}
+	a.pending -= n
+	if a.pending > 0 {
+		a.mu.Unlock()
+		return
+	}
+	close(a.done)
+	callbacks := a.callbacks
+	a.callbacks = nil
+	err = a.err
+	a.mu.Unlock()
+
+	for _, fn := range callbacks {
+		fn(err)
+	}
+}
+
+// IsRetryable tells whether a write failed with err may succeed if retried,
+// per the mapping documented on Ack.
+func IsRetryable(err error) bool {
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrBackendUnavailable) || errors.Is(err, ErrClosed) ||
+		errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// TopSQLRecordsAcked stores records like TopSQLRecordsFrom, returning once they
+// are taken and an Ack resolved once their metrics are durable. A failed call
+// returns the Ack resolved with its error too. A batch written already is
+// acknowledged at once.
+func TopSQLRecordsAcked(ctx context.Context, src Source, records []*tipb.CPUTimeRecord) (*Ack, error) {
+	src.ack = newAck()
+	err := TopSQLRecordsFrom(ctx, src, records)
+	src.ack.complete(1, err)
+	return src.ack, err
+}
+
+// ResourceMeteringRecordsAcked stores records like ResourceMeteringRecordsFrom,
+// acknowledged like TopSQLRecordsAcked.
+func ResourceMeteringRecordsAcked(ctx context.Context, src Source, records []*rsmetering.CPUTimeRecord) (*Ack, error) {
+	src.ack = newAck()
+	err := ResourceMeteringRecordsFrom(ctx, src, records)
+	src.ack.complete(1, err)
+	return src.ack, err
+}
+
+// ackWriter is a MetricWriter resolving the acks of the metrics once written,
+// acks being parallel to metrics. The ones of metrics it fails to take are
+// left to the caller along with the error.
+type ackWriter interface {
+	writeMetricsAcked(requestID string, metrics []Metric, acks []*Ack) error
+}
+
+// acksOf returns the acks of n metrics of one write acknowledged by a, nil if nil.
+func acksOf(a *Ack, n int) []*Ack {
+	if a == nil || n == 0 {
+		return nil
+	}
+	acks := make([]*Ack, n)
+	for i := range acks {
+		acks[i] = a
+	}
+	return acks
+}
+
+// completeAcks resolves a metric of each of acks, failed with err unless nil.
+func completeAcks(acks []*Ack, err error) {
+	for _, a := range acks {
+		if a != nil {
+			a.complete(1, err)
+		}
+	}
+}
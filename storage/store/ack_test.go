@@ -0,0 +1,42 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+func TestAckFailsRejectedMetrics(t *testing.T) {
+	for _, bufferSize := range []string{"0", "16"} {
+		t.Run("async-buffer-size="+bufferSize, func(t *testing.T) {
+			if err := pflag.Set("store.async-buffer-size", bufferSize); err != nil {
+				t.Fatal(err)
+			}
+			defer pflag.Set("store.async-buffer-size", "0")
+			db, err := genji.Open(":memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			store.Init(store.NewHandlerWriter(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "cannot parse json line", http.StatusBadRequest)
+			}), db, nil)
+			defer store.Stop()
+
+			ack, _ := store.TopSQLRecordsAcked(context.Background(), store.Source{}, []*tipb.CPUTimeRecord{cpuTimeRecord(1632700800, 35)})
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := ack.Wait(ctx); !errors.Is(err, store.ErrInvalidMetric) {
+				t.Fatalf("got error %v, want %v", err, store.ErrInvalidMetric)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	adaptiveBatchMin    = pflag.Int("store.batch-min-size", 64, "Minimum number of metrics per import when adaptive batching is enabled")
+	adaptiveBatchMax    = pflag.Int("store.batch-max-size", 0, "Maximum number of metrics per import, adapted to the import latency in between. 0 disables adaptive batching")
+	adaptiveBatchTarget = pflag.Duration("store.batch-target-latency", 200*time.Millisecond, "Import latency above which the batch size shrinks and below half of which it grows")
+)
+
+type AdaptiveBatchConfig struct {
+	MinSize int
+	MaxSize int
+	// TargetLatency is the import latency to stay under.
+	TargetLatency time.Duration
+}
+
+var _ MetricWriter = &AdaptiveBatcher{}
+
+// AdaptiveBatcher splits writes into imports of a size adapted to the observed
+// latency: the size grows additively while imports take less than half of the
+// target latency and is halved once an import exceeds it.
+type AdaptiveBatcher struct {
+	inner MetricWriter
+	cfg   AdaptiveBatchConfig
+
+	mu   sync.Mutex
+	size int
+}
+
+func NewAdaptiveBatcher(inner MetricWriter, cfg AdaptiveBatchConfig) *AdaptiveBatcher {
+	cfg = cfg.normalize()
+	return &AdaptiveBatcher{inner: inner, cfg: cfg, size: cfg.MinSize}
+}
+
+func (cfg AdaptiveBatchConfig) normalize() AdaptiveBatchConfig {
+	if cfg.MinSize <= 0 {
+		cfg.MinSize = 1
+	}
+	if cfg.MaxSize < cfg.MinSize {
+		cfg.MaxSize = cfg.MinSize
+	}
+	return cfg
+}
+
+// SetConfig changes the bounds and the target latency, clamping the current size into the bounds.
+func (b *AdaptiveBatcher) SetConfig(cfg AdaptiveBatchConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cfg = cfg.normalize()
+	if b.size < b.cfg.MinSize {
+		b.size = b.cfg.MinSize
+	}
+	if b.size > b.cfg.MaxSize {
+		b.size = b.cfg.MaxSize
+	}
+}
+
+func (b *AdaptiveBatcher) WriteMetrics(metrics []Metric) error {
+	return b.writeMetricsOf("", metrics)
+}
+
+func (b *AdaptiveBatcher) writeMetricsOf(requestID string, metrics []Metric) error {
+	for len(metrics) != 0 {
+		n := b.Size()
+		if n > len(metrics) {
+			n = len(metrics)
+		}
+
+		start := clock.Now()
+		err := writeMetricsOf(b.inner, requestID, metrics[:n])
+		b.observe(n, clock.Now().Sub(start), err)
+		if err != nil {
+			return err
+		}
+		metrics = metrics[n:]
+	}
+	return nil
+}
+
+// Size returns the current number of metrics per import.
+func (b *AdaptiveBatcher) Size() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.size
+}
+
+func (b *AdaptiveBatcher) observe(n int, latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case err != nil || latency > b.cfg.TargetLatency:
+		b.size /= 2
+	case latency < b.cfg.TargetLatency/2 && n == b.size:
+		// Only full batches tell that a larger one would be fast enough
+		b.size += b.cfg.MinSize
+	}
+
+	if b.size < b.cfg.MinSize {
+		b.size = b.cfg.MinSize
+	}
+	if b.size > b.cfg.MaxSize {
+		b.size = b.cfg.MaxSize
+	}
+}
+
+func (b *AdaptiveBatcher) Close() error {
+	if closer, ok := b.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/genjidb/genji/document"
+	errs "github.com/genjidb/genji/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// Capabilities are the kinds of data an agent is able to report.
+type Capabilities uint32
+
+const (
+	// CapabilitySQLMetas tells the agent reports the SQL metas of the digests
+	// of its records.
+	CapabilitySQLMetas Capabilities = 1 << iota
+	// CapabilityPlanDigests tells the agent labels its records by plan digest.
+	CapabilityPlanDigests
+	// CapabilityReadWriteKeys tells the agent reports the keys read and written.
+	CapabilityReadWriteKeys
+)
+
+var capabilityNames = []struct {
+	capability Capabilities
+	name       string
+}{
+	{CapabilitySQLMetas, "sql_metas"},
+	{CapabilityPlanDigests, "plan_digests"},
+	{CapabilityReadWriteKeys, "read_write_keys"},
+}
+
+// ParseCapabilities parses the capability names the receiver got from an agent.
+func ParseCapabilities(names []string) (Capabilities, error) {
+	var c Capabilities
+	for _, name := range names {
+		found := false
+		for _, n := range capabilityNames {
+			if n.name == name {
+				c |= n.capability
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown capability %q", name)
+		}
+	}
+	return c, nil
+}
+
+// Names returns the names of c, as ParseCapabilities takes them.
+func (c Capabilities) Names() []string {
+	var names []string
+	for _, n := range capabilityNames {
+		if c&n.capability != 0 {
+			names = append(names, n.name)
+		}
+	}
+	return names
+}
+
+func (c Capabilities) String() string {
+	return strings.Join(c.Names(), ",")
+}
+
+// lacks reports whether the agent of src is known unable to report c. The
+// capabilities of an agent reporting no version are unknown, assumed all.
+func (src Source) lacks(c Capabilities) bool {
+	return len(src.AgentVersion) != 0 && src.Capabilities&c == 0
+}
+
+type agentInfo struct {
+	version      string
+	capabilities Capabilities
+}
+
+var agents = struct {
+	sync.Mutex
+	written map[string]agentInfo // instance -> the agent columns written
+}{written: make(map[string]agentInfo)}
+
+// setAgents sets the agent_version and the capabilities of the instances to
+// those of the agent of src unless written already. A version change is logged
+// once. The returned func records the writes as done, to call once db
+// committed.
+func setAgents(db execer, keys []instanceKey, src Source) (func(), error) {
+	info := agentInfo{version: src.AgentVersion, capabilities: src.Capabilities}
+	var changed []string
+	agents.Lock()
+	for _, key := range keys {
+		if written, ok := agents.written[key.instance]; !ok || written != info {
+			changed = append(changed, key.instance)
+		}
+	}
+	agents.Unlock()
+	if len(changed) == 0 {
+		return func() {}, nil
+	}
+
+	err := update(db, func(tx execer) error {
+		for _, instance := range changed {
+			old, recorded, err := storedAgent(tx, instance)
+			if err != nil {
+				return err
+			}
+			if recorded && old == info {
+				continue
+			}
+			if len(old.version) != 0 && old.version != info.version {
+				log.Info("the agent version of the instance changed",
+					zap.String("instance", instance),
+					zap.String("from", old.version),
+					zap.String("to", info.version))
+			}
+			err = tx.Exec("UPDATE instance SET agent_version = ?, capabilities = ? WHERE instance = ?",
+				info.version, int64(info.capabilities), instance)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		agents.Lock()
+		for _, instance := range changed {
+			agents.written[instance] = info
+		}
+		agents.Unlock()
+	}, nil
+}
+
+// storedAgent returns the agent columns of the row of instance and whether
+// they are recorded, missing in rows written before they were.
+func storedAgent(tx execer, instance string) (agentInfo, bool, error) {
+	d, err := tx.QueryDocument("SELECT agent_version, capabilities FROM instance WHERE instance = ?", instance)
+	if errors.Is(err, errs.ErrDocumentNotFound) {
+		return agentInfo{}, false, nil
+	}
+	if err != nil {
+		return agentInfo{}, false, err
+	}
+	var version *string
+	var capabilities *int64
+	if err = document.Scan(d, &version, &capabilities); err != nil {
+		return agentInfo{}, false, err
+	}
+	if version == nil {
+		return agentInfo{}, false, nil
+	}
+	info := agentInfo{version: *version}
+	if capabilities != nil {
+		info.capabilities = Capabilities(*capabilities)
+	}
+	return info, true, nil
+}
+
+// AgentStats are the agent last reporting an instance.
+type AgentStats struct {
+	Version      string   `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// Agents returns the agents of a known version written for the instances
+// since started.
+func Agents() map[string]AgentStats {
+	agents.Lock()
+	defer agents.Unlock()
+
+	var res map[string]AgentStats
+	for instance, info := range agents.written {
+		if len(info.version) == 0 {
+			continue
+		}
+		if res == nil {
+			res = make(map[string]AgentStats)
+		}
+		res[instance] = AgentStats{Version: info.version, Capabilities: info.capabilities.Names()}
+	}
+	return res
+}
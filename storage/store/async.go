@@ -0,0 +1,293 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	asyncBufferSize    = pflag.Int("store.async-buffer-size", 0, "Max number of metrics queued for writing in the background. 0 writes synchronously")
+	asyncBatchSize     = pflag.Int("store.async-batch-size", 512, "Max number of queued metrics per write")
+	asyncFlushInterval = pflag.Duration("store.async-flush-interval", time.Second, "Max time a metric stays queued before being written")
+	asyncWorkers       = pflag.Int("store.async-workers", 1, "Number of goroutines writing the queued metrics concurrently, fixed however many metrics are queued")
+)
+
+var (
+	queueWaitHistogram   = metrics.NewHistogram(`diag_store_queue_wait_seconds`)
+	queueDroppedCounter  = metrics.NewCounter(`diag_store_queue_metrics_dropped_total{reason="overflow"}`)
+	queueFailedCounter   = metrics.NewCounter(`diag_store_queue_metrics_dropped_total{reason="failure"}`)
+	queueWrittenCounter  = metrics.NewCounter(`diag_store_queue_metrics_written_total`)
+	errAsyncWriterClosed = fmt.Errorf("%w: async writer is closed", ErrClosed)
+	errQueueFull         = fmt.Errorf("%w: async queue is full", ErrRateLimited)
+	_                    = metrics.NewGauge(`diag_store_async_active_workers`, func() float64 {
+		if asyncWriter == nil {
+			return 0
+		}
+		return float64(asyncWriter.Stats().ActiveWorkers)
+	})
+)
+
+type AsyncWriterConfig struct {
+	// BatchSize is the max number of metrics per write of the inner writer.
+	BatchSize int
+	// BufferSize is the max number of queued metrics. New metrics are dropped when full.
+	BufferSize int
+	// FlushInterval is the max time a metric stays queued before being written.
+	FlushInterval time.Duration
+	// Workers is the number of goroutines writing batches concurrently, 1 if
+	// not positive. A batch waits in the queue while all of them are busy.
+	Workers int
+}
+
+type queuedMetric struct {
+	metric     Metric
+	enqueuedAt time.Time
+	// ack is resolved once the metric is written or dropped, nil if not
+	// waited for.
+	ack *Ack
+}
+
+var (
+	_ MetricWriter = &AsyncWriter{}
+	_ ackWriter    = &AsyncWriter{}
+)
+
+// AsyncWriter queues metrics and writes them to inner from a fixed pool of
+// background goroutines, recording how long each metric waited in the queue
+// until the write including it. Queued metrics are lost on crash.
+type AsyncWriter struct {
+	inner MetricWriter
+	cfg   AsyncWriterConfig
+
+	pending chan queuedMetric
+	// batches hands the batches cut from pending to the workers.
+	batches chan []queuedMetric
+	active  int32
+	// oldest are when the oldest metric of each batch not written yet was
+	// queued, the one cut and the ones written.
+	oldestMu sync.Mutex
+	oldest   []time.Time
+
+	closeMu sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func NewAsyncWriter(inner MetricWriter, cfg AsyncWriterConfig) *AsyncWriter {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 64 * 1024
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 1
+	}
+
+	w := &AsyncWriter{
+		inner:   inner,
+		cfg:     cfg,
+		pending: make(chan queuedMetric, cfg.BufferSize),
+		batches: make(chan []queuedMetric),
+	}
+	w.wg.Add(1 + cfg.Workers)
+	go w.run()
+	for i := 0; i < cfg.Workers; i++ {
+		go w.work()
+	}
+	return w
+}
+
+// WriteMetrics enqueues metrics without waiting for them to be written. The
+// metrics, their labels included, are copied since the callers reuse their
+// buffers.
+func (w *AsyncWriter) WriteMetrics(metrics []Metric) error {
+	return w.writeMetricsAcked("", metrics, nil)
+}
+
+// writeMetricsAcked enqueues metrics like WriteMetrics, resolving the acks
+// once written, or at once with errQueueFull for the ones dropped.
+func (w *AsyncWriter) writeMetricsAcked(_ string, metrics []Metric, acks []*Ack) error {
+	w.closeMu.RLock()
+	defer w.closeMu.RUnlock()
+
+	if w.closed {
+		return errAsyncWriterClosed
+	}
+
+	now := clock.Now()
+	for i, m := range metrics {
+		m.Timestamps = append([]uint64(nil), m.Timestamps...)
+		m.Values = append([]uint64(nil), m.Values...)
+		m.Metric.Labels = copyLabels(m.Metric.Labels)
+		q := queuedMetric{metric: m, enqueuedAt: now}
+		if len(acks) != 0 {
+			q.ack = acks[i]
+		}
+
+		select {
+		case w.pending <- q:
+		default:
+			queueDroppedCounter.Inc()
+			if q.ack != nil {
+				q.ack.complete(1, errQueueFull)
+			}
+		}
+	}
+	return nil
+}
+
+// copyLabels returns a copy of labels, nil if nil.
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	res := make(map[string]string, len(labels))
+	for key, value := range labels {
+		res[key] = value
+	}
+	return res
+}
+
+// Close stops accepting metrics and waits until the queued ones are written.
+func (w *AsyncWriter) Close() error {
+	w.closeMu.Lock()
+	if w.closed {
+		w.closeMu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.pending)
+	w.closeMu.Unlock()
+
+	w.wg.Wait()
+	if closer, ok := w.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// run cuts the queued metrics into batches for the workers, blocking while
+// they are all busy.
+func (w *AsyncWriter) run() {
+	defer w.wg.Done()
+	defer close(w.batches)
+
+	ticker := clock.NewTicker(w.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]queuedMetric, 0, w.cfg.BatchSize)
+	dispatch := func() {
+		if len(batch) != 0 {
+			w.batches <- batch
+			batch = make([]queuedMetric, 0, w.cfg.BatchSize)
+		}
+	}
+	for {
+		select {
+		case q, ok := <-w.pending:
+			if !ok {
+				dispatch()
+				return
+			}
+			if len(batch) == 0 {
+				w.addOldest(q.enqueuedAt)
+			}
+			batch = append(batch, q)
+			if len(batch) >= w.cfg.BatchSize {
+				dispatch()
+			}
+		case <-ticker.C():
+			dispatch()
+		}
+	}
+}
+
+func (w *AsyncWriter) work() {
+	defer w.wg.Done()
+
+	for batch := range w.batches {
+		atomic.AddInt32(&w.active, 1)
+		w.flush(batch)
+		atomic.AddInt32(&w.active, -1)
+	}
+}
+
+func (w *AsyncWriter) addOldest(t time.Time) {
+	w.oldestMu.Lock()
+	w.oldest = append(w.oldest, t)
+	w.oldestMu.Unlock()
+}
+
+func (w *AsyncWriter) removeOldest(t time.Time) {
+	w.oldestMu.Lock()
+	defer w.oldestMu.Unlock()
+
+	for i, o := range w.oldest {
+		if o.Equal(t) {
+			w.oldest = append(w.oldest[:i], w.oldest[i+1:]...)
+			return
+		}
+	}
+}
+
+// Stats returns the state of the queue. The age of the oldest metric only
+// counts the ones taken by the background goroutines, which are behind the
+// channel by one pending write at most.
+func (w *AsyncWriter) Stats() AsyncQueueStats {
+	var oldest time.Time
+	w.oldestMu.Lock()
+	for _, o := range w.oldest {
+		if oldest.IsZero() || o.Before(oldest) {
+			oldest = o
+		}
+	}
+	w.oldestMu.Unlock()
+
+	s := AsyncQueueStats{
+		Length:        len(w.pending),
+		Capacity:      cap(w.pending),
+		Workers:       w.cfg.Workers,
+		ActiveWorkers: int(atomic.LoadInt32(&w.active)),
+	}
+	if !oldest.IsZero() {
+		s.OldestAgeSecs = clock.Now().Sub(oldest).Seconds()
+	}
+	return s
+}
+
+func (w *AsyncWriter) flush(batch []queuedMetric) {
+	defer w.removeOldest(batch[0].enqueuedAt)
+
+	now := clock.Now()
+	ms := make([]Metric, 0, len(batch))
+	for _, q := range batch {
+		queueWaitHistogram.Update(now.Sub(q.enqueuedAt).Seconds())
+		ms = append(ms, q.metric)
+	}
+
+	err := w.inner.WriteMetrics(ms)
+	for _, q := range batch {
+		if q.ack != nil {
+			q.ack.complete(1, err)
+		}
+	}
+	if err != nil {
+		queueFailedCounter.Add(len(ms))
+		log.Warn("failed to write queued metrics", zap.Int("metrics", len(ms)), zap.Error(err))
+		return
+	}
+	queueWrittenCounter.Add(len(ms))
+	notifyFlush(ms)
+}
@@ -0,0 +1,46 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+)
+
+func TestAsyncWriterCopiesMetrics(t *testing.T) {
+	tsdb := testutil.NewMemTSDB()
+	w := store.NewAsyncWriter(tsdb, store.AsyncWriterConfig{
+		BatchSize:     16,
+		BufferSize:    16,
+		FlushInterval: time.Hour,
+	})
+
+	metrics := []store.Metric{{
+		Timestamps: []uint64{1000},
+		Values:     []uint64{7},
+	}}
+	metrics[0].Metric.Name = "cpu_time"
+	metrics[0].Metric.Instance = "a"
+	metrics[0].Metric.Labels = map[string]string{"zone": "z1"}
+	if err := w.WriteMetrics(metrics); err != nil {
+		t.Fatal(err)
+	}
+
+	// The caller reuses its buffers once the write returns.
+	metrics[0].Metric.Labels["zone"] = "z2"
+	metrics[0].Timestamps[0] = 2000
+	metrics[0].Values[0] = 9
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tsdb.AssertSamples(t, `cpu_time{instance="a",zone="z1"}`, testutil.Sample{TimestampMs: 1000, Value: 7})
+	series, err := tsdb.Series(`cpu_time{zone="z2"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 0 {
+		t.Fatalf("got series %v written with the labels changed after the write", series)
+	}
+}
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/pflag"
+)
+
+var (
+	maxInflightBytes  = pflag.Int("store.max-inflight-bytes", 0, "Max estimated encoded size of the metrics being written at once across all imports, the others waiting. 0 means unlimited")
+	inflightWaitLimit = pflag.Duration("store.inflight-wait-timeout", 30*time.Second, "Max time a write waits for --store.max-inflight-bytes before failing, within the deadline of its request. 0 means no limit")
+)
+
+var (
+	budgetWaitHistogram = metrics.NewHistogram(`diag_store_inflight_wait_seconds`)
+	budgetFailedCounter = metrics.NewCounter(`diag_store_inflight_wait_failures_total`)
+
+	// inflightBudget bounds writeTimeseriesDB, nil if unlimited.
+	inflightBudget *ByteBudget
+)
+
+// ByteBudget is a weighted semaphore of bytes granting the waiters in order,
+// so large acquisitions are not starved by small ones.
+type ByteBudget struct {
+	mu      sync.Mutex
+	size    int
+	used    int
+	waiters list.List // of *budgetWaiter
+}
+
+type budgetWaiter struct {
+	n     int
+	ready chan struct{}
+}
+
+func NewByteBudget(size int) *ByteBudget {
+	return &ByteBudget{size: size}
+}
+
+// Acquire waits until n bytes are available or ctx is done. An n over the size
+// takes the whole budget, so it still goes through once alone.
+func (b *ByteBudget) Acquire(ctx context.Context, n int) error {
+	n = b.clamp(n)
+
+	b.mu.Lock()
+	if b.size-b.used >= n && b.waiters.Len() == 0 {
+		b.used += n
+		b.mu.Unlock()
+		return nil
+	}
+	w := &budgetWaiter{n: n, ready: make(chan struct{})}
+	elem := b.waiters.PushBack(w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-w.ready:
+			// Granted meanwhile, give it back.
+			b.used -= n
+			b.grant()
+		default:
+			isFront := b.waiters.Front() == elem
+			b.waiters.Remove(elem)
+			// The ones behind may fit now.
+			if isFront {
+				b.grant()
+			}
+		}
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Release returns n bytes taken by Acquire.
+func (b *ByteBudget) Release(n int) {
+	n = b.clamp(n)
+
+	b.mu.Lock()
+	b.used -= n
+	if b.used < 0 {
+		b.mu.Unlock()
+		panic("byte budget released more than acquired")
+	}
+	b.grant()
+	b.mu.Unlock()
+}
+
+// InUse returns the bytes acquired and the number of waiters.
+func (b *ByteBudget) InUse() (int, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used, b.waiters.Len()
+}
+
+func (b *ByteBudget) clamp(n int) int {
+	if n > b.size {
+		return b.size
+	}
+	return n
+}
+
+// grant wakes the waiters in order as long as they fit. b.mu must be held.
+func (b *ByteBudget) grant() {
+	for elem := b.waiters.Front(); elem != nil; elem = b.waiters.Front() {
+		w := elem.Value.(*budgetWaiter)
+		if b.size-b.used < w.n {
+			return
+		}
+		b.used += w.n
+		b.waiters.Remove(elem)
+		close(w.ready)
+	}
+}
+
+// acquireInflight takes the estimated encoded size of metrics from the budget,
+// waiting until ctx is done at most, and returns the release, a no-op if
+// unlimited.
+func acquireInflight(ctx context.Context, metrics []Metric) (func(), error) {
+	if inflightBudget == nil {
+		return func() {}, nil
+	}
+	return acquireInflightBytes(ctx, EstimateEncodedSize(metrics))
+}
+
+// acquireInflightBytes is acquireInflight of n bytes.
+func acquireInflightBytes(ctx context.Context, n int) (func(), error) {
+	budget := inflightBudget
+	if budget == nil {
+		return func() {}, nil
+	}
+
+	if *inflightWaitLimit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *inflightWaitLimit)
+		defer cancel()
+	}
+
+	start := clock.Now()
+	if err := budget.Acquire(ctx, n); err != nil {
+		budgetFailedCounter.Inc()
+		return nil, fmt.Errorf("%w: waited %s for --store.max-inflight-bytes: %v", ErrRateLimited, clock.Now().Sub(start).Round(time.Millisecond), err)
+	}
+	budgetWaitHistogram.Update(clock.Now().Sub(start).Seconds())
+	return func() { budget.Release(n) }, nil
+}
@@ -0,0 +1,41 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireInflightBytesWaitsWithinContext(t *testing.T) {
+	inflightBudget = NewByteBudget(10)
+	defer func() { inflightBudget = nil }()
+
+	release, err := acquireInflightBytes(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	done := make(chan error, 1)
+	go func() {
+		_, err := acquireInflightBytes(ctx, 5)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("got error %v, want %v", err, ErrRateLimited)
+		}
+	case <-time.After(*inflightWaitLimit / 2):
+		t.Fatal("the wait for the budget outlives its context")
+	}
+	if _, waiters := inflightBudget.InUse(); waiters != 0 {
+		t.Fatalf("got %d waiters of the budget after the context is done", waiters)
+	}
+}
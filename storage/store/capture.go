@@ -0,0 +1,175 @@
+package store
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+var (
+	disablePlanMeta    = pflag.Bool("store.disable-plan-meta", false, "Drop plan metas and the plan_digest labels of series")
+	disableInternalSQL = pflag.Bool("store.disable-internal-sql", false, "Drop the metas of internal SQLs and the series of the digests known to be internal, along with the ones held by --store.unknown-digest-grace until their meta tells they are internal")
+)
+
+var (
+	droppedPlanMetaCounter       = metrics.NewCounter(`diag_store_capture_dropped_total{kind="plan_meta"}`)
+	strippedPlanLabelCounter     = metrics.NewCounter(`diag_store_capture_dropped_total{kind="plan_label"}`)
+	droppedInternalMetaCounter   = metrics.NewCounter(`diag_store_capture_dropped_total{kind="internal_sql_meta"}`)
+	droppedInternalSeriesCounter = metrics.NewCounter(`diag_store_capture_dropped_total{kind="internal_sql_series"}`)
+	internalDigests              = newDigestSet(seenCacheCapacity)
+)
+
+// CaptureStats tells what the capture switches dropped since start.
+type CaptureStats struct {
+	PlanMetaDisabled        bool   `json:"plan_meta_disabled"`
+	InternalSQLDisabled     bool   `json:"internal_sql_disabled"`
+	DroppedPlanMetas        uint64 `json:"dropped_plan_metas"`
+	StrippedPlanLabels      uint64 `json:"stripped_plan_labels"`
+	DroppedInternalSQLMetas uint64 `json:"dropped_internal_sql_metas"`
+	DroppedInternalSeries   uint64 `json:"dropped_internal_series"`
+	KnownInternalDigests    int    `json:"known_internal_digests"`
+}
+
+func Capture() CaptureStats {
+	cfg := CurrentConfig()
+	return CaptureStats{
+		PlanMetaDisabled:        cfg.DisablePlanMeta,
+		InternalSQLDisabled:     cfg.DisableInternalSQL,
+		DroppedPlanMetas:        droppedPlanMetaCounter.Get(),
+		StrippedPlanLabels:      strippedPlanLabelCounter.Get(),
+		DroppedInternalSQLMetas: droppedInternalMetaCounter.Get(),
+		DroppedInternalSeries:   droppedInternalSeriesCounter.Get(),
+		KnownInternalDigests:    internalDigests.size(),
+	}
+}
+
+// digestSet is a set of digests holding at most capacity ones, the later ones
+// being ignored.
+type digestSet struct {
+	mu       sync.RWMutex
+	digests  map[string]struct{}
+	capacity int
+}
+
+func newDigestSet(capacity int) *digestSet {
+	return &digestSet{digests: make(map[string]struct{}), capacity: capacity}
+}
+
+func (s *digestSet) add(digest string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.digests) < s.capacity {
+		s.digests[digest] = struct{}{}
+	}
+}
+
+func (s *digestSet) contains(digest string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.digests[digest]
+	return ok
+}
+
+func (s *digestSet) size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.digests)
+}
+
+// loadInternalDigests loads the digests of the internal SQLs stored, so their
+// series can be dropped once internal SQLs are disabled.
+func loadInternalDigests(db *genji.DB) error {
+	res, err := db.Query("SELECT digest FROM sql_digest WHERE is_internal = true")
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return res.Iterate(func(d types.Document) error {
+		var digest string
+		if err := document.Scan(d, &digest); err != nil {
+			return err
+		}
+		internalDigests.add(digest)
+		return nil
+	})
+}
+
+// capturedSQLMetas remembers the internal digests among metas of tenant and
+// drops them if internal SQLs are disabled.
+func capturedSQLMetas(tenant string, metas []*tipb.SQLMeta) []*tipb.SQLMeta {
+	var internal int
+	for _, meta := range metas {
+		if meta.IsInternalSql {
+			internalDigests.add(TenantKey(tenant, hex.EncodeToString(meta.SqlDigest)))
+			internal++
+		}
+	}
+	if internal == 0 || !CurrentConfig().DisableInternalSQL {
+		return metas
+	}
+
+	res := make([]*tipb.SQLMeta, 0, len(metas)-internal)
+	for _, meta := range metas {
+		if !meta.IsInternalSql {
+			res = append(res, meta)
+		}
+	}
+	droppedInternalMetaCounter.Add(internal)
+	return res
+}
+
+// capturedPlanMetas returns metas unless plan metas are disabled.
+func capturedPlanMetas(metas []*tipb.PlanMeta) []*tipb.PlanMeta {
+	if !CurrentConfig().DisablePlanMeta {
+		return metas
+	}
+	droppedPlanMetaCounter.Add(len(metas))
+	return nil
+}
+
+// dropInternalSeries drops the series of the digests known to be internal if internal SQLs are disabled.
+func dropInternalSeries(cfg Config, metrics *[]Metric) {
+	if !cfg.DisableInternalSQL || internalDigests.size() == 0 {
+		return
+	}
+
+	res := (*metrics)[:0]
+	for _, m := range *metrics {
+		if internalDigests.contains(seriesKeyOf(&m)) {
+			droppedInternalSeriesCounter.Inc()
+			continue
+		}
+		res = append(res, m)
+	}
+	*metrics = res
+}
+
+// stripPlanDigests removes the plan digests if plan metas are disabled. The
+// series of the plans of a SQL then add up into one.
+func stripPlanDigests(cfg Config, metrics *[]Metric) {
+	if !cfg.DisablePlanMeta {
+		return
+	}
+
+	var stripped bool
+	for i := range *metrics {
+		if m := &(*metrics)[i]; len(m.Metric.PlanDigest) != 0 {
+			m.Metric.PlanDigest = ""
+			strippedPlanLabelCounter.Inc()
+			stripped = true
+		}
+	}
+	if stripped {
+		mergeConflicts(metrics, ConflictSum)
+	}
+}
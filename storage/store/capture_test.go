@@ -0,0 +1,91 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+func TestDropInternalSQLBeforeItsMeta(t *testing.T) {
+	for name, value := range map[string]string{
+		"store.unknown-digest-grace": "1h",
+		"store.disable-internal-sql": "true",
+	} {
+		old := pflag.Lookup(name).Value.String()
+		if err := pflag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		defer pflag.Set(name, old)
+	}
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	audit.Init(s.DB)
+	defer audit.Stop()
+
+	// The digests are of this test only, the seen caches outliving the stores
+	// of the other ones
+	record := func(digest byte) *tipb.CPUTimeRecord {
+		return &tipb.CPUTimeRecord{
+			SqlDigest:              []byte{0xc1, digest},
+			Instance:               "tidb-0:10080",
+			Job:                    "tidb",
+			RecordListTimestampSec: []uint64{1632700800},
+			RecordListCpuTimeMs:    []uint32{35},
+		}
+	}
+	sample := testutil.Sample{TimestampMs: 1632700800000, Value: 35}
+	before := store.Capture()
+
+	// Held until the metas arrive, a mix of internal and user SQLs
+	if err := store.TopSQLRecords([]*tipb.CPUTimeRecord{record(0x01), record(0x02)}); err != nil {
+		t.Fatal(err)
+	}
+	s.TSDB.AssertSamples(t, `cpu_time{sql_digest="c101"}`)
+	s.TSDB.AssertSamples(t, `cpu_time{sql_digest="c102"}`)
+	err = store.SQLMetas([]*tipb.SQLMeta{
+		{SqlDigest: []byte{0xc1, 0x01}, NormalizedSql: "select * from t where id = ?"},
+		{SqlDigest: []byte{0xc1, 0x02}, NormalizedSql: "select * from mysql.tidb", IsInternalSql: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TSDB.AssertSamples(t, `cpu_time{sql_digest="c101"}`, sample)
+	s.TSDB.AssertSamples(t, `cpu_time{sql_digest="c102"}`)
+	if got := storedTexts(t, s.DB, "sql_digest", "sql_text"); len(got["c101"]) == 0 || len(got["c102"]) != 0 {
+		t.Fatalf("got sql texts %v, want the one of c101 only", got)
+	}
+	// Known internal from now on
+	if err := store.TopSQLRecords([]*tipb.CPUTimeRecord{record(0x02)}); err != nil {
+		t.Fatal(err)
+	}
+	s.TSDB.AssertSamples(t, `cpu_time{sql_digest="c102"}`)
+	if got := store.Capture().DroppedInternalSeries - before.DroppedInternalSeries; got != 2 {
+		t.Fatalf("got %d internal series dropped, want 2", got)
+	}
+
+	// Written once its meta arrives with the option off
+	cfg := store.CurrentConfig()
+	cfg.DisableInternalSQL = false
+	if err := store.Reconfigure(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.TopSQLRecords([]*tipb.CPUTimeRecord{record(0x03)}); err != nil {
+		t.Fatal(err)
+	}
+	s.TSDB.AssertSamples(t, `cpu_time{sql_digest="c103"}`)
+	err = store.SQLMetas([]*tipb.SQLMeta{
+		{SqlDigest: []byte{0xc1, 0x03}, NormalizedSql: "select * from mysql.stats_meta", IsInternalSql: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.TSDB.AssertSamples(t, `cpu_time{sql_digest="c103"}`, sample)
+}
@@ -0,0 +1,16 @@
+package store
+
+import "github.com/zhongzc/diag_backend/utils"
+
+// clock is the time source of the store and its background jobs, overridable
+// for deterministic tests.
+var clock = utils.RealClock
+
+// SetClock replaces the clock of the store, the real one if c is nil. It is a
+// test hook to call before Init, not safe concurrently with the writes.
+func SetClock(c utils.Clock) {
+	if c == nil {
+		c = utils.RealClock
+	}
+	clock = c
+}
@@ -0,0 +1,280 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// RecordFormat is the shape of the TopSQL records a TiDB version reports.
+type RecordFormat string
+
+const (
+	// RecordFormatLists zips the timestamp and the cpu time lists, fields 10
+	// and 11, next to the instance and the job, fields 3 and 4, as
+	// tipb.CPUTimeRecord.
+	RecordFormatLists RecordFormat = "lists"
+	// RecordFormatItems has a message per timestamp in field 3, the
+	// TopSQLRecord of TiDB 5.3 and later. The instance and the job are those
+	// of the connection, left to the receiver.
+	RecordFormatItems RecordFormat = "items"
+)
+
+var (
+	listsFormatCounter     = metrics.NewCounter(`diag_store_record_formats_total{format="lists"}`)
+	itemsFormatCounter     = metrics.NewCounter(`diag_store_record_formats_total{format="items"}`)
+	unknownFieldsCounter   = metrics.NewCounter(`diag_store_record_unknown_fields_total`)
+	mismatchedListsCounter = metrics.NewCounter(`diag_store_record_mismatched_lists_total`)
+)
+
+var errMalformedRecord = errors.New("malformed record")
+
+// DecodeTopSQLRecord decodes a TopSQL record of either format into the lists
+// of a tipb.CPUTimeRecord. Fields unknown to the format are skipped and counted.
+func DecodeTopSQLRecord(data []byte) (*tipb.CPUTimeRecord, RecordFormat, error) {
+	format, err := detectRecordFormat(data)
+	if err != nil {
+		return nil, "", err
+	}
+	r := &tipb.CPUTimeRecord{}
+	if format == RecordFormatItems {
+		err = decodeItemsRecord(data, r)
+	} else {
+		err = decodeListsRecord(data, r)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if format == RecordFormatItems {
+		itemsFormatCounter.Inc()
+	} else {
+		listsFormatCounter.Inc()
+	}
+	return r, format, nil
+}
+
+// detectRecordFormat tells the formats apart by field 3, the instance of the
+// lists and an item otherwise. A record having the lists, or a field 3 that
+// is no item, is of the lists.
+func detectRecordFormat(data []byte) (RecordFormat, error) {
+	hasItems, lists := false, false
+	err := eachField(data, func(num uint64, wireType int, _ uint64, value []byte) error {
+		switch {
+		case num == 10 || num == 11:
+			lists = true
+		case num == 3 && wireType == wireBytes && isRecordItem(value):
+			hasItems = true
+		case num == 3:
+			lists = true
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if hasItems && !lists {
+		return RecordFormatItems, nil
+	}
+	return RecordFormatLists, nil
+}
+
+// isRecordItem reports whether data is a TopSQLRecordItem, its known fields
+// of their wire types.
+func isRecordItem(data []byte) bool {
+	err := eachField(data, func(num uint64, wireType int, _ uint64, _ []byte) error {
+		switch {
+		case num == 4 && wireType != wireBytes, num <= 6 && num != 4 && wireType != wireVarint:
+			return errMalformedRecord
+		}
+		return nil
+	})
+	return err == nil
+}
+
+func decodeListsRecord(data []byte, r *tipb.CPUTimeRecord) error {
+	err := eachField(data, func(num uint64, wireType int, v uint64, value []byte) error {
+		switch {
+		case num == 1 && wireType == wireBytes:
+			r.SqlDigest = append([]byte(nil), value...)
+		case num == 2 && wireType == wireBytes:
+			r.PlanDigest = append([]byte(nil), value...)
+		case num == 3 && wireType == wireBytes:
+			r.Instance = string(value)
+		case num == 4 && wireType == wireBytes:
+			r.Job = string(value)
+		case num == 10:
+			return eachVarint(wireType, v, value, func(v uint64) {
+				r.RecordListTimestampSec = append(r.RecordListTimestampSec, v)
+			})
+		case num == 11:
+			return eachVarint(wireType, v, value, func(v uint64) {
+				r.RecordListCpuTimeMs = append(r.RecordListCpuTimeMs, uint32(v))
+			})
+		default:
+			unknownFieldsCounter.Inc()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	zipLists(&r.RecordListTimestampSec, &r.RecordListCpuTimeMs)
+	return nil
+}
+
+func decodeItemsRecord(data []byte, r *tipb.CPUTimeRecord) error {
+	return eachField(data, func(num uint64, wireType int, _ uint64, value []byte) error {
+		switch {
+		case num == 1 && wireType == wireBytes:
+			r.SqlDigest = append([]byte(nil), value...)
+		case num == 2 && wireType == wireBytes:
+			r.PlanDigest = append([]byte(nil), value...)
+		case num == 3 && wireType == wireBytes:
+			return decodeRecordItem(value, r)
+		default:
+			unknownFieldsCounter.Inc()
+		}
+		return nil
+	})
+}
+
+// decodeRecordItem appends the timestamp and the cpu time of a TopSQLRecordItem
+// to the lists of r. The statement counts and durations, fields 3 to 6, are
+// not stored.
+func decodeRecordItem(data []byte, r *tipb.CPUTimeRecord) error {
+	var ts, cpu uint64
+	err := eachField(data, func(num uint64, wireType int, v uint64, _ []byte) error {
+		switch {
+		case num == 1 && wireType == wireVarint:
+			ts = v
+		case num == 2 && wireType == wireVarint:
+			cpu = v
+		case num >= 3 && num <= 6:
+		default:
+			unknownFieldsCounter.Inc()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.RecordListTimestampSec = append(r.RecordListTimestampSec, ts)
+	r.RecordListCpuTimeMs = append(r.RecordListCpuTimeMs, uint32(cpu))
+	return nil
+}
+
+// countUnknownFields counts the fields of rsmetering records kept unrecognized
+// by the decoding.
+func countUnknownFields(records []*rsmetering.CPUTimeRecord) {
+	for _, r := range records {
+		if len(r.XXX_unrecognized) == 0 {
+			continue
+		}
+		_ = eachField(r.XXX_unrecognized, func(uint64, int, uint64, []byte) error {
+			unknownFieldsCounter.Inc()
+			return nil
+		})
+	}
+}
+
+// cpuTimeRecord is a record as the fill functions take it, the samples zipped
+// from lists of one length.
+type cpuTimeRecord struct {
+	instance, job string
+	timestamps    []uint64
+	cpuTimeMs     []uint32
+}
+
+func cpuTimeRecordOf(instance, job string, timestamps []uint64, cpuTimeMs []uint32) cpuTimeRecord {
+	zipLists(&timestamps, &cpuTimeMs)
+	return cpuTimeRecord{instance: instance, job: job, timestamps: timestamps, cpuTimeMs: cpuTimeMs}
+}
+
+// zipLists truncates the longer list to the shorter, counting the mismatch.
+func zipLists(timestamps *[]uint64, cpuTimeMs *[]uint32) {
+	if len(*timestamps) == len(*cpuTimeMs) {
+		return
+	}
+	mismatchedListsCounter.Inc()
+	if len(*timestamps) > len(*cpuTimeMs) {
+		*timestamps = (*timestamps)[:len(*cpuTimeMs)]
+	} else {
+		*cpuTimeMs = (*cpuTimeMs)[:len(*timestamps)]
+	}
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// eachField calls fn with the number, the wire type and the value of each
+// field of the message data, the varint v of varints and the bytes otherwise.
+func eachField(data []byte, fn func(num uint64, wireType int, v uint64, value []byte) error) error {
+	for len(data) != 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 || key>>3 == 0 {
+			return fmt.Errorf("%w: invalid field key", errMalformedRecord)
+		}
+		data = data[n:]
+		num, wireType := key>>3, int(key&7)
+
+		var v uint64
+		var value []byte
+		switch wireType {
+		case wireVarint:
+			if v, n = binary.Uvarint(data); n <= 0 {
+				return fmt.Errorf("%w: truncated varint of field %d", errMalformedRecord, num)
+			}
+		case wireFixed64, wireFixed32:
+			n = 8
+			if wireType == wireFixed32 {
+				n = 4
+			}
+			if len(data) < n {
+				return fmt.Errorf("%w: truncated field %d", errMalformedRecord, num)
+			}
+			value = data[:n]
+		case wireBytes:
+			l, m := binary.Uvarint(data)
+			if m <= 0 || uint64(len(data)-m) < l {
+				return fmt.Errorf("%w: truncated field %d", errMalformedRecord, num)
+			}
+			value = data[m : m+int(l)]
+			n = m + int(l)
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d of field %d", errMalformedRecord, wireType, num)
+		}
+		data = data[n:]
+		if err := fn(num, wireType, v, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// eachVarint calls fn with the values of a repeated varint field, packed or not.
+func eachVarint(wireType int, v uint64, value []byte, fn func(v uint64)) error {
+	switch wireType {
+	case wireVarint:
+		fn(v)
+	case wireBytes:
+		for len(value) != 0 {
+			v, n := binary.Uvarint(value)
+			if n <= 0 {
+				return fmt.Errorf("%w: truncated packed varint", errMalformedRecord)
+			}
+			fn(v)
+			value = value[n:]
+		}
+	default:
+		return fmt.Errorf("%w: unexpected wire type %d of a varint list", errMalformedRecord, wireType)
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+var (
+	configFile         = pflag.String("store.config-file", "", "File of flag=value lines, e.g. store.max-sql-length=4096, applied by Reconfigure whenever it changes")
+	configFileInterval = pflag.Duration("store.config-file-interval", 10*time.Second, "Interval between checks of --store.config-file for changes")
+)
+
+// Config holds the options of the store. The ones tagged immutable are fixed at Init.
+type Config struct {
+	MaxSQLLength          int
+	MaxPlanLength         int
+	TombstoneRetention    time.Duration
+	FilterTombstoneSeries bool
+	EmitHeartbeat         bool
+	HeartbeatSourceAddr   bool
+	EmitSampleCounts      bool
+	ValidateMetrics       bool
+	DisablePlanMeta       bool
+	DisableInternalSQL    bool
+	RedactLiterals        bool
+	VerifySQLDigest       bool
+	SampleConflictPolicy  ConflictPolicy
+	MillisecondSources    string
+	MaxFutureTimestamp    time.Duration
+	TimestampPolicy       TimestampPolicy
+	BatchMinSize          int
+	BatchMaxSize          int // immutable between 0 and non-zero
+	BatchTargetLatency    time.Duration
+	MetaPriority          bool
+	// LogLevel is the level of the global logger, empty to keep it.
+	LogLevel string
+
+	AsyncBufferSize    int           // immutable
+	AsyncBatchSize     int           // immutable
+	AsyncFlushInterval time.Duration // immutable
+	AsyncWorkers       int           // immutable
+	WALPath            string        // immutable
+	CumulativeCPUTime  bool          // immutable
+	CumulativeStaleTTL time.Duration // immutable
+	MetricPrefix       string        // immutable
+	MetricNames        string        // immutable
+	// The normalization of the instances, immutable so that the stored
+	// instances stay in one form
+	NormalizeInstances   bool
+	InstanceLowercase    bool
+	InstanceDefaultPorts string
+	InstanceHostAliases  string
+}
+
+var immutableOptions = map[string]bool{
+	"store.async-buffer-size":      true,
+	"store.async-batch-size":       true,
+	"store.async-flush-interval":   true,
+	"store.async-workers":          true,
+	"store.wal-path":               true,
+	"store.cumulative-cpu-time":    true,
+	"store.cumulative-stale-after": true,
+	"store.metric-prefix":          true,
+	"store.metric-names":           true,
+	"store.normalize-instances":    true,
+	"store.instance-lowercase":     true,
+	"store.instance-default-ports": true,
+	"store.instance-host-aliases":  true,
+}
+
+var (
+	config        atomic.Value // Config
+	reconfigureMu sync.Mutex
+	watcher       *ConfigFileWatcher
+
+	// adaptiveBatcher is the batcher wrapped into metricWriter, nil if not enabled.
+	adaptiveBatcher *AdaptiveBatcher
+)
+
+// ConfigFromFlags returns the config set by the command line flags.
+func ConfigFromFlags() Config {
+	return Config{
+		MaxSQLLength:          *maxSQLLength,
+		MaxPlanLength:         *maxPlanLength,
+		TombstoneRetention:    *tombstoneRetention,
+		FilterTombstoneSeries: *filterTombstoneSeries,
+		EmitHeartbeat:         *emitHeartbeat,
+		HeartbeatSourceAddr:   *heartbeatSourceAddr,
+		EmitSampleCounts:      *emitSampleCounts,
+		ValidateMetrics:       *validateMetrics,
+		MetaPriority:          *metaPriority,
+		DisablePlanMeta:       *disablePlanMeta,
+		DisableInternalSQL:    *disableInternalSQL,
+		RedactLiterals:        *redactLiterals,
+		VerifySQLDigest:       *verifySQLDigest,
+		SampleConflictPolicy:  ConflictPolicy(*conflictPolicyFlag),
+		MillisecondSources:    *millisecondSources,
+		MaxFutureTimestamp:    *maxFutureTimestamp,
+		TimestampPolicy:       TimestampPolicy(*timestampPolicy),
+		BatchMinSize:          *adaptiveBatchMin,
+		BatchMaxSize:          *adaptiveBatchMax,
+		BatchTargetLatency:    *adaptiveBatchTarget,
+		AsyncBufferSize:       *asyncBufferSize,
+		AsyncBatchSize:        *asyncBatchSize,
+		AsyncFlushInterval:    *asyncFlushInterval,
+		AsyncWorkers:          *asyncWorkers,
+		WALPath:               *walPath,
+		CumulativeCPUTime:     *cumulativeCPUTime,
+		CumulativeStaleTTL:    *cumulativeStaleTTL,
+		MetricPrefix:          *metricPrefix,
+		MetricNames:           *metricNames,
+		NormalizeInstances:    *normalizeInstances,
+		InstanceLowercase:     *instanceLowercase,
+		InstanceDefaultPorts:  *instanceDefaultPorts,
+		InstanceHostAliases:   *instanceHostAliases,
+	}
+}
+
+// CurrentConfig returns the config in effect, the one of the flags before Init.
+func CurrentConfig() Config {
+	if cfg, ok := config.Load().(Config); ok {
+		return cfg
+	}
+	return ConfigFromFlags()
+}
+
+// flagSet binds the options of cfg to flags named after the command line ones.
+func (cfg *Config) flagSet() *pflag.FlagSet {
+	fs := pflag.NewFlagSet("store", pflag.ContinueOnError)
+	fs.IntVar(&cfg.MaxSQLLength, "store.max-sql-length", cfg.MaxSQLLength, "")
+	fs.IntVar(&cfg.MaxPlanLength, "store.max-plan-length", cfg.MaxPlanLength, "")
+	fs.DurationVar(&cfg.TombstoneRetention, "store.tombstone-retention", cfg.TombstoneRetention, "")
+	fs.BoolVar(&cfg.FilterTombstoneSeries, "store.tombstone-filter-series", cfg.FilterTombstoneSeries, "")
+	fs.BoolVar(&cfg.EmitHeartbeat, "store.emit-heartbeat", cfg.EmitHeartbeat, "")
+	fs.BoolVar(&cfg.HeartbeatSourceAddr, "store.heartbeat-source-addr", cfg.HeartbeatSourceAddr, "")
+	fs.BoolVar(&cfg.EmitSampleCounts, "store.emit-sample-counts", cfg.EmitSampleCounts, "")
+	fs.BoolVar(&cfg.ValidateMetrics, "store.validate-metrics", cfg.ValidateMetrics, "")
+	fs.BoolVar(&cfg.DisablePlanMeta, "store.disable-plan-meta", cfg.DisablePlanMeta, "")
+	fs.BoolVar(&cfg.DisableInternalSQL, "store.disable-internal-sql", cfg.DisableInternalSQL, "")
+	fs.BoolVar(&cfg.RedactLiterals, "store.redact-literals", cfg.RedactLiterals, "")
+	fs.BoolVar(&cfg.VerifySQLDigest, "store.verify-sql-digest", cfg.VerifySQLDigest, "")
+	fs.StringVar((*string)(&cfg.SampleConflictPolicy), "store.sample-conflict-policy", string(cfg.SampleConflictPolicy), "")
+	fs.StringVar(&cfg.MillisecondSources, "store.millisecond-timestamp-sources", cfg.MillisecondSources, "")
+	fs.DurationVar(&cfg.MaxFutureTimestamp, "store.max-future-timestamp", cfg.MaxFutureTimestamp, "")
+	fs.StringVar((*string)(&cfg.TimestampPolicy), "store.implausible-timestamp-policy", string(cfg.TimestampPolicy), "")
+	fs.IntVar(&cfg.BatchMinSize, "store.batch-min-size", cfg.BatchMinSize, "")
+	fs.IntVar(&cfg.BatchMaxSize, "store.batch-max-size", cfg.BatchMaxSize, "")
+	fs.DurationVar(&cfg.BatchTargetLatency, "store.batch-target-latency", cfg.BatchTargetLatency, "")
+	fs.BoolVar(&cfg.MetaPriority, "store.meta-priority", cfg.MetaPriority, "")
+	fs.StringVar(&cfg.LogLevel, "log.level", cfg.LogLevel, "")
+	fs.IntVar(&cfg.AsyncBufferSize, "store.async-buffer-size", cfg.AsyncBufferSize, "")
+	fs.IntVar(&cfg.AsyncBatchSize, "store.async-batch-size", cfg.AsyncBatchSize, "")
+	fs.DurationVar(&cfg.AsyncFlushInterval, "store.async-flush-interval", cfg.AsyncFlushInterval, "")
+	fs.IntVar(&cfg.AsyncWorkers, "store.async-workers", cfg.AsyncWorkers, "")
+	fs.StringVar(&cfg.WALPath, "store.wal-path", cfg.WALPath, "")
+	fs.BoolVar(&cfg.CumulativeCPUTime, "store.cumulative-cpu-time", cfg.CumulativeCPUTime, "")
+	fs.DurationVar(&cfg.CumulativeStaleTTL, "store.cumulative-stale-after", cfg.CumulativeStaleTTL, "")
+	fs.StringVar(&cfg.MetricPrefix, "store.metric-prefix", cfg.MetricPrefix, "")
+	fs.StringVar(&cfg.MetricNames, "store.metric-names", cfg.MetricNames, "")
+	fs.BoolVar(&cfg.NormalizeInstances, "store.normalize-instances", cfg.NormalizeInstances, "")
+	fs.BoolVar(&cfg.InstanceLowercase, "store.instance-lowercase", cfg.InstanceLowercase, "")
+	fs.StringVar(&cfg.InstanceDefaultPorts, "store.instance-default-ports", cfg.InstanceDefaultPorts, "")
+	fs.StringVar(&cfg.InstanceHostAliases, "store.instance-host-aliases", cfg.InstanceHostAliases, "")
+	return fs
+}
+
+func (cfg Config) validate() error {
+	if _, err := parseConflictPolicy(string(cfg.SampleConflictPolicy)); err != nil {
+		return err
+	}
+	if _, err := parseTimestampPolicy(string(cfg.TimestampPolicy)); err != nil {
+		return err
+	}
+	if _, err := resolveMetricNames(cfg.MetricPrefix, cfg.MetricNames); err != nil {
+		return err
+	}
+	if _, err := newNormalizer(cfg); err != nil {
+		return err
+	}
+	if len(cfg.LogLevel) != 0 {
+		var level zapcore.Level
+		if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return fmt.Errorf("%w: invalid log level %q", ErrInvalidConfig, cfg.LogLevel)
+		}
+	}
+	return nil
+}
+
+// diffConfig returns the changed options as `name: old -> new`, failing on a
+// change of an immutable one.
+func diffConfig(old, new Config) ([]string, error) {
+	oldFs, newFs := old.flagSet(), new.flagSet()
+
+	var changes []string
+	var err error
+	newFs.VisitAll(func(f *pflag.Flag) {
+		before := oldFs.Lookup(f.Name).Value.String()
+		after := f.Value.String()
+		if before == after || err != nil {
+			return
+		}
+		if immutableOptions[f.Name] {
+			err = fmt.Errorf("%w: %s cannot be changed at runtime, restart to change it from %q to %q", ErrInvalidConfig, f.Name, before, after)
+			return
+		}
+		changes = append(changes, fmt.Sprintf("%s: %s -> %s", f.Name, before, after))
+	})
+	if err != nil {
+		return nil, err
+	}
+	if (old.BatchMaxSize > 0) != (new.BatchMaxSize > 0) {
+		return nil, fmt.Errorf("%w: store.batch-max-size cannot change between 0 and non-zero at runtime, restart to enable or disable adaptive batching", ErrInvalidConfig)
+	}
+	return changes, nil
+}
+
+// Reconfigure applies the options of cfg changeable at runtime. It fails without
+// applying any option if cfg is invalid or changes an immutable one.
+func Reconfigure(cfg Config) error {
+	reconfigureMu.Lock()
+	defer reconfigureMu.Unlock()
+
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	changes, err := diffConfig(CurrentConfig(), cfg)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	if adaptiveBatcher != nil {
+		adaptiveBatcher.SetConfig(AdaptiveBatchConfig{
+			MinSize:       cfg.BatchMinSize,
+			MaxSize:       cfg.BatchMaxSize,
+			TargetLatency: cfg.BatchTargetLatency,
+		})
+	}
+	if len(cfg.LogLevel) != 0 {
+		var level zapcore.Level
+		_ = level.UnmarshalText([]byte(cfg.LogLevel))
+		log.SetLevel(level)
+	}
+	config.Store(cfg)
+
+	log.Info("reconfigured the store", zap.Strings("changes", changes))
+	params := map[string]string{"changes": strings.Join(changes, ", ")}
+	err = audit.Do("reconfigure", audit.CallerSystem, params, func() (int, error) {
+		return len(changes), nil
+	})
+	if err != nil {
+		log.Warn("failed to audit the reconfiguration", zap.Error(err))
+	}
+	return nil
+}
+
+// ParseConfig applies the `flag=value` lines of r onto base. Empty lines and
+// lines starting with # are skipped.
+func ParseConfig(r io.Reader, base Config) (Config, error) {
+	cfg := base
+	fs := cfg.flagSet()
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(text, "--"), "=", 2)
+		if len(kv) != 2 {
+			return base, fmt.Errorf("%w: line %d: expect flag=value", ErrInvalidConfig, line)
+		}
+		name := strings.TrimSpace(kv[0])
+		if fs.Lookup(name) == nil {
+			return base, fmt.Errorf("%w: line %d: unknown option %s", ErrInvalidConfig, line, name)
+		}
+		if err := fs.Set(name, strings.TrimSpace(kv[1])); err != nil {
+			return base, fmt.Errorf("%w: line %d: %v", ErrInvalidConfig, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return base, err
+	}
+	return cfg, nil
+}
+
+// ConfigFileWatcher calls Reconfigure with the config file applied onto the
+// flags whenever the modification time or the size of the file changes.
+type ConfigFileWatcher struct {
+	path     string
+	interval time.Duration
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewConfigFileWatcher(path string, interval time.Duration) *ConfigFileWatcher {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return &ConfigFileWatcher{path: path, interval: interval}
+}
+
+// Start applies the file once and watches it in the background.
+func (w *ConfigFileWatcher) Start() {
+	w.stopCh = make(chan struct{})
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+
+		ticker := clock.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		var modTime time.Time
+		var size int64 = -1
+		for {
+			if info, err := os.Stat(w.path); err != nil {
+				log.Warn("failed to stat the config file", zap.String("path", w.path), zap.Error(err))
+			} else if !info.ModTime().Equal(modTime) || info.Size() != size {
+				modTime, size = info.ModTime(), info.Size()
+				if err = w.reload(); err != nil {
+					log.Warn("failed to apply the config file", zap.String("path", w.path), zap.Error(err))
+				}
+			}
+
+			select {
+			case <-ticker.C():
+			case <-w.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (w *ConfigFileWatcher) reload() error {
+	f, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// Onto the flags rather than the current config, so removing a line reverts it
+	cfg, err := ParseConfig(f, ConfigFromFlags())
+	if err != nil {
+		return err
+	}
+	return Reconfigure(cfg)
+}
+
+func (w *ConfigFileWatcher) Stop() {
+	if w.stopCh == nil {
+		return
+	}
+	close(w.stopCh)
+	w.wg.Wait()
+	w.stopCh = nil
+}
@@ -0,0 +1,108 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+// TestReconfigureWhileWriting is meant for -race, changing the options read
+// by the ingestion while it runs.
+func TestReconfigureWhileWriting(t *testing.T) {
+	// Wraps the writer into the adaptive batcher reconfigured below
+	if err := pflag.Set("store.batch-max-size", "256"); err != nil {
+		t.Fatal(err)
+	}
+	defer pflag.Set("store.batch-max-size", "0")
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	audit.Init(s.DB)
+	defer audit.Stop()
+
+	base := store.CurrentConfig()
+	configs := make([]store.Config, 4)
+	for i := range configs {
+		cfg := base
+		cfg.MaxSQLLength = 16 << uint(i*2)
+		cfg.RedactLiterals = i%2 == 1
+		cfg.ValidateMetrics = i%2 == 0
+		cfg.SampleConflictPolicy = []store.ConflictPolicy{store.ConflictLastWins, store.ConflictMax, store.ConflictSum, store.ConflictLastWins}[i]
+		cfg.BatchMinSize = 8 << uint(i)
+		cfg.BatchMaxSize = 512 << uint(i)
+		configs[i] = cfg
+	}
+	immutable := base
+	immutable.AsyncWorkers++
+
+	const writers, rounds = 4, 50
+	text := "select * from t where id = 1 and name = 'a' " + strings.Repeat("and x = 2 ", 10)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				digest := []byte{byte(w), byte(i)}
+				if err := store.SQLMetas([]*tipb.SQLMeta{{SqlDigest: digest, NormalizedSql: text}}); err != nil {
+					t.Error(err)
+					return
+				}
+				err := store.TopSQLRecords([]*tipb.CPUTimeRecord{{
+					SqlDigest:              digest,
+					Instance:               fmt.Sprintf("tidb-%d:10080", w),
+					Job:                    "tidb",
+					RecordListTimestampSec: []uint64{uint64(1632700800 + i)},
+					RecordListCpuTimeMs:    []uint32{10},
+				}})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds*writers; i++ {
+			if err := store.Reconfigure(configs[i%len(configs)]); err != nil {
+				t.Error(err)
+				return
+			}
+			// Rejected as a whole, keeping the config in effect
+			if err := store.Reconfigure(immutable); !errors.Is(err, store.ErrInvalidConfig) {
+				t.Errorf("got error %v of a change of an immutable option", err)
+				return
+			}
+			_ = store.CurrentConfig()
+		}
+	}()
+	wg.Wait()
+
+	last := configs[(rounds*writers-1)%len(configs)]
+	if got := store.CurrentConfig(); got != last {
+		t.Fatalf("got config %+v, want %+v", got, last)
+	}
+	if got := len(storedTexts(t, s.DB, "sql_digest", "sql_text")); got != writers*rounds {
+		t.Fatalf("got %d sql metas stored, want %d", got, writers*rounds)
+	}
+	want := make([]testutil.Sample, rounds)
+	for i := range want {
+		want[i] = testutil.Sample{TimestampMs: uint64(1632700800+i) * 1000, Value: 10}
+	}
+	for w := 0; w < writers; w++ {
+		s.TSDB.AssertSamples(t, fmt.Sprintf(`cpu_time{instance="tidb-%d:10080"}`, w), want...)
+	}
+}
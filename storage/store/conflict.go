@@ -0,0 +1,136 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/zhongzc/diag_backend/utils"
+
+	"github.com/spf13/pflag"
+)
+
+// ConflictPolicy is how the samples of a series sharing a timestamp within a
+// batch are merged. A sample sharing the timestamp of one written by an
+// earlier batch is written as is, left to the timeseries db to deduplicate.
+type ConflictPolicy string
+
+const (
+	// ConflictLastWins keeps the value of the sample received last.
+	ConflictLastWins ConflictPolicy = "last-wins"
+	ConflictMax      ConflictPolicy = "max"
+	// ConflictSum adds the values up, saturating at the maximum of uint64.
+	ConflictSum ConflictPolicy = "sum"
+)
+
+var (
+	conflictPolicyFlag = pflag.String("store.sample-conflict-policy", string(ConflictLastWins), "How to merge samples of a series sharing a timestamp within a batch: last-wins, max or sum")
+)
+
+func parseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case ConflictLastWins, ConflictMax, ConflictSum:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: unknown sample conflict policy %q", ErrInvalidConfig, s)
+}
+
+func (p ConflictPolicy) merge(old, new uint64) uint64 {
+	switch p {
+	case ConflictMax:
+		if new > old {
+			return new
+		}
+		return old
+	case ConflictSum:
+		return utils.AddSaturating(old, new)
+	}
+	return new
+}
+
+// mergeConflicts merges the metrics of the same series into one and resolves
+// samples sharing a timestamp by the policy. Series already free of conflicts
+// are left untouched. Only the metrics of one batch are merged, no samples
+// being kept across the batches.
+func mergeConflicts(metrics *[]Metric, policy ConflictPolicy) {
+	ms := *metrics
+	if len(ms) == 0 {
+		return
+	}
+
+	var dup bool
+	for i := range ms {
+		if !strictlyIncreasing(ms[i].Timestamps) {
+			dup = true
+			break
+		}
+	}
+	if !dup {
+		seen := make(map[seriesKey]struct{}, len(ms))
+		for i := range ms {
+			key := ms[i].Metric.seriesKey()
+			if _, ok := seen[key]; ok {
+				dup = true
+				break
+			}
+			seen[key] = struct{}{}
+		}
+	}
+	if !dup {
+		return
+	}
+
+	type series struct {
+		index  int
+		values map[uint64]uint64
+	}
+	byKey := make(map[seriesKey]*series, len(ms))
+	res := ms[:0]
+	for i := range ms {
+		m := ms[i]
+		key := m.Metric.seriesKey()
+		s, ok := byKey[key]
+		if !ok {
+			s = &series{index: len(res), values: make(map[uint64]uint64, len(m.Timestamps))}
+			byKey[key] = s
+			res = append(res, m)
+		}
+
+		for j, ts := range m.Timestamps {
+			if j >= len(m.Values) {
+				break
+			}
+			if old, ok := s.values[ts]; ok {
+				s.values[ts] = policy.merge(old, m.Values[j])
+			} else {
+				s.values[ts] = m.Values[j]
+			}
+		}
+	}
+
+	for _, s := range byKey {
+		m := &res[s.index]
+		timestamps := make([]uint64, 0, len(s.values))
+		for ts := range s.values {
+			timestamps = append(timestamps, ts)
+		}
+		sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+		values := make([]uint64, 0, len(timestamps))
+		for _, ts := range timestamps {
+			values = append(values, s.values[ts])
+		}
+		m.Timestamps = timestamps
+		m.Values = values
+	}
+
+	*metrics = res
+}
+
+func strictlyIncreasing(timestamps []uint64) bool {
+	for i := 1; i < len(timestamps); i++ {
+		if timestamps[i] <= timestamps[i-1] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,77 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+// conflictingRecords are records of one series from overlapping windows, both
+// carrying a sample of 1632700801.
+func conflictingRecords(ms ...uint32) []*tipb.CPUTimeRecord {
+	record := func(secs []uint64, ms []uint32) *tipb.CPUTimeRecord {
+		return &tipb.CPUTimeRecord{
+			SqlDigest:              []byte{0x5e, 0x4c},
+			Instance:               "tidb-0:10080",
+			Job:                    "tidb",
+			RecordListTimestampSec: secs,
+			RecordListCpuTimeMs:    ms,
+		}
+	}
+	return []*tipb.CPUTimeRecord{
+		record([]uint64{1632700800, 1632700801}, []uint32{10, ms[0]}),
+		record([]uint64{1632700801, 1632700802}, []uint32{ms[1], 30}),
+	}
+}
+
+func TestSampleConflictPolicies(t *testing.T) {
+	for _, tt := range []struct {
+		policy store.ConflictPolicy
+		// want is the merged sample of 40 then 25.
+		want float64
+	}{
+		{policy: store.ConflictLastWins, want: 25},
+		{policy: store.ConflictMax, want: 40},
+		{policy: store.ConflictSum, want: 65},
+	} {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			if err := pflag.Set("store.sample-conflict-policy", string(tt.policy)); err != nil {
+				t.Fatal(err)
+			}
+			defer pflag.Set("store.sample-conflict-policy", string(store.ConflictLastWins))
+			s, err := testutil.NewMemStore()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			// Merged within a batch
+			if err := store.TopSQLRecords(conflictingRecords(40, 25)); err != nil {
+				t.Fatal(err)
+			}
+			s.TSDB.AssertSamples(t, `cpu_time{sql_digest="5e4c"}`,
+				testutil.Sample{TimestampMs: 1632700800000, Value: 10},
+				testutil.Sample{TimestampMs: 1632700801000, Value: tt.want},
+				testutil.Sample{TimestampMs: 1632700802000, Value: 30},
+			)
+
+			// Written as is across batches whatever the policy, the later
+			// sample winning in the MemTSDB
+			s.TSDB.Reset()
+			for _, r := range conflictingRecords(40, 25) {
+				if err := store.TopSQLRecords([]*tipb.CPUTimeRecord{r}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			s.TSDB.AssertSamples(t, `cpu_time{sql_digest="5e4c"}`,
+				testutil.Sample{TimestampMs: 1632700800000, Value: 10},
+				testutil.Sample{TimestampMs: 1632700801000, Value: 25},
+				testutil.Sample{TimestampMs: 1632700802000, Value: 30},
+			)
+		})
+	}
+}
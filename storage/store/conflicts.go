@@ -0,0 +1,67 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+var (
+	sqlDigestInserts  = newMetaInserts("sql_digest")
+	planDigestInserts = newMetaInserts("plan_digest")
+)
+
+// metaInserts counts the rows of a meta table inserted and the ones skipped
+// by ON CONFLICT DO NOTHING, their digest being stored already, which tells
+// the churn of the digests.
+type metaInserts struct {
+	inserted, conflicted *metrics.Counter
+}
+
+func newMetaInserts(table string) *metaInserts {
+	m := &metaInserts{
+		inserted:   metrics.NewCounter(fmt.Sprintf(`diag_store_meta_rows_total{table=%q,result="inserted"}`, table)),
+		conflicted: metrics.NewCounter(fmt.Sprintf(`diag_store_meta_rows_total{table=%q,result="conflicted"}`, table)),
+	}
+	metrics.NewGauge(fmt.Sprintf(`diag_store_meta_conflict_ratio{table=%q}`, table), m.conflictRatio)
+	return m
+}
+
+// observe counts the rows inserted, fresh telling whether each was missing.
+func (m *metaInserts) observe(fresh []bool) {
+	inserted := 0
+	for _, f := range fresh {
+		if f {
+			inserted++
+		}
+	}
+	m.inserted.Add(inserted)
+	m.conflicted.Add(len(fresh) - inserted)
+}
+
+// conflictRatio returns the share of the rows conflicting since the start, 0
+// before any.
+func (m *metaInserts) conflictRatio() float64 {
+	conflicted := m.conflicted.Get()
+	total := m.inserted.Get() + conflicted
+	if total == 0 {
+		return 0
+	}
+	return float64(conflicted) / float64(total)
+}
+
+// freshKeys reports whether each of the n keys is missing in table, looking
+// up the ones not in cache. It must be called before the keys are inserted,
+// and the returned func records the keys in cache, to call once their inserts
+// committed.
+func freshKeys(db execer, cache *seenCache, table string, n int, keyAt func(i int) string) ([]bool, func()) {
+	fresh := make([]bool, n)
+	for i := range fresh {
+		fresh[i] = isNewKey(db, cache, table, "digest", keyAt(i))
+	}
+	return fresh, func() {
+		for i := range fresh {
+			cache.add(keyAt(i))
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zhongzc/diag_backend/utils"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	cumulativeCPUTime  = pflag.Bool("store.cumulative-cpu-time", false, "Emit cpu_time as a monotonic cumulative counter per series instead of per-window deltas")
+	cumulativeStaleTTL = pflag.Duration("store.cumulative-stale-after", 10*time.Minute, "Forget the running total of a cumulative series that has not been reported for this long")
+)
+
+type seriesKey struct {
+	name       string
+	instance   string
+	sqlDigest  string
+	planDigest string
+	extra      string
+}
+
+type cumulativeSeries struct {
+	total    uint64
+	lastSeen time.Time
+}
+
+// cumulator keeps a running total per series and rewrites deltas into cumulative values.
+// A total overflowing uint64 restarts from the delta, read as a counter reset.
+type cumulator struct {
+	mu     sync.Mutex
+	series map[seriesKey]*cumulativeSeries
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newCumulator() *cumulator {
+	return &cumulator{
+		series: make(map[seriesKey]*cumulativeSeries),
+		stopCh: make(chan struct{}),
+	}
+}
+
+// accumulate rewrites the deltas of metrics into the running totals. The
+// returned func takes the deltas back from the totals, for a failed write.
+func (c *cumulator) accumulate(metrics []Metric) func() {
+	now := clock.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	type change struct {
+		series      *cumulativeSeries
+		before, now uint64
+	}
+	changes := make([]change, 0, len(metrics))
+	for i := range metrics {
+		m := &metrics[i]
+		key := m.Metric.seriesKey()
+
+		s, ok := c.series[key]
+		if !ok {
+			s = &cumulativeSeries{}
+			c.series[key] = s
+		}
+		s.lastSeen = now
+
+		before := s.total
+		for j, v := range m.Values {
+			s.total = utils.AddCounter(s.total, v)
+			m.Values[j] = s.total
+		}
+		changes = append(changes, change{series: s, before: before, now: s.total})
+	}
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		// Backwards so that a series repeated in metrics goes back to its
+		// first total
+		for i := len(changes) - 1; i >= 0; i-- {
+			ch := changes[i]
+			switch {
+			case ch.series.total == ch.now:
+				ch.series.total = ch.before
+			case ch.now >= ch.before && ch.series.total >= ch.now-ch.before:
+				// Accumulated since by a concurrent write
+				ch.series.total -= ch.now - ch.before
+			}
+		}
+	}
+}
+
+func (c *cumulator) cleanup(staleAfter time.Duration) {
+	deadline := clock.Now().Add(-staleAfter)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, s := range c.series {
+		if s.lastSeen.Before(deadline) {
+			delete(c.series, key)
+		}
+	}
+}
+
+func (c *cumulator) startCleanup(staleAfter time.Duration) {
+	interval := staleAfter / 2
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := clock.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				c.cleanup(staleAfter)
+			case <-c.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (c *cumulator) stop() {
+	close(c.stopCh)
+	c.wg.Wait()
+}
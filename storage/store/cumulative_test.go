@@ -0,0 +1,54 @@
+package store_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+func cpuTimeRecord(ts uint64, cpuTimeMs uint32) *tipb.CPUTimeRecord {
+	return &tipb.CPUTimeRecord{
+		SqlDigest:              []byte{0x5e, 0x4c},
+		PlanDigest:             []byte{0xa1, 0x0b},
+		Instance:               "tidb-0:10080",
+		Job:                    "tidb",
+		RecordListTimestampSec: []uint64{ts},
+		RecordListCpuTimeMs:    []uint32{cpuTimeMs},
+	}
+}
+
+func TestCumulativeCPUTimeRollsBackFailedWrites(t *testing.T) {
+	if err := pflag.Set("store.cumulative-cpu-time", "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer pflag.Set("store.cumulative-cpu-time", "false")
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := store.TopSQLRecords([]*tipb.CPUTimeRecord{cpuTimeRecord(1632700800, 35)}); err != nil {
+		t.Fatal(err)
+	}
+	errWrite := errors.New("tsdb unavailable")
+	s.TSDB.SetError(errWrite)
+	if err := store.TopSQLRecords([]*tipb.CPUTimeRecord{cpuTimeRecord(1632700801, 120)}); !errors.Is(err, errWrite) {
+		t.Fatalf("got error %v, want %v", err, errWrite)
+	}
+	s.TSDB.SetError(nil)
+	if err := store.TopSQLRecords([]*tipb.CPUTimeRecord{cpuTimeRecord(1632700802, 10)}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed write is not counted in the total
+	s.TSDB.AssertSamples(t, `cpu_time{sql_digest="5e4c"}`,
+		testutil.Sample{TimestampMs: 1632700800000, Value: 35},
+		testutil.Sample{TimestampMs: 1632700802000, Value: 45},
+	)
+}
@@ -0,0 +1,184 @@
+package store
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/pflag"
+)
+
+var (
+	dedupWindow   = pflag.Duration("store.dedup-window", 0, "Window within which a batch identical to one written, e.g. retried by an agent, is dropped. 0 disables the dedup")
+	dedupCapacity = pflag.Int("store.dedup-capacity", 64*1024, "Max number of batch keys remembered for --store.dedup-window, the oldest forgotten first")
+)
+
+var duplicateBatchCounter = metrics.NewCounter(`diag_store_duplicate_batches_total`)
+
+// Source describes who reported a batch, as known by the receiver.
+type Source struct {
+	// Fingerprint identifies the reporting agent, e.g. by a connection id or its start time.
+	Fingerprint string
+	// Sequence is the sequence number of the report, 0 if unknown. Batches
+	// are deduped by their full content, of the same sequence number.
+	Sequence uint64
+	// Addr is the peer address of the agent, e.g. of its gRPC connection,
+	// stored as the source_addr of the instances reported. Empty if unknown.
+	Addr string
+	// Tenant is the tenant, the keyspace, the agent reports for, checked by
+	// the receiver. DefaultTenant if none.
+	Tenant string
+	// RequestID identifies the report upstream, e.g. by the request ID of its
+	// RPC, sent along the imports in the RequestIDHeader and logged. Empty if
+	// none, it is not captured.
+	RequestID string
+	// AgentVersion is the version the agent reported, empty if unknown, and
+	// Capabilities what it is able to report, unknown without a version.
+	AgentVersion string
+	Capabilities Capabilities
+
+	// ack is resolved once the metrics of the records are durable, nil if
+	// not waited for.
+	ack *Ack
+}
+
+// batchKey is the sha256 of the full content of a batch, qualified by the
+// agent and the sequence number reporting it.
+type batchKey [sha256.Size]byte
+
+type marshaler interface {
+	Marshal() ([]byte, error)
+}
+
+// newBatchKey returns the key of a batch of kind reported by src, false if it
+// cannot be computed.
+func newBatchKey(kind string, src Source, records []marshaler) (batchKey, bool) {
+	var key batchKey
+	h := sha256.New()
+	writeString(h, kind)
+	if src.Tenant != DefaultTenant {
+		writeString(h, src.Tenant)
+	}
+	writeString(h, src.Fingerprint)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], src.Sequence)
+	_, _ = h.Write(buf[:])
+	for _, r := range records {
+		b, err := r.Marshal()
+		if err != nil {
+			return key, false
+		}
+		writeString(h, string(b))
+	}
+	copy(key[:], h.Sum(nil))
+	return key, true
+}
+
+// writeString writes s prefixed by its length, so the concatenation is unambiguous.
+func writeString(h hash.Hash, s string) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(len(s)))
+	_, _ = h.Write(buf[:])
+	_, _ = h.Write([]byte(s))
+}
+
+// batchSet remembers the batch keys written within the window, at most capacity ones.
+type batchSet struct {
+	mu    sync.Mutex
+	keys  map[batchKey]*list.Element
+	order list.List // of *batchEntry, oldest first
+}
+
+type batchEntry struct {
+	key       batchKey
+	writtenAt time.Time
+	// writing tells the batch is being written, claimed but not settled.
+	writing bool
+}
+
+var (
+	writtenBatches = &batchSet{keys: make(map[batchKey]*list.Element)}
+
+	errBatchWriting = fmt.Errorf("%w: an identical batch is being written", ErrRateLimited)
+)
+
+// claim remembers key as being written unless known already, in which case
+// it returns false and whether the batch of key is still being written.
+func (s *batchSet) claim(key batchKey, now time.Time, window time.Duration, capacity int) (bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire(now, window)
+	if e, ok := s.keys[key]; ok {
+		return false, e.Value.(*batchEntry).writing
+	}
+	s.push(&batchEntry{key: key, writtenAt: now, writing: true}, capacity)
+	return true, false
+}
+
+// settle remembers key claimed as written from now, or forgets it if not
+// written.
+func (s *batchSet) settle(key batchKey, now time.Time, written bool, capacity int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.keys[key]; ok {
+		delete(s.keys, key)
+		s.order.Remove(e)
+	}
+	if written {
+		s.push(&batchEntry{key: key, writtenAt: now}, capacity)
+	}
+}
+
+// push remembers e as the newest key, forgetting the oldest ones beyond
+// capacity. s.mu must be held.
+func (s *batchSet) push(e *batchEntry, capacity int) {
+	for capacity > 0 && s.order.Len() >= capacity {
+		oldest := s.order.Front()
+		delete(s.keys, oldest.Value.(*batchEntry).key)
+		s.order.Remove(oldest)
+	}
+	s.keys[e.key] = s.order.PushBack(e)
+}
+
+// expire forgets the keys older than window. s.mu must be held.
+func (s *batchSet) expire(now time.Time, window time.Duration) {
+	for oldest := s.order.Front(); oldest != nil; oldest = s.order.Front() {
+		e := oldest.Value.(*batchEntry)
+		if now.Sub(e.writtenAt) < window {
+			return
+		}
+		delete(s.keys, e.key)
+		s.order.Remove(oldest)
+	}
+}
+
+// dedup tells whether the batch of key was written within the window, and
+// returns the func to call with the error writing the batch otherwise, a
+// no-op if disabled. A batch identical to one being written fails with an
+// error to retry, dropped if the other one was written by then.
+func dedup(key func() (batchKey, bool)) (bool, func(err error), error) {
+	window := *dedupWindow
+	if window <= 0 {
+		return false, func(error) {}, nil
+	}
+	k, ok := key()
+	if !ok {
+		return false, func(error) {}, nil
+	}
+	claimed, writing := writtenBatches.claim(k, clock.Now(), window, *dedupCapacity)
+	if writing {
+		return false, nil, errBatchWriting
+	}
+	if !claimed {
+		duplicateBatchCounter.Inc()
+		return true, nil, nil
+	}
+	return false, func(err error) {
+		writtenBatches.settle(k, clock.Now(), err == nil, *dedupCapacity)
+	}, nil
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"container/list"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+func topSQLBatchKey(t *testing.T, src Source, cpuTimeMs uint32) batchKey {
+	t.Helper()
+
+	r := &tipb.CPUTimeRecord{
+		SqlDigest:              []byte{0x5e, 0x4c},
+		Instance:               "tidb-0:10080",
+		RecordListTimestampSec: []uint64{1632700800},
+		RecordListCpuTimeMs:    []uint32{cpuTimeMs},
+	}
+	key, ok := newBatchKey("topsql", src, []marshaler{r})
+	if !ok {
+		t.Fatal("cannot compute the batch key")
+	}
+	return key
+}
+
+func TestBatchKeyOfContent(t *testing.T) {
+	src := Source{Fingerprint: "agent-1", Sequence: 7}
+	key := topSQLBatchKey(t, src, 35)
+	if topSQLBatchKey(t, src, 35) != key {
+		t.Fatal("identical batches got different keys")
+	}
+
+	for name, other := range map[string]batchKey{
+		"content":     topSQLBatchKey(t, src, 120),
+		"fingerprint": topSQLBatchKey(t, Source{Fingerprint: "agent-2", Sequence: 7}, 35),
+		"sequence":    topSQLBatchKey(t, Source{Fingerprint: "agent-1", Sequence: 8}, 35),
+		"tenant":      topSQLBatchKey(t, Source{Fingerprint: "agent-1", Sequence: 7, Tenant: "ks1"}, 35),
+	} {
+		if other == key {
+			t.Errorf("batches of another %s got the same key", name)
+		}
+	}
+}
+
+func TestBatchSetClaimsOnce(t *testing.T) {
+	s := &batchSet{keys: make(map[batchKey]*list.Element)}
+	now := time.Unix(1632700800, 0)
+	key := batchKey{1}
+
+	if claimed, _ := s.claim(key, now, time.Minute, 0); !claimed {
+		t.Fatal("a new key is not claimed")
+	}
+	if claimed, writing := s.claim(key, now, time.Minute, 0); claimed || !writing {
+		t.Fatalf("got claimed %v and writing %v of a key being written, want false and true", claimed, writing)
+	}
+
+	// A failed write lets the batch be retried
+	s.settle(key, now, false, 0)
+	if claimed, _ := s.claim(key, now, time.Minute, 0); !claimed {
+		t.Fatal("the key of a failed write is not claimed again")
+	}
+
+	s.settle(key, now, true, 0)
+	if claimed, writing := s.claim(key, now.Add(time.Second), time.Minute, 0); claimed || writing {
+		t.Fatalf("got claimed %v and writing %v of a key written, want false and false", claimed, writing)
+	}
+	if claimed, _ := s.claim(key, now.Add(time.Minute), time.Minute, 0); !claimed {
+		t.Fatal("the key is not claimed once out of the window")
+	}
+}
+
+func TestBatchSetClaimsConcurrently(t *testing.T) {
+	s := &batchSet{keys: make(map[batchKey]*list.Element)}
+	now := time.Unix(1632700800, 0)
+
+	claims := make(chan bool)
+	for i := 0; i < 8; i++ {
+		go func() {
+			claimed, _ := s.claim(batchKey{1}, now, time.Minute, 0)
+			claims <- claimed
+		}()
+	}
+	n := 0
+	for i := 0; i < 8; i++ {
+		if <-claims {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatalf("the key is claimed %d times, want once", n)
+	}
+}
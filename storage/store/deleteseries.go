@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zhongzc/diag_backend/utils"
+)
+
+// deleteHandler serves `/api/v1/admin/tsdb/delete_series` of the timeseries db,
+// nil if the metrics are not written to one.
+var deleteHandler http.HandlerFunc
+
+// SetDeleteHandler sets the handler DeleteSeries sends the deletes to.
+func SetDeleteHandler(handler http.HandlerFunc) {
+	deleteHandler = handler
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// DeleteSeries deletes the samples within [startMs, endMs] of the series whose
+// labels equal matchers. Zero startMs and endMs delete the series as a whole,
+// the only deletion VictoriaMetrics supports, which rejects a range. Only the
+// series of the tenant of ctx are deleted.
+func DeleteSeries(ctx context.Context, matchers map[string]string, startMs, endMs int64) error {
+	if deleteHandler == nil {
+		return ErrNoDeleteEndpoint
+	}
+	if len(matchers) == 0 {
+		return fmt.Errorf("no matcher of the series to delete")
+	}
+	if startMs < 0 || endMs < startMs {
+		return fmt.Errorf("invalid range [%d, %d] of the series to delete", startMs, endMs)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tenant := TenantFrom(ctx)
+	if err := CheckTenant(tenant); err != nil {
+		return err
+	}
+	scoped := make(map[string]string, len(matchers)+1)
+	for name, value := range matchers {
+		scoped[name] = value
+	}
+	// The series of DefaultTenant have no tenant label, which "" matches
+	scoped[labelTenant] = tenant
+	matchers = scoped
+
+	names := make([]string, 0, len(matchers))
+	for name := range matchers {
+		if _, changed := sanitizeLabelName(name); changed {
+			return fmt.Errorf("invalid label name %q of the series to delete", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var selector strings.Builder
+	selector.WriteByte('{')
+	for i, name := range names {
+		if i != 0 {
+			selector.WriteByte(',')
+		}
+		fmt.Fprintf(&selector, `%s="%s"`, name, labelValueEscaper.Replace(matchers[name]))
+	}
+	selector.WriteByte('}')
+
+	query := url.Values{"match[]": {selector.String()}}
+	if startMs != 0 || endMs != 0 {
+		query.Set("start", strconv.FormatFloat(float64(startMs)/1000, 'f', 3, 64))
+		query.Set("end", strconv.FormatFloat(float64(endMs)/1000, 'f', 3, 64))
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", "/api/v1/admin/tsdb/delete_series?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", *userAgent)
+
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	respR := utils.NewRespWriter(bufResp, header)
+	deleteHandler(&respR, req)
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		if respR.Code >= 500 {
+			return fmt.Errorf("%w: timeseries db, code: %d, error: %s", ErrBackendUnavailable, respR.Code, respR.Body.String())
+		}
+		return fmt.Errorf("failed to delete series, code: %d, error: %s", respR.Code, respR.Body.String())
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"expvar"
+
+	"github.com/zhongzc/diag_backend/utils"
+)
+
+// Diagnostics is a snapshot of the internal state of the store for live debugging,
+// published as the `store` expvar.
+type Diagnostics struct {
+	BytesPool         utils.PoolStats           `json:"bytes_pool"`
+	AsyncQueue        *AsyncQueueStats          `json:"async_queue,omitempty"`
+	WAL               *WALStats                 `json:"wal,omitempty"`
+	SeenCaches        map[string]SeenCacheStats `json:"seen_caches"`
+	Tombstones        int                       `json:"tombstones"`
+	ConflictSupported bool                      `json:"conflict_supported"`
+	ClockSkews        map[string]ClockSkewStats `json:"clock_skews,omitempty"`
+	Agents            map[string]AgentStats     `json:"agents,omitempty"`
+}
+
+type AsyncQueueStats struct {
+	Length        int     `json:"length"`
+	Capacity      int     `json:"capacity"`
+	OldestAgeSecs float64 `json:"oldest_age_secs"`
+	Workers       int     `json:"workers"`
+	ActiveWorkers int     `json:"active_workers"`
+}
+
+type WALStats struct {
+	Path      string `json:"path"`
+	SizeBytes int64  `json:"size_bytes"`
+	Segments  int    `json:"segments"`
+	// PendingBytes are the bytes of the metrics not written yet.
+	PendingBytes int64 `json:"pending_bytes"`
+	Failed       bool  `json:"failed"`
+}
+
+type SeenCacheStats struct {
+	Size     int     `json:"size"`
+	Capacity int     `json:"capacity"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRate  float64 `json:"hit_rate"`
+}
+
+func init() {
+	expvar.Publish("store", expvar.Func(func() interface{} {
+		return Diagnose()
+	}))
+}
+
+// Diagnose takes the snapshot, locking each subsystem briefly in turn.
+func Diagnose() Diagnostics {
+	d := Diagnostics{
+		BytesPool: bytesP.Stats(),
+		SeenCaches: map[string]SeenCacheStats{
+			"instance":    seenInstances.stats(),
+			"sql_digest":  seenSQLDigests.stats(),
+			"plan_digest": seenPlanDigests.stats(),
+		},
+		Tombstones:        tombstones.size(),
+		ConflictSupported: conflictSupported,
+		ClockSkews:        ClockSkews(),
+		Agents:            Agents(),
+	}
+	if asyncWriter != nil {
+		s := asyncWriter.Stats()
+		d.AsyncQueue = &s
+	}
+	if walWriter != nil {
+		s := walWriter.Stats()
+		d.WAL = &s
+	}
+	return d
+}
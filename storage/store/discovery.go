@@ -0,0 +1,179 @@
+package store
+
+import (
+	"encoding/hex"
+	"errors"
+	"sync"
+
+	"github.com/zhongzc/diag_backend/notify"
+
+	errs "github.com/genjidb/genji/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tipb/go-tipb"
+	"go.uber.org/zap"
+)
+
+const (
+	seenCacheCapacity = 64 * 1024
+	sqlPreviewLength  = 256
+)
+
+var (
+	seenInstances   = newSeenCache(seenCacheCapacity)
+	seenSQLDigests  = newSeenCache(seenCacheCapacity)
+	seenPlanDigests = newSeenCache(seenCacheCapacity)
+)
+
+// seenCache remembers keys known to be stored, so only the misses have to be looked up.
+type seenCache struct {
+	mu       sync.Mutex
+	keys     map[string]struct{}
+	capacity int
+
+	hits, misses uint64
+}
+
+func newSeenCache(capacity int) *seenCache {
+	return &seenCache{keys: make(map[string]struct{}), capacity: capacity}
+}
+
+// contains reports whether key has been recorded, without recording it.
+func (c *seenCache) contains(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.keys[key]
+	if ok {
+		c.hits++
+	} else {
+		c.misses++
+	}
+	return ok
+}
+
+func (c *seenCache) add(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.keys) >= c.capacity {
+		c.keys = make(map[string]struct{})
+	}
+	c.keys[key] = struct{}{}
+}
+
+func (c *seenCache) stats() SeenCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := SeenCacheStats{Size: len(c.keys), Capacity: c.capacity, Hits: c.hits, Misses: c.misses}
+	if c.hits+c.misses != 0 {
+		s.HitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	return s
+}
+
+// isNewKey reports whether key is absent in the table and cache. It must be
+// called before key is inserted, and key added to cache once committed, since
+// db may be a transaction rolled back.
+func isNewKey(db execer, cache *seenCache, table, column, key string) bool {
+	if cache.contains(key) {
+		return false
+	}
+
+	_, err := db.QueryDocument("SELECT "+column+" FROM "+table+" WHERE "+column+" = ?", key)
+	if errors.Is(err, errs.ErrDocumentNotFound) {
+		return true
+	}
+	if err != nil {
+		log.Debug("failed to look up a key", zap.String("table", table), zap.Error(err))
+	}
+	return false
+}
+
+func discoverInstances(db execer, n int, instanceAt func(i int) string) []string {
+	if !notify.Enabled() {
+		return nil
+	}
+
+	var res []string
+	for i := 0; i < n; i++ {
+		instance := instanceAt(i)
+		if isNewKey(db, seenInstances, "instance", "instance", instance) {
+			res = append(res, instance)
+		} else {
+			// Committed, db being the document db
+			seenInstances.add(instance)
+		}
+	}
+	return res
+}
+
+// discoverSQLMetas returns the metas to notify of, fresh telling whether each
+// is missing in sql_digest as freshKeys does.
+func discoverSQLMetas(metas []*tipb.SQLMeta, fresh []bool) []*tipb.SQLMeta {
+	if !notify.Enabled() {
+		return nil
+	}
+
+	var res []*tipb.SQLMeta
+	for i, meta := range metas {
+		if fresh[i] {
+			res = append(res, meta)
+		}
+	}
+	return res
+}
+
+func discoverPlanMetas(metas []*tipb.PlanMeta, fresh []bool) []*tipb.PlanMeta {
+	if !notify.Enabled() {
+		return nil
+	}
+
+	var res []*tipb.PlanMeta
+	for i, meta := range metas {
+		if fresh[i] {
+			res = append(res, meta)
+		}
+	}
+	return res
+}
+
+// notifyInstances notifies of the instances discovered, recording them as
+// stored, to call once their ingestion committed.
+func notifyInstances(instances []string) {
+	now := clock.Now().Unix()
+	for _, instance := range instances {
+		seenInstances.add(instance)
+		notify.Notify(notify.Event{
+			Type:      notify.EventNewInstance,
+			Instance:  instance,
+			FirstSeen: now,
+		})
+	}
+}
+
+func notifySQLMetas(tenant string, metas []*tipb.SQLMeta) {
+	now := clock.Now().Unix()
+	for _, meta := range metas {
+		preview, _ := truncateText(meta.NormalizedSql, sqlPreviewLength)
+		notify.Notify(notify.Event{
+			Type:       notify.EventNewSQLDigest,
+			Digest:     hex.EncodeToString(meta.SqlDigest),
+			FirstSeen:  now,
+			SQLPreview: preview,
+			Tenant:     tenant,
+		})
+	}
+}
+
+func notifyPlanMetas(tenant string, metas []*tipb.PlanMeta) {
+	now := clock.Now().Unix()
+	for _, meta := range metas {
+		notify.Notify(notify.Event{
+			Type:      notify.EventNewPlanDigest,
+			Digest:    hex.EncodeToString(meta.PlanDigest),
+			FirstSeen: now,
+			Tenant:    tenant,
+		})
+	}
+}
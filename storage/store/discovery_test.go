@@ -0,0 +1,149 @@
+package store
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/notify"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+func TestSeenDigestsRecordedOnCommit(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	Init(nil, db, nil)
+	defer Stop()
+
+	sqlMeta := &tipb.SQLMeta{SqlDigest: []byte{0xd1, 0x5c}, NormalizedSql: "select ?"}
+	planMeta := &tipb.PlanMeta{PlanDigest: []byte{0xd1, 0x5d}, NormalizedPlan: "Point_Get"}
+	sqlKey := TenantKey(DefaultTenant, hex.EncodeToString(sqlMeta.SqlDigest))
+	planKey := TenantKey(DefaultTenant, hex.EncodeToString(planMeta.PlanDigest))
+
+	errRollback := errors.New("rollback")
+	err = WithTx(func(tx *Tx) error {
+		if err := tx.SQLMetas([]*tipb.SQLMeta{sqlMeta}); err != nil {
+			return err
+		}
+		// Found in the transaction the second time
+		if err := tx.SQLMetas([]*tipb.SQLMeta{sqlMeta}); err != nil {
+			return err
+		}
+		if err := tx.PlanMetas([]*tipb.PlanMeta{planMeta}); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("got error %v, want %v", err, errRollback)
+	}
+	if seenSQLDigests.contains(sqlKey) || seenPlanDigests.contains(planKey) {
+		t.Fatal("the digests rolled back are recorded as stored")
+	}
+
+	fresh, _ := freshKeys(db, seenSQLDigests, "sql_digest", 1, func(int) string { return sqlKey })
+	if !fresh[0] {
+		t.Fatal("the digest rolled back is not fresh")
+	}
+	if err := Metas(context.Background(), []*tipb.SQLMeta{sqlMeta}, []*tipb.PlanMeta{planMeta}); err != nil {
+		t.Fatal(err)
+	}
+	if !seenSQLDigests.contains(sqlKey) || !seenPlanDigests.contains(planKey) {
+		t.Fatal("the digests committed are not recorded as stored")
+	}
+}
+
+// failingWriter fails the writes with err if set.
+type failingWriter struct {
+	mu  sync.Mutex
+	err error
+}
+
+func (w *failingWriter) WriteMetrics([]Metric) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+func (w *failingWriter) setError(err error) {
+	w.mu.Lock()
+	w.err = err
+	w.mu.Unlock()
+}
+
+func TestDiscoveryNotifiesAfterFailedFirstWrite(t *testing.T) {
+	events := make(chan notify.Event, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e notify.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer srv.Close()
+	if err := pflag.Set("notify.webhook-url", srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	defer pflag.Set("notify.webhook-url", "")
+	notify.Init()
+	defer notify.Stop()
+
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	w := &failingWriter{err: ErrBackendUnavailable}
+	Init(w, db, nil)
+	defer Stop()
+
+	record := *testRecords[0]
+	record.Instance = "tidb-discovered:10080"
+	if err := TopSQLRecords([]*tipb.CPUTimeRecord{&record}); !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("got error %v, want %v", err, ErrBackendUnavailable)
+	}
+	meta := &tipb.SQLMeta{SqlDigest: []byte{0xd1, 0x5e}, NormalizedSql: "select ?"}
+	errRollback := errors.New("rollback")
+	if err := WithTx(func(tx *Tx) error {
+		if err := tx.SQLMetas([]*tipb.SQLMeta{meta}); err != nil {
+			return err
+		}
+		return errRollback
+	}); !errors.Is(err, errRollback) {
+		t.Fatalf("got error %v, want %v", err, errRollback)
+	}
+
+	w.setError(nil)
+	if err := TopSQLRecords([]*tipb.CPUTimeRecord{&record}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SQLMetas([]*tipb.SQLMeta{meta}); err != nil {
+		t.Fatal(err)
+	}
+	// Delivered in order by the webhook goroutine
+	for _, want := range []notify.Event{
+		{Type: notify.EventNewInstance, Instance: record.Instance},
+		{Type: notify.EventNewSQLDigest, Digest: "d15e"},
+	} {
+		select {
+		case e := <-events:
+			if e.Type != want.Type || e.Instance != want.Instance || e.Digest != want.Digest {
+				t.Fatalf("got event %+v, want %+v", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event %+v", want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// docTable is a table of the document db as the store writes it.
+type docTable struct {
+	name string
+	// key is the TEXT primary key.
+	key string
+	// columns are the types of the other fields, checked if declared.
+	columns map[string]string
+}
+
+// docIndex is an index of the document db the store relies on.
+type docIndex struct {
+	name, table, path string
+	// backfill runs before the index is created, e.g. to fill the field in
+	// the rows written before it was recorded.
+	backfill string
+}
+
+var docTables = []docTable{
+	{name: "sql_digest", key: "digest", columns: map[string]string{
+		"tenant": "TEXT", "sql_text": "TEXT", "is_internal": "BOOL", "digest_mismatch": "BOOL", "first_seen": "INTEGER",
+	}},
+	{name: "plan_digest", key: "digest", columns: map[string]string{"tenant": "TEXT", "plan_text": "TEXT", "first_seen": "INTEGER"}},
+	{name: "instance", key: "instance", columns: map[string]string{
+		"job": "TEXT", "last_seen": "INTEGER", "source_addr": "TEXT", "missing_since": "INTEGER",
+		"agent_version": "TEXT", "capabilities": "INTEGER",
+	}},
+	{name: "digest_tombstone", key: "digest", columns: map[string]string{"tenant": "TEXT", "deleted_at": "INTEGER"}},
+	{name: "watermark", key: "instance", columns: map[string]string{"sample_ms": "INTEGER", "written_at": "INTEGER"}},
+	{name: "sql_plan", key: "pair", columns: map[string]string{"tenant": "TEXT", "sql_digest": "TEXT", "plan_digest": "TEXT"}},
+}
+
+var docIndexes = []docIndex{
+	// For the GC of the tombstones
+	{name: "digest_tombstone_deleted_at", table: "digest_tombstone", path: "deleted_at"},
+	// For the purge of a SQL digest
+	{name: "sql_plan_sql_digest", table: "sql_plan", path: "sql_digest"},
+	// For the filters on internal SQLs, the rows missing is_internal being
+	// set not internal so that is_internal = false finds them in the index
+	{
+		name: "sql_digest_is_internal", table: "sql_digest", path: "is_internal",
+		backfill: "UPDATE sql_digest SET is_internal = false WHERE is_internal IS NULL",
+	},
+}
+
+func (t docTable) create() string {
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s VARCHAR(255) PRIMARY KEY)", t.name, t.key)
+}
+
+func (t docTable) keyShape() string {
+	return t.key + " TEXT PRIMARY KEY"
+}
+
+// statements returns the statements creating i.
+func (i docIndex) statements() []string {
+	if len(i.backfill) == 0 {
+		return []string{i.String()}
+	}
+	return []string{i.backfill, i.String()}
+}
+
+// String returns the statement of i as the catalog of genji shows it.
+func (i docIndex) String() string {
+	return fmt.Sprintf("CREATE INDEX %s ON %s (%s)", i.name, i.table, i.path)
+}
+
+// SchemaChange is a difference of the document db from the tables and indexes
+// the store expects, as CheckSchema reports it.
+type SchemaChange struct {
+	Table string `json:"table"`
+	// Index is the index differing, empty for the table itself.
+	Index    string `json:"index,omitempty"`
+	Expected string `json:"expected"`
+	// Actual is the shape found, empty if missing.
+	Actual string `json:"actual,omitempty"`
+	// Statements repair the difference, none if it is to fix by hand.
+	Statements []string `json:"statements,omitempty"`
+}
+
+// Repairable reports whether initDocumentDB repairs c.
+func (c SchemaChange) Repairable() bool {
+	return len(c.Statements) != 0
+}
+
+func (c SchemaChange) String() string {
+	what := "table " + c.Table
+	if len(c.Index) != 0 {
+		what = "index " + c.Index + " of table " + c.Table
+	}
+	if len(c.Actual) == 0 {
+		return fmt.Sprintf("%s is missing, expected %s", what, c.Expected)
+	}
+	return fmt.Sprintf("%s differs, %s instead of %s", what, c.Actual, c.Expected)
+}
+
+// CheckSchema returns the changes Init makes to the tables and indexes of
+// db, the drifts it fails on being not Repairable, without making them.
+func CheckSchema(db *genji.DB) ([]SchemaChange, error) {
+	tables, indexes, err := loadCatalog(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []SchemaChange
+	for _, t := range docTables {
+		stmt, ok := tables[t.name]
+		if !ok {
+			changes = append(changes, SchemaChange{
+				Table:      t.name,
+				Expected:   t.keyShape(),
+				Statements: []string{t.create()},
+			})
+			continue
+		}
+		changes = append(changes, t.drifts(stmt)...)
+	}
+	for _, i := range docIndexes {
+		change := SchemaChange{Table: i.table, Index: i.name, Expected: i.String()}
+		stmt, ok := indexes[i.name]
+		switch {
+		case !ok:
+			change.Statements = i.statements()
+		case stmt != i.String():
+			// An index only speeds up the reads, so it is rebuilt
+			change.Actual = stmt
+			change.Statements = append([]string{"DROP INDEX " + i.name}, i.statements()...)
+		default:
+			continue
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// drifts returns the differences of the table created by stmt from t.
+func (t docTable) drifts(stmt string) []SchemaChange {
+	var changes []SchemaChange
+	key := "no primary key"
+	for _, c := range parseFieldConstraints(stmt) {
+		if c.primaryKey {
+			key = strings.Join(strings.Fields(c.path+" "+c.typ+" PRIMARY KEY"), " ")
+			continue
+		}
+		if expected, ok := t.columns[c.path]; ok && len(c.typ) != 0 && c.typ != expected {
+			changes = append(changes, SchemaChange{
+				Table:    t.name,
+				Expected: fmt.Sprintf("%s %s", c.path, expected),
+				Actual:   fmt.Sprintf("%s %s", c.path, c.typ),
+			})
+		}
+		// The store leaves out the fields it has no value of, and knows
+		// nothing of the extra ones
+		if c.notNull {
+			changes = append(changes, SchemaChange{
+				Table:    t.name,
+				Expected: c.path + " nullable",
+				Actual:   strings.Join(strings.Fields(c.path+" "+c.typ+" NOT NULL"), " "),
+			})
+		}
+	}
+	if key != t.keyShape() {
+		changes = append([]SchemaChange{{Table: t.name, Expected: t.keyShape(), Actual: key}}, changes...)
+	}
+	return changes
+}
+
+// loadCatalog returns the CREATE statements of the tables and the indexes of
+// db by name.
+func loadCatalog(db *genji.DB) (tables, indexes map[string]string, err error) {
+	tables, indexes = make(map[string]string), make(map[string]string)
+	res, err := db.Query("SELECT name, type, sql FROM __genji_catalog")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Close()
+
+	err = res.Iterate(func(d types.Document) error {
+		var name, typ, stmt string
+		if err := document.Scan(d, &name, &typ, &stmt); err != nil {
+			return err
+		}
+		switch typ {
+		case "table":
+			tables[name] = stmt
+		case "index":
+			indexes[name] = stmt
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return tables, indexes, nil
+}
+
+type fieldConstraint struct {
+	path       string
+	typ        string // empty if undeclared
+	primaryKey bool
+	// notNull is set for a NOT NULL without a DEFAULT.
+	notNull bool
+}
+
+var constraintTypes = map[string]bool{
+	"TEXT": true, "INTEGER": true, "DOUBLE": true, "BOOL": true, "BLOB": true, "ARRAY": true, "DOCUMENT": true,
+}
+
+// parseFieldConstraints parses the field constraints of a CREATE TABLE
+// statement of the catalog, e.g. `CREATE TABLE t (a TEXT PRIMARY KEY, b INTEGER)`.
+func parseFieldConstraints(stmt string) []fieldConstraint {
+	open, end := strings.IndexByte(stmt, '('), strings.LastIndexByte(stmt, ')')
+	if open < 0 || end < open {
+		return nil
+	}
+
+	var res []fieldConstraint
+	depth, start := 0, open+1
+	for i := open + 1; i <= end; i++ {
+		switch stmt[i] {
+		case '(':
+			depth++
+			continue
+		case ')':
+			if i != end {
+				depth--
+				continue
+			}
+		case ',':
+			if depth != 0 {
+				continue
+			}
+		default:
+			continue
+		}
+		fields := strings.Fields(stmt[start:i])
+		start = i + 1
+		if len(fields) == 0 {
+			continue
+		}
+		c := fieldConstraint{path: fields[0]}
+		if len(fields) > 1 && constraintTypes[fields[1]] {
+			c.typ = fields[1]
+		}
+		shape := strings.Join(fields, " ")
+		c.primaryKey = strings.Contains(shape, "PRIMARY KEY")
+		c.notNull = !c.primaryKey && strings.Contains(shape, "NOT NULL") && !strings.Contains(shape, "DEFAULT")
+		res = append(res, c)
+	}
+	return res
+}
+
+// verifySchema applies the repairable changes of db, failing on a drift
+// with all of them.
+func verifySchema(db *genji.DB) error {
+	changes, err := CheckSchema(db)
+	if err != nil {
+		return err
+	}
+	var drifts []string
+	for _, c := range changes {
+		if !c.Repairable() {
+			drifts = append(drifts, c.String())
+		}
+	}
+	if len(drifts) != 0 {
+		return fmt.Errorf("%w: %s", ErrSchemaDrift, strings.Join(drifts, "; "))
+	}
+
+	// A new db misses everything, which is no repair
+	fresh := len(changes) == len(docTables)+len(docIndexes)
+	for _, c := range changes {
+		for _, stmt := range c.Statements {
+			if err := db.Exec(stmt); err != nil {
+				return fmt.Errorf("failed to repair the schema, %s: %w", c, err)
+			}
+		}
+		if !fresh {
+			log.Info("repaired the document db schema", zap.Stringer("change", c), zap.Strings("statements", c.Statements))
+		}
+	}
+	return nil
+}
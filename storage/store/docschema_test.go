@@ -0,0 +1,155 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+)
+
+// openSchemaFixture opens an in-memory db made by the statements of
+// testdata/schema/name.sql, a db of an older or hand-edited schema.
+func openSchemaFixture(t *testing.T, name string) *genji.DB {
+	t.Helper()
+	stmts, err := ioutil.ReadFile(filepath.Join("testdata", "schema", name+".sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if err := db.Exec(string(stmts)); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func queryCount(t *testing.T, db *genji.DB, q string) int {
+	t.Helper()
+	d, err := db.QueryDocument(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := document.Scan(d, &n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSchemaDrift(t *testing.T) {
+	for _, tt := range []struct {
+		fixture string
+		// drifts are the changes failing verifySchema.
+		drifts []string
+		// check runs on the repaired db.
+		check func(t *testing.T, db *genji.DB)
+	}{
+		{
+			// Of a version before is_internal, backfilled for the index
+			fixture: "missing_columns",
+			check: func(t *testing.T, db *genji.DB) {
+				if n := queryCount(t, db, "SELECT COUNT(*) FROM sql_digest WHERE is_internal = false"); n != 2 {
+					t.Fatalf("got %d rows backfilled not internal, want 2", n)
+				}
+				if err := db.Exec("INSERT INTO instance (instance, job, last_seen) VALUES ('tidb-1:10080', 'tidb', 1632700800)"); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			// Written by another tool, nullable or with a default
+			fixture: "extra_columns",
+			check: func(t *testing.T, db *genji.DB) {
+				if err := db.Exec("INSERT INTO sql_digest (digest, tenant, sql_text, is_internal) VALUES ('a10b', '', 'select 1', false)"); err != nil {
+					t.Fatal(err)
+				}
+				if err := db.Exec("INSERT INTO instance (instance, job) VALUES ('tidb-0:10080', 'tidb')"); err != nil {
+					t.Fatal(err)
+				}
+				if n := queryCount(t, db, "SELECT COUNT(*) FROM sql_digest WHERE sql_hash = 'h1'"); n != 1 {
+					t.Fatalf("got %d rows keeping the extra column, want 1", n)
+				}
+			},
+		},
+		{
+			// Failing every insert of the store
+			fixture: "extra_not_null",
+			drifts:  []string{"table instance differs, region TEXT NOT NULL instead of region nullable"},
+		},
+		{
+			fixture: "wrong_types",
+			drifts: []string{
+				"table sql_digest differs, digest INTEGER PRIMARY KEY instead of digest TEXT PRIMARY KEY",
+				"table sql_digest differs, first_seen TEXT instead of first_seen INTEGER",
+				"table watermark differs, sample_ms DOUBLE instead of sample_ms INTEGER",
+			},
+		},
+		{
+			fixture: "stale_index",
+			check: func(t *testing.T, db *genji.DB) {
+				_, indexes, err := loadCatalog(db)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := "CREATE INDEX sql_plan_sql_digest ON sql_plan (sql_digest)"; indexes["sql_plan_sql_digest"] != want {
+					t.Fatalf("got index %q, want %q", indexes["sql_plan_sql_digest"], want)
+				}
+				if n := queryCount(t, db, "SELECT COUNT(*) FROM sql_plan WHERE sql_digest = '5e4c'"); n != 1 {
+					t.Fatalf("got %d rows by the rebuilt index, want 1", n)
+				}
+			},
+		},
+	} {
+		t.Run(tt.fixture, func(t *testing.T) {
+			db := openSchemaFixture(t, tt.fixture)
+			changes, err := CheckSchema(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var drifts []string
+			for _, c := range changes {
+				if !c.Repairable() {
+					drifts = append(drifts, c.String())
+				}
+			}
+			if strings.Join(drifts, "\n") != strings.Join(tt.drifts, "\n") {
+				t.Fatalf("got drifts %q, want %q", drifts, tt.drifts)
+			}
+
+			err = verifySchema(db)
+			if len(tt.drifts) != 0 {
+				if !errors.Is(err, ErrSchemaDrift) {
+					t.Fatalf("got error %v, want a schema drift", err)
+				}
+				for _, drift := range tt.drifts {
+					if !strings.Contains(err.Error(), drift) {
+						t.Fatalf("got error %v, want it naming %q", err, drift)
+					}
+				}
+				// Failed fast, nothing repaired
+				after, err := CheckSchema(db)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(after) != len(changes) {
+					t.Fatalf("got %d changes after the failure, want the %d ones left", len(after), len(changes))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if after, err := CheckSchema(db); err != nil || len(after) != 0 {
+				t.Fatalf("got changes %v and error %v after the repair, want none", after, err)
+			}
+			tt.check(t, db)
+		})
+	}
+}
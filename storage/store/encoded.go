@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var encodedRetryBackoff = pflag.Duration("store.encoded-retry-backoff", time.Second, "Wait after a retryable failure of an encoded write before retrying it, until its ctx is done")
+
+var (
+	encodedWritesCounter   = metrics.NewCounter(`diag_store_encoded_writes_total`)
+	encodedMetricsCounter  = metrics.NewCounter(`diag_store_encoded_metrics_total`)
+	encodedRetriesCounter  = metrics.NewCounter(`diag_store_encoded_retries_total`)
+	encodedFailuresCounter = metrics.NewCounter(`diag_store_encoded_failures_total`)
+
+	// encodedTarget is the writer Init got if it imports encoded bodies, nil
+	// otherwise.
+	encodedTarget encodedWriter
+)
+
+// encodedWriter is a MetricWriter importing bodies encoded already.
+type encodedWriter interface {
+	writeEncoded(requestID string, body []byte) error
+}
+
+// WriteEncoded imports body, metricCount metrics encoded as an import body of
+// the writer given to Init, e.g. NDJSON, as is. It takes the in-flight budget
+// and is retried on the retryable failures until ctx is done, but skips the
+// async queue and the wal, the watermarks and the read back of the writes.
+// Only a writer of NewHandlerWriter takes encoded bodies.
+func WriteEncoded(ctx context.Context, body []byte, metricCount int) error {
+	exit, err := enter()
+	if err != nil {
+		return err
+	}
+	defer exit()
+	target := encodedTarget
+	if target == nil {
+		return fmt.Errorf("%w: the metric writer takes no encoded bodies", ErrInvalidConfig)
+	}
+	if len(body) == 0 {
+		return nil
+	}
+
+	release, err := acquireInflightBytes(ctx, len(body))
+	if err != nil {
+		encodedFailuresCounter.Inc()
+		return err
+	}
+	defer release()
+
+	requestID := RequestIDFrom(ctx)
+	for {
+		if err := ctx.Err(); err != nil {
+			encodedFailuresCounter.Inc()
+			return err
+		}
+		err := target.writeEncoded(requestID, body)
+		if err == nil {
+			break
+		}
+		if !IsRetryable(err) {
+			encodedFailuresCounter.Inc()
+			return err
+		}
+		encodedRetriesCounter.Inc()
+		log.Debug("failed to write an encoded body, retrying", zap.String("request_id", requestID), zap.Error(err))
+		timer := clock.NewTimer(*encodedRetryBackoff)
+		select {
+		case <-timer.C():
+		case <-ctx.Done():
+			timer.Stop()
+			encodedFailuresCounter.Inc()
+			return err
+		}
+	}
+	encodedWritesCounter.Inc()
+	encodedMetricsCounter.Add(metricCount)
+	notifyFlushEncoded(metricCount, body)
+	return nil
+}
@@ -0,0 +1,34 @@
+package store
+
+import "errors"
+
+// The failure modes of the store, wrapped by the errors returned so callers
+// can tell them apart with errors.Is.
+var (
+	// ErrClosed is returned by the ingestion calls once Stop began, and by the
+	// writers once closed.
+	ErrClosed = errors.New("store is closed")
+	// ErrNotInitialized is returned by the ingestion calls before Init, and by
+	// the writes of metrics if Init got no writer.
+	ErrNotInitialized = errors.New("store is not initialized")
+	// ErrBackendUnavailable is returned when the timeseries db or the sink
+	// fails to take the metrics, which may be retried.
+	ErrBackendUnavailable = errors.New("backend unavailable")
+	// ErrRateLimited is returned when the backend or the in-flight budget of
+	// the store pushes back.
+	ErrRateLimited = errors.New("rate limited")
+	// ErrInvalidConfig is returned for invalid options of the store or its writers.
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrInvalidMetric is returned for malformed metrics caught by
+	// --store.validate-metrics or rejected by the timeseries db.
+	ErrInvalidMetric = errors.New("invalid metric")
+	// ErrInvalidDigest is returned for digests containing the "/" separating
+	// the tenant of the keys of the meta tables.
+	ErrInvalidDigest = errors.New("invalid digest")
+	// ErrSchemaDrift is returned by Init when a table of the document db is
+	// not of the shape the store writes, to migrate by hand.
+	ErrSchemaDrift = errors.New("schema drift")
+	// ErrNoDeleteEndpoint is returned by DeleteSeries when the metrics are not
+	// written to a backend it can delete from.
+	ErrNoDeleteEndpoint = errors.New("no delete endpoint configured")
+)
@@ -0,0 +1,15 @@
+package store
+
+// The failpoints of the store, for the tests to inject errors with failpoint.Enable.
+const (
+	// FailpointGenjiExec fails the statements and transactions of the meta writes.
+	FailpointGenjiExec = "store/genji-exec"
+	// FailpointHTTPPost fails the import requests of the handler writer.
+	FailpointHTTPPost = "store/http-post"
+	// FailpointWALAppend fails the appends to the wal, once their room is
+	// reserved.
+	FailpointWALAppend = "store/wal-append"
+	// FailpointConflictProbe fails the ON CONFLICT statement of the probe of the
+	// document db, as a genji version without it does.
+	FailpointConflictProbe = "store/conflict-probe"
+)
@@ -0,0 +1,97 @@
+package store_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/failpoint"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+func countRows(t *testing.T, db *genji.DB, table string) int {
+	t.Helper()
+	d, err := db.QueryDocument("SELECT COUNT(*) FROM " + table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := document.Scan(d, &n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestInsertFallbackWithoutConflictSupport(t *testing.T) {
+	// Probed as a genji version without ON CONFLICT DO NOTHING
+	failpoint.Enable(store.FailpointConflictProbe, func() error {
+		return errors.New("found ON, expected ;")
+	})
+	s, err := testutil.NewMemStore()
+	failpoint.Disable(store.FailpointConflictProbe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if store.Diagnose().ConflictSupported {
+		t.Fatal("got conflict supported, want the fallback")
+	}
+
+	// Inserted once, the rows of later batches left as is. The digests are of
+	// this test only, the seen caches outliving the stores of the other ones
+	for _, text := range []string{"select 1", "select 2"} {
+		if err := s.SeedSQLMeta([]byte{0xfa, 0x11}, text); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SeedPlanMeta([]byte{0xfb, 0x22}, text); err != nil {
+			t.Fatal(err)
+		}
+		err := store.TopSQLRecords([]*tipb.CPUTimeRecord{{
+			SqlDigest:              []byte{0xfa, 0x11},
+			PlanDigest:             []byte{0xfb, 0x22},
+			Instance:               "tidb-0:10080",
+			Job:                    "tidb",
+			RecordListTimestampSec: []uint64{1632700800},
+			RecordListCpuTimeMs:    []uint32{10},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := storedTexts(t, s.DB, "sql_digest", "sql_text")["fa11"]; got != "select 1" {
+		t.Fatalf("got sql text %q, want the first one kept", got)
+	}
+	if got := storedTexts(t, s.DB, "plan_digest", "plan_text")["fb22"]; got != "select 1" {
+		t.Fatalf("got plan text %q, want the first one kept", got)
+	}
+	for _, table := range []string{"sql_digest", "plan_digest", "sql_plan", "instance"} {
+		if got := countRows(t, s.DB, table); got != 1 {
+			t.Fatalf("got %d rows of %s, want 1", got, table)
+		}
+	}
+
+	// Concurrent inserts of a key do not conflict
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			metas := []*tipb.SQLMeta{
+				{SqlDigest: []byte{0x01}, NormalizedSql: "select 3"},
+				{SqlDigest: []byte{0x02}, NormalizedSql: "select 4"},
+			}
+			if err := store.SQLMetas(metas); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := countRows(t, s.DB, "sql_digest"); got != 3 {
+		t.Fatalf("got %d rows of sql_digest, want 3", got)
+	}
+}
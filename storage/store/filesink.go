@@ -0,0 +1,293 @@
+package store
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	fileSinkPrefix     = "metrics"
+	fileSinkActiveName = fileSinkPrefix + ".ndjson"
+)
+
+type FileSinkConfig struct {
+	// Dir is the directory holding the metric files.
+	Dir string
+	// MaxFileSize is the size in bytes at which the active file is rotated.
+	MaxFileSize int64
+	// RetentionBytes caps the total size of rotated files, the oldest ones are
+	// deleted when exceeded. Zero means no cap.
+	RetentionBytes int64
+	// Compress enables gzip compression of the written metrics.
+	Compress bool
+	// LabelPolicy sanitizes the labels before encoding.
+	LabelPolicy LabelPolicy
+}
+
+var _ MetricWriter = &FileSink{}
+
+// FileSink appends NDJSON encoded metrics to size-rotated files in a directory.
+//
+// Rotation renames the active file to a timestamped name, so a crash leaves either
+// the complete active file or a complete rotated one. A crash in the middle of a
+// write may leave a truncated tail, which ReadFileSink skips.
+type FileSink struct {
+	cfg FileSinkConfig
+
+	mu     sync.Mutex
+	active *os.File
+	size   int64
+}
+
+func NewFileSink(cfg FileSinkConfig) (*FileSink, error) {
+	if len(cfg.Dir) == 0 {
+		return nil, fmt.Errorf("%w: empty file sink directory", ErrInvalidConfig)
+	}
+	if cfg.MaxFileSize <= 0 {
+		return nil, fmt.Errorf("%w: unexpected max file size %d", ErrInvalidConfig, cfg.MaxFileSize)
+	}
+	if err := os.MkdirAll(cfg.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	s := &FileSink{cfg: cfg}
+
+	// The active file left by the previous run may be encoded differently, seal it first.
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	if err := s.openActive(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileSink) WriteMetrics(metrics []Metric) error {
+	buf := bytesP.Get()
+	defer bytesP.Put(buf)
+
+	metrics = sanitizeLabels(metrics, s.cfg.LabelPolicy)
+	if s.cfg.Compress {
+		// Each write produces an individual gzip member. Concatenated members are
+		// still a valid gzip stream.
+		gw := gzip.NewWriter(buf)
+		if err := encodeMetrics(gw, metrics); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+	} else if err := encodeMetrics(buf, metrics); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return fmt.Errorf("%w: file sink is closed", ErrClosed)
+	}
+
+	n, err := s.active.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if s.size < s.cfg.MaxFileSize {
+		return nil
+	}
+	if err = s.active.Close(); err != nil {
+		return err
+	}
+	s.active = nil
+	if err = s.rotate(); err != nil {
+		return err
+	}
+	if err = s.prune(); err != nil {
+		return err
+	}
+	return s.openActive()
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active == nil {
+		return nil
+	}
+	err := s.active.Close()
+	s.active = nil
+	return err
+}
+
+func (s *FileSink) openActive() error {
+	file, err := os.OpenFile(filepath.Join(s.cfg.Dir, s.activeName()), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	s.active = file
+	s.size = stat.Size()
+	return nil
+}
+
+// rotate renames an existing non-empty active file to a sealed one.
+func (s *FileSink) rotate() error {
+	for _, name := range []string{fileSinkActiveName, fileSinkActiveName + ".gz"} {
+		activePath := filepath.Join(s.cfg.Dir, name)
+		stat, err := os.Stat(activePath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if stat.Size() == 0 {
+			if err = os.Remove(activePath); err != nil {
+				return err
+			}
+			continue
+		}
+
+		ext := strings.TrimPrefix(name, fileSinkPrefix)
+		sealed := fmt.Sprintf("%s-%020d%s", fileSinkPrefix, clock.Now().UnixNano(), ext)
+		if err = os.Rename(activePath, filepath.Join(s.cfg.Dir, sealed)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prune deletes the oldest sealed files until they fit into the retention size.
+func (s *FileSink) prune() error {
+	if s.cfg.RetentionBytes <= 0 {
+		return nil
+	}
+
+	sealed, err := sealedFiles(s.cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, f := range sealed {
+		total += f.Size()
+	}
+	for _, f := range sealed {
+		if total <= s.cfg.RetentionBytes {
+			break
+		}
+		if err = os.Remove(filepath.Join(s.cfg.Dir, f.Name())); err != nil {
+			return err
+		}
+		total -= f.Size()
+	}
+	return nil
+}
+
+func (s *FileSink) activeName() string {
+	if s.cfg.Compress {
+		return fileSinkActiveName + ".gz"
+	}
+	return fileSinkActiveName
+}
+
+// sealedFiles returns the rotated files in the directory, oldest first.
+func sealedFiles(dir string) ([]os.FileInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []os.FileInfo
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasPrefix(name, fileSinkPrefix+"-") {
+			continue
+		}
+		res = append(res, info)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name() < res[j].Name()
+	})
+	return res, nil
+}
+
+// ReadFileSink decodes all metrics written by a FileSink in dir, oldest first,
+// and calls fn for each of them. It stops at the first error returned by fn.
+func ReadFileSink(dir string, fn func(m Metric) error) error {
+	sealed, err := sealedFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, f := range sealed {
+		names = append(names, f.Name())
+	}
+	names = append(names, fileSinkActiveName, fileSinkActiveName+".gz")
+
+	for _, name := range names {
+		if err = readMetricFile(filepath.Join(dir, name), fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readMetricFile(path string, fn func(m Metric) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = bufio.NewReader(file)
+	if strings.HasSuffix(path, ".gz") {
+		gr, err := gzip.NewReader(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	decoder := json.NewDecoder(r)
+	for {
+		var m Metric
+		err = decoder.Decode(&m)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A truncated tail is left by a crash in the middle of a write.
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		if err = fn(m); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package store
+
+import "sync/atomic"
+
+// onFlush holds the func set by SetOnFlush, nil if none.
+var onFlush atomic.Value // func(count int, bytes int)
+
+// SetOnFlush sets fn to be called after each successful write of metrics,
+// with their number and estimated encoded size in bytes, or none if nil. The
+// metrics are written or appended to the wal then, see Ack, the ones queued by
+// --store.async-buffer-size once written from the queue. fn is never called
+// for failed, rejected or dropped metrics, runs on the writing goroutine and
+// must not block.
+func SetOnFlush(fn func(count int, bytes int)) {
+	onFlush.Store(fn)
+}
+
+func notifyFlush(metrics []Metric) {
+	fn, _ := onFlush.Load().(func(count int, bytes int))
+	if fn != nil && len(metrics) != 0 {
+		fn(len(metrics), EstimateEncodedSize(metrics))
+	}
+}
+
+// notifyFlushEncoded notifies of an encoded body of count metrics written.
+func notifyFlushEncoded(count int, body []byte) {
+	fn, _ := onFlush.Load().(func(count int, bytes int))
+	if fn != nil && len(body) != 0 {
+		fn(count, len(body))
+	}
+}
@@ -0,0 +1,81 @@
+package store_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+// countingWriter counts the metrics written, failing the writes with err if set.
+type countingWriter struct {
+	mu      sync.Mutex
+	err     error
+	written int
+}
+
+func (w *countingWriter) WriteMetrics(metrics []store.Metric) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.written += len(metrics)
+	return nil
+}
+
+func TestOnFlushCountsWrittenMetrics(t *testing.T) {
+	for _, tt := range []struct {
+		bufferSize string
+		err        error
+	}{
+		{bufferSize: "0"},
+		{bufferSize: "16"},
+		// The metrics of the records overflow the queue
+		{bufferSize: "1"},
+		{bufferSize: "0", err: store.ErrInvalidMetric},
+		{bufferSize: "16", err: store.ErrInvalidMetric},
+	} {
+		t.Run(fmt.Sprintf("async-buffer-size=%s,err=%v", tt.bufferSize, tt.err), func(t *testing.T) {
+			if err := pflag.Set("store.async-buffer-size", tt.bufferSize); err != nil {
+				t.Fatal(err)
+			}
+			defer pflag.Set("store.async-buffer-size", "0")
+			db, err := genji.Open(":memory:")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			var mu sync.Mutex
+			flushed := 0
+			store.SetOnFlush(func(count int, bytes int) {
+				mu.Lock()
+				flushed += count
+				mu.Unlock()
+			})
+			defer store.SetOnFlush(nil)
+			w := &countingWriter{err: tt.err}
+			store.Init(w, db, nil)
+
+			other := cpuTimeRecord(1632700800, 10)
+			other.SqlDigest = []byte{0x7f, 0x1d}
+			_ = store.TopSQLRecords([]*tipb.CPUTimeRecord{cpuTimeRecord(1632700800, 35), other})
+			// Stop flushes the queue
+			store.Stop()
+
+			mu.Lock()
+			defer mu.Unlock()
+			if flushed != w.written {
+				t.Fatalf("got %d metrics flushed, want %d written", flushed, w.written)
+			}
+			if tt.err == nil && w.written == 0 {
+				t.Fatal("no metric written")
+			}
+		})
+	}
+}
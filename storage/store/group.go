@@ -0,0 +1,98 @@
+package store
+
+import (
+	"context"
+
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// GroupTagRecord mirrors `resource_usage_agent.GroupTagRecord` of newer kvproto versions,
+// where the samples of all resource dimensions are grouped under one ResourceGroupTag.
+// The vendored kvproto still only carries the flat `CPUTimeRecord`, so the receiver
+// converts the proto message into this shape.
+type GroupTagRecord struct {
+	ResourceGroupTag []byte
+	Items            []GroupTagRecordItem
+}
+
+type GroupTagRecordItem struct {
+	TimestampSec uint64
+	CPUTimeMs    uint64
+	ReadKeys     uint64
+	WriteKeys    uint64
+}
+
+func ResourceMeteringGroupRecords(ctx context.Context, records []*GroupTagRecord, instance string) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tenant := TenantFrom(ctx)
+	if err := CheckTenant(tenant); err != nil {
+		return err
+	}
+	instance = NormalizeInstance(instance)
+
+	discovered := discoverInstances(documentDB, 1, func(int) string {
+		return instance
+	})
+
+	err := ingest(ctx, Source{Tenant: tenant, RequestID: RequestIDFrom(ctx)}, 1, func(int) (string, string) {
+		return instance, ""
+	}, func(target *[]Metric) error {
+		return fillGroupTagRecordsToMetric(records, instance, target)
+	})
+	if err != nil {
+		return err
+	}
+	notifyInstances(discovered)
+	return nil
+}
+
+// transform GroupTagRecord to util.Metric, one series per resource dimension
+func fillGroupTagRecordsToMetric(
+	records []*GroupTagRecord,
+	instance string,
+	target *[]Metric,
+) error {
+	tag := tipb.ResourceGroupTag{}
+	units := timestampUnitsOf(CurrentConfig())
+
+	for _, rawRecord := range records {
+		if err := decodeResourceGroupTag(rawRecord.ResourceGroupTag, &tag); err != nil {
+			return err
+		}
+
+		var readKeys, writeKeys bool
+		for _, item := range rawRecord.Items {
+			readKeys = readKeys || item.ReadKeys != 0
+			writeKeys = writeKeys || item.WriteKeys != 0
+		}
+
+		cpu := appendTaggedMetric(target, MetricName(MetricCPUTime), instance, "", &tag)
+		for _, item := range rawRecord.Items {
+			cpu.Timestamps = append(cpu.Timestamps, units.toMillis(item.TimestampSec, instance, ""))
+			cpu.Values = append(cpu.Values, item.CPUTimeMs)
+		}
+
+		// Skip the dimensions never reported to avoid creating all-zero series.
+		if readKeys {
+			m := appendTaggedMetric(target, MetricName(MetricReadKeys), instance, "", &tag)
+			for _, item := range rawRecord.Items {
+				m.Timestamps = append(m.Timestamps, units.toMillis(item.TimestampSec, instance, ""))
+				m.Values = append(m.Values, item.ReadKeys)
+			}
+		}
+		if writeKeys {
+			m := appendTaggedMetric(target, MetricName(MetricWriteKeys), instance, "", &tag)
+			for _, item := range rawRecord.Items {
+				m.Timestamps = append(m.Timestamps, units.toMillis(item.TimestampSec, instance, ""))
+				m.Values = append(m.Values, item.WriteKeys)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package store
+
+import "github.com/spf13/pflag"
+
+var (
+	emitHeartbeat = pflag.Bool("store.emit-heartbeat", false, "Emit a topsql_up sample with value 1 per instance on each ingestion, at the newest timestamp of the batch")
+)
+
+// appendHeartbeats appends one topsql_up sample per instance of metrics, so that an
+// instance stopping reporting is distinguishable from one reporting zero CPU.
+func appendHeartbeats(target *[]Metric) {
+	n := len(*target)
+	for i := 0; i < n; i++ {
+		src := &(*target)[i]
+		if len(src.Timestamps) == 0 {
+			continue
+		}
+
+		maxTs := src.Timestamps[0]
+		for _, ts := range src.Timestamps[1:] {
+			if ts > maxTs {
+				maxTs = ts
+			}
+		}
+
+		var hb *Metric
+		for j := n; j < len(*target); j++ {
+			if (*target)[j].Metric.Instance == src.Metric.Instance {
+				hb = &(*target)[j]
+				break
+			}
+		}
+		if hb == nil {
+			m := Metric{Timestamps: []uint64{maxTs}, Values: []uint64{1}}
+			m.Metric.Name = MetricName(MetricHeartbeat)
+			m.Metric.Instance = src.Metric.Instance
+			m.Metric.Job = src.Metric.Job
+			*target = append(*target, m)
+			continue
+		}
+		if maxTs > hb.Timestamps[0] {
+			hb.Timestamps[0] = maxTs
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package store
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/zhongzc/diag_backend/utils"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	histogramBuckets = pflag.Int("store.cpu-histogram-buckets", 0, "Emit the cpu time samples of each series and ingestion as a histogram of this many exponential buckets, i.e. cpu_time_bucket, cpu_time_count and cpu_time_sum, instead of cpu_time, which the Top SQL queries read. 0 disables it")
+	histogramStart   = pflag.Float64("store.cpu-histogram-start", 1, "Upper bound in milliseconds of the first cpu time histogram bucket")
+	histogramFactor  = pflag.Float64("store.cpu-histogram-factor", 2, "Factor between the upper bounds of consecutive cpu time histogram buckets")
+)
+
+// cpuHistogramBounds are the upper bounds of the cpu time buckets, nil if disabled.
+var cpuHistogramBounds []float64
+
+// ExponentialBuckets returns count upper bounds starting at start, each factor times the previous one.
+func ExponentialBuckets(start, factor float64, count int) ([]float64, error) {
+	if count <= 0 || start <= 0 || factor <= 1 {
+		return nil, fmt.Errorf("%w: invalid exponential buckets, expect a positive count and start and a factor above 1, got %d, %g and %g", ErrInvalidConfig, count, start, factor)
+	}
+
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds, nil
+}
+
+// bucketize replaces each cpu_time series by a histogram of its samples at
+// the newest timestamp, the cumulative cpu_time_bucket series by the upper bound
+// `le` plus cpu_time_count and cpu_time_sum. The histograms of an ingestion are
+// not accumulated with the previous ones.
+func bucketize(metrics *[]Metric, bounds []float64) {
+	name := MetricName(MetricCPUTime)
+	n := 0
+	for _, m := range *metrics {
+		if m.Metric.Name == name && len(m.Timestamps) != 0 {
+			n++
+		}
+	}
+	if n == 0 {
+		return
+	}
+
+	res := make([]Metric, 0, len(*metrics)+n*(len(bounds)+2))
+	counts := make([]uint64, len(bounds))
+	for _, m := range *metrics {
+		if m.Metric.Name != name || len(m.Timestamps) == 0 {
+			res = append(res, m)
+			continue
+		}
+
+		maxTs := m.Timestamps[0]
+		for _, ts := range m.Timestamps[1:] {
+			if ts > maxTs {
+				maxTs = ts
+			}
+		}
+
+		for i := range counts {
+			counts[i] = 0
+		}
+		var sum uint64
+		for _, v := range m.Values {
+			sum = utils.AddSaturating(sum, v)
+			for i, bound := range bounds {
+				if float64(v) <= bound {
+					counts[i]++
+				}
+			}
+		}
+
+		for i, bound := range bounds {
+			res = append(res, histogramMetric(m.Metric, name+"_bucket", strconv.FormatFloat(bound, 'g', -1, 64), maxTs, counts[i]))
+		}
+		res = append(res, histogramMetric(m.Metric, name+"_bucket", "+Inf", maxTs, uint64(len(m.Values))))
+		res = append(res, histogramMetric(m.Metric, name+"_count", "", maxTs, uint64(len(m.Values))))
+		res = append(res, histogramMetric(m.Metric, name+"_sum", "", maxTs, sum))
+	}
+	*metrics = append((*metrics)[:0], res...)
+}
+
+func histogramMetric(tags topSQLTags, name, le string, ts uint64, value uint64) Metric {
+	tags.Name = name
+	if len(le) != 0 {
+		labels := make(map[string]string, len(tags.Labels)+1)
+		for key, value := range tags.Labels {
+			labels[key] = value
+		}
+		labels["le"] = le
+		tags.Labels = labels
+	}
+	return Metric{Metric: tags, Timestamps: []uint64{ts}, Values: []uint64{value}}
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	identityConflictWindow = pflag.Duration("store.identity-conflict-window", time.Minute, "Window within which records of an instance from two reporting fingerprints are taken as two agents claiming the instance, 0 to disable the detection")
+	identityConflictLabel  = pflag.Bool("store.identity-conflict-label", false, `Label the series of the agent claiming an instance already reported by another one with conflict="true"`)
+)
+
+var identityConflictCounter = metrics.NewCounter(`diag_store_identity_conflicts_total`)
+
+// identities is the owner of each instance, the fingerprint that reported it
+// first and kept reporting it within the window.
+var identities = newIdentityTracker()
+
+type instanceOwner struct {
+	fingerprint string
+	lastSeen    time.Time
+	// lastLogged is when the last conflict over the instance was logged.
+	lastLogged time.Time
+}
+
+type identityTracker struct {
+	mu     sync.Mutex
+	owners map[string]*instanceOwner
+}
+
+func newIdentityTracker() *identityTracker {
+	return &identityTracker{owners: make(map[string]*instanceOwner)}
+}
+
+// observe records that fingerprint reports instance at now, telling whether
+// another fingerprint owns the instance. The owner is taken over once silent
+// for the window.
+func (t *identityTracker) observe(instance, fingerprint string, now time.Time, window time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	owner, ok := t.owners[instance]
+	if !ok || owner.fingerprint == fingerprint || now.Sub(owner.lastSeen) >= window {
+		if !ok {
+			owner = &instanceOwner{}
+			t.owners[instance] = owner
+		}
+		owner.fingerprint = fingerprint
+		owner.lastSeen = now
+		return false
+	}
+
+	identityConflictCounter.Inc()
+	if now.Sub(owner.lastLogged) >= window {
+		owner.lastLogged = now
+		log.Error("two agents report as the same instance, their series are double counted",
+			zap.String("instance", instance),
+			zap.String("owner", owner.fingerprint),
+			zap.String("conflicting", fingerprint))
+	}
+	return true
+}
+
+// conflictingInstances returns the instances of records owned by another
+// fingerprint, nil if fingerprint is empty or the detection is disabled.
+func conflictingInstances(fingerprint string, records []*tipb.CPUTimeRecord) map[string]struct{} {
+	window := *identityConflictWindow
+	if len(fingerprint) == 0 || window <= 0 {
+		return nil
+	}
+
+	now := clock.Now()
+	var conflicting map[string]struct{}
+	observed := make(map[string]struct{})
+	for _, r := range records {
+		if _, ok := observed[r.Instance]; ok {
+			continue
+		}
+		observed[r.Instance] = struct{}{}
+		if identities.observe(r.Instance, fingerprint, now, window) {
+			if conflicting == nil {
+				conflicting = make(map[string]struct{})
+			}
+			conflicting[r.Instance] = struct{}{}
+		}
+	}
+	return conflicting
+}
+
+// labelConflicts labels the metrics of the conflicting instances with conflict="true" if enabled.
+func labelConflicts(metrics []Metric, conflicting map[string]struct{}) {
+	if len(conflicting) == 0 || !*identityConflictLabel {
+		return
+	}
+	for i := range metrics {
+		if _, ok := conflicting[metrics[i].Metric.Instance]; !ok {
+			continue
+		}
+		labels := make(map[string]string, len(metrics[i].Metric.Labels)+1)
+		for k, v := range metrics[i].Metric.Labels {
+			labels[k] = v
+		}
+		labels["conflict"] = "true"
+		metrics[i].Metric.Labels = labels
+	}
+}
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+var (
+	kafkaSentCounter            = metrics.NewCounter(`diag_store_kafka_messages_total{result="sent"}`)
+	kafkaDroppedOverflowCounter = metrics.NewCounter(`diag_store_kafka_messages_total{result="dropped_overflow"}`)
+	kafkaDroppedFailureCounter  = metrics.NewCounter(`diag_store_kafka_messages_total{result="dropped_failure"}`)
+	kafkaRetriesCounter         = metrics.NewCounter(`diag_store_kafka_retries_total`)
+)
+
+type KafkaMessage struct {
+	Key   []byte
+	Value []byte
+}
+
+// KafkaAcks is the acknowledgement level required from the brokers.
+type KafkaAcks int
+
+const (
+	KafkaAcksNone   KafkaAcks = 0
+	KafkaAcksLeader KafkaAcks = 1
+	KafkaAcksAll    KafkaAcks = -1
+)
+
+// KafkaProducer is the subset of a Kafka client KafkaSink depends on.
+type KafkaProducer interface {
+	// Produce publishes messages to topic and returns after they are acknowledged at the acks level.
+	Produce(topic string, acks KafkaAcks, messages []KafkaMessage) error
+}
+
+type KafkaSinkConfig struct {
+	Topic string
+	Acks  KafkaAcks
+	// BatchSize is the max number of messages per Produce call.
+	BatchSize int
+	// BufferSize is the max number of pending messages. New messages are dropped when full.
+	BufferSize int
+	// FlushInterval is the max time a message stays buffered before being produced.
+	FlushInterval time.Duration
+	// MaxRetries is the number of retries of a failed Produce call before its messages are dropped.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// LabelPolicy sanitizes the labels before encoding.
+	LabelPolicy LabelPolicy
+}
+
+var _ MetricWriter = &KafkaSink{}
+
+// KafkaSink publishes each metric as a JSON message keyed by instance. Messages are
+// produced by a single background goroutine, so the order of a series is preserved.
+type KafkaSink struct {
+	cfg      KafkaSinkConfig
+	producer KafkaProducer
+
+	pending chan KafkaMessage
+	closeMu sync.RWMutex
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+func NewKafkaSink(producer KafkaProducer, cfg KafkaSinkConfig) (*KafkaSink, error) {
+	if producer == nil {
+		return nil, fmt.Errorf("%w: nil kafka producer", ErrInvalidConfig)
+	}
+	if len(cfg.Topic) == 0 {
+		return nil, fmt.Errorf("%w: empty kafka topic", ErrInvalidConfig)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.BufferSize <= 0 {
+		cfg.BufferSize = 64 * 1024
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+
+	s := &KafkaSink{
+		cfg:      cfg,
+		producer: producer,
+		pending:  make(chan KafkaMessage, cfg.BufferSize),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// WriteMetrics enqueues metrics without waiting for them to be produced.
+func (s *KafkaSink) WriteMetrics(metrics []Metric) error {
+	s.closeMu.RLock()
+	defer s.closeMu.RUnlock()
+
+	if s.closed {
+		return fmt.Errorf("%w: kafka sink is closed", ErrClosed)
+	}
+
+	for _, m := range sanitizeLabels(metrics, s.cfg.LabelPolicy) {
+		value, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+
+		select {
+		case s.pending <- KafkaMessage{Key: []byte(m.Metric.Instance), Value: value}:
+		default:
+			kafkaDroppedOverflowCounter.Inc()
+		}
+	}
+	return nil
+}
+
+// Close stops accepting metrics and waits until the buffered ones are produced or dropped.
+func (s *KafkaSink) Close() error {
+	s.closeMu.Lock()
+	if s.closed {
+		s.closeMu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.pending)
+	s.closeMu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+func (s *KafkaSink) run() {
+	defer s.wg.Done()
+
+	ticker := clock.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]KafkaMessage, 0, s.cfg.BatchSize)
+	for {
+		select {
+		case msg, ok := <-s.pending:
+			if !ok {
+				s.produce(batch)
+				return
+			}
+			batch = append(batch, msg)
+			if len(batch) >= s.cfg.BatchSize {
+				s.produce(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C():
+			s.produce(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (s *KafkaSink) produce(batch []KafkaMessage) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	for i := 0; i <= s.cfg.MaxRetries; i++ {
+		if i > 0 {
+			kafkaRetriesCounter.Inc()
+			time.Sleep(s.cfg.RetryBackoff)
+		}
+		if err = s.producer.Produce(s.cfg.Topic, s.cfg.Acks, batch); err == nil {
+			kafkaSentCounter.Add(len(batch))
+			return
+		}
+	}
+
+	kafkaDroppedFailureCounter.Add(len(batch))
+	log.Warn("failed to produce metrics to kafka",
+		zap.String("topic", s.cfg.Topic),
+		zap.Int("messages", len(batch)),
+		zap.Error(err),
+	)
+}
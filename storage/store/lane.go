@@ -0,0 +1,64 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/pflag"
+)
+
+var metaPriority = pflag.Bool("store.meta-priority", false, "Let the meta writes take the document db ahead of the instance rows of the waiting reports, so that the metas are not queued behind a flood of reports")
+
+var metaLagHistogram = metrics.NewHistogram(`diag_store_meta_lag_seconds`)
+
+// metaLanes orders the writes of the document db with --store.meta-priority:
+// a report waits for the meta writes started before it, and the meta writes
+// started after it wait for the genji lock only, so that the metas are not
+// queued behind the reports of a flood.
+var metaLanes = newLaneGate()
+
+type laneGate struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// entered and exited count the meta writes, the ones running being the
+	// difference.
+	entered, exited uint64
+}
+
+func newLaneGate() *laneGate {
+	g := &laneGate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// enterMeta marks a meta write as running until the returned func is called.
+func (g *laneGate) enterMeta() func() {
+	g.mu.Lock()
+	g.entered++
+	g.mu.Unlock()
+	return func() {
+		g.mu.Lock()
+		g.exited++
+		g.mu.Unlock()
+		g.cond.Broadcast()
+	}
+}
+
+// waitMetas waits for as many meta writes to end as are running, so a steady
+// flow of metas does not starve the report.
+func (g *laneGate) waitMetas() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	target := g.entered
+	for g.exited < target {
+		g.cond.Wait()
+	}
+}
+
+// observeMetaLag records the lag of a meta write received at start and just
+// committed.
+func observeMetaLag(start time.Time) {
+	metaLagHistogram.Update(clock.Now().Sub(start).Seconds())
+}
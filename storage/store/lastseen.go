@@ -0,0 +1,54 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// lastSeenResolution is the min interval between the updates of the last_seen
+// of an instance, to not write the instance table on every batch.
+const lastSeenResolution = time.Minute
+
+var lastSeen = struct {
+	sync.Mutex
+	touched map[string]int64 // instance -> the last_seen written, unix seconds
+}{touched: make(map[string]int64)}
+
+// touchInstances sets the last_seen of the instances to now, unless set within
+// lastSeenResolution. The returned func records the writes as done, to call
+// once db committed.
+func touchInstances(db execer, keys []instanceKey) (func(), error) {
+	now := clock.Now().Unix()
+
+	var stale []string
+	lastSeen.Lock()
+	for _, key := range keys {
+		if now-lastSeen.touched[key.instance] >= int64(lastSeenResolution.Seconds()) {
+			stale = append(stale, key.instance)
+		}
+	}
+	lastSeen.Unlock()
+	if len(stale) == 0 {
+		return func() {}, nil
+	}
+
+	err := update(db, func(tx execer) error {
+		for _, instance := range stale {
+			if err := tx.Exec("UPDATE instance SET last_seen = ? WHERE instance = ?", now, instance); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		lastSeen.Lock()
+		for _, instance := range stale {
+			lastSeen.touched[instance] = now
+		}
+		lastSeen.Unlock()
+	}, nil
+}
@@ -0,0 +1,66 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/genjidb/genji/document"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+func TestLastSeenOfTheClock(t *testing.T) {
+	clock := testutil.NewFakeClock(time.Unix(1632700830, 0))
+	store.SetClock(clock)
+	defer store.SetClock(utils.RealClock)
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The instance is of this test only, the written last_seen outliving the
+	// stores of the other ones
+	const instance = "tidb-7:10080"
+	lastSeen := func() int64 {
+		t.Helper()
+		d, err := s.DB.QueryDocument("SELECT last_seen FROM instance WHERE instance = ?", instance)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var secs int64
+		if err := document.Scan(d, &secs); err != nil {
+			t.Fatal(err)
+		}
+		return secs
+	}
+
+	for _, step := range []struct {
+		advance time.Duration
+		want    int64
+	}{
+		{want: 1632700830},
+		// Within a minute of the last update
+		{advance: 59 * time.Second, want: 1632700830},
+		{advance: time.Second, want: 1632700890},
+		{advance: time.Hour, want: 1632704490},
+	} {
+		clock.Advance(step.advance)
+		err := store.TopSQLRecords([]*tipb.CPUTimeRecord{{
+			SqlDigest:              []byte{0x5e, 0x4c},
+			Instance:               instance,
+			Job:                    "tidb",
+			RecordListTimestampSec: []uint64{uint64(clock.Now().Unix())},
+			RecordListCpuTimeMs:    []uint32{35},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lastSeen(); got != step.want {
+			t.Fatalf("got last_seen %d at %d, want %d", got, clock.Now().Unix(), step.want)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package store_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+	"go.uber.org/goleak"
+)
+
+func TestStopLeavesNoGoroutines(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	// The background goroutines of the async queue, the cumulator and the
+	// config watcher, along with the ones of every store
+	configPath := filepath.Join(t.TempDir(), "store.conf")
+	// Changing nothing, so not audited
+	line := "store.max-sql-length=" + pflag.Lookup("store.max-sql-length").Value.String() + "\n"
+	if err := ioutil.WriteFile(configPath, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range map[string]string{
+		"store.async-buffer-size":    "16",
+		"store.cumulative-cpu-time":  "true",
+		"store.config-file":          configPath,
+		"store.config-file-interval": "10ms",
+	} {
+		old := pflag.Lookup(name).Value.String()
+		if err := pflag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		defer pflag.Set(name, old)
+	}
+
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.TopSQLRecords([]*tipb.CPUTimeRecord{{
+		SqlDigest:              []byte{0x5e, 0x4c},
+		Instance:               "tidb-0:10080",
+		Job:                    "tidb",
+		RecordListTimestampSec: []uint64{1632700800},
+		RecordListCpuTimeMs:    []uint32{35},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,37 @@
+package store
+
+import "sync"
+
+// lifecycle lets Stop wait for the ingestion calls in flight, and reject the
+// later ones, before the writers and the document db are closed.
+var lifecycle struct {
+	sync.RWMutex
+	opened, closed bool
+}
+
+// enter admits an ingestion call, which must call the returned exit once done.
+func enter() (exit func(), err error) {
+	lifecycle.RLock()
+	if !lifecycle.opened {
+		lifecycle.RUnlock()
+		return nil, ErrNotInitialized
+	}
+	if lifecycle.closed {
+		lifecycle.RUnlock()
+		return nil, ErrClosed
+	}
+	return lifecycle.RUnlock, nil
+}
+
+// closeLifecycle rejects the new ingestion calls and waits for the ones in flight.
+func closeLifecycle() {
+	lifecycle.Lock()
+	lifecycle.closed = true
+	lifecycle.Unlock()
+}
+
+func openLifecycle() {
+	lifecycle.Lock()
+	lifecycle.opened, lifecycle.closed = true, false
+	lifecycle.Unlock()
+}
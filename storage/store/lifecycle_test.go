@@ -0,0 +1,69 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+var testRecords = []*tipb.CPUTimeRecord{{
+	SqlDigest:              []byte{0x5e, 0x4c},
+	Instance:               "tidb-0:10080",
+	Job:                    "tidb",
+	RecordListTimestampSec: []uint64{1632700800},
+	RecordListCpuTimeMs:    []uint32{35},
+}}
+
+func TestIngestBeforeInit(t *testing.T) {
+	// As if no other test ran Init
+	lifecycle.Lock()
+	opened, closed := lifecycle.opened, lifecycle.closed
+	lifecycle.opened = false
+	lifecycle.Unlock()
+	defer func() {
+		lifecycle.Lock()
+		lifecycle.opened, lifecycle.closed = opened, closed
+		lifecycle.Unlock()
+	}()
+
+	if err := TopSQLRecords(testRecords); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("got error %v of the records, want %v", err, ErrNotInitialized)
+	}
+	if err := SQLMetas([]*tipb.SQLMeta{{SqlDigest: []byte{0x5e, 0x4c}, NormalizedSql: "select ?"}}); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("got error %v of the metas, want %v", err, ErrNotInitialized)
+	}
+	if err := WriteEncoded(context.Background(), []byte("{}\n"), 1); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("got error %v of the encoded write, want %v", err, ErrNotInitialized)
+	}
+}
+
+func TestIngestWithoutWriter(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	Init(nil, db, nil)
+
+	if err := TopSQLRecords(testRecords); !errors.Is(err, ErrNotInitialized) {
+		t.Errorf("got error %v of the records, want %v", err, ErrNotInitialized)
+	}
+	// The metas need no writer
+	if err := SQLMetas([]*tipb.SQLMeta{{SqlDigest: []byte{0x5e, 0x4c}, NormalizedSql: "select ?"}}); err != nil {
+		t.Errorf("got error %v of the metas", err)
+	}
+
+	Stop()
+	if err := TopSQLRecords(testRecords); !errors.Is(err, ErrClosed) {
+		t.Errorf("got error %v of the records after Stop, want %v", err, ErrClosed)
+	}
+	if err := SQLMetas([]*tipb.SQLMeta{{SqlDigest: []byte{0x5e, 0x4c}, NormalizedSql: "select ?"}}); !errors.Is(err, ErrClosed) {
+		t.Errorf("got error %v of the metas after Stop, want %v", err, ErrClosed)
+	}
+	if err := WriteEncoded(context.Background(), []byte("{}\n"), 1); !errors.Is(err, ErrClosed) {
+		t.Errorf("got error %v of the encoded write after Stop, want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,234 @@
+// Package loadgen generates synthetic TopSQL and resource metering workloads,
+// the same for the same seed, to measure the ingestion against.
+package loadgen
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// maxMisses is the number of statements drawn already in a row after which
+// batch takes the next one not drawn.
+const maxMisses = 8
+
+// Config shapes the workload.
+type Config struct {
+	// Seed makes the workload reproducible.
+	Seed int64
+	// Instances is the number of TiDB instances, and of TiKV instances for the
+	// resource metering records.
+	Instances int
+	// Statements is the number of SQL digests, drawn by Zipf's law of exponent
+	// ZipfS, which must be greater than 1. The larger, the more skewed.
+	Statements int
+	ZipfS      float64
+	// PlansPerStatement is the number of plan digests of each SQL digest.
+	PlansPerStatement int
+	// RecordsPerInstance is the number of records of an instance per batch, at
+	// most Statements as a batch has one record per instance and SQL digest.
+	RecordsPerInstance int
+	// SamplesPerRecord is the number of seconds of a record, one sample each.
+	SamplesPerRecord int
+	// SQLLength and PlanLength are the lengths of the normalized texts.
+	SQLLength  int
+	PlanLength int
+	// StartSecs is the unix time of the first sample.
+	StartSecs uint64
+}
+
+// DefaultConfig is a small cluster reporting a skewed workload every minute.
+func DefaultConfig() Config {
+	return Config{
+		Seed:               1,
+		Instances:          4,
+		Statements:         1000,
+		ZipfS:              1.1,
+		PlansPerStatement:  2,
+		RecordsPerInstance: 200,
+		SamplesPerRecord:   60,
+		SQLLength:          256,
+		PlanLength:         1024,
+		StartSecs:          1600000000,
+	}
+}
+
+func (cfg Config) validate() error {
+	switch {
+	case cfg.Instances <= 0:
+		return fmt.Errorf("%w: non-positive instance count %d", store.ErrInvalidConfig, cfg.Instances)
+	case cfg.Statements <= 0:
+		return fmt.Errorf("%w: non-positive statement count %d", store.ErrInvalidConfig, cfg.Statements)
+	case cfg.ZipfS <= 1:
+		return fmt.Errorf("%w: zipf exponent %v not greater than 1", store.ErrInvalidConfig, cfg.ZipfS)
+	case cfg.PlansPerStatement <= 0:
+		return fmt.Errorf("%w: non-positive plan count %d", store.ErrInvalidConfig, cfg.PlansPerStatement)
+	case cfg.RecordsPerInstance <= 0 || cfg.RecordsPerInstance > cfg.Statements:
+		return fmt.Errorf("%w: records per instance %d not within [1, %d]", store.ErrInvalidConfig, cfg.RecordsPerInstance, cfg.Statements)
+	case cfg.SamplesPerRecord <= 0:
+		return fmt.Errorf("%w: non-positive sample count %d", store.ErrInvalidConfig, cfg.SamplesPerRecord)
+	}
+	return nil
+}
+
+// Generator makes the batches of a workload one after another, each covering
+// the SamplesPerRecord seconds after the previous one. It is not safe for
+// concurrent use.
+type Generator struct {
+	cfg  Config
+	rng  *rand.Rand
+	zipf *rand.Zipf
+
+	sqlDigests  [][]byte
+	planDigests [][][]byte
+	nextSecs    uint64
+}
+
+func New(cfg Config) (*Generator, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	rng := rand.New(rand.NewSource(cfg.Seed))
+	g := &Generator{
+		cfg:      cfg,
+		rng:      rng,
+		zipf:     rand.NewZipf(rng, cfg.ZipfS, 1, uint64(cfg.Statements-1)),
+		nextSecs: cfg.StartSecs,
+	}
+	for i := 0; i < cfg.Statements; i++ {
+		g.sqlDigests = append(g.sqlDigests, g.digest())
+		plans := make([][]byte, 0, cfg.PlansPerStatement)
+		for j := 0; j < cfg.PlansPerStatement; j++ {
+			plans = append(plans, g.digest())
+		}
+		g.planDigests = append(g.planDigests, plans)
+	}
+	return g, nil
+}
+
+// SQLMetas returns the metas of all SQL digests.
+func (g *Generator) SQLMetas() []*tipb.SQLMeta {
+	metas := make([]*tipb.SQLMeta, 0, len(g.sqlDigests))
+	for i, digest := range g.sqlDigests {
+		metas = append(metas, &tipb.SQLMeta{SqlDigest: digest, NormalizedSql: sqlText(i, g.cfg.SQLLength)})
+	}
+	return metas
+}
+
+// PlanMetas returns the metas of all plan digests.
+func (g *Generator) PlanMetas() []*tipb.PlanMeta {
+	metas := make([]*tipb.PlanMeta, 0, len(g.planDigests)*g.cfg.PlansPerStatement)
+	for i, plans := range g.planDigests {
+		for j, digest := range plans {
+			metas = append(metas, &tipb.PlanMeta{PlanDigest: digest, NormalizedPlan: planText(i, j, g.cfg.PlanLength)})
+		}
+	}
+	return metas
+}
+
+// TopSQLBatch returns the TopSQL records of the next seconds of all TiDB instances.
+func (g *Generator) TopSQLBatch() []*tipb.CPUTimeRecord {
+	var records []*tipb.CPUTimeRecord
+	g.batch(func(instance int, stmt int, plan []byte, timestamps []uint64, cpuTimes []uint32) {
+		records = append(records, &tipb.CPUTimeRecord{
+			SqlDigest:              g.sqlDigests[stmt],
+			PlanDigest:             plan,
+			Instance:               fmt.Sprintf("tidb-%d:10080", instance),
+			Job:                    "tidb",
+			RecordListTimestampSec: timestamps,
+			RecordListCpuTimeMs:    cpuTimes,
+		})
+	})
+	return records
+}
+
+// ResourceMeteringBatch returns the resource metering records of the next
+// seconds of all TiKV instances.
+func (g *Generator) ResourceMeteringBatch() []*rsmetering.CPUTimeRecord {
+	var records []*rsmetering.CPUTimeRecord
+	g.batch(func(instance int, stmt int, plan []byte, timestamps []uint64, cpuTimes []uint32) {
+		tag, _ := (&tipb.ResourceGroupTag{SqlDigest: g.sqlDigests[stmt], PlanDigest: plan}).Marshal()
+		records = append(records, &rsmetering.CPUTimeRecord{
+			ResourceGroupTag:       tag,
+			Instance:               fmt.Sprintf("tikv-%d:20180", instance),
+			Job:                    "tikv",
+			RecordListTimestampSec: timestamps,
+			RecordListCpuTimeMs:    cpuTimes,
+		})
+	})
+	return records
+}
+
+// batch draws the statements of each instance and their samples, the hotter
+// statements taking the more cpu time.
+func (g *Generator) batch(fn func(instance int, stmt int, plan []byte, timestamps []uint64, cpuTimes []uint32)) {
+	startSecs := g.nextSecs
+	g.nextSecs += uint64(g.cfg.SamplesPerRecord)
+
+	for instance := 0; instance < g.cfg.Instances; instance++ {
+		drawn := make(map[int]struct{}, g.cfg.RecordsPerInstance)
+		misses := 0
+		for len(drawn) < g.cfg.RecordsPerInstance {
+			stmt := int(g.zipf.Uint64())
+			if _, ok := drawn[stmt]; ok {
+				if misses++; misses < maxMisses {
+					continue
+				}
+				// The tail is rarely drawn, take the next statement instead.
+				for ; ; stmt = (stmt + 1) % g.cfg.Statements {
+					if _, ok := drawn[stmt]; !ok {
+						break
+					}
+				}
+			}
+			misses = 0
+			drawn[stmt] = struct{}{}
+
+			timestamps := make([]uint64, 0, g.cfg.SamplesPerRecord)
+			cpuTimes := make([]uint32, 0, g.cfg.SamplesPerRecord)
+			maxCPUTime := 1 + 1000/(stmt+1)
+			for i := 0; i < g.cfg.SamplesPerRecord; i++ {
+				timestamps = append(timestamps, startSecs+uint64(i))
+				cpuTimes = append(cpuTimes, uint32(1+g.rng.Intn(maxCPUTime)))
+			}
+			plans := g.planDigests[stmt]
+			fn(instance, stmt, plans[g.rng.Intn(len(plans))], timestamps, cpuTimes)
+		}
+	}
+}
+
+func (g *Generator) digest() []byte {
+	digest := make([]byte, 32)
+	_, _ = g.rng.Read(digest)
+	return digest
+}
+
+func sqlText(stmt, length int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "select * from t%d where id = ?", stmt)
+	for i := 0; sb.Len() < length; i++ {
+		fmt.Fprintf(&sb, " and c%d = ?", i)
+	}
+	return truncate(sb.String(), length)
+}
+
+func planText(stmt, plan, length int) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Projection_%d\tt%d.*", plan, stmt)
+	for i := 0; sb.Len() < length; i++ {
+		fmt.Fprintf(&sb, "\n\tTableReader_%d\tdata:Selection_%d\tcop[tikv]\teq(t%d.c%d, ?)", i, i, stmt, i)
+	}
+	return truncate(sb.String(), length)
+}
+
+func truncate(s string, length int) string {
+	if length > 0 && len(s) > length {
+		return s[:length]
+	}
+	return s
+}
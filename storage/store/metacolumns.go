@@ -0,0 +1,180 @@
+package store
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// SQLMetaColumn is a column of sql_digest written for each SQL meta inserted.
+type SQLMetaColumn struct {
+	Name string
+	// Value returns the value of the column for meta, after the redaction of
+	// --store.redact-literals, nil for NULL.
+	Value func(meta *tipb.SQLMeta) interface{}
+}
+
+// PlanMetaColumn is a column of plan_digest written for each plan meta inserted.
+type PlanMetaColumn struct {
+	Name  string
+	Value func(meta *tipb.PlanMeta) interface{}
+}
+
+// sqlMetaRow is a SQL meta as inserted, the value of its columns.
+type sqlMetaRow struct {
+	meta       *tipb.SQLMeta
+	key, text  string
+	mismatched bool
+	firstSeen  int64
+}
+
+type planMetaRow struct {
+	meta      *tipb.PlanMeta
+	key, text string
+	firstSeen int64
+}
+
+type sqlMetaColumn struct {
+	name  string
+	value func(r *sqlMetaRow, tenant string) interface{}
+}
+
+type planMetaColumn struct {
+	name  string
+	value func(r *planMetaRow, tenant string) interface{}
+}
+
+// The columns every meta row has, the key first as insertMissing takes it.
+var (
+	baseSQLMetaColumns = []sqlMetaColumn{
+		{"digest", func(r *sqlMetaRow, _ string) interface{} { return r.key }},
+		{"tenant", func(_ *sqlMetaRow, tenant string) interface{} { return tenant }},
+		{"sql_text", func(r *sqlMetaRow, _ string) interface{} { return r.text }},
+		{"is_internal", func(r *sqlMetaRow, _ string) interface{} { return r.meta.IsInternalSql }},
+		{"digest_mismatch", func(r *sqlMetaRow, _ string) interface{} { return r.mismatched }},
+		{"first_seen", func(r *sqlMetaRow, _ string) interface{} { return r.firstSeen }},
+	}
+	basePlanMetaColumns = []planMetaColumn{
+		{"digest", func(r *planMetaRow, _ string) interface{} { return r.key }},
+		{"tenant", func(_ *planMetaRow, tenant string) interface{} { return tenant }},
+		{"plan_text", func(r *planMetaRow, _ string) interface{} { return r.text }},
+		{"first_seen", func(r *planMetaRow, _ string) interface{} { return r.firstSeen }},
+	}
+
+	sqlMetaColumns  atomic.Value // []sqlMetaColumn
+	planMetaColumns atomic.Value // []planMetaColumn
+)
+
+// SetSQLMetaColumns adds extra to the columns of the SQL metas inserted from
+// then on, e.g. a db_name the agent reports, replacing the extra ones set
+// before. The rows inserted already keep theirs.
+func SetSQLMetaColumns(extra ...SQLMetaColumn) error {
+	columns := append([]sqlMetaColumn(nil), baseSQLMetaColumns...)
+	names := make(map[string]bool, len(columns)+len(extra))
+	for _, c := range columns {
+		names[c.name] = true
+	}
+	for _, c := range extra {
+		if err := checkMetaColumn(names, c.Name, c.Value == nil); err != nil {
+			return err
+		}
+		value := c.Value
+		columns = append(columns, sqlMetaColumn{c.Name, func(r *sqlMetaRow, _ string) interface{} { return value(r.meta) }})
+	}
+	sqlMetaColumns.Store(columns)
+	return nil
+}
+
+// SetPlanMetaColumns adds extra to the columns of the plan metas inserted
+// from then on, like SetSQLMetaColumns.
+func SetPlanMetaColumns(extra ...PlanMetaColumn) error {
+	columns := append([]planMetaColumn(nil), basePlanMetaColumns...)
+	names := make(map[string]bool, len(columns)+len(extra))
+	for _, c := range columns {
+		names[c.name] = true
+	}
+	for _, c := range extra {
+		if err := checkMetaColumn(names, c.Name, c.Value == nil); err != nil {
+			return err
+		}
+		value := c.Value
+		columns = append(columns, planMetaColumn{c.Name, func(r *planMetaRow, _ string) interface{} { return value(r.meta) }})
+	}
+	planMetaColumns.Store(columns)
+	return nil
+}
+
+// checkMetaColumn checks an extra column name, adding it to the names taken.
+func checkMetaColumn(names map[string]bool, name string, noValue bool) error {
+	if !metricNameRegexp.MatchString(name) || strings.ContainsRune(name, ':') {
+		return fmt.Errorf("%w: invalid meta column name %q", ErrInvalidConfig, name)
+	}
+	if names[name] {
+		return fmt.Errorf("%w: meta column %q is set twice", ErrInvalidConfig, name)
+	}
+	if noValue {
+		return fmt.Errorf("%w: meta column %q has no value", ErrInvalidConfig, name)
+	}
+	names[name] = true
+	return nil
+}
+
+func currentSQLMetaColumns() []sqlMetaColumn {
+	if columns, ok := sqlMetaColumns.Load().([]sqlMetaColumn); ok {
+		return columns
+	}
+	return baseSQLMetaColumns
+}
+
+func currentPlanMetaColumns() []planMetaColumn {
+	if columns, ok := planMetaColumns.Load().([]planMetaColumn); ok {
+		return columns
+	}
+	return basePlanMetaColumns
+}
+
+// insertHeader returns the header and the element of an insert of the
+// columns names into table, quoted for the names being keywords.
+func insertHeader(table string, names []string) (header, elem string) {
+	header = "INSERT INTO " + table + "(`" + strings.Join(names, "`, `") + "`) VALUES "
+	elem = "(" + strings.TrimSuffix(strings.Repeat("?, ", len(names)), ", ") + ")"
+	return header, elem
+}
+
+// insertSQLMetaRows inserts rows of tenant into sql_digest with the current
+// columns.
+func insertSQLMetaRows(db execer, tenant string, rows []sqlMetaRow) error {
+	columns := currentSQLMetaColumns()
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	header, elem := insertHeader("sql_digest", names)
+	return insert(db, header, elem, len(rows), onConflictDoNothing, func(target *[]interface{}) {
+		for i := range rows {
+			for _, c := range columns {
+				*target = append(*target, c.value(&rows[i], tenant))
+			}
+		}
+	})
+}
+
+// insertPlanMetaRows inserts rows of tenant into plan_digest with the current
+// columns.
+func insertPlanMetaRows(db execer, tenant string, rows []planMetaRow) error {
+	columns := currentPlanMetaColumns()
+	names := make([]string, len(columns))
+	for i, c := range columns {
+		names[i] = c.name
+	}
+	header, elem := insertHeader("plan_digest", names)
+	return insert(db, header, elem, len(rows), onConflictDoNothing, func(target *[]interface{}) {
+		for i := range rows {
+			for _, c := range columns {
+				*target = append(*target, c.value(&rows[i], tenant))
+			}
+		}
+	})
+}
@@ -3,7 +3,7 @@ package store
 type Metric struct {
 	Metric     topSQLTags `json:"metric"`
 	Timestamps []uint64   `json:"timestamps"` // in millisecond
-	Values     []uint32   `json:"values"`
+	Values     []uint64   `json:"values"`
 }
 
 type topSQLTags struct {
@@ -12,4 +12,8 @@ type topSQLTags struct {
 	Job        string `json:"job"`
 	SQLDigest  string `json:"sql_digest"`
 	PlanDigest string `json:"plan_digest,omitempty"`
+
+	// Labels holds the labels beyond the fixed ones. Entries named after a
+	// fixed label are ignored by the encoders, the fixed fields always win.
+	Labels map[string]string `json:"-"`
 }
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+var (
+	normalizeInstances   = pflag.Bool("store.normalize-instances", false, "Normalize the instances reported and queried, so one node reported in several formats is one instance: trims spaces, schemes, paths and the trailing dot of hosts. Run `diagctl instances merge` once after enabling it")
+	instanceLowercase    = pflag.Bool("store.instance-lowercase", true, "Lowercase the hosts of the instances, with --store.normalize-instances")
+	instanceDefaultPorts = pflag.String("store.instance-default-ports", "", "Comma separated ports stripped from the instances, e.g. 4000,10080, with --store.normalize-instances")
+	instanceHostAliases  = pflag.String("store.instance-host-aliases", "", "Comma separated short=fqdn pairs replacing the hosts of the instances, e.g. tidb-0=tidb-0.tidb-peer.tidb.svc, with --store.normalize-instances")
+)
+
+// instanceNormalizer holds the normalization fixed at Init, nil if disabled.
+var instanceNormalizer atomic.Value // *normalizer
+
+type normalizer struct {
+	lowercase bool
+	ports     map[string]struct{}
+	aliases   map[string]string
+}
+
+func newNormalizer(cfg Config) (*normalizer, error) {
+	if !cfg.NormalizeInstances {
+		return nil, nil
+	}
+	n := &normalizer{
+		lowercase: cfg.InstanceLowercase,
+		ports:     make(map[string]struct{}),
+		aliases:   make(map[string]string),
+	}
+	for _, port := range strings.Split(cfg.InstanceDefaultPorts, ",") {
+		if port = strings.TrimSpace(port); len(port) != 0 {
+			n.ports[port] = struct{}{}
+		}
+	}
+	for _, pair := range strings.Split(cfg.InstanceHostAliases, ",") {
+		if pair = strings.TrimSpace(pair); len(pair) == 0 {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 || len(strings.TrimSpace(kv[1])) == 0 {
+			return nil, fmt.Errorf("%w: expect short=fqdn in --store.instance-host-aliases, got %q", ErrInvalidConfig, pair)
+		}
+		short, fqdn := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if n.lowercase {
+			short, fqdn = strings.ToLower(short), strings.ToLower(fqdn)
+		}
+		n.aliases[short] = fqdn
+	}
+	return n, nil
+}
+
+func (n *normalizer) normalize(instance string) string {
+	s := strings.TrimSpace(instance)
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	if i := strings.IndexByte(s, '/'); i >= 0 {
+		s = s[:i]
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// No port, or not an address at all
+		host, port = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), ""
+	}
+	host = strings.TrimSuffix(host, ".")
+	if n.lowercase {
+		host = strings.ToLower(host)
+	}
+	if fqdn, ok := n.aliases[host]; ok {
+		host = fqdn
+	}
+	if _, ok := n.ports[port]; ok {
+		port = ""
+	}
+
+	if len(port) != 0 {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.IndexByte(host, ':') >= 0 && net.ParseIP(host) != nil {
+		// An IPv6 address keeps its brackets
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// NormalizeInstance returns instance as stored with --store.normalize-instances,
+// unchanged without it. The queries filter by the normalized instances.
+func NormalizeInstance(instance string) string {
+	if n, _ := instanceNormalizer.Load().(*normalizer); n != nil {
+		return n.normalize(instance)
+	}
+	return instance
+}
+
+// normalizedTopSQLRecords returns records with their instances normalized,
+// copying the changed ones rather than modifying the ones of the caller.
+func normalizedTopSQLRecords(records []*tipb.CPUTimeRecord) []*tipb.CPUTimeRecord {
+	n, _ := instanceNormalizer.Load().(*normalizer)
+	if n == nil {
+		return records
+	}
+	var res []*tipb.CPUTimeRecord
+	for i, record := range records {
+		instance := n.normalize(record.Instance)
+		if instance == record.Instance {
+			continue
+		}
+		if res == nil {
+			res = append([]*tipb.CPUTimeRecord(nil), records...)
+		}
+		r := *record
+		r.Instance = instance
+		res[i] = &r
+	}
+	if res == nil {
+		return records
+	}
+	return res
+}
+
+// normalizedRsMeteringRecords is normalizedTopSQLRecords of resource metering records.
+func normalizedRsMeteringRecords(records []*rsmetering.CPUTimeRecord) []*rsmetering.CPUTimeRecord {
+	n, _ := instanceNormalizer.Load().(*normalizer)
+	if n == nil {
+		return records
+	}
+	var res []*rsmetering.CPUTimeRecord
+	for i, record := range records {
+		instance := n.normalize(record.Instance)
+		if instance == record.Instance {
+			continue
+		}
+		if res == nil {
+			res = append([]*rsmetering.CPUTimeRecord(nil), records...)
+		}
+		r := *record
+		r.Instance = instance
+		res[i] = &r
+	}
+	if res == nil {
+		return records
+	}
+	return res
+}
+
+// instanceRow is a row of the instance table.
+type instanceRow struct {
+	instance   string
+	job        string
+	lastSeen   *int64
+	sourceAddr *string
+}
+
+// MergeInstances rewrites on behalf of caller the instance rows under their
+// normalized instances, merging the rows of the same one into a row of the
+// first job found and the latest last_seen along with its source_addr. The
+// series written keep their instance labels. It returns the number of rows
+// replaced, none without --store.normalize-instances.
+func MergeInstances(caller string) (int, error) {
+	n, _ := instanceNormalizer.Load().(*normalizer)
+	if n == nil {
+		return 0, nil
+	}
+
+	affected := 0
+	err := audit.Do("merge_instances", caller, nil, func() (int, error) {
+		return affected, documentDB.Update(func(tx *genji.Tx) error {
+			var rows []instanceRow
+			res, err := tx.Query("SELECT instance, job, last_seen, source_addr FROM instance")
+			if err != nil {
+				return err
+			}
+			err = res.Iterate(func(d types.Document) error {
+				var r instanceRow
+				if err := document.Scan(d, &r.instance, &r.job, &r.lastSeen, &r.sourceAddr); err != nil {
+					return err
+				}
+				rows = append(rows, r)
+				return nil
+			})
+			_ = res.Close()
+			if err != nil {
+				return err
+			}
+
+			groups := make(map[string][]instanceRow)
+			var keys []string
+			for _, r := range rows {
+				key := n.normalize(r.instance)
+				if _, ok := groups[key]; !ok {
+					keys = append(keys, key)
+				}
+				groups[key] = append(groups[key], r)
+			}
+
+			for _, key := range keys {
+				group := groups[key]
+				if len(group) == 1 && group[0].instance == key {
+					continue
+				}
+				merged := instanceRow{instance: key}
+				for _, r := range group {
+					if len(merged.job) == 0 {
+						merged.job = r.job
+					}
+					if r.lastSeen != nil && (merged.lastSeen == nil || *r.lastSeen > *merged.lastSeen) {
+						merged.lastSeen, merged.sourceAddr = r.lastSeen, r.sourceAddr
+					}
+					if err := tx.Exec("DELETE FROM instance WHERE instance = ?", r.instance); err != nil {
+						return err
+					}
+					affected++
+				}
+				if err := tx.Exec("INSERT INTO instance(instance, job) VALUES (?, ?)", merged.instance, merged.job); err != nil {
+					return err
+				}
+				if merged.lastSeen != nil {
+					if err := tx.Exec("UPDATE instance SET last_seen = ? WHERE instance = ?", *merged.lastSeen, key); err != nil {
+						return err
+					}
+				}
+				if merged.sourceAddr != nil {
+					if err := tx.Exec("UPDATE instance SET source_addr = ? WHERE instance = ?", *merged.sourceAddr, key); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err == nil && affected != 0 {
+		// The merged rows may hold another address and agent
+		sourceAddrs.Lock()
+		sourceAddrs.written = make(map[string]string)
+		sourceAddrs.Unlock()
+		agents.Lock()
+		agents.written = make(map[string]agentInfo)
+		agents.Unlock()
+	}
+	return affected, err
+}
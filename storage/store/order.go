@@ -0,0 +1,58 @@
+package store
+
+import (
+	"sort"
+	"strings"
+)
+
+// sortedByInstance returns metrics ordered by instance, then by series, so the
+// series of an instance are contiguous in the import. metrics is left as is.
+func sortedByInstance(metrics []Metric) []Metric {
+	if sort.SliceIsSorted(metrics, func(i, j int) bool {
+		return lessSeries(&metrics[i].Metric, &metrics[j].Metric)
+	}) {
+		return metrics
+	}
+	res := append([]Metric(nil), metrics...)
+	sort.SliceStable(res, func(i, j int) bool {
+		return lessSeries(&res[i].Metric, &res[j].Metric)
+	})
+	return res
+}
+
+func lessSeries(a, b *topSQLTags) bool {
+	for _, pair := range [][2]string{
+		{a.Instance, b.Instance},
+		{a.Name, b.Name},
+		{a.Job, b.Job},
+		{a.SQLDigest, b.SQLDigest},
+		{a.PlanDigest, b.PlanDigest},
+	} {
+		if pair[0] != pair[1] {
+			return pair[0] < pair[1]
+		}
+	}
+	if len(a.Labels) == 0 || len(b.Labels) == 0 {
+		return len(a.Labels) < len(b.Labels)
+	}
+	return extraLabelsKey(a) < extraLabelsKey(b)
+}
+
+// extraLabelsKey orders the series by their labels beyond the fixed ones.
+func extraLabelsKey(t *topSQLTags) string {
+	keys := make([]string, 0, len(t.Labels))
+	for key := range t.Labels {
+		if !isFixedLabel(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString(key)
+		b.WriteByte(0)
+		b.WriteString(t.Labels[key])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
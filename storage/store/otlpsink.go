@@ -0,0 +1,224 @@
+package store
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricpb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+var (
+	otlpExportedCounter = metrics.NewCounter(`diag_store_otlp_points_total{result="exported"}`)
+	otlpDroppedCounter  = metrics.NewCounter(`diag_store_otlp_points_total{result="dropped"}`)
+)
+
+type OTLPSinkConfig struct {
+	// Endpoint is the host:port of the OTLP/gRPC receiver.
+	Endpoint string
+	Headers  map[string]string
+	// TLS is used to connect to the receiver, nil means plaintext.
+	TLS            *tls.Config
+	ExportInterval time.Duration
+	ExportTimeout  time.Duration
+	// MaxPendingPoints caps the data points buffered between exports. New points are dropped when full.
+	MaxPendingPoints int
+	// LabelPolicy sanitizes the labels before encoding, the attributes must be
+	// valid UTF-8.
+	LabelPolicy LabelPolicy
+}
+
+var _ MetricWriter = &OTLPSink{}
+
+// OTLPSink exports metrics as OTLP Sum data points, batched per export interval.
+type OTLPSink struct {
+	cfg    OTLPSinkConfig
+	conn   *grpc.ClientConn
+	client colmetricpb.MetricsServiceClient
+
+	mu      sync.Mutex
+	pending map[string][]*metricpb.NumberDataPoint // metric name -> points
+	count   int
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+func NewOTLPSink(cfg OTLPSinkConfig) (*OTLPSink, error) {
+	if len(cfg.Endpoint) == 0 {
+		return nil, fmt.Errorf("%w: empty otlp endpoint", ErrInvalidConfig)
+	}
+	if cfg.ExportInterval <= 0 {
+		cfg.ExportInterval = 10 * time.Second
+	}
+	if cfg.ExportTimeout <= 0 {
+		cfg.ExportTimeout = 10 * time.Second
+	}
+	if cfg.MaxPendingPoints <= 0 {
+		cfg.MaxPendingPoints = 1024 * 1024
+	}
+
+	dialOption := grpc.WithInsecure()
+	if cfg.TLS != nil {
+		dialOption = grpc.WithTransportCredentials(credentials.NewTLS(cfg.TLS))
+	}
+	conn, err := grpc.Dial(cfg.Endpoint, dialOption)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &OTLPSink{
+		cfg:     cfg,
+		conn:    conn,
+		client:  colmetricpb.NewMetricsServiceClient(conn),
+		pending: make(map[string][]*metricpb.NumberDataPoint),
+		stopCh:  make(chan struct{}),
+	}
+	s.wg.Add(1)
+	go s.run()
+	return s, nil
+}
+
+// WriteMetrics buffers metrics as data points for the next export.
+func (s *OTLPSink) WriteMetrics(metrics []Metric) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range sanitizeLabels(metrics, s.cfg.LabelPolicy) {
+		attributes := otlpAttributes(m)
+		for i := range m.Timestamps {
+			if s.count >= s.cfg.MaxPendingPoints {
+				otlpDroppedCounter.Inc()
+				continue
+			}
+
+			s.pending[m.Metric.Name] = append(s.pending[m.Metric.Name], otlpPoint(attributes, m.Timestamps[i], m.Values[i]))
+			s.count++
+		}
+	}
+	return nil
+}
+
+// otlpPoint is a point of value v, an int one unless past the max int64.
+func otlpPoint(attributes []*commonpb.KeyValue, tsMillis, v uint64) *metricpb.NumberDataPoint {
+	p := &metricpb.NumberDataPoint{Attributes: attributes, TimeUnixNano: tsMillis * uint64(time.Millisecond)}
+	if v > math.MaxInt64 {
+		p.Value = &metricpb.NumberDataPoint_AsDouble{AsDouble: float64(v)}
+	} else {
+		p.Value = &metricpb.NumberDataPoint_AsInt{AsInt: int64(v)}
+	}
+	return p
+}
+
+// Close exports the buffered points and closes the connection.
+func (s *OTLPSink) Close() error {
+	close(s.stopCh)
+	s.wg.Wait()
+	return s.conn.Close()
+}
+
+func (s *OTLPSink) run() {
+	defer s.wg.Done()
+
+	ticker := clock.NewTicker(s.cfg.ExportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			s.export()
+		case <-s.stopCh:
+			s.export()
+			return
+		}
+	}
+}
+
+func (s *OTLPSink) export() {
+	s.mu.Lock()
+	pending, count := s.pending, s.count
+	s.pending = make(map[string][]*metricpb.NumberDataPoint)
+	s.count = 0
+	s.mu.Unlock()
+
+	if count == 0 {
+		return
+	}
+
+	temporality := metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA
+	if cpuTimeCumulator != nil {
+		temporality = metricpb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE
+	}
+
+	ilm := &metricpb.InstrumentationLibraryMetrics{
+		InstrumentationLibrary: &commonpb.InstrumentationLibrary{Name: "diag_backend"},
+	}
+	for name, points := range pending {
+		ilm.Metrics = append(ilm.Metrics, &metricpb.Metric{
+			Name: name,
+			Unit: "ms",
+			Data: &metricpb.Metric_Sum{Sum: &metricpb.Sum{
+				DataPoints:             points,
+				AggregationTemporality: temporality,
+				IsMonotonic:            true,
+			}},
+		})
+	}
+	req := &colmetricpb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricpb.ResourceMetrics{{
+			Resource: &resourcepb.Resource{Attributes: []*commonpb.KeyValue{
+				otlpStringAttribute("service.name", "diag_backend"),
+			}},
+			InstrumentationLibraryMetrics: []*metricpb.InstrumentationLibraryMetrics{ilm},
+		}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.cfg.ExportTimeout)
+	defer cancel()
+	for key, value := range s.cfg.Headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, key, value)
+	}
+
+	if _, err := s.client.Export(ctx, req); err != nil {
+		otlpDroppedCounter.Add(count)
+		log.Warn("failed to export metrics via otlp", zap.String("endpoint", s.cfg.Endpoint), zap.Error(err))
+		return
+	}
+	otlpExportedCounter.Add(count)
+}
+
+func otlpAttributes(m Metric) []*commonpb.KeyValue {
+	attributes := []*commonpb.KeyValue{
+		otlpStringAttribute("instance", m.Metric.Instance),
+		otlpStringAttribute("job", m.Metric.Job),
+		otlpStringAttribute("sql_digest", m.Metric.SQLDigest),
+	}
+	if len(m.Metric.PlanDigest) != 0 {
+		attributes = append(attributes, otlpStringAttribute("plan_digest", m.Metric.PlanDigest))
+	}
+	for key, value := range m.Metric.Labels {
+		if !isFixedLabel(key) {
+			attributes = append(attributes, otlpStringAttribute(key, value))
+		}
+	}
+	return attributes
+}
+
+func otlpStringAttribute(key, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   key,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}},
+	}
+}
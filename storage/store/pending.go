@@ -0,0 +1,264 @@
+package store
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	errs "github.com/genjidb/genji/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	unknownDigestGrace      = pflag.Duration("store.unknown-digest-grace", 0, "Hold the metrics of a sql digest whose SQL meta is not stored yet for up to this long, written once the meta arrives, so dashboards do not show them as raw digests meanwhile. 0 disables it")
+	unknownDigestMaxPending = pflag.Int("store.unknown-digest-max-pending", 100000, "Max metrics held by --store.unknown-digest-grace, the others are written at once")
+)
+
+var (
+	heldMetricsCounter       = metrics.NewCounter(`diag_store_unknown_digest_metrics_total{result="held"}`)
+	resolvedMetricsCounter   = metrics.NewCounter(`diag_store_unknown_digest_metrics_total{result="resolved"}`)
+	expiredMetricsCounter    = metrics.NewCounter(`diag_store_unknown_digest_metrics_total{result="expired"}`)
+	overflowedMetricsCounter = metrics.NewCounter(`diag_store_unknown_digest_metrics_total{result="overflowed"}`)
+
+	// pendingDigests holds the metrics of unknown digests, nil if disabled.
+	pendingDigests *pendingSet
+	// knownSQLDigests remembers the digests known to have a SQL meta.
+	knownSQLDigests = newSeenCache(seenCacheCapacity)
+)
+
+type pendingSet struct {
+	grace      time.Duration
+	maxPending int
+
+	mu       sync.Mutex
+	byDigest map[string]*pendingMetrics
+	count    int
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type pendingMetrics struct {
+	metrics []Metric
+	// acks are the acks of metrics, nil if not waited for.
+	acks     []*Ack
+	deadline time.Time
+}
+
+func newPendingSet(grace time.Duration, maxPending int) *pendingSet {
+	s := &pendingSet{
+		grace:      grace,
+		maxPending: maxPending,
+		byDigest:   make(map[string]*pendingMetrics),
+		stop:       make(chan struct{}),
+	}
+	metrics.NewGauge(`diag_store_unknown_digest_pending_metrics`, func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(s.count)
+	})
+
+	interval := grace / 4
+	if interval < 100*time.Millisecond {
+		interval = 100 * time.Millisecond
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				s.flush(expiredMetricsCounter, func(p *pendingMetrics) bool {
+					return !clock.Now().Before(p.deadline)
+				})
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s
+}
+
+// split moves the metrics of the digests without a SQL meta on db out of
+// metrics, while there is room. The returned ones are to hold once the others
+// are written.
+func (s *pendingSet) split(db execer, metrics *[]Metric) []Metric {
+	s.mu.Lock()
+	room := s.maxPending - s.count
+	s.mu.Unlock()
+
+	var held []Metric
+	known := make(map[string]bool)
+	n := 0
+	for _, m := range *metrics {
+		if !IsOthersDigest(m.Metric.SQLDigest) {
+			key := seriesKeyOf(&m)
+			ok, looked := known[key]
+			if !looked {
+				ok = isKnownSQLDigest(db, key)
+				known[key] = ok
+			}
+			if !ok {
+				if len(held) < room {
+					m.Timestamps = append([]uint64(nil), m.Timestamps...)
+					m.Values = append([]uint64(nil), m.Values...)
+					held = append(held, m)
+					continue
+				}
+				overflowedMetricsCounter.Inc()
+			}
+		}
+		(*metrics)[n] = m
+		n++
+	}
+	*metrics = (*metrics)[:n]
+	return held
+}
+
+// hold keeps held until their metas arrive or the grace expires, ack resolved
+// once they are written if not nil. The ones of digests resolved meanwhile are
+// written at once.
+func (s *pendingSet) hold(held []Metric, ack *Ack) {
+	if ack != nil {
+		ack.add(len(held))
+	}
+	var resolved []Metric
+	var internal int
+	dropInternal := CurrentConfig().DisableInternalSQL
+	deadline := clock.Now().Add(s.grace)
+
+	s.mu.Lock()
+	for _, m := range held {
+		key := seriesKeyOf(&m)
+		if knownSQLDigests.contains(key) {
+			if dropInternal && internalDigests.contains(key) {
+				internal++
+				continue
+			}
+			resolved = append(resolved, m)
+			continue
+		}
+		p, ok := s.byDigest[key]
+		if !ok {
+			p = &pendingMetrics{deadline: deadline}
+			s.byDigest[key] = p
+		}
+		p.metrics = append(p.metrics, m)
+		p.acks = append(p.acks, ack)
+		s.count++
+	}
+	s.mu.Unlock()
+	heldMetricsCounter.Add(len(held) - len(resolved) - internal)
+
+	if internal != 0 {
+		droppedInternalSeriesCounter.Add(internal)
+		completeAcks(acksOf(ack, internal), nil)
+	}
+	writePending(resolved, acksOf(ack, len(resolved)), resolvedMetricsCounter)
+}
+
+// resolve writes the metrics held for the digests of metas of tenant, dropping
+// the ones of internal SQLs if disabled.
+func (s *pendingSet) resolve(tenant string, metas []*tipb.SQLMeta) {
+	// digest -> whether to drop its metrics
+	keys := make(map[string]bool, len(metas))
+	dropInternal := CurrentConfig().DisableInternalSQL
+	for _, meta := range metas {
+		keys[TenantKey(tenant, hex.EncodeToString(meta.SqlDigest))] = dropInternal && meta.IsInternalSql
+	}
+	if internal, acks := s.take(func(p *pendingMetrics) bool {
+		return keys[seriesKeyOf(&p.metrics[0])]
+	}); len(internal) != 0 {
+		droppedInternalSeriesCounter.Add(len(internal))
+		completeAcks(acks, nil)
+	}
+	s.flush(resolvedMetricsCounter, func(p *pendingMetrics) bool {
+		_, ok := keys[seriesKeyOf(&p.metrics[0])]
+		return ok
+	})
+}
+
+// flush writes and forgets the pending metrics matched by match.
+func (s *pendingSet) flush(counter *metrics.Counter, match func(p *pendingMetrics) bool) {
+	res, acks := s.take(match)
+	writePending(res, acks, counter)
+}
+
+// take forgets the pending metrics matched by match, returning them and their
+// acks.
+func (s *pendingSet) take(match func(p *pendingMetrics) bool) ([]Metric, []*Ack) {
+	var res []Metric
+	var acks []*Ack
+	s.mu.Lock()
+	for digest, p := range s.byDigest {
+		if match(p) {
+			res = append(res, p.metrics...)
+			acks = append(acks, p.acks...)
+			s.count -= len(p.metrics)
+			delete(s.byDigest, digest)
+		}
+	}
+	s.mu.Unlock()
+	return res, acks
+}
+
+// close writes all the pending metrics.
+func (s *pendingSet) close() {
+	close(s.stop)
+	s.wg.Wait()
+	s.flush(expiredMetricsCounter, func(*pendingMetrics) bool {
+		return true
+	})
+}
+
+// writePending writes res, releasing the holds of their acks, nil or parallel
+// to res, once handed over to the write.
+func writePending(res []Metric, acks []*Ack, counter *metrics.Counter) {
+	if len(res) == 0 {
+		return
+	}
+	counter.Add(len(res))
+	// Held across requests
+	if err := writeTimeseriesDB(context.Background(), "", res, acks); err != nil {
+		log.Warn("failed to write the metrics held for their sql metas", zap.Int("metrics", len(res)), zap.Error(err))
+	}
+	completeAcks(acks, nil)
+}
+
+// isKnownSQLDigest reports whether the TenantKey key has a SQL meta on db.
+func isKnownSQLDigest(db execer, key string) bool {
+	if knownSQLDigests.contains(key) {
+		return true
+	}
+	_, err := db.QueryDocument("SELECT digest FROM sql_digest WHERE digest = ?", key)
+	if errors.Is(err, errs.ErrDocumentNotFound) {
+		return false
+	}
+	if err != nil {
+		// Not worth holding the metrics for
+		log.Debug("failed to look up a sql digest", zap.Error(err))
+		return true
+	}
+	knownSQLDigests.add(key)
+	return true
+}
+
+// resolveSQLMetas records the digests of metas of tenant as known, once
+// committed, and writes the metrics held for them.
+func resolveSQLMetas(tenant string, metas []*tipb.SQLMeta) {
+	if pendingDigests == nil {
+		return
+	}
+	for _, meta := range metas {
+		knownSQLDigests.add(TenantKey(tenant, hex.EncodeToString(meta.SqlDigest)))
+	}
+	pendingDigests.resolve(tenant, metas)
+}
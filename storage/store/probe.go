@@ -0,0 +1,101 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/zhongzc/diag_backend/utils/failpoint"
+
+	"github.com/genjidb/genji"
+	errs "github.com/genjidb/genji/errors"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const onConflictDoNothing = " ON CONFLICT DO NOTHING"
+
+var errProbeDone = errors.New("probe done")
+
+// conflictSupported tells whether the document db understands ON CONFLICT DO
+// NOTHING. If not, insert falls back to insertMissing.
+var conflictSupported = true
+
+// probeConflictSupport checks that the document db understands the
+// `ON CONFLICT DO NOTHING` the inserts rely on, which older genji versions fail
+// to parse. The probe table is rolled back.
+func probeConflictSupport(db *genji.DB) (bool, error) {
+	var conflictErr error
+	err := db.Update(func(tx *genji.Tx) error {
+		for _, stmt := range []string{
+			"CREATE TABLE conflict_probe (k INT PRIMARY KEY)",
+			"INSERT INTO conflict_probe(k) VALUES (1)",
+		} {
+			if err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		if conflictErr = failpoint.Eval(FailpointConflictProbe); conflictErr == nil {
+			conflictErr = tx.Exec("INSERT INTO conflict_probe(k) VALUES (1)" + onConflictDoNothing)
+		}
+		return errProbeDone
+	})
+	if !errors.Is(err, errProbeDone) {
+		return false, fmt.Errorf("failed to probe the document db: %w", err)
+	}
+	if conflictErr != nil {
+		log.Warn("the document db does not support ON CONFLICT DO NOTHING, falling back to select-then-insert", zap.Error(conflictErr))
+		return false, nil
+	}
+	return true, nil
+}
+
+// insertMissing is insert without ON CONFLICT DO NOTHING. Each row is inserted
+// unless a document with its key exists, taking the first field of header as the
+// primary key, all in a transaction so concurrent inserts of a key conflict.
+// On a Tx, the rows are part of it.
+func insertMissing(db execer, header string, elem string, times int, fill func(target *[]interface{})) error {
+	table, key, err := parseInsertHeader(header)
+	if err != nil {
+		return err
+	}
+	fields := strings.Count(elem, "?")
+
+	ps := prepareSliceP.Get()
+	defer prepareSliceP.Put(ps)
+
+	fill(ps)
+	if len(*ps) != fields*times {
+		return fmt.Errorf("unexpected %d values for %d rows of %d fields", len(*ps), times, fields)
+	}
+
+	selectStmt := fmt.Sprintf("SELECT %s FROM %s WHERE %s = ?", key, table, key)
+	insertStmt := header + elem
+	return update(db, func(tx execer) error {
+		for i := 0; i < times; i++ {
+			row := (*ps)[i*fields : (i+1)*fields]
+			_, err := tx.QueryDocument(selectStmt, row[0])
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, errs.ErrDocumentNotFound) {
+				return err
+			}
+			if err = tx.Exec(insertStmt, row...); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// parseInsertHeader returns the table and the first field of `INSERT INTO {table}({fields}...) VALUES `.
+func parseInsertHeader(header string) (table, key string, err error) {
+	rest := strings.TrimPrefix(header, "INSERT INTO ")
+	open := strings.IndexByte(rest, '(')
+	end := strings.IndexAny(rest, ",)")
+	if rest == header || open <= 0 || end <= open+1 {
+		return "", "", fmt.Errorf("unexpected insert header %q", header)
+	}
+	return strings.TrimSpace(rest[:open]), strings.TrimSpace(rest[open+1 : end]), nil
+}
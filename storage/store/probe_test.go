@@ -0,0 +1,62 @@
+package store
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/utils/failpoint"
+
+	"github.com/genjidb/genji"
+)
+
+func TestProbeConflictSupport(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	down, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = down.Close()
+	defer func() { conflictSupported = true }()
+
+	for _, step := range []struct {
+		name string
+		db   *genji.DB
+		// unsupported fails the ON CONFLICT statement as an older genji does.
+		unsupported bool
+		want        bool
+	}{
+		{name: "supported", db: db, want: true},
+		{name: "unsupported", db: db, unsupported: true, want: false},
+		// The state of the previous probe is kept
+		{name: "down", db: down, want: false},
+		{name: "recovered", db: db, want: true},
+	} {
+		if step.unsupported {
+			failpoint.Enable(FailpointConflictProbe, func() error {
+				return errors.New("found ON, expected ;")
+			})
+		}
+		err := initDocumentDB(step.db)
+		failpoint.Disable(FailpointConflictProbe)
+		if step.db == down {
+			if err == nil || !strings.Contains(err.Error(), "failed to probe the document db") {
+				t.Fatalf("got error %v of the %s probe", err, step.name)
+			}
+		} else if err != nil {
+			t.Fatalf("got error %v of the %s probe", err, step.name)
+		}
+		if got := Diagnose().ConflictSupported; got != step.want {
+			t.Fatalf("got conflict supported %v after the %s probe, want %v", got, step.name, step.want)
+		}
+
+		// Rolled back, so the next probe creates it again
+		if _, err := db.QueryDocument("SELECT k FROM conflict_probe"); err == nil {
+			t.Fatalf("got the probe table left after the %s probe", step.name)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package store
+
+import (
+	"strings"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+var redactLiterals = pflag.Bool("store.redact-literals", false, "Replace the string and numeric literals left in SQL texts by ? before storing them, in case agents send unnormalized statements")
+
+var redactedSQLCounter = metrics.NewCounter(`diag_store_redacted_sql_total`)
+
+// redactedSQLMetas returns metas with the literals of the texts redacted if
+// enabled. The metas modified are copied since the callers own them.
+func redactedSQLMetas(metas []*tipb.SQLMeta) []*tipb.SQLMeta {
+	if !CurrentConfig().RedactLiterals {
+		return metas
+	}
+
+	var res []*tipb.SQLMeta
+	for i, meta := range metas {
+		text, redacted := redactSQL(meta.NormalizedSql)
+		if !redacted {
+			if res != nil {
+				res = append(res, meta)
+			}
+			continue
+		}
+		redactedSQLCounter.Inc()
+		if res == nil {
+			res = make([]*tipb.SQLMeta, 0, len(metas))
+			res = append(res, metas[:i]...)
+		}
+		cp := *meta
+		cp.NormalizedSql = text
+		res = append(res, &cp)
+	}
+	if res == nil {
+		return metas
+	}
+	return res
+}
+
+// redactSQL replaces the string, hex, bit and numeric literals of sql by ?,
+// telling whether there were any. Identifiers, comments and placeholders are
+// kept as is, so normalized texts are never changed.
+func redactSQL(sql string) (string, bool) {
+	if !strings.ContainsAny(sql, "'\"0123456789") {
+		return sql, false
+	}
+
+	var b strings.Builder
+	redacted := false
+	// last is the end of sql copied to b, once redacted.
+	last := 0
+	replace := func(start, end int) {
+		if !redacted {
+			b.Grow(len(sql))
+			redacted = true
+		}
+		b.WriteString(sql[last:start])
+		b.WriteByte('?')
+		last = end
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == '\'' || c == '"':
+			end := skipQuoted(sql, i)
+			start := i
+			// A hex or bit string, e.g. X'1F' or b'01'
+			if c == '\'' && i > 0 && strings.IndexByte("xXbB", sql[i-1]) >= 0 && (i == 1 || !isIdentByte(sql[i-2])) {
+				start--
+			}
+			replace(start, end)
+			i = end
+		case c == '`':
+			i = skipQuoted(sql, i)
+		case c == '#':
+			i = skipLine(sql, i)
+		case c == '-' && strings.HasPrefix(sql[i:], "-- "):
+			i = skipLine(sql, i)
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			if end := strings.Index(sql[i+2:], "*/"); end >= 0 {
+				i += 2 + end + 2
+			} else {
+				i = len(sql)
+			}
+		case isIdentByte(c) && !isDigit(c):
+			for i < len(sql) && isIdentByte(sql[i]) {
+				i++
+			}
+		case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1]) && (i == 0 || !isIdentByte(sql[i-1]))):
+			end, ok := scanNumber(sql, i)
+			if ok {
+				replace(i, end)
+			}
+			i = end
+		default:
+			i++
+		}
+	}
+	if !redacted {
+		return sql, false
+	}
+	b.WriteString(sql[last:])
+	return b.String(), true
+}
+
+// skipQuoted returns the end of the string or quoted identifier starting at i,
+// which ends at the same quote not escaped by a backslash or doubling.
+func skipQuoted(sql string, i int) int {
+	quote := sql[i]
+	for i++; i < len(sql); i++ {
+		switch sql[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			if i+1 < len(sql) && sql[i+1] == quote {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(sql)
+}
+
+func skipLine(sql string, i int) int {
+	if end := strings.IndexByte(sql[i:], '\n'); end >= 0 {
+		return i + end + 1
+	}
+	return len(sql)
+}
+
+// scanNumber returns the end of the number starting at i, telling whether it is
+// one rather than an identifier starting with digits, e.g. 1st.
+func scanNumber(sql string, i int) (int, bool) {
+	start := i
+	if sql[i] == '0' && i+1 < len(sql) && (sql[i+1] == 'x' || sql[i+1] == 'b') {
+		j := i + 2
+		for j < len(sql) && isIdentByte(sql[j]) {
+			j++
+		}
+		return j, isRadixDigits(sql[i+2:j], sql[i+1])
+	}
+
+	for i < len(sql) && isDigit(sql[i]) {
+		i++
+	}
+	if i < len(sql) && sql[i] == '.' {
+		i++
+		for i < len(sql) && isDigit(sql[i]) {
+			i++
+		}
+	}
+	if i < len(sql) && (sql[i] == 'e' || sql[i] == 'E') {
+		j := i + 1
+		if j < len(sql) && (sql[j] == '+' || sql[j] == '-') {
+			j++
+		}
+		if j < len(sql) && isDigit(sql[j]) {
+			for i = j; i < len(sql) && isDigit(sql[i]); i++ {
+			}
+		}
+	}
+	if i < len(sql) && isIdentByte(sql[i]) {
+		for i < len(sql) && isIdentByte(sql[i]) {
+			i++
+		}
+		return i, false
+	}
+	return i, i > start
+}
+
+func isRadixDigits(s string, radix byte) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if radix == 'b' && c != '0' && c != '1' {
+			return false
+		}
+		if radix == 'x' && !isDigit(c) && (c|0x20 < 'a' || c|0x20 > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c|0x20 >= 'a' && c|0x20 <= 'z') || c >= 0x80
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"github.com/zhongzc/diag_backend/storage/audit"
+	"github.com/zhongzc/diag_backend/storage/textcrypt"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+)
+
+// ReencryptTexts rewrites on behalf of caller the SQL and plan texts not
+// encrypted with the active key, e.g. plain ones or after a key rotation. The
+// keys the texts are encrypted with must be kept in the keyring until then.
+func ReencryptTexts(caller string) error {
+	return audit.Do("reencrypt_texts", caller, nil, func() (int, error) {
+		affected := 0
+		err := documentDB.Update(func(tx *genji.Tx) error {
+			for _, t := range []struct{ table, column string }{
+				{"sql_digest", "sql_text"},
+				{"plan_digest", "plan_text"},
+			} {
+				n, err := reencryptColumn(tx, t.table, t.column)
+				if err != nil {
+					return err
+				}
+				affected += n
+			}
+			return nil
+		})
+		return affected, err
+	})
+}
+
+func reencryptColumn(tx *genji.Tx, table, column string) (int, error) {
+	type row struct{ digest, text string }
+	var stale []row
+
+	res, err := tx.Query("SELECT digest, " + column + " FROM " + table)
+	if err != nil {
+		return 0, err
+	}
+	err = res.Iterate(func(d types.Document) error {
+		var r row
+		if err := document.Scan(d, &r.digest, &r.text); err != nil {
+			return err
+		}
+		if !textcrypt.IsCurrent(r.text) {
+			stale = append(stale, r)
+		}
+		return nil
+	})
+	_ = res.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range stale {
+		text, err := textcrypt.Decrypt(r.text, r.digest)
+		if err != nil {
+			return 0, err
+		}
+		if text, err = textcrypt.Encrypt(text, r.digest); err != nil {
+			return 0, err
+		}
+		if err = tx.Exec("UPDATE "+table+" SET "+column+" = ? WHERE digest = ?", text, r.digest); err != nil {
+			return 0, err
+		}
+	}
+	return len(stale), nil
+}
@@ -0,0 +1,139 @@
+package store_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+	"github.com/zhongzc/diag_backend/storage/query"
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/storage/textcrypt"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+)
+
+// storedTexts returns the texts of table as stored, by digest.
+func storedTexts(t *testing.T, db *genji.DB, table, column string) map[string]string {
+	t.Helper()
+	res, err := db.Query("SELECT digest, " + column + " FROM " + table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	texts := make(map[string]string)
+	err = res.Iterate(func(d types.Document) error {
+		var digest, text string
+		if err := document.Scan(d, &digest, &text); err != nil {
+			return err
+		}
+		texts[store.DigestOfKey(digest)] = text
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return texts
+}
+
+// checkEncrypted fails unless every text is stored encrypted with key and reads
+// back as want.
+func checkEncrypted(t *testing.T, db *genji.DB, key string, want map[string]string) {
+	t.Helper()
+	stored := storedTexts(t, db, "sql_digest", "sql_text")
+	for digest, text := range storedTexts(t, db, "plan_digest", "plan_text") {
+		stored[digest] = text
+	}
+	for digest, text := range stored {
+		if !strings.HasPrefix(text, "enc:v1:"+key+":") {
+			t.Fatalf("got text %q of %s stored, want it encrypted with %s", text, digest, key)
+		}
+	}
+
+	got := make(map[string]string)
+	err := query.AllSQLMetas(context.Background(), func(item query.SQLMetaItem) error {
+		got[item.Digest] = item.SQLText
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = query.AllPlanMetas(context.Background(), func(item query.PlanMetaItem) error {
+		got[item.Digest] = item.PlanText
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for digest, text := range want {
+		if got[digest] != text {
+			t.Fatalf("got text %q of %s, want %q", got[digest], digest, text)
+		}
+	}
+}
+
+func TestReencryptTexts(t *testing.T) {
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	audit.Init(s.DB)
+	defer audit.Stop()
+	defer textcrypt.Init(nil)
+
+	// Stored in plain before the keyring is set
+	want := map[string]string{"5e4c": "select * from t where id = ?", "a10b": "Point_Get"}
+	if err := s.SeedSQLMeta([]byte{0x5e, 0x4c}, want["5e4c"]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SeedPlanMeta([]byte{0xa1, 0x0b}, want["a10b"]); err != nil {
+		t.Fatal(err)
+	}
+
+	k1, err := textcrypt.NewKeyring(map[string][]byte{"k1": []byte("0123456789abcdef")}, "k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	textcrypt.Init(k1)
+	// Read as is until rewritten
+	if got := storedTexts(t, s.DB, "sql_digest", "sql_text")["5e4c"]; got != want["5e4c"] {
+		t.Fatalf("got text %q stored", got)
+	}
+	if err := store.ReencryptTexts("test"); err != nil {
+		t.Fatal(err)
+	}
+	checkEncrypted(t, s.DB, "k1", want)
+
+	// Rotated to k2, k1 kept for the texts of before
+	keys := map[string][]byte{"k1": []byte("0123456789abcdef"), "k2": []byte("fedcba9876543210")}
+	k2, err := textcrypt.NewKeyring(keys, "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	textcrypt.Init(k2)
+	if err := store.ReencryptTexts("test"); err != nil {
+		t.Fatal(err)
+	}
+	checkEncrypted(t, s.DB, "k2", want)
+
+	// k1 can go once rewritten
+	delete(keys, "k1")
+	k2only, err := textcrypt.NewKeyring(keys, "k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	textcrypt.Init(k2only)
+	checkEncrypted(t, s.DB, "k2", want)
+
+	var events []audit.Event
+	if err := audit.ListAuditEvents(audit.Filter{Operation: "reencrypt_texts"}, &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Affected != 2 || events[1].Affected != 2 {
+		t.Fatalf("got audit events %+v, want 2 of 2 texts", events)
+	}
+}
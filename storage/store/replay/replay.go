@@ -0,0 +1,93 @@
+// Package replay feeds a traffic capture of the store back through its
+// ingestion calls, to reproduce the workload it was captured from.
+package replay
+
+import (
+	"context"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils"
+)
+
+type Options struct {
+	// Speed divides the intervals between the batches as captured, 2 replaying
+	// twice as fast. Zero replays the batches back to back.
+	Speed float64
+	// Clock paces the replay, the wall clock if nil.
+	Clock utils.Clock
+}
+
+type Stats struct {
+	Batches int `json:"batches"`
+	Records int `json:"records"`
+	// Failed is the number of batches whose ingestion failed, the replay going
+	// on with the next ones.
+	Failed    int    `json:"failed"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Replay ingests the batches captured in dir into the store, which must be
+// initialized, until all are replayed or ctx is done.
+func Replay(ctx context.Context, dir string, opts Options) (Stats, error) {
+	clock := opts.Clock
+	if clock == nil {
+		clock = utils.RealClock
+	}
+
+	var stats Stats
+	var firstNanos int64
+	var start time.Time
+	err := store.ReadCapture(dir, func(b *store.CapturedBatch) error {
+		if stats.Batches == 0 {
+			firstNanos, start = b.ArrivalNanos, clock.Now()
+		} else if opts.Speed > 0 {
+			due := start.Add(time.Duration(float64(b.ArrivalNanos-firstNanos) / opts.Speed))
+			if err := sleepUntil(ctx, clock, due); err != nil {
+				return err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		stats.Batches++
+		n, err := ingest(ctx, b)
+		stats.Records += n
+		if err != nil {
+			stats.Failed++
+			stats.LastError = err.Error()
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func ingest(ctx context.Context, b *store.CapturedBatch) (int, error) {
+	switch b.Kind {
+	case store.CaptureTopSQL:
+		return len(b.TopSQLRecords), store.TopSQLRecordsFrom(ctx, b.Source, b.TopSQLRecords)
+	case store.CaptureResourceMetering:
+		return len(b.ResourceMeteringRecords), store.ResourceMeteringRecordsFrom(ctx, b.Source, b.ResourceMeteringRecords)
+	case store.CaptureSQLMetas:
+		return len(b.SQLMetas), store.Metas(store.WithTenant(ctx, b.Source.Tenant), b.SQLMetas, nil)
+	case store.CapturePlanMetas:
+		return len(b.PlanMetas), store.Metas(store.WithTenant(ctx, b.Source.Tenant), nil, b.PlanMetas)
+	}
+	return 0, nil
+}
+
+func sleepUntil(ctx context.Context, clock utils.Clock, due time.Time) error {
+	d := due.Sub(clock.Now())
+	if d <= 0 {
+		return nil
+	}
+	timer := clock.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
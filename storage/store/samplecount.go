@@ -0,0 +1,76 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/zhongzc/diag_backend/utils"
+
+	"github.com/spf13/pflag"
+)
+
+var emitSampleCounts = pflag.Bool("store.emit-sample-counts", false, "Emit a topsql_samples_total counter per instance of the samples ingested, at the newest timestamp of each batch")
+
+// sampleTotals are the samples ingested per instance since start. A total
+// overflowing uint64 restarts from the count, read as a counter reset.
+var sampleTotals = struct {
+	sync.Mutex
+	totals map[string]uint64
+}{totals: make(map[string]uint64)}
+
+type sampleCount struct {
+	instance string
+	job      string
+	count    uint64
+	maxTs    uint64
+}
+
+// countSamples counts the timestamps of metrics per instance.
+func countSamples(metrics []Metric) []*sampleCount {
+	var res []*sampleCount
+	byInstance := make(map[string]*sampleCount)
+	for i := range metrics {
+		m := &metrics[i]
+		if len(m.Timestamps) == 0 {
+			continue
+		}
+		c, ok := byInstance[m.Metric.Instance]
+		if !ok {
+			c = &sampleCount{instance: m.Metric.Instance, job: m.Metric.Job}
+			byInstance[m.Metric.Instance] = c
+			res = append(res, c)
+		}
+		c.count += uint64(len(m.Timestamps))
+		for _, ts := range m.Timestamps {
+			if ts > c.maxTs {
+				c.maxTs = ts
+			}
+		}
+	}
+	return res
+}
+
+// appendSampleCounts adds counts to the totals and appends one
+// topsql_samples_total sample per instance, the total at the newest timestamp.
+// The returned func takes counts back from the totals, for a failed write.
+func appendSampleCounts(target *[]Metric, counts []*sampleCount) func() {
+	sampleTotals.Lock()
+	defer sampleTotals.Unlock()
+
+	for _, c := range counts {
+		total := utils.AddCounter(sampleTotals.totals[c.instance], c.count)
+		sampleTotals.totals[c.instance] = total
+
+		m := Metric{Timestamps: []uint64{c.maxTs}, Values: []uint64{total}}
+		m.Metric.Name = MetricName(MetricSampleCount)
+		m.Metric.Instance = c.instance
+		m.Metric.Job = c.job
+		*target = append(*target, m)
+	}
+	return func() {
+		sampleTotals.Lock()
+		defer sampleTotals.Unlock()
+		for _, c := range counts {
+			sampleTotals.totals[c.instance] -= c.count
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/VictoriaMetrics/metrics"
+)
+
+// LabelPolicy tells how a writer sanitizes the labels of the metrics before
+// encoding them, for the constraints of its backend.
+type LabelPolicy string
+
+const (
+	// LabelsAsIs writes the labels unchanged.
+	LabelsAsIs LabelPolicy = "none"
+	// LabelsPrometheus replaces the invalid UTF-8 of the values by U+FFFD and
+	// the characters of the names out of [a-zA-Z0-9_] by _, prefixing a name
+	// starting with a digit by _. A renamed label taken already is dropped.
+	LabelsPrometheus LabelPolicy = "prometheus"
+	// LabelsASCII also replaces the characters of the values other than
+	// printable ASCII by _.
+	LabelsASCII LabelPolicy = "ascii"
+)
+
+var (
+	sanitizedValuesCounter = metrics.NewCounter(`diag_store_sanitized_labels_total{part="value"}`)
+	sanitizedNamesCounter  = metrics.NewCounter(`diag_store_sanitized_labels_total{part="name"}`)
+	droppedLabelsCounter   = metrics.NewCounter(`diag_store_sanitized_labels_total{part="dropped"}`)
+)
+
+// ParseLabelPolicy parses a policy, empty for LabelsAsIs.
+func ParseLabelPolicy(s string) (LabelPolicy, error) {
+	switch p := LabelPolicy(s); p {
+	case "":
+		return LabelsAsIs, nil
+	case LabelsAsIs, LabelsPrometheus, LabelsASCII:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: unknown label policy %q", ErrInvalidConfig, s)
+}
+
+// sanitizeLabels returns metrics with their labels sanitized by policy. The
+// changed metrics are copied, metrics itself is left untouched.
+func sanitizeLabels(metrics []Metric, policy LabelPolicy) []Metric {
+	if policy != LabelsPrometheus && policy != LabelsASCII {
+		return metrics
+	}
+
+	var res []Metric
+	for i := range metrics {
+		tags, changed := sanitizeTags(metrics[i].Metric, policy)
+		if !changed {
+			continue
+		}
+		if res == nil {
+			res = append([]Metric(nil), metrics...)
+		}
+		res[i].Metric = tags
+	}
+	if res == nil {
+		return metrics
+	}
+	return res
+}
+
+func sanitizeTags(tags topSQLTags, policy LabelPolicy) (topSQLTags, bool) {
+	var changed bool
+	for _, value := range []*string{&tags.Name, &tags.Instance, &tags.Job, &tags.SQLDigest, &tags.PlanDigest} {
+		if sanitized, ok := sanitizeLabelValue(*value, policy); ok {
+			*value = sanitized
+			changed = true
+		}
+	}
+
+	// Sorted, so which of the labels renamed alike is kept is stable.
+	keys := make([]string, 0, len(tags.Labels))
+	for key := range tags.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var labels map[string]string
+	for _, key := range keys {
+		name, nameChanged := sanitizeLabelName(key)
+		value, valueChanged := sanitizeLabelValue(tags.Labels[key], policy)
+		if !nameChanged && !valueChanged {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(tags.Labels))
+			for k, v := range tags.Labels {
+				labels[k] = v
+			}
+		}
+		if nameChanged {
+			delete(labels, key)
+			if _, taken := labels[name]; taken || isFixedLabel(name) {
+				droppedLabelsCounter.Inc()
+				continue
+			}
+		}
+		labels[name] = value
+	}
+	if labels != nil {
+		tags.Labels = labels
+		changed = true
+	}
+	return tags, changed
+}
+
+// sanitizeLabelValue returns the sanitized value and whether it changed.
+func sanitizeLabelValue(value string, policy LabelPolicy) (string, bool) {
+	if policy == LabelsASCII {
+		valid := true
+		for i := 0; i < len(value); i++ {
+			if value[i] < ' ' || value[i] > '~' {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return value, false
+		}
+		sanitizedValuesCounter.Inc()
+		return strings.Map(func(r rune) rune {
+			if r < ' ' || r > '~' {
+				return '_'
+			}
+			return r
+		}, value), true
+	}
+
+	if utf8.ValidString(value) {
+		return value, false
+	}
+	sanitizedValuesCounter.Inc()
+	return strings.ToValidUTF8(value, string(utf8.RuneError)), true
+}
+
+// sanitizeLabelName returns the name made valid as a Prometheus label name and
+// whether it changed.
+func sanitizeLabelName(name string) (string, bool) {
+	valid := len(name) != 0 && !isDigit(name[0])
+	for i := 0; i < len(name) && valid; i++ {
+		valid = isLabelNameChar(name[i])
+	}
+	if valid {
+		return name, false
+	}
+
+	sanitizedNamesCounter.Inc()
+	var b strings.Builder
+	if len(name) == 0 || isDigit(name[0]) {
+		b.WriteByte('_')
+	}
+	for i := 0; i < len(name); i++ {
+		if isLabelNameChar(name[i]) {
+			b.WriteByte(name[i])
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String(), true
+}
+
+func isLabelNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || isDigit(c) || c == '_'
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/spf13/pflag"
+)
+
+var (
+	metricPrefix = pflag.String("store.metric-prefix", "", "Prefix of the names of the series written and read, e.g. diag_ for diag_cpu_time, so several backends share a timeseries db")
+	metricNames  = pflag.String("store.metric-names", "", "Names of the series written and read replacing the default ones, before --store.metric-prefix, as comma separated kind=name pairs, e.g. cpu_time=topsql_cpu_time. The kinds are the default names")
+)
+
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// MetricKind is a kind of series the store writes.
+type MetricKind int
+
+const (
+	MetricCPUTime MetricKind = iota
+	MetricReadKeys
+	MetricWriteKeys
+	MetricHeartbeat
+	MetricSampleCount
+)
+
+// MetricSchema describes the series of a kind.
+type MetricSchema struct {
+	// Name is the default name of the series, which also names the kind in
+	// --store.metric-names.
+	Name string
+	// Labels are the labels of the series, besides the ones of a TagExtractor.
+	Labels []string
+	// Unit is the unit of the values.
+	Unit string
+}
+
+// schemas are the series the store writes, the writes and the reads of which
+// name them by MetricName.
+var schemas = [...]MetricSchema{
+	MetricCPUTime:     {Name: "cpu_time", Labels: []string{labelInstance, labelJob, labelSQLDigest, labelPlanDigest}, Unit: "milliseconds"},
+	MetricReadKeys:    {Name: "read_keys", Labels: []string{labelInstance, labelSQLDigest, labelPlanDigest}, Unit: "keys"},
+	MetricWriteKeys:   {Name: "write_keys", Labels: []string{labelInstance, labelSQLDigest, labelPlanDigest}, Unit: "keys"},
+	MetricHeartbeat:   {Name: "topsql_up", Labels: []string{labelInstance, labelJob}, Unit: "1"},
+	MetricSampleCount: {Name: "topsql_samples_total", Labels: []string{labelInstance, labelJob}, Unit: "samples"},
+}
+
+// resolvedNames holds the names of the kinds fixed at Init, a
+// [len(schemas)]string.
+var resolvedNames atomic.Value
+
+// Schema returns the schema of kind.
+func Schema(kind MetricKind) MetricSchema {
+	return schemas[kind]
+}
+
+// MetricName returns the name of the series of kind as written, the one of the
+// flags before Init.
+func MetricName(kind MetricKind) string {
+	if names, ok := resolvedNames.Load().([len(schemas)]string); ok {
+		return names[kind]
+	}
+	cfg := ConfigFromFlags()
+	names, err := resolveMetricNames(cfg.MetricPrefix, cfg.MetricNames)
+	if err != nil {
+		return cfg.MetricPrefix + schemas[kind].Name
+	}
+	return names[kind]
+}
+
+// resolveMetricNames returns the names of the kinds, the overrides of names
+// replacing the default ones, all prefixed by prefix.
+func resolveMetricNames(prefix, overrides string) ([len(schemas)]string, error) {
+	var names [len(schemas)]string
+	for kind, schema := range schemas {
+		names[kind] = schema.Name
+	}
+	for _, pair := range strings.Split(overrides, ",") {
+		if pair = strings.TrimSpace(pair); len(pair) == 0 {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return names, fmt.Errorf("%w: expect kind=name in --store.metric-names, got %q", ErrInvalidConfig, pair)
+		}
+		kind := -1
+		for k, schema := range schemas {
+			if schema.Name == strings.TrimSpace(kv[0]) {
+				kind = k
+			}
+		}
+		if kind < 0 {
+			return names, fmt.Errorf("%w: unknown metric kind %q in --store.metric-names", ErrInvalidConfig, kv[0])
+		}
+		names[kind] = strings.TrimSpace(kv[1])
+	}
+
+	seen := make(map[string]bool, len(names))
+	for kind := range names {
+		names[kind] = prefix + names[kind]
+		name := names[kind]
+		if !metricNameRegexp.MatchString(name) {
+			return names, fmt.Errorf("%w: invalid metric name %q", ErrInvalidConfig, name)
+		}
+		if seen[name] {
+			return names, fmt.Errorf("%w: metric name %q is used by two kinds", ErrInvalidConfig, name)
+		}
+		seen[name] = true
+	}
+	return names, nil
+}
@@ -0,0 +1,384 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	segmentExt = ".seg"
+	// segmentHeaderSize is the size of the frame header of a record, its
+	// length and checksum.
+	segmentHeaderSize = 8
+	// maxSegmentRecordSize bounds the length read from a header, a larger one
+	// is taken as corruption.
+	maxSegmentRecordSize = 1 << 30
+)
+
+var (
+	segmentCorruptedCounter = metrics.NewCounter(`diag_store_segment_truncated_bytes_total`)
+
+	// errStopRead stops segmentLog.read without an error.
+	errStopRead        = errors.New("stop reading")
+	errCorruptedRecord = errors.New("corrupted record")
+)
+
+// segmentPos is the position right after a record in the log.
+type segmentPos struct {
+	seq    uint64
+	offset int64
+}
+
+func (p segmentPos) before(o segmentPos) bool {
+	return p.seq < o.seq || (p.seq == o.seq && p.offset < o.offset)
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// segmentLog is an append-only log of records split into numbered segment
+// files of a directory, the building block of the on-disk buffers of the store.
+//
+// A record is framed by its length and crc32-c checksum, so a crash in the
+// middle of an append leaves a torn tail, cut when the log is opened. Appends
+// go to a new segment on every open, the older ones are never written again.
+type segmentLog struct {
+	dir            string
+	maxSegmentSize int64
+
+	mu sync.Mutex
+	// segments are the segment files, oldest first, the last one active.
+	segments []segment
+	active   *os.File
+	size     int64
+}
+
+// openSegmentLog opens the log of dir, checking the records of every segment
+// and cutting each at its first torn or corrupted record.
+func openSegmentLog(dir string, maxSegmentSize int64) (*segmentLog, error) {
+	if maxSegmentSize <= 0 {
+		return nil, fmt.Errorf("%w: unexpected max segment size %d", ErrInvalidConfig, maxSegmentSize)
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	l := &segmentLog{dir: dir, maxSegmentSize: maxSegmentSize}
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		size, err := l.recover(seq, info.Size())
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			if err = os.Remove(l.path(seq)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		l.segments = append(l.segments, segment{seq: seq, size: size})
+		l.size += size
+	}
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].seq < l.segments[j].seq
+	})
+
+	if err = l.openActive(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// recover returns the size of the valid records of segment seq, truncating
+// the file to it.
+func (l *segmentLog) recover(seq uint64, size int64) (int64, error) {
+	var valid int64
+	err := l.readSegment(seq, 0, size, func(_ []byte, offset int64) error {
+		valid = offset
+		return nil
+	})
+	if err != nil && !errors.Is(err, errCorruptedRecord) {
+		return 0, err
+	}
+	if valid == size {
+		return size, nil
+	}
+
+	segmentCorruptedCounter.Add(int(size - valid))
+	log.Warn("cut the torn or corrupted tail of a segment",
+		zap.String("path", l.path(seq)),
+		zap.Int64("valid_bytes", valid),
+		zap.Int64("truncated_bytes", size-valid),
+		zap.NamedError("reason", err))
+	if err = os.Truncate(l.path(seq), valid); err != nil {
+		return 0, err
+	}
+	return valid, nil
+}
+
+// openActive creates the segment following the last one. l.mu must be held
+// unless opening.
+func (l *segmentLog) openActive() error {
+	seq := uint64(1)
+	if len(l.segments) != 0 {
+		seq = l.segments[len(l.segments)-1].seq + 1
+	}
+	file, err := os.OpenFile(l.path(seq), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err = syncDir(l.dir); err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.active = file
+	l.segments = append(l.segments, segment{seq: seq})
+	return nil
+}
+
+// append writes a record, synced to disk if sync is set, and returns the
+// position after it. The active segment is sealed first if the record makes
+// it exceed the max segment size.
+func (l *segmentLog) append(record []byte, sync bool) (segmentPos, error) {
+	buf := make([]byte, segmentHeaderSize+len(record))
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(record)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(record, castagnoli))
+	copy(buf[segmentHeaderSize:], record)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return segmentPos{}, fmt.Errorf("%w: segment log is closed", ErrClosed)
+	}
+	last := &l.segments[len(l.segments)-1]
+	if last.size > 0 && last.size+int64(len(buf)) > l.maxSegmentSize {
+		if err := l.sealLocked(); err != nil {
+			return segmentPos{}, err
+		}
+		last = &l.segments[len(l.segments)-1]
+	}
+
+	n, err := l.active.Write(buf)
+	last.size += int64(n)
+	l.size += int64(n)
+	if err != nil {
+		// Cut the partial record, a later append would be read after it.
+		if terr := l.active.Truncate(last.size - int64(n)); terr == nil {
+			last.size -= int64(n)
+			l.size -= int64(n)
+		}
+		return segmentPos{}, err
+	}
+	if sync {
+		if err = l.active.Sync(); err != nil {
+			return segmentPos{}, err
+		}
+	}
+	return segmentPos{seq: last.seq, offset: last.size}, nil
+}
+
+// sealLocked syncs and closes the active segment and opens the next one.
+func (l *segmentLog) sealLocked() error {
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+	if err := l.active.Close(); err != nil {
+		return err
+	}
+	l.active = nil
+	return l.openActive()
+}
+
+// sync syncs the active segment to disk.
+func (l *segmentLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return nil
+	}
+	return l.active.Sync()
+}
+
+// start returns the position before the first record.
+func (l *segmentLog) start() segmentPos {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return segmentPos{seq: l.segments[0].seq}
+}
+
+// read calls fn with the records after from, as appended when called, and the
+// position after each. It stops without an error if fn returns errStopRead.
+func (l *segmentLog) read(from segmentPos, fn func(record []byte, end segmentPos) error) error {
+	l.mu.Lock()
+	segments := append([]segment(nil), l.segments...)
+	l.mu.Unlock()
+
+	for _, s := range segments {
+		if s.seq < from.seq {
+			continue
+		}
+		offset := int64(0)
+		if s.seq == from.seq {
+			offset = from.offset
+		}
+		err := l.readSegment(s.seq, offset, s.size, func(record []byte, end int64) error {
+			return fn(record, segmentPos{seq: s.seq, offset: end})
+		})
+		if err == errStopRead {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment calls fn with the records of segment seq between offset and
+// limit and the offset after each.
+func (l *segmentLog) readSegment(seq uint64, offset, limit int64, fn func(record []byte, end int64) error) error {
+	if offset >= limit {
+		return nil
+	}
+	file, err := os.Open(l.path(seq))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(io.LimitReader(file, limit-offset))
+	var header [segmentHeaderSize]byte
+	for offset < limit {
+		if _, err = io.ReadFull(r, header[:]); err != nil {
+			return fmt.Errorf("%w: torn header at %d: %v", errCorruptedRecord, offset, err)
+		}
+		n := binary.LittleEndian.Uint32(header[0:4])
+		if n > maxSegmentRecordSize {
+			return fmt.Errorf("%w: length %d at %d", errCorruptedRecord, n, offset)
+		}
+		record := make([]byte, n)
+		if _, err = io.ReadFull(r, record); err != nil {
+			return fmt.Errorf("%w: torn record at %d: %v", errCorruptedRecord, offset, err)
+		}
+		if crc32.Checksum(record, castagnoli) != binary.LittleEndian.Uint32(header[4:8]) {
+			return fmt.Errorf("%w: checksum mismatch at %d", errCorruptedRecord, offset)
+		}
+		offset += segmentHeaderSize + int64(n)
+		if err = fn(record, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate deletes the sealed segments wholly before pos, or ending at it,
+// and returns the bytes freed.
+func (l *segmentLog) truncate(pos segmentPos) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var freed int64
+	for len(l.segments) > 1 {
+		first := l.segments[0]
+		if first.seq > pos.seq || (first.seq == pos.seq && first.size > pos.offset) {
+			break
+		}
+		if err := os.Remove(l.path(first.seq)); err != nil {
+			return freed, err
+		}
+		freed += first.size
+		l.size -= first.size
+		l.segments = l.segments[1:]
+	}
+	return freed, nil
+}
+
+// pending returns the bytes of the records after pos.
+func (l *segmentLog) pending(pos segmentPos) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var n int64
+	for _, s := range l.segments {
+		if s.seq == pos.seq {
+			n += s.size - pos.offset
+		} else if s.seq > pos.seq {
+			n += s.size
+		}
+	}
+	return n
+}
+
+// stats returns the total size and the number of segments.
+func (l *segmentLog) stats() (int64, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.size, len(l.segments)
+}
+
+func (l *segmentLog) close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.active == nil {
+		return nil
+	}
+	err := l.active.Sync()
+	if cerr := l.active.Close(); err == nil {
+		err = cerr
+	}
+	l.active = nil
+	return err
+}
+
+func (l *segmentLog) path(seq uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+// syncDir syncs a directory so the files created or removed in it survive a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+package store
+
+// EstimateEncodedSize returns the size in bytes of metrics encoded by encodeMetrics,
+// exact unless labels need escaping in JSON.
+func EstimateEncodedSize(metrics []Metric) int {
+	size := 0
+	for i := range metrics {
+		m := &metrics[i]
+
+		// {"metric":{},"timestamps":[],"values":[]}\n
+		size += 42
+		size += len(`"__name__":""`) + len(m.Metric.Name)
+		size += len(`,"instance":""`) + len(m.Metric.Instance)
+		size += len(`,"job":""`) + len(m.Metric.Job)
+		size += len(`,"sql_digest":""`) + len(m.Metric.SQLDigest)
+		if len(m.Metric.PlanDigest) != 0 {
+			size += len(`,"plan_digest":""`) + len(m.Metric.PlanDigest)
+		}
+		for key, value := range m.Metric.Labels {
+			if !isFixedLabel(key) {
+				size += len(`,"":""`) + len(key) + len(value)
+			}
+		}
+
+		// A nil slice is encoded as null instead of []
+		if m.Timestamps == nil {
+			size += 2
+		}
+		if m.Values == nil {
+			size += 2
+		}
+		for j, ts := range m.Timestamps {
+			if j != 0 {
+				size++
+			}
+			size += decimalDigits(ts)
+		}
+		for j, v := range m.Values {
+			if j != 0 {
+				size++
+			}
+			size += decimalDigits(v)
+		}
+	}
+	return size
+}
+
+func decimalDigits(v uint64) int {
+	n := 1
+	for v >= 10 {
+		v /= 10
+		n++
+	}
+	return n
+}
@@ -0,0 +1,186 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	skewThreshold   = pflag.Duration("store.clock-skew-threshold", 0, "Deviation of the newest timestamp of a batch of an instance from the wall clock beyond which the instance is taken as skewed. 0 disables the detection")
+	skewReportDelay = pflag.Duration("store.clock-skew-report-delay", 0, "Expected age of the newest sample of a batch on arrival, e.g. the report interval of the agents, not counted as skew")
+	skewCorrect     = pflag.Bool("store.clock-skew-correct", false, "Shift the timestamps of the skewed instances by their smoothed skew before writing")
+	skewSmoothing   = pflag.Float64("store.clock-skew-smoothing", 0.3, "Weight of the latest measure in the smoothed skew, in (0, 1]")
+)
+
+// ClockSkewStats is the clock skew measured of an instance.
+type ClockSkewStats struct {
+	// SkewSecs is the smoothed deviation of the clock of the instance from this
+	// server, positive if ahead.
+	SkewSecs     float64 `json:"skew_secs"`
+	LastSkewSecs float64 `json:"last_skew_secs"`
+	Skewed       bool    `json:"skewed"`
+	// CorrectionSecs is how much the timestamps of the last batch were shifted
+	// back, negative if forth.
+	CorrectionSecs float64 `json:"correction_secs"`
+	UpdatedAt      int64   `json:"updated_at"` // unix seconds
+}
+
+type instanceSkew struct {
+	stats ClockSkewStats
+	// The max raw and corrected timestamps written, so a change of the
+	// correction never moves samples before written ones.
+	written             bool
+	lastRawMillis       int64
+	lastCorrectedMillis int64
+}
+
+type skewTracker struct {
+	mu        sync.Mutex
+	instances map[string]*instanceSkew
+}
+
+var skews = &skewTracker{instances: make(map[string]*instanceSkew)}
+
+// ClockSkew returns the skew measured of instance, false if none.
+func ClockSkew(instance string) (ClockSkewStats, bool) {
+	skews.mu.Lock()
+	defer skews.mu.Unlock()
+	s, ok := skews.instances[instance]
+	if !ok {
+		return ClockSkewStats{}, false
+	}
+	return s.stats, true
+}
+
+// ClockSkews returns the skews measured of all instances.
+func ClockSkews() map[string]ClockSkewStats {
+	skews.mu.Lock()
+	defer skews.mu.Unlock()
+	res := make(map[string]ClockSkewStats, len(skews.instances))
+	for instance, s := range skews.instances {
+		res[instance] = s.stats
+	}
+	return res
+}
+
+// correctSkews measures the skew of each instance of metrics by its newest
+// timestamp and, in correction mode, shifts all timestamps of the skewed ones
+// by the same offset, which keeps the order of samples within each series.
+func correctSkews(metrics []Metric) {
+	threshold := *skewThreshold
+	if threshold <= 0 || len(metrics) == 0 {
+		return
+	}
+
+	type span struct{ oldest, newest int64 }
+	spans := make(map[string]*span)
+	for i := range metrics {
+		for _, ts := range metrics[i].Timestamps {
+			s, ok := spans[metrics[i].Metric.Instance]
+			if !ok {
+				s = &span{oldest: int64(ts), newest: int64(ts)}
+				spans[metrics[i].Metric.Instance] = s
+			}
+			if int64(ts) < s.oldest {
+				s.oldest = int64(ts)
+			}
+			if int64(ts) > s.newest {
+				s.newest = int64(ts)
+			}
+		}
+	}
+
+	now := clock.Now()
+	expected := now.Add(-*skewReportDelay).UnixNano() / int64(time.Millisecond)
+	offsets := make(map[string]int64)
+	skews.mu.Lock()
+	for instance, sp := range spans {
+		s := skews.measure(instance, float64(sp.newest-expected)/1000, threshold, now)
+		var offset int64
+		if s.stats.Skewed && *skewCorrect {
+			offset = s.offset(sp.oldest)
+		}
+		s.stats.CorrectionSecs = float64(offset) / 1000
+		s.track(sp.newest, offset)
+		if offset != 0 {
+			offsets[instance] = offset
+		}
+	}
+	skews.mu.Unlock()
+
+	if len(offsets) == 0 {
+		return
+	}
+	for i := range metrics {
+		offset, ok := offsets[metrics[i].Metric.Instance]
+		if !ok {
+			continue
+		}
+		for j, ts := range metrics[i].Timestamps {
+			metrics[i].Timestamps[j] = uint64(int64(ts) - offset)
+		}
+	}
+}
+
+// measure updates the smoothed skew of instance. skews.mu must be held.
+func (t *skewTracker) measure(instance string, skewSecs float64, threshold time.Duration, now time.Time) *instanceSkew {
+	s, ok := t.instances[instance]
+	if !ok {
+		s = &instanceSkew{stats: ClockSkewStats{SkewSecs: skewSecs}}
+		t.instances[instance] = s
+		metrics.GetOrCreateGauge(fmt.Sprintf(`diag_store_clock_skew_seconds{instance=%q}`, instance), func() float64 {
+			stats, _ := ClockSkew(instance)
+			return stats.SkewSecs
+		})
+		metrics.GetOrCreateGauge(fmt.Sprintf(`diag_store_clock_skew_correction_seconds{instance=%q}`, instance), func() float64 {
+			stats, _ := ClockSkew(instance)
+			return stats.CorrectionSecs
+		})
+	} else {
+		alpha := *skewSmoothing
+		if alpha <= 0 || alpha > 1 {
+			alpha = 1
+		}
+		s.stats.SkewSecs = alpha*skewSecs + (1-alpha)*s.stats.SkewSecs
+	}
+	s.stats.LastSkewSecs = skewSecs
+	s.stats.UpdatedAt = now.Unix()
+
+	skewed := math.Abs(s.stats.SkewSecs) > threshold.Seconds()
+	if skewed && !s.stats.Skewed {
+		log.Warn("the clock of the instance is skewed", zap.String("instance", instance), zap.Float64("skew_secs", s.stats.SkewSecs))
+	}
+	s.stats.Skewed = skewed
+	return s
+}
+
+// offset returns the millis to subtract from the timestamps of a batch starting
+// at oldest, the smoothed skew reduced so that a batch after the samples
+// written stays after them once corrected.
+func (s *instanceSkew) offset(oldest int64) int64 {
+	offset := int64(math.Round(s.stats.SkewSecs * 1000))
+	if s.written && oldest > s.lastRawMillis {
+		if limit := oldest - s.lastCorrectedMillis - 1; offset > limit {
+			offset = limit
+		}
+	}
+	return offset
+}
+
+// track records the newest timestamp of a batch shifted by offset.
+func (s *instanceSkew) track(newest, offset int64) {
+	if !s.written || newest > s.lastRawMillis {
+		s.lastRawMillis = newest
+	}
+	if corrected := newest - offset; !s.written || corrected > s.lastCorrectedMillis {
+		s.lastCorrectedMillis = corrected
+	}
+	s.written = true
+}
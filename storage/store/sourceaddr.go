@@ -0,0 +1,68 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/spf13/pflag"
+)
+
+const labelSourceAddr = "source_addr"
+
+var heartbeatSourceAddr = pflag.Bool("store.heartbeat-source-addr", false, "Label the topsql_up samples of --store.emit-heartbeat by the source_addr of the agent reporting the instance")
+
+var sourceAddrs = struct {
+	sync.Mutex
+	written map[string]string // instance -> the source_addr written
+}{written: make(map[string]string)}
+
+// setSourceAddrs sets the source_addr of the instances to addr unless written
+// already, skipped if addr is unknown. The returned func records the writes as
+// done, to call once db committed.
+func setSourceAddrs(db execer, keys []instanceKey, addr string) (func(), error) {
+	if len(addr) == 0 {
+		return func() {}, nil
+	}
+
+	var changed []string
+	sourceAddrs.Lock()
+	for _, key := range keys {
+		if sourceAddrs.written[key.instance] != addr {
+			changed = append(changed, key.instance)
+		}
+	}
+	sourceAddrs.Unlock()
+	if len(changed) == 0 {
+		return func() {}, nil
+	}
+
+	err := update(db, func(tx execer) error {
+		for _, instance := range changed {
+			if err := tx.Exec("UPDATE instance SET source_addr = ? WHERE instance = ?", addr, instance); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		sourceAddrs.Lock()
+		for _, instance := range changed {
+			sourceAddrs.written[instance] = addr
+		}
+		sourceAddrs.Unlock()
+	}, nil
+}
+
+// labelSourceAddrs labels heartbeats by addr.
+func labelSourceAddrs(heartbeats []Metric, addr string) {
+	for i := range heartbeats {
+		m := &heartbeats[i]
+		if m.Metric.Labels == nil {
+			m.Metric.Labels = make(map[string]string, 1)
+		}
+		m.Metric.Labels[labelSourceAddr] = addr
+	}
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var verifySQLDigest = pflag.Bool("store.verify-sql-digest", false, "Recompute the digests of SQL metas from their normalized texts as TiDB does and flag the metas whose digest differs, e.g. of agents hashing differently")
+
+// digestMismatchLogInterval is the min interval between the logs of mismatches.
+const digestMismatchLogInterval = 10 * time.Second
+
+var (
+	verifiedDigestCounter   = metrics.NewCounter(`diag_store_sql_digest_verifications_total{result="matched"}`)
+	mismatchedDigestCounter = metrics.NewCounter(`diag_store_sql_digest_verifications_total{result="mismatched"}`)
+
+	// lastMismatchLog is the unix nanos of the last log of a mismatch.
+	lastMismatchLog int64
+)
+
+// expectedSQLDigest returns the digest TiDB computes of a normalized SQL text,
+// the sha256 of it.
+func expectedSQLDigest(normalizedSQL string) []byte {
+	sum := sha256.Sum256([]byte(normalizedSQL))
+	return sum[:]
+}
+
+// verifiedSQLMetas tells which of metas have a digest differing from the one
+// recomputed from the text, all false if the verification is off.
+func verifiedSQLMetas(metas []*tipb.SQLMeta) []bool {
+	mismatched := make([]bool, len(metas))
+	if !CurrentConfig().VerifySQLDigest {
+		return mismatched
+	}
+
+	for i, meta := range metas {
+		expected := expectedSQLDigest(meta.NormalizedSql)
+		if bytes.Equal(expected, meta.SqlDigest) {
+			verifiedDigestCounter.Inc()
+			continue
+		}
+		mismatched[i] = true
+		mismatchedDigestCounter.Inc()
+		logDigestMismatch(meta.SqlDigest, expected)
+	}
+	return mismatched
+}
+
+func logDigestMismatch(sent, expected []byte) {
+	now := clock.Now().UnixNano()
+	last := atomic.LoadInt64(&lastMismatchLog)
+	if now-last < int64(digestMismatchLogInterval) || !atomic.CompareAndSwapInt64(&lastMismatchLog, last, now) {
+		return
+	}
+	log.Warn("SQL digest differs from the one recomputed from the text, the agent may hash differently",
+		zap.String("digest", hex.EncodeToString(sent)),
+		zap.String("expected", hex.EncodeToString(expected)),
+		zap.Uint64("mismatches", mismatchedDigestCounter.Get()))
+}
@@ -0,0 +1,63 @@
+package store
+
+// seenSQLPlans are the keys of the sql_plan rows known to be stored.
+var seenSQLPlans = newSeenCache(seenCacheCapacity)
+
+// sqlPlanKey returns the key of the sql_plan row associating the plan digest
+// planDigest with the SQL digest sqlDigest of tenant.
+func sqlPlanKey(tenant, sqlDigest, planDigest string) string {
+	return TenantKey(tenant, sqlDigest+"."+planDigest)
+}
+
+// sqlPlan is a sql_plan row associating the plan digest planDigest with the
+// SQL digest sqlDigest, the key of the tenant.
+type sqlPlan struct{ key, sqlDigest, planDigest string }
+
+// sqlPlansOf returns the sql_plan rows of metrics of tenant not known to be
+// stored.
+func sqlPlansOf(tenant string, metrics []Metric) []sqlPlan {
+	var pairs []sqlPlan
+	seen := make(map[string]struct{})
+	for i := range metrics {
+		m := &metrics[i].Metric
+		if len(m.SQLDigest) == 0 || len(m.PlanDigest) == 0 || IsOthersDigest(m.SQLDigest) {
+			continue
+		}
+		key := sqlPlanKey(tenant, m.SQLDigest, m.PlanDigest)
+		if _, ok := seen[key]; ok || seenSQLPlans.contains(key) {
+			continue
+		}
+		seen[key] = struct{}{}
+		pairs = append(pairs, sqlPlan{key: key, sqlDigest: TenantKey(tenant, m.SQLDigest), planDigest: m.PlanDigest})
+	}
+	return pairs
+}
+
+// insertSQLPlans inserts pairs of tenant in the sql_plan table, for counting
+// the SQLs of several plans. The returned func records the rows as stored, to
+// call once db committed.
+func insertSQLPlans(db execer, tenant string, pairs []sqlPlan) (func(), error) {
+	if len(pairs) == 0 {
+		return func() {}, nil
+	}
+
+	err := insert(
+		db,
+		"INSERT INTO sql_plan(pair, tenant, sql_digest, plan_digest) VALUES ",
+		"(?, ?, ?, ?)", len(pairs),
+		onConflictDoNothing,
+		func(target *[]interface{}) {
+			for _, p := range pairs {
+				*target = append(*target, p.key, tenant, p.sqlDigest, p.planDigest)
+			}
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		for _, p := range pairs {
+			seenSQLPlans.add(p.key)
+		}
+	}, nil
+}
@@ -1,13 +1,16 @@
 package store
 
 import (
-	"bytes"
+	"context"
 	"encoding/hex"
 	"encoding/json"
-	"net/http"
+	"io"
 
+	"github.com/zhongzc/diag_backend/storage/textcrypt"
 	"github.com/zhongzc/diag_backend/utils"
+	"github.com/zhongzc/diag_backend/utils/failpoint"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/genjidb/genji"
 	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
 	"github.com/pingcap/log"
@@ -16,134 +19,516 @@ import (
 )
 
 var (
-	writeHandler http.HandlerFunc
-	documentDB   *genji.DB
+	metricWriter MetricWriter
+	// hasWriter tells Init got a writer, not the case of the offline tools.
+	hasWriter  bool
+	documentDB *genji.DB
 
 	bytesP         = utils.BytesBufferPool{}
 	headerP        = utils.HeaderPool{}
 	metricsP       = MetricSlicePool{}
 	stringBuilderP = StringBuilderPool{}
 	prepareSliceP  = PrepareSlicePool{}
+
+	cpuTimeCumulator *cumulator
+
+	// the writers wrapped into metricWriter, nil if not enabled
+	walWriter   *WAL
+	asyncWriter *AsyncWriter
 )
 
-func Init(handler http.HandlerFunc, documentDB *genji.DB) {
-	writeHandler = handler
+// Init prepares the store. A nil extractor labels series by the SQL and plan digests.
+func Init(writer MetricWriter, documentDB *genji.DB, extractor TagExtractor) {
+	hasWriter = writer != nil
+	encodedTarget, _ = writer.(encodedWriter)
+	// The innermost writer confirms the writes the watermarks advance with.
+	writer = &watermarkWriter{inner: writer}
+	metricWriter = writer
+	adaptiveBatcher, walWriter, asyncWriter = nil, nil, nil
+	tagExtractor = extractor
+	cfg := ConfigFromFlags()
+	if err := cfg.validate(); err != nil {
+		log.Fatal("invalid store config", zap.Error(err))
+	}
+	config.Store(cfg)
+	// Validated along with cfg
+	names, _ := resolveMetricNames(cfg.MetricPrefix, cfg.MetricNames)
+	resolvedNames.Store(names)
+	n, _ := newNormalizer(cfg)
+	instanceNormalizer.Store(n)
+	if *histogramBuckets > 0 {
+		if cfg.CumulativeCPUTime {
+			log.Fatal("invalid store config, --store.cpu-histogram-buckets and --store.cumulative-cpu-time are exclusive")
+		}
+		bounds, err := ExponentialBuckets(*histogramStart, *histogramFactor, *histogramBuckets)
+		if err != nil {
+			log.Fatal("invalid store config", zap.Error(err))
+		}
+		cpuHistogramBounds = bounds
+	}
+	if *maxInflightBytes > 0 {
+		budget := NewByteBudget(*maxInflightBytes)
+		metrics.NewGauge(`diag_store_inflight_bytes`, func() float64 {
+			used, _ := budget.InUse()
+			return float64(used)
+		})
+		inflightBudget = budget
+	}
 	if err := initDocumentDB(documentDB); err != nil {
 		log.Fatal("cannot init tables", zap.Error(err))
 	}
+
+	if cfg.BatchMaxSize > 0 {
+		batcher := NewAdaptiveBatcher(writer, AdaptiveBatchConfig{
+			MinSize:       cfg.BatchMinSize,
+			MaxSize:       cfg.BatchMaxSize,
+			TargetLatency: cfg.BatchTargetLatency,
+		})
+		metrics.NewGauge(`diag_store_adaptive_batch_size`, func() float64 {
+			return float64(batcher.Size())
+		})
+		writer = batcher
+		metricWriter = writer
+		adaptiveBatcher = batcher
+	}
+
+	if len(*trafficCaptureDir) != 0 {
+		c, err := openTrafficCapture(*trafficCaptureDir, *trafficCaptureMaxSize, *trafficDigestsOnly)
+		if err != nil {
+			log.Fatal("cannot open the traffic capture", zap.String("dir", *trafficCaptureDir), zap.Error(err))
+		}
+		traffic = c
+	}
+
+	if len(cfg.WALPath) != 0 {
+		// The wal takes the place of the async queue, written in the background too.
+		if cfg.AsyncBufferSize > 0 {
+			log.Warn("--store.async-buffer-size is ignored with --store.wal-path, the metrics are queued in the wal")
+		}
+		wal, err := NewWAL(WALConfigFromFlags(cfg.WALPath), writer)
+		if err != nil {
+			log.Fatal("cannot open the wal", zap.String("path", cfg.WALPath), zap.Error(err))
+		}
+		metrics.NewGauge(`diag_store_wal_pending_bytes`, func() float64 {
+			return float64(wal.Stats().PendingBytes)
+		})
+		metricWriter = wal
+		walWriter = wal
+	} else if cfg.AsyncBufferSize > 0 {
+		asyncWriter = NewAsyncWriter(metricWriter, AsyncWriterConfig{
+			BatchSize:     cfg.AsyncBatchSize,
+			BufferSize:    cfg.AsyncBufferSize,
+			FlushInterval: cfg.AsyncFlushInterval,
+			Workers:       cfg.AsyncWorkers,
+		})
+		metricWriter = asyncWriter
+	}
+
+	if *unknownDigestGrace > 0 {
+		pendingDigests = newPendingSet(*unknownDigestGrace, *unknownDigestMaxPending)
+	}
+	if cfg.CumulativeCPUTime {
+		cpuTimeCumulator = newCumulator()
+		cpuTimeCumulator.startCleanup(cfg.CumulativeStaleTTL)
+	}
+	tombstones.startGC()
+	if err := watermarks.load(documentDB); err != nil {
+		log.Warn("failed to load the watermarks", zap.Error(err))
+	}
+	watermarks.startPersist(documentDB, *watermarkFlushInterval)
+
+	openLifecycle()
+	if len(*pdEndpoint) != 0 {
+		StartTopologySync(NewPDTopology(*pdEndpoint, nil), *topologySyncInterval)
+	}
+
+	if len(*configFile) != 0 {
+		watcher = NewConfigFileWatcher(*configFile, *configFileInterval)
+		watcher.Start()
+	}
+}
+
+// Stop waits for the ingestion calls in flight, which fail with ErrClosed from
+// then on, and closes the writers.
+func Stop() {
+	closeLifecycle()
+	if watcher != nil {
+		watcher.Stop()
+	}
+	stopTopologySync()
+	deleteHandler = nil
+	encodedTarget = nil
+	tombstones.stopGC()
+	if cpuTimeCumulator != nil {
+		cpuTimeCumulator.stop()
+		cpuTimeCumulator = nil
+	}
+	if pendingDigests != nil {
+		// Before the writers close
+		pendingDigests.close()
+		pendingDigests = nil
+	}
+
+	if closer, ok := metricWriter.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Warn("failed to close the metric writer", zap.Error(err))
+		}
+	}
+	// After the queued metrics are written
+	watermarks.stopPersist(documentDB)
+	if traffic != nil {
+		if err := traffic.close(); err != nil {
+			log.Warn("failed to close the traffic capture", zap.Error(err))
+		}
+		traffic = nil
+	}
 }
 
 func TopSQLRecords(records []*tipb.CPUTimeRecord) error {
+	return TopSQLRecordsFrom(context.Background(), Source{}, records)
+}
+
+// TopSQLRecordsFrom stores records reported by src under its tenant. The
+// fingerprint of src detects two agents reporting as the same instance,
+// skipped if empty, and the batch is dropped if written already within
+// --store.dedup-window. It returns once the metrics are written, appended to
+// the wal or queued by --store.async-buffer-size, see TopSQLRecordsAcked, or
+// fails once ctx is done waiting for --store.max-inflight-bytes.
+func TopSQLRecordsFrom(ctx context.Context, src Source, records []*tipb.CPUTimeRecord) error {
 	if len(records) == 0 {
 		return nil
 	}
-
-	var err error
-	err = insert(
-		"INSERT INTO instance(instance, job) VALUES ",
-		"(?, ?)", len(records),
-		" ON CONFLICT DO NOTHING",
-		func(target *[]interface{}) {
-			for _, record := range records {
-				*target = append(*target, record.Instance)
-				*target = append(*target, record.Job)
-			}
-		},
-	)
+	if err := CheckTenant(src.Tenant); err != nil {
+		return err
+	}
+	exit, err := enter()
 	if err != nil {
 		return err
 	}
+	defer exit()
+	captureBatch(CapturedBatch{Kind: CaptureTopSQL, Source: src, TopSQLRecords: records})
+	records = normalizedTopSQLRecords(records)
+
+	duplicate, written, err := dedup(func() (batchKey, bool) {
+		batch := make([]marshaler, 0, len(records))
+		for _, r := range records {
+			batch = append(batch, r)
+		}
+		return newBatchKey("topsql", src, batch)
+	})
+	if err != nil || duplicate {
+		return err
+	}
+	conflicting := conflictingInstances(src.Fingerprint, records)
+
+	discovered := discoverInstances(documentDB, len(records), func(i int) string {
+		return records[i].Instance
+	})
 
-	err = storeRecords(func(target *[]Metric) error {
+	err = ingest(ctx, src, len(records), func(i int) (string, string) {
+		return records[i].Instance, records[i].Job
+	}, func(target *[]Metric) error {
 		fillTopSQLProtoToMetric(records, target)
+		labelConflicts(*target, conflicting)
 		return nil
 	})
-	return err
+	written(err)
+	if err != nil {
+		return err
+	}
+	notifyInstances(discovered)
+	return nil
 }
 
 func ResourceMeteringRecords(records []*rsmetering.CPUTimeRecord) error {
+	return ResourceMeteringRecordsFrom(context.Background(), Source{}, records)
+}
+
+// ResourceMeteringRecordsFrom stores records reported by src under its tenant,
+// dropping the batch if written already within --store.dedup-window, like
+// TopSQLRecordsFrom.
+func ResourceMeteringRecordsFrom(ctx context.Context, src Source, records []*rsmetering.CPUTimeRecord) error {
 	if len(records) == 0 {
 		return nil
 	}
-
-	var err error
-	err = insert(
-		"INSERT INTO instance(instance, job) VALUES ",
-		"(?, ?)", len(records),
-		" ON CONFLICT DO NOTHING",
-		func(target *[]interface{}) {
-			for _, record := range records {
-				*target = append(*target, record.Instance)
-				*target = append(*target, record.Job)
-			}
-		},
-	)
+	if err := CheckTenant(src.Tenant); err != nil {
+		return err
+	}
+	exit, err := enter()
 	if err != nil {
 		return err
 	}
+	defer exit()
+	captureBatch(CapturedBatch{Kind: CaptureResourceMetering, Source: src, ResourceMeteringRecords: records})
+	countUnknownFields(records)
+	records = normalizedRsMeteringRecords(records)
+
+	duplicate, written, err := dedup(func() (batchKey, bool) {
+		batch := make([]marshaler, 0, len(records))
+		for _, r := range records {
+			batch = append(batch, r)
+		}
+		return newBatchKey("resource_metering", src, batch)
+	})
+	if err != nil || duplicate {
+		return err
+	}
 
-	err = storeRecords(func(target *[]Metric) error {
+	discovered := discoverInstances(documentDB, len(records), func(i int) string {
+		return records[i].Instance
+	})
+
+	err = ingest(ctx, src, len(records), func(i int) (string, string) {
+		return records[i].Instance, records[i].Job
+	}, func(target *[]Metric) error {
 		return fillRsMeteringProtoToMetric(records, target)
 	})
-	return err
+	written(err)
+	if err != nil {
+		return err
+	}
+	notifyInstances(discovered)
+	return nil
 }
 
 func SQLMetas(metas []*tipb.SQLMeta) error {
+	exit, err := enter()
+	if err != nil {
+		return err
+	}
+	defer exit()
+	start := clock.Now()
+	if CurrentConfig().MetaPriority {
+		defer metaLanes.enterMeta()()
+	}
+	discovered, stored, err := insertSQLMetas(documentDB, DefaultTenant, metas)
+	if err != nil {
+		return err
+	}
+	stored()
+	observeMetaLag(start)
+	resolveSQLMetas(DefaultTenant, metas)
+	notifySQLMetas(DefaultTenant, discovered)
+	return nil
+}
+
+// insertSQLMetas inserts metas of tenant on db and returns the discovered ones
+// to notify of. The returned func records the digests as stored, to call once
+// db committed.
+func insertSQLMetas(db execer, tenant string, metas []*tipb.SQLMeta) ([]*tipb.SQLMeta, func(), error) {
 	if len(metas) == 0 {
-		return nil
+		return nil, func() {}, nil
 	}
+	captureBatch(CapturedBatch{Kind: CaptureSQLMetas, Source: Source{Tenant: tenant}, SQLMetas: metas})
 
-	return insert(
-		"INSERT INTO sql_digest(digest, sql_text, is_internal) VALUES ",
-		"(?, ?, ?)", len(metas),
-		" ON CONFLICT DO NOTHING",
-		func(target *[]interface{}) {
-			for _, meta := range metas {
-				*target = append(*target, hex.EncodeToString(meta.SqlDigest))
-				*target = append(*target, meta.NormalizedSql)
-				*target = append(*target, meta.IsInternalSql)
-			}
-		},
-	)
+	if metas = capturedSQLMetas(tenant, liveSQLMetas(tenant, uniqueSQLMetas(metas))); len(metas) == 0 {
+		return nil, func() {}, nil
+	}
+	mismatched := verifiedSQLMetas(metas)
+	metas = redactedSQLMetas(metas)
+
+	maxLength := CurrentConfig().MaxSQLLength
+	now := clock.Now().Unix()
+	rows := make([]sqlMetaRow, len(metas))
+	for i, meta := range metas {
+		sqlText, truncated := truncateText(meta.NormalizedSql, maxLength)
+		if truncated {
+			truncatedSQLCounter.Inc()
+		}
+
+		rows[i] = sqlMetaRow{meta: meta, key: TenantKey(tenant, hex.EncodeToString(meta.SqlDigest)), mismatched: mismatched[i], firstSeen: now}
+		var err error
+		if rows[i].text, err = textcrypt.Encrypt(sqlText, rows[i].key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fresh, stored := freshKeys(db, seenSQLDigests, "sql_digest", len(rows), func(i int) string { return rows[i].key })
+	if err := insertSQLMetaRows(db, tenant, rows); err != nil {
+		return nil, nil, err
+	}
+	sqlDigestInserts.observe(fresh)
+	return discoverSQLMetas(metas, fresh), stored, nil
 }
 
 func PlanMetas(metas []*tipb.PlanMeta) error {
+	exit, err := enter()
+	if err != nil {
+		return err
+	}
+	defer exit()
+	start := clock.Now()
+	if CurrentConfig().MetaPriority {
+		defer metaLanes.enterMeta()()
+	}
+	discovered, stored, err := insertPlanMetas(documentDB, DefaultTenant, metas)
+	if err != nil {
+		return err
+	}
+	stored()
+	observeMetaLag(start)
+	notifyPlanMetas(DefaultTenant, discovered)
+	return nil
+}
+
+// insertPlanMetas inserts metas of tenant on db and returns the discovered ones
+// to notify of, recording their digests as stored like insertSQLMetas.
+func insertPlanMetas(db execer, tenant string, metas []*tipb.PlanMeta) ([]*tipb.PlanMeta, func(), error) {
 	if len(metas) == 0 {
-		return nil
+		return nil, func() {}, nil
 	}
+	captureBatch(CapturedBatch{Kind: CapturePlanMetas, Source: Source{Tenant: tenant}, PlanMetas: metas})
 
-	return insert(
-		"INSERT INTO plan_digest(digest, plan_text) VALUES ",
-		"(?, ?)", len(metas),
-		" ON CONFLICT DO NOTHING",
-		func(target *[]interface{}) {
-			for _, meta := range metas {
-				*target = append(*target, hex.EncodeToString(meta.PlanDigest))
-				*target = append(*target, meta.NormalizedPlan)
-			}
-		},
-	)
+	if metas = capturedPlanMetas(livePlanMetas(tenant, uniquePlanMetas(metas))); len(metas) == 0 {
+		return nil, func() {}, nil
+	}
+
+	maxLength := CurrentConfig().MaxPlanLength
+	now := clock.Now().Unix()
+	rows := make([]planMetaRow, len(metas))
+	for i, meta := range metas {
+		planText, truncated := truncateText(meta.NormalizedPlan, maxLength)
+		if truncated {
+			truncatedPlanCounter.Inc()
+		}
+
+		rows[i] = planMetaRow{meta: meta, key: TenantKey(tenant, hex.EncodeToString(meta.PlanDigest)), firstSeen: now}
+		var err error
+		if rows[i].text, err = textcrypt.Encrypt(planText, rows[i].key); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	fresh, stored := freshKeys(db, seenPlanDigests, "plan_digest", len(rows), func(i int) string { return rows[i].key })
+	if err := insertPlanMetaRows(db, tenant, rows); err != nil {
+		return nil, nil, err
+	}
+	planDigestInserts.observe(fresh)
+	return discoverPlanMetas(metas, fresh), stored, nil
 }
 
 func initDocumentDB(db *genji.DB) error {
 	documentDB = db
 
-	createTableStmts := []string{
-		"CREATE TABLE IF NOT EXISTS sql_digest (digest VARCHAR(255) PRIMARY KEY)",
-		"CREATE TABLE IF NOT EXISTS plan_digest (digest VARCHAR(255) PRIMARY KEY)",
-		"CREATE TABLE IF NOT EXISTS instance (instance VARCHAR(255) PRIMARY KEY)",
+	supported, err := probeConflictSupport(db)
+	if err != nil {
+		return err
+	}
+	conflictSupported = supported
+
+	if err = verifySchema(db); err != nil {
+		return err
 	}
 
-	for _, stmt := range createTableStmts {
-		if err := db.Exec(stmt); err != nil {
-			return err
+	if err = backfillTenants(db); err != nil {
+		return err
+	}
+	if err = tombstones.load(db); err != nil {
+		return err
+	}
+	return loadInternalDigests(db)
+}
+
+// uniqueSQLMetas returns the first meta of every digest, metas itself if no digest repeats.
+func uniqueSQLMetas(metas []*tipb.SQLMeta) []*tipb.SQLMeta {
+	seen := make(map[string]struct{}, len(metas))
+	var res []*tipb.SQLMeta
+	for i, meta := range metas {
+		if _, ok := seen[string(meta.SqlDigest)]; !ok {
+			seen[string(meta.SqlDigest)] = struct{}{}
+			if res != nil {
+				res = append(res, meta)
+			}
+			continue
+		}
+		if res == nil {
+			res = append(make([]*tipb.SQLMeta, 0, len(metas)), metas[:i]...)
 		}
 	}
+	if res == nil {
+		return metas
+	}
+	return res
+}
 
-	return nil
+// uniquePlanMetas returns the first meta of every digest, metas itself if no digest repeats.
+func uniquePlanMetas(metas []*tipb.PlanMeta) []*tipb.PlanMeta {
+	seen := make(map[string]struct{}, len(metas))
+	var res []*tipb.PlanMeta
+	for i, meta := range metas {
+		if _, ok := seen[string(meta.PlanDigest)]; !ok {
+			seen[string(meta.PlanDigest)] = struct{}{}
+			if res != nil {
+				res = append(res, meta)
+			}
+			continue
+		}
+		if res == nil {
+			res = append(make([]*tipb.PlanMeta, 0, len(metas)), metas[:i]...)
+		}
+	}
+	if res == nil {
+		return metas
+	}
+	return res
+}
+
+type instanceKey struct {
+	instance string
+	job      string
+}
+
+// insertInstances upserts the distinct instances among n records reported by
+// src in a single statement. The returned func is to call once db committed.
+func insertInstances(db execer, n int, src Source, instanceAt func(i int) (instance, job string)) (func(), error) {
+	seen := make(map[instanceKey]struct{}, 1)
+	keys := make([]instanceKey, 0, 1)
+	for i := 0; i < n; i++ {
+		instance, job := instanceAt(i)
+		key := instanceKey{instance: instance, job: job}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+
+	err := insert(
+		db,
+		"INSERT INTO instance(instance, job) VALUES ",
+		"(?, ?)", len(keys),
+		onConflictDoNothing,
+		func(target *[]interface{}) {
+			for _, key := range keys {
+				*target = append(*target, key.instance)
+				*target = append(*target, key.job)
+			}
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	touched, err := touchInstances(db, keys)
+	if err != nil {
+		return nil, err
+	}
+	addrSet, err := setSourceAddrs(db, keys, src.Addr)
+	if err != nil {
+		return nil, err
+	}
+	agentSet, err := setAgents(db, keys, src)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		touched()
+		addrSet()
+		agentSet()
+	}, nil
 }
 
 func insert(
+	db execer,
 	header string, // INSERT INTO {table}({fields}...) VALUES
 	elem string, times int, // (?, ?, ... , ?), (?, ?, ... , ?), ... (?, ?, ... , ?)
 	footer string, // ON CONFLICT DO NOTHING
@@ -153,8 +538,12 @@ func insert(
 		log.Fatal("unexpected zero times", zap.Int("times", times))
 	}
 
+	if footer == onConflictDoNothing && !conflictSupported {
+		return insertMissing(db, header, elem, times, fill)
+	}
+
 	prepareStmt := buildPrepareStmt(header, elem, times, footer)
-	return execStmt(prepareStmt, fill)
+	return execStmt(db, prepareStmt, fill)
 }
 
 func buildPrepareStmt(header string, elem string, times int, footer string) string {
@@ -172,8 +561,11 @@ func buildPrepareStmt(header string, elem string, times int, footer string) stri
 	return sb.String()
 }
 
-func execStmt(prepareStmt string, fill func(target *[]interface{})) error {
-	stmt, err := documentDB.Prepare(prepareStmt)
+func execStmt(db execer, prepareStmt string, fill func(target *[]interface{})) error {
+	if err := failpoint.Eval(FailpointGenjiExec); err != nil {
+		return err
+	}
+	stmt, err := db.Prepare(prepareStmt)
 	if err != nil {
 		return err
 	}
@@ -185,14 +577,82 @@ func execStmt(prepareStmt string, fill func(target *[]interface{})) error {
 	return stmt.Exec(*ps...)
 }
 
-func storeRecords(fill func(target *[]Metric) error) error {
+// storeRecords writes the metrics filled by fill from src, looking up the
+// digests on db, then calls commit with the sql_plan rows of the metrics. A
+// failed commit takes the totals back like a failed write, so the retry
+// rewrites the same samples.
+func storeRecords(ctx context.Context, db execer, src Source, fill func(target *[]Metric) error, commit func(pairs []sqlPlan) (func(), error)) error {
 	metrics := metricsP.Get()
 	defer metricsP.Put(metrics)
 
 	if err := fill(metrics); err != nil {
 		return err
 	}
-	return writeTimeseriesDB(*metrics)
+	if err := checkSeriesDigests(*metrics); err != nil {
+		return err
+	}
+	labelTenants(*metrics, src.Tenant)
+	cfg := CurrentConfig()
+	checkTimestamps(*metrics, cfg.TimestampPolicy, cfg.MaxFutureTimestamp)
+	correctSkews(*metrics)
+	dropTombstonedSeries(metrics)
+	dropInternalSeries(cfg, metrics)
+	mergeConflicts(metrics, cfg.SampleConflictPolicy)
+	stripPlanDigests(cfg, metrics)
+	var counts []*sampleCount
+	if cfg.EmitSampleCounts {
+		// Before the buckets multiply the samples
+		counts = countSamples(*metrics)
+	}
+	if cpuHistogramBounds != nil {
+		bucketize(metrics, cpuHistogramBounds)
+	}
+	undoCumulative := func() {}
+	if cpuTimeCumulator != nil {
+		undoCumulative = cpuTimeCumulator.accumulate(*metrics)
+	}
+	if cfg.EmitHeartbeat {
+		n := len(*metrics)
+		appendHeartbeats(metrics)
+		if cfg.HeartbeatSourceAddr && len(src.Addr) != 0 {
+			labelSourceAddrs((*metrics)[n:], src.Addr)
+		}
+	}
+	undo := undoCumulative
+	if len(counts) != 0 {
+		undoCounts := appendSampleCounts(metrics, counts)
+		undo = func() {
+			undoCounts()
+			undoCumulative()
+		}
+	}
+	if cfg.ValidateMetrics {
+		if err := checkMetrics(*metrics); err != nil {
+			undo()
+			return err
+		}
+	}
+	pairs := sqlPlansOf(src.Tenant, *metrics)
+	var held []Metric
+	// Metas never to arrive are not waited for
+	if pendingDigests != nil && !src.lacks(CapabilitySQLMetas) {
+		held = pendingDigests.split(db, metrics)
+	}
+	if err := writeTimeseriesDB(ctx, src.RequestID, *metrics, acksOf(src.ack, len(*metrics))); err != nil {
+		undo()
+		log.Debug("failed to store the records", zap.String("request_id", src.RequestID), zap.Error(err))
+		return err
+	}
+	stored, err := commit(pairs)
+	if err != nil {
+		undo()
+		return err
+	}
+	stored()
+	if len(held) != 0 {
+		pendingDigests.hold(held, src.ack)
+	}
+	return nil
 }
 
 // transform tipb.CPUTimeRecord to util.Metric
@@ -200,23 +660,18 @@ func fillTopSQLProtoToMetric(
 	records []*tipb.CPUTimeRecord,
 	target *[]Metric,
 ) {
+	units := timestampUnitsOf(CurrentConfig())
 	for _, rawRecord := range records {
 		*target = append(*target, Metric{})
 		m := &(*target)[len(*target)-1]
 
-		m.Metric.Name = "cpu_time"
+		m.Metric.Name = MetricName(MetricCPUTime)
 		m.Metric.Instance = rawRecord.Instance
 		m.Metric.Job = rawRecord.Job
-		m.Metric.SQLDigest = hex.EncodeToString(rawRecord.SqlDigest)
+		m.Metric.SQLDigest = sqlDigestLabel(rawRecord.SqlDigest)
 		m.Metric.PlanDigest = hex.EncodeToString(rawRecord.PlanDigest)
 
-		for i := range rawRecord.RecordListCpuTimeMs {
-			tsMillis := rawRecord.RecordListTimestampSec[i] * 1000
-			cpuTime := rawRecord.RecordListCpuTimeMs[i]
-
-			m.Timestamps = append(m.Timestamps, tsMillis)
-			m.Values = append(m.Values, cpuTime)
-		}
+		appendCPUTimes(m, cpuTimeRecordOf(rawRecord.Instance, rawRecord.Job, rawRecord.RecordListTimestampSec, rawRecord.RecordListCpuTimeMs), units)
 	}
 }
 
@@ -226,65 +681,130 @@ func fillRsMeteringProtoToMetric(
 	target *[]Metric,
 ) error {
 	tag := tipb.ResourceGroupTag{}
+	units := timestampUnitsOf(CurrentConfig())
 
 	for _, rawRecord := range records {
-		*target = append(*target, Metric{})
-		m := &(*target)[len(*target)-1]
-
-		m.Metric.Name = "cpu_time"
-		m.Metric.Instance = rawRecord.Instance
-		m.Metric.Job = rawRecord.Job
-
-		tag.Reset()
-		if err := tag.Unmarshal(rawRecord.ResourceGroupTag); err != nil {
+		if err := decodeResourceGroupTag(rawRecord.ResourceGroupTag, &tag); err != nil {
 			return err
 		}
+		m := appendTaggedMetric(target, MetricName(MetricCPUTime), rawRecord.Instance, rawRecord.Job, &tag)
 
-		m.Metric.SQLDigest = hex.EncodeToString(tag.SqlDigest)
-		m.Metric.PlanDigest = hex.EncodeToString(tag.PlanDigest)
+		appendCPUTimes(m, cpuTimeRecordOf(rawRecord.Instance, rawRecord.Job, rawRecord.RecordListTimestampSec, rawRecord.RecordListCpuTimeMs), units)
+	}
 
-		for i := range rawRecord.RecordListCpuTimeMs {
-			tsMillis := rawRecord.RecordListTimestampSec[i] * 1000
-			cpuTime := rawRecord.RecordListCpuTimeMs[i]
+	return nil
+}
 
-			m.Timestamps = append(m.Timestamps, tsMillis)
-			m.Values = append(m.Values, cpuTime)
-		}
+// appendCPUTimes appends the samples of r to m.
+func appendCPUTimes(m *Metric, r cpuTimeRecord, units timestampUnits) {
+	for i := range r.cpuTimeMs {
+		m.Timestamps = append(m.Timestamps, units.toMillis(r.timestamps[i], r.instance, r.job))
+		m.Values = append(m.Values, uint64(r.cpuTimeMs[i]))
 	}
+}
 
-	return nil
+func decodeResourceGroupTag(raw []byte, tag *tipb.ResourceGroupTag) error {
+	tag.Reset()
+	return tag.Unmarshal(raw)
 }
 
-func writeTimeseriesDB(metrics []Metric) error {
-	bufReq := bytesP.Get()
-	bufResp := bytesP.Get()
-	header := headerP.Get()
+// OthersDigest is the sql_digest of the records without a SQL digest, the
+// others aggregated by TiDB beyond its top SQLs, e.g. all of the windows with
+// Top SQL disabled. No SQL meta is expected for it.
+const OthersDigest = "__others__"
 
-	defer bytesP.Put(bufReq)
-	defer bytesP.Put(bufResp)
-	defer headerP.Put(header)
+// IsOthersDigest tells whether the sql_digest digest is of the others, also
+// the empty one of the series written before OthersDigest was.
+func IsOthersDigest(digest string) bool {
+	return len(digest) == 0 || digest == OthersDigest
+}
 
-	if err := encodeMetrics(bufReq, metrics); err != nil {
-		return err
+func sqlDigestLabel(digest []byte) string {
+	if len(digest) == 0 {
+		return OthersDigest
+	}
+	return hex.EncodeToString(digest)
+}
+
+// appendTaggedMetric appends an empty series labeled by the resource group tag and returns it.
+func appendTaggedMetric(target *[]Metric, name, instance, job string, tag *tipb.ResourceGroupTag) *Metric {
+	*target = append(*target, Metric{})
+	m := &(*target)[len(*target)-1]
+
+	m.Metric.Name = name
+	m.Metric.Instance = instance
+	m.Metric.Job = job
+	if tagExtractor == nil {
+		m.Metric.SQLDigest = sqlDigestLabel(tag.SqlDigest)
+		m.Metric.PlanDigest = hex.EncodeToString(tag.PlanDigest)
+	} else {
+		applyTagLabels(&m.Metric, tagExtractor(tag))
+		if len(m.Metric.SQLDigest) == 0 {
+			m.Metric.SQLDigest = OthersDigest
+		}
 	}
 
-	respR := utils.NewRespWriter(bufResp, header)
-	req, err := http.NewRequest("POST", "/api/v1/import", bufReq)
+	return m
+}
+
+// writeTimeseriesDB writes metrics on behalf of the request requestID, empty
+// if unknown, resolving acks, nil or parallel to metrics, as they are written.
+func writeTimeseriesDB(ctx context.Context, requestID string, metrics []Metric, acks []*Ack) error {
+	if !hasWriter {
+		return ErrNotInitialized
+	}
+	for _, a := range acks {
+		if a != nil {
+			a.add(1)
+		}
+	}
+	release, err := acquireInflight(ctx, metrics)
 	if err != nil {
+		completeAcks(acks, err)
 		return err
 	}
-	writeHandler(&respR, req)
-
-	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
-		log.Warn("failed to write timeseries db", zap.String("error", respR.Body.String()))
+	defer release()
+	if aw, ok := metricWriter.(ackWriter); ok && len(acks) != 0 {
+		err = aw.writeMetricsAcked(requestID, metrics, acks)
+		if err != nil {
+			completeAcks(acks, err)
+		}
+	} else {
+		err = writeMetricsOf(metricWriter, requestID, metrics)
+		completeAcks(acks, err)
+	}
+	if err != nil {
+		return err
+	}
+	// The async queue notifies once the metrics are written
+	if asyncWriter == nil {
+		notifyFlush(metrics)
 	}
 	return nil
 }
 
-func encodeMetrics(buf *bytes.Buffer, metrics []Metric) error {
+func encodeMetrics(w io.Writer, metrics []Metric) error {
+	return encodeMetricsDelimited(w, metrics, "\n", false)
+}
+
+// encodeMetricsDelimited writes the JSON of each metric followed by delimiter,
+// but the last if omitTrailing is set.
+func encodeMetricsDelimited(w io.Writer, metrics []Metric, delimiter string, omitTrailing bool) error {
+	buf := bytesP.Get()
+	defer bytesP.Put(buf)
+
 	encoder := json.NewEncoder(buf)
-	for _, m := range metrics {
-		if err := encoder.Encode(m); err != nil {
+	for i := range metrics {
+		buf.Reset()
+		if err := encoder.Encode(&metrics[i]); err != nil {
+			return err
+		}
+		// Replace the newline the encoder ends each value with.
+		buf.Truncate(buf.Len() - 1)
+		if i < len(metrics)-1 || !omitTrailing {
+			buf.WriteString(delimiter)
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
 			return err
 		}
 	}
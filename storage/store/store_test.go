@@ -0,0 +1,162 @@
+package store_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/genjidb/genji"
+	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+const (
+	benchInstances = 10
+	benchDigests   = 100
+	benchSamples   = 60
+)
+
+// discardWriter takes the metrics without writing them, so that the
+// benchmarks measure the ingest path only.
+type discardWriter struct{}
+
+func (discardWriter) WriteMetrics([]store.Metric) error {
+	return nil
+}
+
+func initBenchStore(b *testing.B) {
+	b.Helper()
+
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	store.Init(discardWriter{}, db, nil)
+	b.Cleanup(func() {
+		store.Stop()
+		db.Close()
+	})
+}
+
+func benchSQLDigest(i int) []byte {
+	return []byte(fmt.Sprintf("sql-%04d", i))
+}
+
+func benchPlanDigest(i int) []byte {
+	return []byte(fmt.Sprintf("plan-%03d", i))
+}
+
+// benchTopSQLRecords returns a batch of benchDigests records per instance,
+// benchSamples samples each, the n-th batch starting after the n-1-th.
+func benchTopSQLRecords(n int) []*tipb.CPUTimeRecord {
+	records := make([]*tipb.CPUTimeRecord, 0, benchInstances*benchDigests)
+	for i := 0; i < benchInstances; i++ {
+		for j := 0; j < benchDigests; j++ {
+			r := &tipb.CPUTimeRecord{
+				SqlDigest:  benchSQLDigest(j),
+				PlanDigest: benchPlanDigest(j),
+				Instance:   fmt.Sprintf("tidb-%d:10080", i),
+				Job:        "tidb",
+			}
+			for k := 0; k < benchSamples; k++ {
+				r.RecordListTimestampSec = append(r.RecordListTimestampSec, uint64(1632700800+n*benchSamples+k))
+				r.RecordListCpuTimeMs = append(r.RecordListCpuTimeMs, uint32(k))
+			}
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+func BenchmarkTopSQLRecords(b *testing.B) {
+	initBenchStore(b)
+	batches := make([][]*tipb.CPUTimeRecord, b.N)
+	for i := range batches {
+		batches[i] = benchTopSQLRecords(i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.TopSQLRecords(batches[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(benchInstances*benchDigests*benchSamples), "samples/op")
+}
+
+func BenchmarkResourceMeteringRecords(b *testing.B) {
+	initBenchStore(b)
+	tags := make([][]byte, benchDigests)
+	for i := range tags {
+		tag, err := (&tipb.ResourceGroupTag{SqlDigest: benchSQLDigest(i), PlanDigest: benchPlanDigest(i)}).Marshal()
+		if err != nil {
+			b.Fatal(err)
+		}
+		tags[i] = tag
+	}
+	batches := make([][]*rsmetering.CPUTimeRecord, b.N)
+	for n := range batches {
+		for _, r := range benchTopSQLRecords(n) {
+			batches[n] = append(batches[n], &rsmetering.CPUTimeRecord{
+				ResourceGroupTag:       tags[len(batches[n])%benchDigests],
+				RecordListTimestampSec: r.RecordListTimestampSec,
+				RecordListCpuTimeMs:    r.RecordListCpuTimeMs,
+				Instance:               r.Instance,
+				Job:                    r.Job,
+			})
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.ResourceMeteringRecords(batches[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(benchInstances*benchDigests*benchSamples), "samples/op")
+}
+
+func BenchmarkSQLMetas(b *testing.B) {
+	initBenchStore(b)
+	batches := make([][]*tipb.SQLMeta, b.N)
+	for n := range batches {
+		for i := 0; i < benchDigests; i++ {
+			batches[n] = append(batches[n], &tipb.SQLMeta{
+				SqlDigest:     benchSQLDigest(n*benchDigests + i),
+				NormalizedSql: fmt.Sprintf("select * from t%d where id = ?", i),
+			})
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.SQLMetas(batches[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPlanMetas(b *testing.B) {
+	initBenchStore(b)
+	batches := make([][]*tipb.PlanMeta, b.N)
+	for n := range batches {
+		for i := 0; i < benchDigests; i++ {
+			batches[n] = append(batches[n], &tipb.PlanMeta{
+				PlanDigest:     benchPlanDigest(n*benchDigests + i),
+				NormalizedPlan: fmt.Sprintf("TableReader_%d", i),
+			})
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.PlanMetas(batches[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
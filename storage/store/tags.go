@@ -0,0 +1,139 @@
+package store
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+const (
+	labelName       = "__name__"
+	labelInstance   = "instance"
+	labelJob        = "job"
+	labelSQLDigest  = "sql_digest"
+	labelPlanDigest = "plan_digest"
+)
+
+// TagExtractor maps a decoded ResourceGroupTag to the labels of the series it tags.
+// The sql_digest and plan_digest keys fill the corresponding fixed labels.
+type TagExtractor func(tag *tipb.ResourceGroupTag) map[string]string
+
+// DefaultTagExtractor labels series by the SQL and plan digests.
+func DefaultTagExtractor(tag *tipb.ResourceGroupTag) map[string]string {
+	return map[string]string{
+		labelSQLDigest:  hex.EncodeToString(tag.SqlDigest),
+		labelPlanDigest: hex.EncodeToString(tag.PlanDigest),
+	}
+}
+
+var tagExtractor TagExtractor
+
+func isFixedLabel(key string) bool {
+	switch key {
+	case labelName, labelInstance, labelJob, labelSQLDigest, labelPlanDigest:
+		return true
+	}
+	return false
+}
+
+func applyTagLabels(tags *topSQLTags, labels map[string]string) {
+	for key, value := range labels {
+		switch key {
+		case labelSQLDigest:
+			tags.SQLDigest = value
+		case labelPlanDigest:
+			tags.PlanDigest = value
+		case labelName, labelInstance, labelJob:
+			// Not overridable by tags
+		default:
+			if tags.Labels == nil {
+				tags.Labels = make(map[string]string)
+			}
+			tags.Labels[key] = value
+		}
+	}
+}
+
+// plainTags has the fields of topSQLTags and the default JSON encoding.
+type plainTags topSQLTags
+
+func (t topSQLTags) MarshalJSON() ([]byte, error) {
+	if len(t.Labels) == 0 {
+		return json.Marshal(plainTags(t))
+	}
+
+	labels := make(map[string]string, len(t.Labels)+5)
+	for key, value := range t.Labels {
+		if !isFixedLabel(key) {
+			labels[key] = value
+		}
+	}
+	labels[labelName] = t.Name
+	labels[labelInstance] = t.Instance
+	labels[labelJob] = t.Job
+	labels[labelSQLDigest] = t.SQLDigest
+	if len(t.PlanDigest) != 0 {
+		labels[labelPlanDigest] = t.PlanDigest
+	}
+	return json.Marshal(labels)
+}
+
+func (t *topSQLTags) UnmarshalJSON(data []byte) error {
+	labels := make(map[string]string)
+	if err := json.Unmarshal(data, &labels); err != nil {
+		return err
+	}
+
+	*t = topSQLTags{
+		Name:     labels[labelName],
+		Instance: labels[labelInstance],
+		Job:      labels[labelJob],
+	}
+	delete(labels, labelName)
+	delete(labels, labelInstance)
+	delete(labels, labelJob)
+	applyTagLabels(t, labels)
+	return nil
+}
+
+func (t *topSQLTags) seriesKey() seriesKey {
+	return seriesKey{
+		name:       t.Name,
+		instance:   t.Instance,
+		sqlDigest:  t.SQLDigest,
+		planDigest: t.PlanDigest,
+		extra:      t.extraKey(),
+	}
+}
+
+// extraKey is a stable representation of the extra labels for identifying a
+// series. The names and values are length-prefixed, so a value containing the
+// separators does not collide with another label set.
+func (t *topSQLTags) extraKey() string {
+	if len(t.Labels) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(t.Labels))
+	for key := range t.Labels {
+		if !isFixedLabel(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var b []byte
+	for _, key := range keys {
+		value := t.Labels[key]
+		b = strconv.AppendInt(b, int64(len(key)), 10)
+		b = append(b, ':')
+		b = append(b, key...)
+		b = strconv.AppendInt(b, int64(len(value)), 10)
+		b = append(b, ':')
+		b = append(b, value...)
+	}
+	return string(b)
+}
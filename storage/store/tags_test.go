@@ -0,0 +1,36 @@
+package store
+
+import "testing"
+
+func TestExtraKeyCollision(t *testing.T) {
+	tags := func(labels map[string]string) topSQLTags {
+		return topSQLTags{Name: "cpu_time", Instance: "tidb-0:10080", SQLDigest: "5e4c", Labels: labels}
+	}
+	for _, pair := range [][2]map[string]string{
+		{{"a": "1,b=2"}, {"a": "1", "b": "2"}},
+		{{"a": "1=b"}, {"a=1": "b"}},
+		{{"a": "1:11:b1:c"}, {"a": "1", "b": "c"}},
+	} {
+		a, b := tags(pair[0]), tags(pair[1])
+		if a.extraKey() == b.extraKey() {
+			t.Fatalf("got the key %q of both %v and %v", a.extraKey(), pair[0], pair[1])
+		}
+
+		// Not merged as a conflict of one series
+		metrics := []Metric{
+			{Metric: a, Timestamps: []uint64{1632700800000, 1632700800000}, Values: []uint64{1, 2}},
+			{Metric: b, Timestamps: []uint64{1632700800000}, Values: []uint64{4}},
+		}
+		mergeConflicts(&metrics, ConflictSum)
+		if len(metrics) != 2 || metrics[0].Values[0] != 3 || metrics[1].Values[0] != 4 {
+			t.Fatalf("got metrics %+v of %v and %v, want them apart", metrics, pair[0], pair[1])
+		}
+	}
+
+	// The fixed labels are not part of the key
+	a := tags(map[string]string{"zone": "z1", labelInstance: "tidb-1:10080"})
+	b := tags(map[string]string{"zone": "z1"})
+	if a.extraKey() != b.extraKey() {
+		t.Fatalf("got keys %q and %q of the same extra labels", a.extraKey(), b.extraKey())
+	}
+}
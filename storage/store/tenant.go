@@ -0,0 +1,135 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/genjidb/genji"
+)
+
+// DefaultTenant is the tenant of the writes and the reads not naming one, the
+// one of the metas and the series stored before tenants were.
+const DefaultTenant = ""
+
+const (
+	labelTenant = "tenant"
+	// maxTenantLength bounds a tenant, a keyspace name of TiDB.
+	maxTenantLength = 64
+)
+
+// tenantTables are the meta tables partitioned by tenant. The key of a row is
+// TenantKey(tenant, digest), its tenant column the tenant.
+var tenantTables = []string{"sql_digest", "plan_digest", "digest_tombstone"}
+
+type tenantCtxKey struct{}
+
+// WithTenant returns ctx scoping the store and the queries run with it to tenant.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, tenant)
+}
+
+// TenantFrom returns the tenant of ctx, DefaultTenant if none.
+func TenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantCtxKey{}).(string)
+	return tenant
+}
+
+// CheckTenant checks that tenant is a keyspace name, letters, digits, _ and -.
+func CheckTenant(tenant string) error {
+	if len(tenant) > maxTenantLength {
+		return fmt.Errorf("tenant %q is longer than %d", tenant, maxTenantLength)
+	}
+	for i := 0; i < len(tenant); i++ {
+		if c := tenant[i]; !isLabelNameChar(c) && c != '-' {
+			return fmt.Errorf("invalid character %q in tenant %q", c, tenant)
+		}
+	}
+	return nil
+}
+
+// TenantKey is the key of digest in the meta tables of tenant, digest itself
+// for DefaultTenant.
+func TenantKey(tenant, digest string) string {
+	if tenant == DefaultTenant {
+		return digest
+	}
+	return tenant + "/" + digest
+}
+
+// CheckDigest checks that digest has no "/", so that no digest of a tenant
+// is the TenantKey of another.
+func CheckDigest(digest string) error {
+	if strings.IndexByte(digest, '/') >= 0 {
+		return fmt.Errorf("%w: %q contains /", ErrInvalidDigest, digest)
+	}
+	return nil
+}
+
+// checkSeriesDigests checks the digests of metrics, e.g. the ones of a
+// TagExtractor.
+func checkSeriesDigests(metrics []Metric) error {
+	for i := range metrics {
+		m := &metrics[i].Metric
+		if err := CheckDigest(m.SQLDigest); err != nil {
+			return err
+		}
+		if err := CheckDigest(m.PlanDigest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DigestOfKey returns the digest of a TenantKey.
+func DigestOfKey(key string) string {
+	return key[strings.LastIndexByte(key, '/')+1:]
+}
+
+// tenantOf returns the tenant of the series of m.
+func tenantOf(m *Metric) string {
+	return m.Metric.Labels[labelTenant]
+}
+
+// seriesKeyOf returns the TenantKey of the sql digest of m.
+func seriesKeyOf(m *Metric) string {
+	return TenantKey(tenantOf(m), m.Metric.SQLDigest)
+}
+
+// labelTenants labels metrics by tenant unless DefaultTenant, taking over
+// the tenant a TagExtractor labeled them by.
+func labelTenants(metrics []Metric, tenant string) {
+	for i := range metrics {
+		m := &metrics[i]
+		if tenant == DefaultTenant {
+			if t, ok := m.Metric.Labels[labelTenant]; ok && CheckTenant(t) != nil {
+				delete(m.Metric.Labels, labelTenant)
+			}
+			continue
+		}
+		if m.Metric.Labels == nil {
+			m.Metric.Labels = make(map[string]string, 1)
+		}
+		m.Metric.Labels[labelTenant] = tenant
+	}
+}
+
+// tenantParams adds tenant to the audit params unless DefaultTenant.
+func tenantParams(tenant string, params map[string]string) map[string]string {
+	if tenant != DefaultTenant {
+		params[labelTenant] = tenant
+	}
+	return params
+}
+
+// backfillTenants sets the tenant of the rows of the tenant tables written
+// before tenants were to DefaultTenant. The tenant column is left unindexed,
+// an index lookup of "" in genji matches every tenant.
+func backfillTenants(db *genji.DB) error {
+	for _, table := range tenantTables {
+		if err := db.Exec("UPDATE "+table+" SET tenant = ? WHERE tenant IS NULL", DefaultTenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package store_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/genjidb/genji"
+	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+func TestIngestRejectsDigestsOfTenantKeys(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tsdb := testutil.NewMemTSDB()
+	store.Init(tsdb, db, func(tag *tipb.ResourceGroupTag) map[string]string {
+		return map[string]string{"sql_digest": "b/" + string(tag.SqlDigest)}
+	})
+	defer store.Stop()
+
+	tag, err := (&tipb.ResourceGroupTag{SqlDigest: []byte("0b")}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.ResourceMeteringRecords([]*rsmetering.CPUTimeRecord{{
+		ResourceGroupTag:       tag,
+		RecordListTimestampSec: []uint64{1632700800},
+		RecordListCpuTimeMs:    []uint32{35},
+		Instance:               "tikv-0:20160",
+		Job:                    "tikv",
+	}})
+	if !errors.Is(err, store.ErrInvalidDigest) {
+		t.Fatalf("got error %v, want %v", err, store.ErrInvalidDigest)
+	}
+	if err := store.DeleteDigest("test", store.DefaultTenant, "b/0b"); !errors.Is(err, store.ErrInvalidDigest) {
+		t.Fatalf("got error %v, want %v", err, store.ErrInvalidDigest)
+	}
+}
@@ -0,0 +1,3 @@
+CREATE TABLE sql_digest (digest TEXT PRIMARY KEY, sql_text TEXT, sql_hash TEXT);
+CREATE TABLE instance (instance TEXT PRIMARY KEY, job TEXT, region TEXT, weight INTEGER DEFAULT 1);
+INSERT INTO sql_digest (digest, sql_text, sql_hash) VALUES ('5e4c', 'select * from t where id = ?', 'h1');
@@ -0,0 +1,2 @@
+CREATE TABLE instance (instance TEXT PRIMARY KEY, job TEXT, region TEXT NOT NULL);
+INSERT INTO instance (instance, job, region) VALUES ('tidb-0:10080', 'tidb', 'us-east');
@@ -0,0 +1,5 @@
+CREATE TABLE sql_digest (digest TEXT PRIMARY KEY, sql_text TEXT);
+CREATE TABLE instance (instance TEXT PRIMARY KEY, job TEXT);
+INSERT INTO sql_digest (digest, sql_text) VALUES ('5e4c', 'select * from t where id = ?');
+INSERT INTO sql_digest (digest, sql_text) VALUES ('a10b', 'update t set v = ? where id = ?');
+INSERT INTO instance (instance, job) VALUES ('tidb-0:10080', 'tidb');
@@ -0,0 +1,3 @@
+CREATE TABLE sql_plan (pair TEXT PRIMARY KEY, sql_digest TEXT, plan_digest TEXT);
+CREATE INDEX sql_plan_sql_digest ON sql_plan (plan_digest);
+INSERT INTO sql_plan (pair, sql_digest, plan_digest) VALUES ('5e4c/9a01', '5e4c', '9a01');
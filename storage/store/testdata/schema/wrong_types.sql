@@ -0,0 +1,2 @@
+CREATE TABLE sql_digest (digest INTEGER PRIMARY KEY, sql_text TEXT, first_seen TEXT);
+CREATE TABLE watermark (instance TEXT PRIMARY KEY, sample_ms DOUBLE);
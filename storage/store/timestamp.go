@@ -0,0 +1,137 @@
+package store
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/pflag"
+)
+
+type TimestampPolicy string
+
+const (
+	// TimestampKeep writes the implausible timestamps as they are, only counted.
+	TimestampKeep TimestampPolicy = "keep"
+	// TimestampClamp moves them to the nearest plausible bound.
+	TimestampClamp TimestampPolicy = "clamp"
+	// TimestampDrop drops their samples.
+	TimestampDrop TimestampPolicy = "drop"
+)
+
+// minPlausibleMillis is 2000-01-01, before any agent reported.
+const minPlausibleMillis = 946684800 * 1000
+
+var (
+	millisecondSources = pflag.String("store.millisecond-timestamp-sources", "", "Comma separated instances or jobs whose agents send the record timestamps in milliseconds instead of seconds")
+	maxFutureTimestamp = pflag.Duration("store.max-future-timestamp", 24*time.Hour, "How far a sample timestamp may be ahead of the wall clock to be plausible")
+	timestampPolicy    = pflag.String("store.implausible-timestamp-policy", string(TimestampKeep), "What to do with the samples timestamped before 2000 or beyond --store.max-future-timestamp: keep, clamp to the bound, or drop")
+
+	// Counted whatever the policy, by the likely cause
+	millisAsSecsCounter = metrics.NewCounter(`diag_store_implausible_timestamps_total{reason="millis_as_secs"}`)
+	secsAsMillisCounter = metrics.NewCounter(`diag_store_implausible_timestamps_total{reason="secs_as_millis"}`)
+	futureCounter       = metrics.NewCounter(`diag_store_implausible_timestamps_total{reason="future"}`)
+	pastCounter         = metrics.NewCounter(`diag_store_implausible_timestamps_total{reason="past"}`)
+)
+
+func parseTimestampPolicy(s string) (TimestampPolicy, error) {
+	switch p := TimestampPolicy(s); p {
+	case TimestampKeep, TimestampClamp, TimestampDrop:
+		return p, nil
+	}
+	return "", fmt.Errorf("%w: unknown implausible timestamp policy %q", ErrInvalidConfig, s)
+}
+
+// SecsToMillis converts unix seconds to milliseconds, saturating at the max uint64.
+func SecsToMillis(secs uint64) uint64 {
+	if secs > math.MaxUint64/1000 {
+		return math.MaxUint64
+	}
+	return secs * 1000
+}
+
+// MillisToSecs converts unix milliseconds to seconds, rounding down.
+func MillisToSecs(millis uint64) uint64 {
+	return millis / 1000
+}
+
+// timestampUnits tells the unit of the record timestamps per source.
+type timestampUnits map[string]struct{}
+
+func timestampUnitsOf(cfg Config) timestampUnits {
+	if len(cfg.MillisecondSources) == 0 {
+		return nil
+	}
+	units := make(timestampUnits)
+	for _, source := range strings.Split(cfg.MillisecondSources, ",") {
+		if source = strings.TrimSpace(source); len(source) != 0 {
+			units[source] = struct{}{}
+		}
+	}
+	return units
+}
+
+// toMillis converts a record timestamp of instance and job to unix milliseconds.
+func (u timestampUnits) toMillis(ts uint64, instance, job string) uint64 {
+	if _, ok := u[instance]; ok {
+		return ts
+	}
+	if _, ok := u[job]; ok && len(job) != 0 {
+		return ts
+	}
+	return SecsToMillis(ts)
+}
+
+// checkTimestamps counts the samples of metrics timestamped out of
+// [2000-01-01, now + max future] by their likely cause and applies the policy.
+// A timestamp in range once divided by 1000 was likely sent in milliseconds
+// as seconds, one in range once multiplied by 1000 the other way around.
+func checkTimestamps(metrics []Metric, policy TimestampPolicy, maxFuture time.Duration) {
+	maxMillis := uint64(clock.Now().Add(maxFuture).UnixNano() / int64(time.Millisecond))
+	plausible := func(ts uint64) bool {
+		return ts >= minPlausibleMillis && ts <= maxMillis
+	}
+
+	for i := range metrics {
+		m := &metrics[i]
+		n := 0
+		for j, ts := range m.Timestamps {
+			if !plausible(ts) {
+				switch {
+				case ts > maxMillis && plausible(MillisToSecs(ts)):
+					millisAsSecsCounter.Inc()
+				case ts < minPlausibleMillis && plausible(SecsToMillis(ts)):
+					secsAsMillisCounter.Inc()
+				case ts > maxMillis:
+					futureCounter.Inc()
+				default:
+					pastCounter.Inc()
+				}
+
+				switch policy {
+				case TimestampDrop:
+					continue
+				case TimestampClamp:
+					if ts > maxMillis {
+						ts = maxMillis
+					} else {
+						ts = minPlausibleMillis
+					}
+				}
+			}
+			m.Timestamps[n] = ts
+			if j < len(m.Values) {
+				m.Values[n] = m.Values[j]
+			}
+			n++
+		}
+		if n != len(m.Timestamps) {
+			m.Timestamps = m.Timestamps[:n]
+			if len(m.Values) > n {
+				m.Values = m.Values[:n]
+			}
+		}
+	}
+}
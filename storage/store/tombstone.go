@@ -0,0 +1,295 @@
+package store
+
+import (
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/audit"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	tombstoneRetention    = pflag.Duration("store.tombstone-retention", 30*24*time.Hour, "Deleted digests are removed for good after this long, after which agents may report them again")
+	filterTombstoneSeries = pflag.Bool("store.tombstone-filter-series", false, "Also drop the series of deleted digests on ingestion")
+)
+
+const tombstoneGCInterval = time.Hour
+
+// tombstoneSet caches the digest_tombstone table, consulted on every ingestion.
+type tombstoneSet struct {
+	mu      sync.RWMutex
+	digests map[string]int64 // digest -> deleted at in seconds
+
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+}
+
+var tombstones = &tombstoneSet{digests: make(map[string]int64)}
+
+func (t *tombstoneSet) load(db *genji.DB) error {
+	res, err := db.Query("SELECT digest, deleted_at FROM digest_tombstone")
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return res.Iterate(func(d types.Document) error {
+		var digest string
+		var deletedAt int64
+		if err := document.Scan(d, &digest, &deletedAt); err != nil {
+			return err
+		}
+		t.digests[digest] = deletedAt
+		return nil
+	})
+}
+
+func (t *tombstoneSet) empty() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.digests) == 0
+}
+
+func (t *tombstoneSet) size() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.digests)
+}
+
+func (t *tombstoneSet) contains(digest string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	_, ok := t.digests[digest]
+	return ok
+}
+
+func (t *tombstoneSet) set(digest string, deletedAt int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.digests[digest] = deletedAt
+}
+
+func (t *tombstoneSet) remove(digests ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, digest := range digests {
+		delete(t.digests, digest)
+	}
+}
+
+func (t *tombstoneSet) startGC() {
+	t.stopCh = make(chan struct{})
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+
+		ticker := clock.NewTicker(tombstoneGCInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C():
+				if err := GCTombstones(audit.CallerSystem, clock.Now().Add(-CurrentConfig().TombstoneRetention).Unix()); err != nil {
+					log.Warn("failed to remove expired tombstones", zap.Error(err))
+				}
+			case <-t.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (t *tombstoneSet) stopGC() {
+	if t.stopCh == nil {
+		return
+	}
+	close(t.stopCh)
+	t.wg.Wait()
+	t.stopCh = nil
+}
+
+// DeleteDigest deletes the SQL and plan metas of digest of tenant on behalf
+// of caller. The metas are kept but hidden from queries, and agents reporting
+// the digest again do not bring them back. The series are kept.
+func DeleteDigest(caller, tenant, digest string) error {
+	if err := CheckDigest(digest); err != nil {
+		return err
+	}
+	params := tenantParams(tenant, map[string]string{"digest": digest})
+	return audit.Do("delete_digest", caller, params, func() (int, error) {
+		key := TenantKey(tenant, digest)
+		affected, err := countMetas(key)
+		if err != nil {
+			return 0, err
+		}
+
+		deletedAt := clock.Now().Unix()
+		err = insert(
+			documentDB,
+			"INSERT INTO digest_tombstone(digest, tenant, deleted_at) VALUES ",
+			"(?, ?, ?)", 1,
+			onConflictDoNothing,
+			func(target *[]interface{}) {
+				*target = append(*target, key, tenant, deletedAt)
+			},
+		)
+		if err != nil {
+			return 0, err
+		}
+		if !tombstones.contains(key) {
+			tombstones.set(key, deletedAt)
+		}
+		return affected, nil
+	})
+}
+
+// UndeleteDigest reverts DeleteDigest of digest of tenant unless the
+// tombstone expired.
+func UndeleteDigest(caller, tenant, digest string) error {
+	if err := CheckDigest(digest); err != nil {
+		return err
+	}
+	params := tenantParams(tenant, map[string]string{"digest": digest})
+	return audit.Do("undelete_digest", caller, params, func() (int, error) {
+		key := TenantKey(tenant, digest)
+		affected, err := countMetas(key)
+		if err != nil {
+			return 0, err
+		}
+		if err = documentDB.Exec("DELETE FROM digest_tombstone WHERE digest = ? AND tenant = ?", key, tenant); err != nil {
+			return 0, err
+		}
+		tombstones.remove(key)
+		return affected, nil
+	})
+}
+
+// GCTombstones removes for good on behalf of caller the digests deleted before beforeTs.
+func GCTombstones(caller string, beforeTs int64) error {
+	params := map[string]string{"before_ts": strconv.FormatInt(beforeTs, 10)}
+	return audit.Do("tombstone_gc", caller, params, func() (int, error) {
+		var expired []string
+		err := documentDB.Update(func(tx *genji.Tx) error {
+			res, err := tx.Query("SELECT digest FROM digest_tombstone WHERE deleted_at < ?", beforeTs)
+			if err != nil {
+				return err
+			}
+			err = res.Iterate(func(d types.Document) error {
+				var digest string
+				if err := document.Scan(d, &digest); err != nil {
+					return err
+				}
+				expired = append(expired, digest)
+				return nil
+			})
+			_ = res.Close()
+			if err != nil {
+				return err
+			}
+
+			for _, digest := range expired {
+				for _, stmt := range []string{
+					"DELETE FROM sql_digest WHERE digest = ?",
+					"DELETE FROM plan_digest WHERE digest = ?",
+					"DELETE FROM sql_plan WHERE sql_digest = ?",
+					"DELETE FROM digest_tombstone WHERE digest = ?",
+				} {
+					if err = tx.Exec(stmt, digest); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		tombstones.remove(expired...)
+		return len(expired), nil
+	})
+}
+
+// countMetas counts the metas of the TenantKey key.
+func countMetas(key string) (int, error) {
+	affected := 0
+	err := documentDB.View(func(tx *genji.Tx) error {
+		for _, table := range []string{"sql_digest", "plan_digest"} {
+			var n int
+			d, err := tx.QueryDocument("SELECT COUNT(*) FROM "+table+" WHERE digest = ?", key)
+			if err != nil {
+				return err
+			}
+			if err = document.Scan(d, &n); err != nil {
+				return err
+			}
+			affected += n
+		}
+		return nil
+	})
+	return affected, err
+}
+
+// liveSQLMetas returns the metas of tenant of digests not deleted, metas
+// itself if none is.
+func liveSQLMetas(tenant string, metas []*tipb.SQLMeta) []*tipb.SQLMeta {
+	if tombstones.empty() {
+		return metas
+	}
+
+	live := make([]*tipb.SQLMeta, 0, len(metas))
+	for _, meta := range metas {
+		if !tombstones.contains(TenantKey(tenant, hex.EncodeToString(meta.SqlDigest))) {
+			live = append(live, meta)
+		}
+	}
+	return live
+}
+
+// livePlanMetas returns the metas of tenant of digests not deleted, metas
+// itself if none is.
+func livePlanMetas(tenant string, metas []*tipb.PlanMeta) []*tipb.PlanMeta {
+	if tombstones.empty() {
+		return metas
+	}
+
+	live := make([]*tipb.PlanMeta, 0, len(metas))
+	for _, meta := range metas {
+		if !tombstones.contains(TenantKey(tenant, hex.EncodeToString(meta.PlanDigest))) {
+			live = append(live, meta)
+		}
+	}
+	return live
+}
+
+// dropTombstonedSeries removes the metrics of deleted SQL or plan digests.
+func dropTombstonedSeries(metrics *[]Metric) {
+	if !CurrentConfig().FilterTombstoneSeries || tombstones.empty() {
+		return
+	}
+
+	res := (*metrics)[:0]
+	for _, m := range *metrics {
+		tenant := tenantOf(&m)
+		if tombstones.contains(TenantKey(tenant, m.Metric.SQLDigest)) || tombstones.contains(TenantKey(tenant, m.Metric.PlanDigest)) {
+			continue
+		}
+		res = append(res, m)
+	}
+	*metrics = res
+}
@@ -0,0 +1,268 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	pdEndpoint           = pflag.String("store.pd-endpoint", "", "Enrich the instances with the topology of the stores known to this PD, e.g. http://127.0.0.1:2379")
+	topologySyncInterval = pflag.Duration("store.topology-sync-interval", time.Minute, "Interval between the syncs of the topology from --store.pd-endpoint")
+)
+
+var (
+	topologySyncedCounter = metrics.NewCounter(`diag_store_topology_syncs_total{result="ok"}`)
+	topologyFailedCounter = metrics.NewCounter(`diag_store_topology_syncs_total{result="error"}`)
+)
+
+// TopologyNode is a node of the cluster as its topology knows it.
+type TopologyNode struct {
+	Instance string
+	Job      string
+	Zone     string
+	Host     string
+	Version  string
+	Status   string
+}
+
+// TopologyProvider lists the nodes of the cluster.
+type TopologyProvider interface {
+	Topology(ctx context.Context) ([]TopologyNode, error)
+}
+
+// pdTopology lists the stores of PD, the TiKV and TiFlash nodes.
+type pdTopology struct {
+	endpoint string
+	client   *http.Client
+}
+
+// NewPDTopology returns the provider of the stores of the PD at endpoint,
+// queried with client, http.DefaultClient if nil.
+func NewPDTopology(endpoint string, client *http.Client) TopologyProvider {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "http://" + endpoint
+	}
+	return &pdTopology{endpoint: strings.TrimSuffix(endpoint, "/"), client: client}
+}
+
+type pdStores struct {
+	Stores []struct {
+		Store struct {
+			Address string `json:"address"`
+			Labels  []struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+			} `json:"labels"`
+			Version   string `json:"version"`
+			StateName string `json:"state_name"`
+		} `json:"store"`
+	} `json:"stores"`
+}
+
+func (p *pdTopology) Topology(ctx context.Context) ([]TopologyNode, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", p.endpoint+"/pd/api/v1/stores", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list the stores of pd, code: %d", resp.StatusCode)
+	}
+
+	var stores pdStores
+	if err := json.NewDecoder(resp.Body).Decode(&stores); err != nil {
+		return nil, err
+	}
+	nodes := make([]TopologyNode, 0, len(stores.Stores))
+	for _, s := range stores.Stores {
+		node := TopologyNode{
+			Instance: s.Store.Address,
+			Job:      "tikv",
+			Version:  s.Store.Version,
+			Status:   s.Store.StateName,
+		}
+		for _, label := range s.Store.Labels {
+			switch label.Key {
+			case "zone":
+				node.Zone = label.Value
+			case "host":
+				node.Host = label.Value
+			case "engine":
+				if label.Value == "tiflash" {
+					node.Job = "tiflash"
+				}
+			}
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// topologySync syncs the topology of a provider in the background.
+type topologySync struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// topologySyncer is the sync running, nil if none.
+var topologySyncer *topologySync
+
+// StartTopologySync syncs the topology of provider every interval from now on,
+// in place of the sync running. The syncs run apart from the ingestion, which
+// their failures leave unaffected.
+func StartTopologySync(provider TopologyProvider, interval time.Duration) {
+	stopTopologySync()
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &topologySync{cancel: cancel}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			syncCtx, cancelSync := context.WithTimeout(ctx, interval)
+			if err := SyncTopology(syncCtx, provider); err != nil && ctx.Err() == nil {
+				log.Warn("failed to sync the topology", zap.Error(err))
+			}
+			cancelSync()
+
+			select {
+			case <-ticker.C():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	topologySyncer = s
+}
+
+func stopTopologySync() {
+	if topologySyncer == nil {
+		return
+	}
+	topologySyncer.cancel()
+	topologySyncer.wg.Wait()
+	topologySyncer = nil
+}
+
+type topologyRow struct {
+	instance                    string
+	job                         string
+	zone, host, version, status string
+	missingSince                int64
+}
+
+// SyncTopology sets the zone, host, version and status of the instances to
+// those of their nodes in the topology of provider. The instances missing from
+// it are marked by the time they were first found missing, possibly
+// decommissioned, unless the topology knows no node of their job. Nothing is
+// written if the topology fails to list.
+func SyncTopology(ctx context.Context, provider TopologyProvider) error {
+	nodes, err := provider.Topology(ctx)
+	if err != nil {
+		topologyFailedCounter.Inc()
+		return err
+	}
+
+	byInstance := make(map[string]TopologyNode, len(nodes))
+	jobs := make(map[string]bool)
+	for _, node := range nodes {
+		byInstance[NormalizeInstance(node.Instance)] = node
+		jobs[node.Job] = true
+	}
+
+	rows, err := topologyRows(ctx)
+	if err != nil {
+		topologyFailedCounter.Inc()
+		return err
+	}
+	// genji keeps the db locked if the transaction fails to begin on a done ctx.
+	if err := ctx.Err(); err != nil {
+		topologyFailedCounter.Inc()
+		return err
+	}
+	now := clock.Now().Unix()
+	err = update(documentDB.WithContext(ctx), func(tx execer) error {
+		for _, r := range rows {
+			node, ok := byInstance[r.instance]
+			switch {
+			case ok:
+				if r.zone == node.Zone && r.host == node.Host && r.version == node.Version && r.status == node.Status && r.missingSince == 0 {
+					continue
+				}
+				err := tx.Exec("UPDATE instance SET zone = ?, host = ?, version = ?, status = ?, missing_since = 0 WHERE instance = ?",
+					node.Zone, node.Host, node.Version, node.Status, r.instance)
+				if err != nil {
+					return err
+				}
+			case jobs[r.job] && r.missingSince == 0:
+				if err := tx.Exec("UPDATE instance SET missing_since = ? WHERE instance = ?", now, r.instance); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		topologyFailedCounter.Inc()
+		return err
+	}
+	topologySyncedCounter.Inc()
+	return nil
+}
+
+func topologyRows(ctx context.Context) ([]topologyRow, error) {
+	res, err := documentDB.WithContext(ctx).Query("SELECT instance, job, zone, host, version, status, missing_since FROM instance")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var rows []topologyRow
+	err = res.Iterate(func(d types.Document) error {
+		// The topology fields are missing in rows never synced
+		var zone, host, version, status *string
+		var missingSince *int64
+		r := topologyRow{}
+		if err := document.Scan(d, &r.instance, &r.job, &zone, &host, &version, &status, &missingSince); err != nil {
+			return err
+		}
+		r.zone, r.host, r.version, r.status = stringOf(zone), stringOf(host), stringOf(version), stringOf(status)
+		if missingSince != nil {
+			r.missingSince = *missingSince
+		}
+		rows = append(rows, r)
+		return nil
+	})
+	return rows, err
+}
+
+func stringOf(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
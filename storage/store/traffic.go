@@ -0,0 +1,310 @@
+package store
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/VictoriaMetrics/metrics"
+	rsmetering "github.com/pingcap/kvproto/pkg/resource_usage_agent"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+// trafficSegmentSize is the size of the segment files of a traffic capture.
+const trafficSegmentSize = 64 << 20
+
+var (
+	trafficCaptureDir     = pflag.String("store.traffic-capture-dir", "", "Directory to record the batches ingested into with their arrival times, to reproduce a workload with diagctl replay. Empty disables the capture")
+	trafficCaptureMaxSize = pflag.Int64("store.traffic-capture-max-size", 1<<30, "Max size in bytes of --store.traffic-capture-dir, the capture stopping once reached")
+	trafficDigestsOnly    = pflag.Bool("store.traffic-capture-digests-only", false, "Capture the metas without their normalized SQLs and plans")
+)
+
+var (
+	capturedBatchesCounter = metrics.NewCounter(`diag_store_traffic_capture_batches_total{result="captured"}`)
+	droppedBatchesCounter  = metrics.NewCounter(`diag_store_traffic_capture_batches_total{result="dropped"}`)
+
+	// traffic is the capture of the ingested batches, nil if not enabled.
+	traffic *trafficCapture
+)
+
+// CaptureKind is the ingestion call of a captured batch.
+type CaptureKind byte
+
+const (
+	CaptureTopSQL CaptureKind = iota + 1
+	CaptureResourceMetering
+	CaptureSQLMetas
+	CapturePlanMetas
+)
+
+// CapturedBatch is a batch as passed to an ingestion call, the one of Kind
+// set. The batches of ResourceMeteringGroupRecords are not captured.
+type CapturedBatch struct {
+	Kind CaptureKind
+	// ArrivalNanos is when the batch was ingested, in unix nanoseconds.
+	ArrivalNanos int64
+	Source       Source
+
+	TopSQLRecords           []*tipb.CPUTimeRecord
+	ResourceMeteringRecords []*rsmetering.CPUTimeRecord
+	SQLMetas                []*tipb.SQLMeta
+	PlanMetas               []*tipb.PlanMeta
+}
+
+// trafficCapture appends the batches ingested to a segment log until it
+// reaches its max size. Appends are not synced, a crash loses the last ones.
+type trafficCapture struct {
+	log         *segmentLog
+	maxSize     int64
+	digestsOnly bool
+	full        int32
+}
+
+func openTrafficCapture(dir string, maxSize int64, digestsOnly bool) (*trafficCapture, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("%w: unexpected max traffic capture size %d", ErrInvalidConfig, maxSize)
+	}
+	l, err := openSegmentLog(dir, trafficSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	return &trafficCapture{log: l, maxSize: maxSize, digestsOnly: digestsOnly}, nil
+}
+
+// captureBatch records b if the traffic capture is enabled.
+func captureBatch(b CapturedBatch) {
+	c := traffic
+	if c == nil {
+		return
+	}
+	if atomic.LoadInt32(&c.full) == 1 {
+		droppedBatchesCounter.Inc()
+		return
+	}
+
+	b.ArrivalNanos = clock.Now().UnixNano()
+	record, err := c.encode(&b)
+	if err != nil {
+		droppedBatchesCounter.Inc()
+		log.Warn("failed to encode a captured batch", zap.Error(err))
+		return
+	}
+	if size, _ := c.log.stats(); size+int64(len(record)) > c.maxSize {
+		if atomic.CompareAndSwapInt32(&c.full, 0, 1) {
+			log.Warn("stopped the traffic capture, --store.traffic-capture-max-size reached", zap.Int64("size", size))
+		}
+		droppedBatchesCounter.Inc()
+		return
+	}
+	if _, err = c.log.append(record, false); err != nil {
+		droppedBatchesCounter.Inc()
+		log.Warn("failed to capture a batch", zap.Error(err))
+		return
+	}
+	capturedBatchesCounter.Inc()
+}
+
+// encode frames b as its kind, arrival time and source followed by the count
+// of its records and each marshaled record prefixed by its length.
+func (c *trafficCapture) encode(b *CapturedBatch) ([]byte, error) {
+	var records []marshaler
+	switch b.Kind {
+	case CaptureTopSQL:
+		for _, r := range b.TopSQLRecords {
+			records = append(records, r)
+		}
+	case CaptureResourceMetering:
+		for _, r := range b.ResourceMeteringRecords {
+			records = append(records, r)
+		}
+	case CaptureSQLMetas:
+		for _, m := range b.SQLMetas {
+			if c.digestsOnly {
+				m = &tipb.SQLMeta{SqlDigest: m.SqlDigest, IsInternalSql: m.IsInternalSql}
+			}
+			records = append(records, m)
+		}
+	case CapturePlanMetas:
+		for _, m := range b.PlanMetas {
+			if c.digestsOnly {
+				m = &tipb.PlanMeta{PlanDigest: m.PlanDigest}
+			}
+			records = append(records, m)
+		}
+	}
+
+	var tmp [binary.MaxVarintLen64]byte
+	buf := []byte{byte(b.Kind)}
+	buf = append(buf, tmp[:binary.PutVarint(tmp[:], b.ArrivalNanos)]...)
+	buf = appendBytes(buf, []byte(b.Source.Fingerprint))
+	buf = appendUvarint(buf, b.Source.Sequence)
+	buf = appendBytes(buf, []byte(b.Source.Addr))
+	buf = appendBytes(buf, []byte(b.Source.Tenant))
+	buf = appendBytes(buf, []byte(b.Source.AgentVersion))
+	buf = appendUvarint(buf, uint64(b.Source.Capabilities))
+	buf = appendUvarint(buf, uint64(len(records)))
+	for _, r := range records {
+		data, err := r.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendBytes(buf, data)
+	}
+	return buf, nil
+}
+
+func (c *trafficCapture) close() error {
+	return c.log.close()
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+func appendBytes(buf, data []byte) []byte {
+	return append(appendUvarint(buf, uint64(len(data))), data...)
+}
+
+// ReadCapture decodes the batches captured in dir, in the order ingested, and
+// calls fn with each. It stops at the first error returned by fn. The torn
+// tail left by a crash is skipped.
+func ReadCapture(dir string, fn func(b *CapturedBatch) error) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var segments []segment
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{seq: seq, size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].seq < segments[j].seq
+	})
+
+	// Read only, the log is not opened to leave dir as is.
+	l := &segmentLog{dir: dir}
+	for _, s := range segments {
+		err = l.readSegment(s.seq, 0, s.size, func(record []byte, _ int64) error {
+			b, err := decodeCapturedBatch(record)
+			if err != nil {
+				return fmt.Errorf("failed to decode %s: %w", l.path(s.seq), err)
+			}
+			return fn(b)
+		})
+		if errors.Is(err, errCorruptedRecord) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var errTruncatedBatch = errors.New("truncated captured batch")
+
+func decodeCapturedBatch(record []byte) (*CapturedBatch, error) {
+	if len(record) == 0 {
+		return nil, errTruncatedBatch
+	}
+	b := &CapturedBatch{Kind: CaptureKind(record[0])}
+	buf := record[1:]
+
+	var n int
+	if b.ArrivalNanos, n = binary.Varint(buf); n <= 0 {
+		return nil, errTruncatedBatch
+	}
+	buf = buf[n:]
+	fingerprint, buf, err := readBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	b.Source.Fingerprint = string(fingerprint)
+	if b.Source.Sequence, n = binary.Uvarint(buf); n <= 0 {
+		return nil, errTruncatedBatch
+	}
+	buf = buf[n:]
+	addr, buf, err := readBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	b.Source.Addr = string(addr)
+	tenant, buf, err := readBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	b.Source.Tenant = string(tenant)
+	version, buf, err := readBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	b.Source.AgentVersion = string(version)
+	capabilities, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errTruncatedBatch
+	}
+	buf = buf[n:]
+	b.Source.Capabilities = Capabilities(capabilities)
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, errTruncatedBatch
+	}
+	buf = buf[n:]
+
+	for i := uint64(0); i < count; i++ {
+		var data []byte
+		if data, buf, err = readBytes(buf); err != nil {
+			return nil, err
+		}
+		switch b.Kind {
+		case CaptureTopSQL:
+			r := &tipb.CPUTimeRecord{}
+			err = r.Unmarshal(data)
+			b.TopSQLRecords = append(b.TopSQLRecords, r)
+		case CaptureResourceMetering:
+			r := &rsmetering.CPUTimeRecord{}
+			err = r.Unmarshal(data)
+			b.ResourceMeteringRecords = append(b.ResourceMeteringRecords, r)
+		case CaptureSQLMetas:
+			m := &tipb.SQLMeta{}
+			err = m.Unmarshal(data)
+			b.SQLMetas = append(b.SQLMetas, m)
+		case CapturePlanMetas:
+			m := &tipb.PlanMeta{}
+			err = m.Unmarshal(data)
+			b.PlanMetas = append(b.PlanMetas, m)
+		default:
+			return nil, fmt.Errorf("unknown captured batch kind %d", b.Kind)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	n, l := binary.Uvarint(buf)
+	if l <= 0 || uint64(len(buf)-l) < n {
+		return nil, nil, errTruncatedBatch
+	}
+	buf = buf[l:]
+	return buf[:n], buf[n:], nil
+}
@@ -0,0 +1,40 @@
+package store
+
+import (
+	"unicode/utf8"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/pflag"
+)
+
+const truncatedMarker = "...(truncated)"
+
+var (
+	maxSQLLength  = pflag.Int("store.max-sql-length", 0, "Maximum length in bytes of a stored normalized SQL, longer ones are truncated. 0 means unlimited")
+	maxPlanLength = pflag.Int("store.max-plan-length", 0, "Maximum length in bytes of a stored normalized plan, longer ones are truncated. 0 means unlimited")
+
+	truncatedSQLCounter  = metrics.NewCounter(`diag_store_truncated_texts_total{table="sql_digest"}`)
+	truncatedPlanCounter = metrics.NewCounter(`diag_store_truncated_texts_total{table="plan_digest"}`)
+)
+
+// truncateText cuts text to at most maxLen bytes ending with truncatedMarker.
+// The cut never splits a multi-byte character.
+func truncateText(text string, maxLen int) (string, bool) {
+	if maxLen <= 0 || len(text) <= maxLen {
+		return text, false
+	}
+
+	keep := maxLen - len(truncatedMarker)
+	if keep < 0 {
+		keep = 0
+	}
+	for keep > 0 && !utf8.RuneStart(text[keep]) {
+		keep--
+	}
+
+	res := text[:keep] + truncatedMarker
+	if len(res) > maxLen {
+		res = res[:maxLen]
+	}
+	return res, true
+}
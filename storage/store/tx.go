@@ -0,0 +1,171 @@
+package store
+
+import (
+	"context"
+
+	"github.com/zhongzc/diag_backend/utils/failpoint"
+
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// execer is what the meta writes run on, either the document db or a transaction of it.
+type execer interface {
+	Exec(q string, args ...interface{}) error
+	Prepare(q string) (*genji.Statement, error)
+	QueryDocument(q string, args ...interface{}) (types.Document, error)
+}
+
+var (
+	_ execer = &genji.DB{}
+	_ execer = &genji.Tx{}
+)
+
+// update runs fn in a transaction on db, or on db itself if it is one already.
+func update(db execer, fn func(tx execer) error) error {
+	if err := failpoint.Eval(FailpointGenjiExec); err != nil {
+		return err
+	}
+	if d, ok := db.(*genji.DB); ok {
+		return d.Update(func(tx *genji.Tx) error {
+			return fn(tx)
+		})
+	}
+	return fn(db)
+}
+
+// ingest writes the metrics filled by fill, then the instances of n records
+// reported from src and the sql_plan rows of the metrics in a short
+// transaction of the document db, so the document db is not held during the
+// write. The failures order as follows:
+//
+//   - metrics fail: nothing is written;
+//   - the rows fail, or the process dies before they commit: the metrics are
+//     written without the rows, and the error makes the agent retry, which
+//     writes the rows and rewrites the same samples.
+//
+// So an acknowledged batch always has its instance rows.
+//
+// With --store.meta-priority the rows are committed after the meta writes
+// running.
+func ingest(ctx context.Context, src Source, n int, instanceAt func(i int) (instance, job string), fill func(target *[]Metric) error) error {
+	var touched func()
+	err := storeRecords(ctx, documentDB, src, fill, func(pairs []sqlPlan) (func(), error) {
+		if CurrentConfig().MetaPriority {
+			metaLanes.waitMetas()
+		}
+		var stored func()
+		err := update(documentDB, func(tx execer) error {
+			var err error
+			if touched, err = insertInstances(tx, n, src, instanceAt); err != nil {
+				return err
+			}
+			stored, err = insertSQLPlans(tx, src.Tenant, pairs)
+			return err
+		})
+		return stored, err
+	})
+	if err != nil {
+		return err
+	}
+	touched()
+	return nil
+}
+
+// Tx batches the meta writes of a logical ingestion unit, committed or rolled
+// back together. The discovered metas are notified of after the commit.
+type Tx struct {
+	tx     *genji.Tx
+	tenant string
+
+	sqlMetas  []*tipb.SQLMeta
+	planMetas []*tipb.PlanMeta
+	// resolved are all the SQL metas written, for the held metrics.
+	resolved []*tipb.SQLMeta
+	// stored record the digests written as stored once committed.
+	stored []func()
+}
+
+// WithTx runs fn in a transaction of the document db for DefaultTenant, which
+// commits if fn returns nil and rolls back otherwise. The Tx must not be used after fn returns,
+// and the package level writes must not be called within fn, which waits for
+// the transaction to end.
+func WithTx(fn func(tx *Tx) error) error {
+	return withTx(context.Background(), fn)
+}
+
+// Metas writes sqlMetas and planMetas of the tenant of ctx in one transaction
+// within ctx, so either both or none are written.
+func Metas(ctx context.Context, sqlMetas []*tipb.SQLMeta, planMetas []*tipb.PlanMeta) error {
+	if len(sqlMetas) == 0 && len(planMetas) == 0 {
+		return nil
+	}
+	return withTx(ctx, func(tx *Tx) error {
+		if err := tx.SQLMetas(sqlMetas); err != nil {
+			return err
+		}
+		return tx.PlanMetas(planMetas)
+	})
+}
+
+func withTx(ctx context.Context, fn func(tx *Tx) error) error {
+	tenant := TenantFrom(ctx)
+	if err := CheckTenant(tenant); err != nil {
+		return err
+	}
+	exit, err := enter()
+	if err != nil {
+		return err
+	}
+	defer exit()
+	start := clock.Now()
+	if CurrentConfig().MetaPriority {
+		defer metaLanes.enterMeta()()
+	}
+	// genji keeps the db locked if the transaction fails to begin on a done ctx.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	t := &Tx{tenant: tenant}
+	err = documentDB.WithContext(ctx).Update(func(tx *genji.Tx) error {
+		t.tx = tx
+		return fn(t)
+	})
+	if err != nil {
+		return err
+	}
+	observeMetaLag(start)
+
+	for _, stored := range t.stored {
+		stored()
+	}
+	resolveSQLMetas(tenant, t.resolved)
+	notifySQLMetas(tenant, t.sqlMetas)
+	notifyPlanMetas(tenant, t.planMetas)
+	return nil
+}
+
+func (t *Tx) SQLMetas(metas []*tipb.SQLMeta) error {
+	discovered, stored, err := insertSQLMetas(t.tx, t.tenant, metas)
+	if err != nil {
+		return err
+	}
+	t.stored = append(t.stored, stored)
+	t.sqlMetas = append(t.sqlMetas, discovered...)
+	if pendingDigests != nil {
+		t.resolved = append(t.resolved, metas...)
+	}
+	return nil
+}
+
+func (t *Tx) PlanMetas(metas []*tipb.PlanMeta) error {
+	discovered, stored, err := insertPlanMetas(t.tx, t.tenant, metas)
+	if err != nil {
+		return err
+	}
+	t.stored = append(t.stored, stored)
+	t.planMetas = append(t.planMetas, discovered...)
+	return nil
+}
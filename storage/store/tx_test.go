@@ -0,0 +1,181 @@
+package store_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/notify"
+	"github.com/zhongzc/diag_backend/storage/query"
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/tipb/go-tipb"
+	"github.com/spf13/pflag"
+)
+
+// blockingWriter blocks the writes until release is closed.
+type blockingWriter struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) WriteMetrics([]store.Metric) error {
+	w.entered <- struct{}{}
+	<-w.release
+	return nil
+}
+
+func TestIngestDoesNotHoldDocumentDBDuringWrite(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	w := &blockingWriter{entered: make(chan struct{}, 1), release: make(chan struct{})}
+	store.Init(w, db, nil)
+	defer store.Stop()
+
+	written := make(chan error, 1)
+	go func() {
+		written <- store.TopSQLRecords([]*tipb.CPUTimeRecord{cpuTimeRecord(1632700800, 35)})
+	}()
+	<-w.entered
+
+	metas := make(chan error, 1)
+	go func() {
+		metas <- store.SQLMetas([]*tipb.SQLMeta{{SqlDigest: []byte{0x5e, 0x4c}, NormalizedSql: "select ?"}})
+	}()
+	select {
+	case err := <-metas:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		// Stop waits for the write
+		close(w.release)
+		t.Fatal("the meta write waits for the write of the metrics")
+	}
+
+	close(w.release)
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIngestWritesNoInstanceOnFailedWrite(t *testing.T) {
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	errWrite := errors.New("tsdb unavailable")
+	s.TSDB.SetError(errWrite)
+	if err := store.TopSQLRecords([]*tipb.CPUTimeRecord{cpuTimeRecord(1632700800, 35)}); !errors.Is(err, errWrite) {
+		t.Fatalf("got error %v, want %v", err, errWrite)
+	}
+	var instances []query.InstanceItem
+	if err := query.AllInstances(context.Background(), &instances); err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 0 {
+		t.Fatalf("got instances %v of a failed write", instances)
+	}
+
+	s.TSDB.SetError(nil)
+	if err := store.TopSQLRecords([]*tipb.CPUTimeRecord{cpuTimeRecord(1632700800, 35)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := query.AllInstances(context.Background(), &instances); err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 1 || instances[0].Instance != "tidb-0:10080" {
+		t.Fatalf("got instances %v, want tidb-0:10080", instances)
+	}
+}
+
+func TestWithTxRollsBackOnFailure(t *testing.T) {
+	events := make(chan notify.Event, 16)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e notify.Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer srv.Close()
+	if err := pflag.Set("notify.webhook-url", srv.URL); err != nil {
+		t.Fatal(err)
+	}
+	defer pflag.Set("notify.webhook-url", "")
+	notify.Init()
+	defer notify.Stop()
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	sqlMetas := []*tipb.SQLMeta{{SqlDigest: []byte{0x7a, 0x01}, NormalizedSql: "select ?"}}
+	planMetas := []*tipb.PlanMeta{{PlanDigest: []byte{0x7a, 0x02}, NormalizedPlan: "Point_Get"}}
+	errRollback := errors.New("rollback")
+	err = store.WithTx(func(tx *store.Tx) error {
+		if err := tx.SQLMetas(sqlMetas); err != nil {
+			return err
+		}
+		if err := tx.PlanMetas(planMetas); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	if !errors.Is(err, errRollback) {
+		t.Fatalf("got error %v, want %v", err, errRollback)
+	}
+	ctx := context.Background()
+	if ok, err := query.HasSQLMeta(ctx, "7a01"); err != nil || ok {
+		t.Fatalf("got SQL meta %v, error %v, of a rolled back transaction", ok, err)
+	}
+	if ok, err := query.HasPlanMeta(ctx, "7a02"); err != nil || ok {
+		t.Fatalf("got plan meta %v, error %v, of a rolled back transaction", ok, err)
+	}
+
+	// Written and notified of by the commit, not skipped as seen
+	if err := store.WithTx(func(tx *store.Tx) error {
+		if err := tx.SQLMetas(sqlMetas); err != nil {
+			return err
+		}
+		return tx.PlanMetas(planMetas)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := query.HasSQLMeta(ctx, "7a01"); err != nil || !ok {
+		t.Fatalf("got SQL meta %v, error %v, of a committed transaction", ok, err)
+	}
+	if ok, err := query.HasPlanMeta(ctx, "7a02"); err != nil || !ok {
+		t.Fatalf("got plan meta %v, error %v, of a committed transaction", ok, err)
+	}
+	for _, want := range []notify.Event{
+		{Type: notify.EventNewSQLDigest, Digest: "7a01"},
+		{Type: notify.EventNewPlanDigest, Digest: "7a02"},
+	} {
+		select {
+		case e := <-events:
+			if e.Type != want.Type || e.Digest != want.Digest {
+				t.Fatalf("got event %+v, want %+v", e, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no event %+v", want)
+		}
+	}
+	select {
+	case e := <-events:
+		t.Fatalf("got event %+v of a rolled back transaction", e)
+	default:
+	}
+}
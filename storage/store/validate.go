@@ -0,0 +1,27 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/spf13/pflag"
+)
+
+var validateMetrics = pflag.Bool("store.validate-metrics", false, "Check the metrics of each write for an empty name or instance and timestamps not paired with values before encoding them, failing the write naming the first malformed one. For debugging, as it costs a pass over the metrics")
+
+// checkMetrics returns an error wrapping ErrInvalidMetric for the first metric
+// with an empty name or instance, or with as many timestamps as values.
+func checkMetrics(metrics []Metric) error {
+	for i := range metrics {
+		m := &metrics[i]
+		switch {
+		case len(m.Metric.Name) == 0:
+			return fmt.Errorf("%w: metric %d of instance %q has an empty name", ErrInvalidMetric, i, m.Metric.Instance)
+		case len(m.Metric.Instance) == 0:
+			return fmt.Errorf("%w: metric %d %s has an empty instance", ErrInvalidMetric, i, m.Metric.Name)
+		case len(m.Timestamps) != len(m.Values):
+			return fmt.Errorf("%w: metric %d %s of instance %q has %d timestamps but %d values",
+				ErrInvalidMetric, i, m.Metric.Name, m.Metric.Instance, len(m.Timestamps), len(m.Values))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"github.com/zhongzc/diag_backend/utils"
+	"go.uber.org/zap"
+)
+
+// ChecksumHeader carries the hex CRC32C of the import payload.
+const ChecksumHeader = "X-Payload-Checksum"
+
+var (
+	verifyMatchedCounter  = metrics.NewCounter(`diag_store_write_verifications_total{result="matched"}`)
+	verifyMismatchCounter = metrics.NewCounter(`diag_store_write_verifications_total{result="mismatched"}`)
+	verifyMissingCounter  = metrics.NewCounter(`diag_store_write_verifications_total{result="missing"}`)
+	verifyFailedCounter   = metrics.NewCounter(`diag_store_write_verifications_total{result="failed"}`)
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func payloadChecksum(payload []byte) string {
+	return fmt.Sprintf("%08x", crc32.Checksum(payload, castagnoli))
+}
+
+// exportedSeries is a line of the `/api/v1/export` response.
+type exportedSeries struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []int64           `json:"timestamps"`
+}
+
+func sampled(rate float64) bool {
+	return rate >= 1 || (rate > 0 && rand.Float64() < rate)
+}
+
+// verifyLater verifies a random one of the just written metrics, after the
+// VerifyDelay if any.
+func (w *handlerWriter) verifyLater(requestID string, written []Metric) {
+	m := written[rand.Intn(len(written))]
+	if len(m.Timestamps) == 0 {
+		return
+	}
+	if w.cfg.VerifyDelay <= 0 {
+		w.verify(requestID, m)
+		return
+	}
+	// The written metrics may be reused once the write returns.
+	labels := make(map[string]string, len(m.Metric.Labels))
+	for key, value := range m.Metric.Labels {
+		labels[key] = value
+	}
+	m.Metric.Labels = labels
+	m.Timestamps = append([]uint64(nil), m.Timestamps...)
+	m.Values = append([]uint64(nil), m.Values...)
+	time.AfterFunc(w.cfg.VerifyDelay, func() {
+		w.verify(requestID, m)
+	})
+}
+
+// verify reads m back through the `/api/v1/export` handler and compares the
+// values at the written timestamps. A series not found is counted as missing,
+// logged only after the VerifyDelay since the timeseries db makes fresh
+// samples searchable with a delay.
+func (w *handlerWriter) verify(requestID string, m Metric) {
+
+	exported, err := w.export(m)
+	if err != nil {
+		verifyFailedCounter.Inc()
+		log.Warn("failed to read back the written metric", zap.String("request_id", requestID), zap.Error(err))
+		return
+	}
+	if exported == nil {
+		verifyMissingCounter.Inc()
+		if w.cfg.VerifyDelay > 0 {
+			log.Warn("the written metric is missing once read back",
+				zap.String("request_id", requestID),
+				zap.String("series", seriesSelector(m.Metric.labels())),
+				zap.Duration("delay", w.cfg.VerifyDelay))
+		}
+		return
+	}
+
+	got := make(map[int64]float64, len(exported.Timestamps))
+	for i, ts := range exported.Timestamps {
+		if i < len(exported.Values) {
+			got[ts] = exported.Values[i]
+		}
+	}
+	for i, ts := range m.Timestamps {
+		if i >= len(m.Values) {
+			break
+		}
+		v, ok := got[int64(ts)]
+		if !ok || v != float64(m.Values[i]) {
+			verifyMismatchCounter.Inc()
+			log.Warn("read back a written metric with different values",
+				zap.String("request_id", requestID),
+				zap.String("series", seriesSelector(exported.Metric)),
+				zap.Uint64("timestamp", ts),
+				zap.Uint64("written", m.Values[i]),
+				zap.Float64("read", v),
+				zap.Bool("found", ok))
+			return
+		}
+	}
+	verifyMatchedCounter.Inc()
+}
+
+// export returns the series of m over the range of its timestamps, nil if not found.
+func (w *handlerWriter) export(m Metric) (*exportedSeries, error) {
+	labels := m.Metric.labels()
+
+	minTs, maxTs := m.Timestamps[0], m.Timestamps[0]
+	for _, ts := range m.Timestamps {
+		if ts < minTs {
+			minTs = ts
+		}
+		if ts > maxTs {
+			maxTs = ts
+		}
+	}
+
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	req, err := http.NewRequest("GET", "/api/v1/export", nil)
+	if err != nil {
+		return nil, err
+	}
+	query := req.URL.Query()
+	query.Set("match[]", seriesSelector(labels))
+	// the range of export is in seconds
+	query.Set("start", strconv.FormatUint(MillisToSecs(minTs), 10))
+	query.Set("end", strconv.FormatUint(MillisToSecs(maxTs)+1, 10))
+	req.URL.RawQuery = query.Encode()
+	req.Header.Set("User-Agent", *userAgent)
+
+	respR := utils.NewRespWriter(bufResp, header)
+	w.readHandler(&respR, req)
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		return nil, fmt.Errorf("failed to export from timeseries db, code: %d, error: %s", respR.Code, respR.Body.String())
+	}
+
+	// The selector matches the labels exactly, but a series with more labels
+	// matches too, so look for the identical one.
+	scanner := bufio.NewScanner(respR.Body)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		s := &exportedSeries{}
+		if err = json.Unmarshal(scanner.Bytes(), s); err != nil {
+			return nil, err
+		}
+		if sameLabels(s.Metric, labels) {
+			return s, nil
+		}
+	}
+	return nil, scanner.Err()
+}
+
+// labels returns the labels of the series of t as the timeseries db stores
+// them, without the empty ones.
+func (t topSQLTags) labels() map[string]string {
+	labels := make(map[string]string, len(t.Labels)+5)
+	for key, value := range t.Labels {
+		if !isFixedLabel(key) && len(value) != 0 {
+			labels[key] = value
+		}
+	}
+	for key, value := range map[string]string{
+		labelName:       t.Name,
+		labelInstance:   t.Instance,
+		labelJob:        t.Job,
+		labelSQLDigest:  t.SQLDigest,
+		labelPlanDigest: t.PlanDigest,
+	} {
+		if len(value) != 0 {
+			labels[key] = value
+		}
+	}
+	return labels
+}
+
+func seriesSelector(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	matchers := make([]string, 0, len(keys))
+	for _, key := range keys {
+		matchers = append(matchers, fmt.Sprintf("%s=%q", key, labels[key]))
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if v, ok := b[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
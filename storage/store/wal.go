@@ -0,0 +1,529 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/zhongzc/diag_backend/utils/failpoint"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var (
+	walPath         = pflag.String("store.wal-path", "", "Directory to log the metrics to before acknowledging them, written from it in the background and replayed on startup. Disabled if empty")
+	walSync         = pflag.String("store.wal-sync", string(WALSyncAlways), "When the wal is synced to disk: always, before acknowledging each write, interval, every --store.wal-sync-interval, or never, leaving it to the OS")
+	walSyncInterval = pflag.Duration("store.wal-sync-interval", time.Second, "Interval between the syncs of the wal with --store.wal-sync=interval")
+	walSegmentSize  = pflag.Int64("store.wal-segment-size", 64*1024*1024, "Size in bytes at which a wal segment is sealed, deleted once all its metrics are written")
+	walMaxSize      = pflag.Int64("store.wal-max-size", 1024*1024*1024, "Max total size in bytes of the wal segments, 0 means unlimited. See --store.wal-full-policy")
+	walFullPolicy   = pflag.String("store.wal-full-policy", string(WALFullBlock), "What a write does when the wal is full: block, waiting up to --store.wal-full-timeout for the written segments to be deleted, or fail at once")
+	walFullTimeout  = pflag.Duration("store.wal-full-timeout", 30*time.Second, "Max time a write waits for space in a full wal with --store.wal-full-policy=block, 0 means no limit")
+	walRetryBackoff = pflag.Duration("store.wal-retry-backoff", time.Second, "Wait after a failed write of the metrics of the wal before retrying it")
+)
+
+// The policies of syncing the wal to disk.
+type WALSyncPolicy string
+
+const (
+	WALSyncAlways   WALSyncPolicy = "always"
+	WALSyncInterval WALSyncPolicy = "interval"
+	WALSyncNever    WALSyncPolicy = "never"
+)
+
+// The behaviors of a write when the wal is full.
+type WALFullPolicy string
+
+const (
+	WALFullBlock WALFullPolicy = "block"
+	WALFullFail  WALFullPolicy = "fail"
+)
+
+const (
+	walLegacySuffix    = ".legacy"
+	walCursorName      = "cursor"
+	walReplayBatchSize = 1024
+)
+
+var (
+	walFullCounter     = metrics.NewCounter(`diag_store_wal_full_total`)
+	walRetriesCounter  = metrics.NewCounter(`diag_store_wal_write_retries_total`)
+	walWrittenCounter  = metrics.NewCounter(`diag_store_wal_metrics_written_total`)
+	walRejectedCounter = metrics.NewCounter(`diag_store_wal_metrics_rejected_total`)
+
+	errWALFull   = fmt.Errorf("%w: wal is full", ErrBackendUnavailable)
+	errWALClosed = fmt.Errorf("%w: wal is closed", ErrClosed)
+)
+
+type WALConfig struct {
+	// Dir is the directory holding the segments.
+	Dir string
+	// Sync is when the segments are synced to disk.
+	Sync WALSyncPolicy
+	// SyncInterval is the interval between the syncs with WALSyncInterval.
+	SyncInterval time.Duration
+	// SegmentSize is the size in bytes at which a segment is sealed.
+	SegmentSize int64
+	// MaxSize caps the total size of the segments, zero means no cap.
+	MaxSize int64
+	// FullPolicy is what a write does when MaxSize is reached.
+	FullPolicy WALFullPolicy
+	// FullTimeout is the max wait for space with WALFullBlock, zero means no limit.
+	FullTimeout time.Duration
+	// BatchSize is the max number of metrics per write of the inner writer.
+	BatchSize int
+	// RetryBackoff is the wait after a failed write of the inner writer.
+	RetryBackoff time.Duration
+}
+
+// WALConfigFromFlags returns the config of the wal of dir set by the command line flags.
+func WALConfigFromFlags(dir string) WALConfig {
+	return WALConfig{
+		Dir:          dir,
+		Sync:         WALSyncPolicy(*walSync),
+		SyncInterval: *walSyncInterval,
+		SegmentSize:  *walSegmentSize,
+		MaxSize:      *walMaxSize,
+		FullPolicy:   WALFullPolicy(*walFullPolicy),
+		FullTimeout:  *walFullTimeout,
+		BatchSize:    *asyncBatchSize,
+		RetryBackoff: *walRetryBackoff,
+	}
+}
+
+var _ MetricWriter = &WAL{}
+
+// WAL appends the metrics to the segments of a directory and returns once
+// they are there, synced to disk as configured, writing them to the wrapped
+// writer from a background goroutine. Failed writes are retried until they
+// succeed unless rejected as invalid, the segments are deleted once all their
+// metrics are written, and the ones left by a previous run are written first
+// on startup.
+//
+// When full, a write blocks or fails as configured. Delivery is at least once,
+// a crash replays the metrics of the partly written segments. With
+// --store.wal-path it takes the place of the AsyncWriter of the store,
+// queueing the metrics on disk instead of in memory.
+type WAL struct {
+	inner MetricWriter
+	cfg   WALConfig
+	log   *segmentLog
+
+	// appended wakes the writing goroutine.
+	appended chan struct{}
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	mu sync.Mutex
+	// written is the position up to which the metrics are written.
+	written segmentPos
+	// freed is closed and replaced whenever segments are deleted or reserved
+	// bytes released.
+	freed chan struct{}
+	// reserved are the bytes of the appends in progress.
+	reserved int64
+	failed   bool
+	closed   bool
+}
+
+func NewWAL(cfg WALConfig, inner MetricWriter) (*WAL, error) {
+	switch cfg.Sync {
+	case WALSyncAlways, WALSyncNever:
+	case WALSyncInterval:
+		if cfg.SyncInterval <= 0 {
+			return nil, fmt.Errorf("%w: unexpected wal sync interval %s", ErrInvalidConfig, cfg.SyncInterval)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown wal sync policy %q", ErrInvalidConfig, cfg.Sync)
+	}
+	if cfg.FullPolicy != WALFullBlock && cfg.FullPolicy != WALFullFail {
+		return nil, fmt.Errorf("%w: unknown wal full policy %q", ErrInvalidConfig, cfg.FullPolicy)
+	}
+	if cfg.MaxSize > 0 && cfg.MaxSize < 2*cfg.SegmentSize {
+		// The active segment is only deleted once sealed, which needs room for the next one.
+		return nil, fmt.Errorf("%w: wal max size %d below twice the segment size %d", ErrInvalidConfig, cfg.MaxSize, cfg.SegmentSize)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 512
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = time.Second
+	}
+
+	legacy, err := moveLegacyWAL(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	l, err := openSegmentLog(cfg.Dir, cfg.SegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(legacy) != 0 {
+		if err = importLegacyWAL(l, legacy); err != nil {
+			_ = l.close()
+			return nil, err
+		}
+	}
+
+	w := &WAL{
+		inner:    inner,
+		cfg:      cfg,
+		log:      l,
+		appended: make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		written:  readWALCursor(cfg.Dir, l.start()),
+		freed:    make(chan struct{}),
+	}
+	if _, err = l.truncate(w.written); err != nil {
+		log.Warn("failed to delete the written wal segments", zap.String("path", cfg.Dir), zap.Error(err))
+	}
+	if pending := l.pending(w.written); pending > 0 {
+		log.Info("replaying the wal", zap.String("path", cfg.Dir), zap.Int64("bytes", pending))
+		w.appended <- struct{}{}
+	}
+	w.wg.Add(1)
+	go w.run()
+	return w, nil
+}
+
+// WriteMetrics returns once metrics are appended to the wal.
+func (w *WAL) WriteMetrics(metrics []Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	buf := bytesP.Get()
+	defer bytesP.Put(buf)
+	if err := encodeMetrics(buf, metrics); err != nil {
+		return err
+	}
+	// Framed by a header in the segment
+	n := int64(segmentHeaderSize + buf.Len())
+	if err := w.reserve(n); err != nil {
+		return err
+	}
+	err := failpoint.Eval(FailpointWALAppend)
+	if err == nil {
+		_, err = w.log.append(buf.Bytes(), w.cfg.Sync == WALSyncAlways)
+	}
+	w.release(n)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case w.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// reserve waits until n bytes fit into the wal as per the full policy, along
+// with the ones reserved by the appends in progress, and reserves them until
+// release. A record larger than the whole wal still goes through once all is
+// written.
+func (w *WAL) reserve(n int64) error {
+	if w.cfg.MaxSize <= 0 {
+		return w.checkClosed()
+	}
+
+	var timeout <-chan time.Time
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return errWALClosed
+		}
+		size, _ := w.log.stats()
+		if size+w.reserved+n <= w.cfg.MaxSize || (w.reserved == 0 && w.log.pending(w.written) == 0) {
+			w.reserved += n
+			w.mu.Unlock()
+			return nil
+		}
+		freed := w.freed
+		w.mu.Unlock()
+
+		if w.cfg.FullPolicy == WALFullFail {
+			walFullCounter.Inc()
+			return errWALFull
+		}
+		if timeout == nil && w.cfg.FullTimeout > 0 {
+			timer := clock.NewTimer(w.cfg.FullTimeout)
+			defer timer.Stop()
+			timeout = timer.C()
+		}
+		select {
+		case <-freed:
+		case <-timeout:
+			walFullCounter.Inc()
+			return fmt.Errorf("%w, waited %s", errWALFull, w.cfg.FullTimeout)
+		case <-w.stop:
+			return errWALClosed
+		}
+	}
+}
+
+// release releases the n bytes reserved once appended or failed.
+func (w *WAL) release(n int64) {
+	if w.cfg.MaxSize <= 0 {
+		return
+	}
+	w.mu.Lock()
+	w.reserved -= n
+	close(w.freed)
+	w.freed = make(chan struct{})
+	w.mu.Unlock()
+}
+
+func (w *WAL) checkClosed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return errWALClosed
+	}
+	return nil
+}
+
+func (w *WAL) run() {
+	defer w.wg.Done()
+
+	var syncC <-chan time.Time
+	if w.cfg.Sync == WALSyncInterval {
+		ticker := clock.NewTicker(w.cfg.SyncInterval)
+		defer ticker.Stop()
+		syncC = ticker.C()
+	}
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-w.appended:
+		case <-retry:
+			retry = nil
+		case <-syncC:
+			if err := w.log.sync(); err != nil {
+				log.Warn("failed to sync the wal", zap.String("path", w.cfg.Dir), zap.Error(err))
+			}
+			continue
+		case <-w.stop:
+			// A last try, the metrics left are written by the next run.
+			w.drain()
+			return
+		}
+		if retry == nil && !w.drain() {
+			retry = clock.NewTimer(w.cfg.RetryBackoff).C()
+		}
+	}
+}
+
+// drain writes the metrics appended until the wal is written, false if a
+// write failed.
+func (w *WAL) drain() bool {
+	w.mu.Lock()
+	from := w.written
+	w.mu.Unlock()
+
+	for {
+		batch, end, err := w.readBatch(from)
+		if err != nil {
+			log.Warn("failed to read the wal", zap.String("path", w.cfg.Dir), zap.Error(err))
+			return false
+		}
+		if len(batch) == 0 {
+			return true
+		}
+		switch err = w.inner.WriteMetrics(batch); {
+		case err == nil:
+			walWrittenCounter.Add(len(batch))
+		case !IsRetryable(err):
+			// Rejected metrics fail the same way when retried
+			walRejectedCounter.Add(len(batch))
+			log.Warn("failed to write the metrics of the wal, dropping", zap.Int("metrics", len(batch)), zap.Error(err))
+		default:
+			walRetriesCounter.Inc()
+			w.mu.Lock()
+			w.failed = true
+			w.mu.Unlock()
+			log.Warn("failed to write the metrics of the wal, retrying", zap.Int("metrics", len(batch)), zap.Error(err))
+			return false
+		}
+
+		freed, err := w.log.truncate(end)
+		if err != nil {
+			log.Warn("failed to delete the written wal segments", zap.String("path", w.cfg.Dir), zap.Error(err))
+		}
+		w.mu.Lock()
+		w.written = end
+		w.failed = false
+		if freed > 0 {
+			close(w.freed)
+			w.freed = make(chan struct{})
+		}
+		w.mu.Unlock()
+		from = end
+	}
+}
+
+// readBatch decodes the metrics of the records after from, the first ones up
+// to the batch size, and returns the position after the last record taken.
+func (w *WAL) readBatch(from segmentPos) ([]Metric, segmentPos, error) {
+	var batch []Metric
+	end := from
+	err := w.log.read(from, func(record []byte, pos segmentPos) error {
+		if len(batch) >= w.cfg.BatchSize {
+			return errStopRead
+		}
+		decoder := json.NewDecoder(bytes.NewReader(record))
+		for {
+			var m Metric
+			if err := decoder.Decode(&m); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			batch = append(batch, m)
+		}
+		end = pos
+		return nil
+	})
+	return batch, end, err
+}
+
+// Stats returns the state of the log.
+func (w *WAL) Stats() WALStats {
+	w.mu.Lock()
+	written, failed := w.written, w.failed
+	w.mu.Unlock()
+
+	size, segments := w.log.stats()
+	return WALStats{
+		Path:         w.cfg.Dir,
+		SizeBytes:    size,
+		Segments:     segments,
+		PendingBytes: w.log.pending(written),
+		Failed:       failed,
+	}
+}
+
+// Close stops accepting metrics, tries to write the ones left and closes the
+// wrapped writer.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.stop)
+	w.wg.Wait()
+
+	var err error
+	if closer, ok := w.inner.(io.Closer); ok {
+		err = closer.Close()
+	}
+	if cerr := writeWALCursor(w.cfg.Dir, w.written); err == nil {
+		err = cerr
+	}
+	if cerr := w.log.close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readWALCursor returns the position up to which a previous run wrote the
+// metrics, kept by a clean close, and removes it: after a crash the first
+// segment is replayed in whole.
+func readWALCursor(dir string, start segmentPos) segmentPos {
+	path := filepath.Join(dir, walCursorName)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return start
+	}
+	_ = os.Remove(path)
+
+	var pos segmentPos
+	if _, err = fmt.Sscanf(string(b), "%d %d", &pos.seq, &pos.offset); err != nil || pos.before(start) {
+		return start
+	}
+	return pos
+}
+
+func writeWALCursor(dir string, pos segmentPos) error {
+	path := filepath.Join(dir, walCursorName)
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", pos.seq, pos.offset)), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// moveLegacyWAL renames the single file wal of the previous versions at dir
+// out of the way, returning its new path, empty if none.
+func moveLegacyWAL(dir string) (string, error) {
+	legacy := dir + walLegacySuffix
+	if _, err := os.Stat(legacy); err == nil {
+		// Moved by a run which crashed before importing it.
+		return legacy, nil
+	}
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", nil
+	}
+	if err = os.Rename(dir, legacy); err != nil {
+		return "", err
+	}
+	return legacy, nil
+}
+
+// importLegacyWAL appends the metrics of a legacy wal to l and removes it.
+func importLegacyWAL(l *segmentLog, path string) error {
+	buf := &bytes.Buffer{}
+	count := 0
+	flush := func() error {
+		if buf.Len() == 0 {
+			return nil
+		}
+		_, err := l.append(buf.Bytes(), false)
+		buf.Reset()
+		return err
+	}
+	err := readMetricFile(path, func(m Metric) error {
+		count++
+		if err := encodeMetrics(buf, []Metric{m}); err != nil {
+			return err
+		}
+		if count%walReplayBatchSize == 0 {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		err = l.sync()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to import the legacy wal %s: %w", path, err)
+	}
+	log.Info("imported the legacy wal", zap.String("path", path), zap.Int("metrics", count))
+	return os.Remove(path)
+}
@@ -0,0 +1,349 @@
+package store_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils"
+	"github.com/zhongzc/diag_backend/utils/failpoint"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+)
+
+func walMetric(i int, digestLength int) []store.Metric {
+	m := store.Metric{Timestamps: []uint64{uint64(i+1) * 1000}, Values: []uint64{1}}
+	m.Metric.Name = "cpu_time"
+	m.Metric.Instance = "a"
+	m.Metric.SQLDigest = strings.Repeat("5e", digestLength/2)
+	return []store.Metric{m}
+}
+
+func walConfig(dir string) store.WALConfig {
+	return store.WALConfig{
+		Dir:          dir,
+		Sync:         store.WALSyncAlways,
+		SegmentSize:  1 << 20,
+		FullPolicy:   store.WALFullBlock,
+		RetryBackoff: time.Hour,
+	}
+}
+
+// fillWAL appends n metrics to the wal of cfg without writing them.
+func fillWAL(t *testing.T, cfg store.WALConfig, n int) {
+	tsdb := testutil.NewMemTSDB()
+	tsdb.SetError(store.ErrBackendUnavailable)
+	w, err := store.NewWAL(cfg, tsdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if err := w.WriteMetrics(walMetric(i, 64)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// replayWAL writes the metrics left in the wal of cfg and returns the number of
+// samples written.
+func replayWAL(t *testing.T, cfg store.WALConfig) int {
+	tsdb := testutil.NewMemTSDB()
+	w, err := store.NewWAL(cfg, tsdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	series, err := tsdb.Series(`cpu_time{instance="a"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) == 0 {
+		return 0
+	}
+	return len(series[0].Samples)
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// recordEnds returns the offset after each record of a segment file, parsing
+// the frame headers of the length and checksum.
+func recordEnds(t *testing.T, path string) []int64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ends []int64
+	for offset := 0; offset < len(data); {
+		offset += 8 + int(binary.LittleEndian.Uint32(data[offset:]))
+		ends = append(ends, int64(offset))
+	}
+	return ends
+}
+
+func copyDir(t *testing.T, from, to string) {
+	infos, err := ioutil.ReadDir(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, info := range infos {
+		data, err := ioutil.ReadFile(filepath.Join(from, info.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(to, info.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWALReplaysCrashAtRandomOffsets(t *testing.T) {
+	fixture := t.TempDir()
+	fillWAL(t, walConfig(fixture), 32)
+	files := segmentFiles(t, fixture)
+	if len(files) != 1 {
+		t.Fatalf("got segments %v, want one", files)
+	}
+	ends := recordEnds(t, files[0])
+
+	// As if killed while appending at offset, the rest never reaching the disk
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 32; i++ {
+		offset := r.Int63n(ends[len(ends)-1] + 1)
+		dir := t.TempDir()
+		copyDir(t, fixture, dir)
+		if err := os.Truncate(filepath.Join(dir, filepath.Base(files[0])), offset); err != nil {
+			t.Fatal(err)
+		}
+
+		want := sort.Search(len(ends), func(i int) bool { return ends[i] > offset })
+		if got := replayWAL(t, walConfig(dir)); got != want {
+			t.Fatalf("got %d metrics replayed of a crash at %d, want %d", got, offset, want)
+		}
+		// Written once and deleted
+		if got := replayWAL(t, walConfig(dir)); got != 0 {
+			t.Fatalf("got %d metrics replayed twice of a crash at %d", got, offset)
+		}
+	}
+}
+
+func TestWALReplaysTornTail(t *testing.T) {
+	for _, tail := range [][]byte{
+		// A torn header
+		{0x10, 0x00, 0x00},
+		// A header of a record torn after a few bytes
+		{0x64, 0x00, 0x00, 0x00, 0xde, 0xad, 0xbe, 0xef, '{', '"'},
+	} {
+		dir := t.TempDir()
+		fillWAL(t, walConfig(dir), 8)
+		files := segmentFiles(t, dir)
+		f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(tail); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if got := replayWAL(t, walConfig(dir)); got != 8 {
+			t.Fatalf("got %d metrics replayed of a torn tail %x, want 8", got, tail)
+		}
+	}
+}
+
+func TestWALReplaysCorruptedSegment(t *testing.T) {
+	dir := t.TempDir()
+	cfg := walConfig(dir)
+	cfg.SegmentSize = 512
+	fillWAL(t, cfg, 16)
+	files := segmentFiles(t, dir)
+	if len(files) < 3 {
+		t.Fatalf("got segments %v, want several", files)
+	}
+	want := 0
+	for _, file := range files[1:] {
+		want += len(recordEnds(t, file))
+	}
+
+	// A byte of the second record of the first segment flipped
+	ends := recordEnds(t, files[0])
+	data, err := ioutil.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[ends[0]+10] ^= 0xff
+	if err := ioutil.WriteFile(files[0], data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The segment is cut before the corrupted record, the next ones are whole
+	if got := replayWAL(t, cfg); got != 1+want {
+		t.Fatalf("got %d metrics replayed, want %d", got, 1+want)
+	}
+}
+
+func TestWALConcurrentWritesStayWithinMaxSize(t *testing.T) {
+	cfg := walConfig(t.TempDir())
+	cfg.SegmentSize = 4096
+	cfg.MaxSize = 2 * cfg.SegmentSize
+	cfg.FullPolicy = store.WALFullFail
+	cfg.Sync = store.WALSyncNever
+	tsdb := testutil.NewMemTSDB()
+	tsdb.SetError(store.ErrBackendUnavailable)
+	w, err := store.NewWAL(cfg, tsdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	// Holds the writes between their check of the room and their append
+	failpoint.Enable(store.FailpointWALAppend, func() error {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	})
+	defer failpoint.Disable(store.FailpointWALAppend)
+
+	var wg sync.WaitGroup
+	var appended int32
+	start := make(chan struct{})
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			err := w.WriteMetrics(walMetric(i, 1024))
+			if err == nil {
+				atomic.AddInt32(&appended, 1)
+			} else if !errors.Is(err, store.ErrBackendUnavailable) {
+				t.Error(err)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	if s := w.Stats(); s.SizeBytes > cfg.MaxSize {
+		t.Fatalf("got %d bytes of %d metrics appended, want at most %d", s.SizeBytes, appended, cfg.MaxSize)
+	}
+	if appended == 0 || appended == 64 {
+		t.Fatalf("got %d metrics appended, want the wal to fill up", appended)
+	}
+}
+
+func TestWALFullPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// free writes the metrics of the full wal if set, unblocking the write.
+		free bool
+	}{
+		{name: "timeout"},
+		{name: "freed", free: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := testutil.NewFakeClock(time.Unix(1632700800, 0))
+			store.SetClock(clock)
+			defer store.SetClock(utils.RealClock)
+			cfg := walConfig(t.TempDir())
+			cfg.SegmentSize = 4096
+			cfg.MaxSize = 2 * cfg.SegmentSize
+			cfg.FullTimeout = time.Minute
+			cfg.RetryBackoff = time.Second
+			if !tt.free {
+				cfg.RetryBackoff = time.Hour
+			}
+			tsdb := testutil.NewMemTSDB()
+			tsdb.SetError(store.ErrBackendUnavailable)
+			w, err := store.NewWAL(cfg, tsdb)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+
+			// Appends until a write blocks, the one after the stop excluded
+			var stopped int32
+			written := make(chan error, 1)
+			go func() {
+				for i := 0; atomic.LoadInt32(&stopped) == 0; i++ {
+					if err := w.WriteMetrics(walMetric(i, 1024)); err != nil {
+						written <- err
+						return
+					}
+				}
+				written <- nil
+			}()
+			// The retry of the failed write and the timeout of the blocked one
+			clock.BlockUntil(2)
+			atomic.StoreInt32(&stopped, 1)
+
+			clock.Advance(time.Millisecond)
+			select {
+			case err := <-written:
+				t.Fatalf("got error %v of a write before the timeout", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			if tt.free {
+				tsdb.SetError(nil)
+				clock.Advance(cfg.RetryBackoff)
+				if err := <-written; err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			clock.Advance(cfg.FullTimeout)
+			if err := <-written; !errors.Is(err, store.ErrBackendUnavailable) || !strings.Contains(err.Error(), "wal is full") {
+				t.Fatalf("got error %v, want the wal full", err)
+			}
+		})
+	}
+}
+
+func TestWALDropsRejectedMetrics(t *testing.T) {
+	var posts int32
+	inner := store.NewHandlerWriter(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posts, 1)
+		http.Error(w, "cannot parse json line", http.StatusBadRequest)
+	})
+	cfg := walConfig(t.TempDir())
+	w, err := store.NewWAL(cfg, inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteMetrics(walMetric(0, 64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Not retried, on Close nor on the next run
+	if got := atomic.LoadInt32(&posts); got != 1 {
+		t.Fatalf("got %d posts of rejected metrics, want 1", got)
+	}
+	if got := replayWAL(t, cfg); got != 0 {
+		t.Fatalf("got %d rejected metrics replayed", got)
+	}
+}
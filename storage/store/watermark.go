@@ -0,0 +1,248 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/genjidb/genji"
+	"github.com/genjidb/genji/document"
+	"github.com/genjidb/genji/types"
+	"github.com/pingcap/log"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+var watermarkFlushInterval = pflag.Duration("store.watermark-flush-interval", 30*time.Second, "Interval between the persistences of the ingestion watermarks of the instances")
+
+// FreshnessItem is the ingestion watermark of an instance.
+type FreshnessItem struct {
+	Instance string `json:"instance"`
+	// LastSampleMillis is the newest timestamp written of the instance.
+	LastSampleMillis uint64 `json:"last_sample_ms"`
+	// LastWriteSecs is when a sample of the instance was last written, unix seconds.
+	LastWriteSecs int64 `json:"last_write_secs"`
+	// StaleSecs is the time since the last write.
+	StaleSecs float64 `json:"stale_secs"`
+}
+
+type watermark struct {
+	sampleMillis uint64
+	writtenAt    time.Time
+}
+
+// watermarks are the newest timestamps confirmed written per instance, only
+// advanced by the innermost writer once the timeseries db accepted them.
+var watermarks = &watermarkSet{marks: make(map[string]*watermark)}
+
+type watermarkSet struct {
+	mu    sync.Mutex
+	marks map[string]*watermark
+	dirty bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+var _ MetricWriter = &watermarkWriter{}
+
+// watermarkWriter advances the watermarks with the metrics inner wrote.
+type watermarkWriter struct {
+	inner MetricWriter
+}
+
+func (w *watermarkWriter) WriteMetrics(metrics []Metric) error {
+	return w.writeMetricsOf("", metrics)
+}
+
+func (w *watermarkWriter) writeMetricsOf(requestID string, metrics []Metric) error {
+	if err := writeMetricsOf(w.inner, requestID, metrics); err != nil {
+		return err
+	}
+	watermarks.advance(metrics, clock.Now())
+	return nil
+}
+
+// Close closes inner, which the wrapping writers close through this one.
+func (w *watermarkWriter) Close() error {
+	if closer, ok := w.inner.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *watermarkSet) advance(ms []Metric, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range ms {
+		instance := ms[i].Metric.Instance
+		if len(instance) == 0 || len(ms[i].Timestamps) == 0 {
+			continue
+		}
+		m, ok := s.marks[instance]
+		if !ok {
+			m = &watermark{}
+			s.marks[instance] = m
+			registerFreshnessGauge(instance)
+		}
+		for _, ts := range ms[i].Timestamps {
+			if ts > m.sampleMillis {
+				m.sampleMillis = ts
+			}
+		}
+		m.writtenAt = now
+		s.dirty = true
+	}
+}
+
+func registerFreshnessGauge(instance string) {
+	metrics.GetOrCreateGauge(fmt.Sprintf(`diag_store_seconds_since_last_write{instance=%q}`, instance), func() float64 {
+		watermarks.mu.Lock()
+		defer watermarks.mu.Unlock()
+		if m, ok := watermarks.marks[instance]; ok {
+			return clock.Now().Sub(m.writtenAt).Seconds()
+		}
+		return 0
+	})
+}
+
+// DataFreshness returns the watermarks of the instances ordered by instance.
+func DataFreshness() []FreshnessItem {
+	now := clock.Now()
+	watermarks.mu.Lock()
+	res := make([]FreshnessItem, 0, len(watermarks.marks))
+	for instance, m := range watermarks.marks {
+		res = append(res, FreshnessItem{
+			Instance:         instance,
+			LastSampleMillis: m.sampleMillis,
+			LastWriteSecs:    m.writtenAt.Unix(),
+			StaleSecs:        now.Sub(m.writtenAt).Seconds(),
+		})
+	}
+	watermarks.mu.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Instance < res[j].Instance
+	})
+	return res
+}
+
+// StaleInstances returns the number of instances not written for staleAfter.
+func StaleInstances(staleAfter time.Duration) int {
+	n := 0
+	for _, item := range DataFreshness() {
+		if item.StaleSecs > staleAfter.Seconds() {
+			n++
+		}
+	}
+	return n
+}
+
+// load reads the watermarks persisted, keeping the newer ones in memory.
+func (s *watermarkSet) load(db *genji.DB) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := db.Query("SELECT instance, sample_ms, written_at FROM watermark")
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	return res.Iterate(func(d types.Document) error {
+		var instance string
+		var sampleMillis uint64
+		var writtenAt int64
+		if err := document.Scan(d, &instance, &sampleMillis, &writtenAt); err != nil {
+			return err
+		}
+		if m, ok := s.marks[instance]; ok && m.sampleMillis >= sampleMillis {
+			return nil
+		}
+		if _, ok := s.marks[instance]; !ok {
+			registerFreshnessGauge(instance)
+		}
+		s.marks[instance] = &watermark{sampleMillis: sampleMillis, writtenAt: time.Unix(writtenAt, 0)}
+		return nil
+	})
+}
+
+// persist writes the watermarks to db if they advanced since the last time.
+func (s *watermarkSet) persist(db *genji.DB) error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	type row struct {
+		instance     string
+		sampleMillis uint64
+		writtenAt    int64
+	}
+	rows := make([]row, 0, len(s.marks))
+	for instance, m := range s.marks {
+		rows = append(rows, row{instance, m.sampleMillis, m.writtenAt.Unix()})
+	}
+	s.dirty = false
+	s.mu.Unlock()
+
+	err := db.Update(func(tx *genji.Tx) error {
+		if err := tx.Exec("DELETE FROM watermark"); err != nil {
+			return err
+		}
+		for _, r := range rows {
+			if err := tx.Exec("INSERT INTO watermark(instance, sample_ms, written_at) VALUES (?, ?, ?)", r.instance, r.sampleMillis, r.writtenAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func (s *watermarkSet) startPersist(db *genji.DB, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := clock.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				if err := s.persist(db); err != nil {
+					log.Warn("failed to persist the watermarks", zap.Error(err))
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopPersist stops the persistence and persists the watermarks a last time.
+func (s *watermarkSet) stopPersist(db *genji.DB) {
+	if s.stop != nil {
+		close(s.stop)
+		s.wg.Wait()
+		s.stop = nil
+	}
+	if db == nil {
+		return
+	}
+	if err := s.persist(db); err != nil {
+		log.Warn("failed to persist the watermarks", zap.Error(err))
+	}
+}
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/zhongzc/diag_backend/utils"
+	"github.com/zhongzc/diag_backend/utils/failpoint"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/spf13/pflag"
+)
+
+var userAgent = pflag.String("store.user-agent", utils.DefaultUserAgent(), "User-Agent of the import requests sent to the timeseries db")
+
+var (
+	splitImportsCounter   = metrics.NewCounter(`diag_store_split_imports_total`)
+	oversizedLinesCounter = metrics.NewCounter(`diag_store_oversized_import_lines_total`)
+)
+
+// MetricWriter is the destination of the metrics transformed from records.
+type MetricWriter interface {
+	WriteMetrics(metrics []Metric) error
+}
+
+// RequestIDHeader carries the request ID of the report an import is for.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDCtxKey struct{}
+
+// WithRequestID returns ctx carrying the request ID of the report written
+// with it, the Source.RequestID of the writes taking a ctx.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDCtxKey{}, requestID)
+}
+
+// RequestIDFrom returns the request ID of ctx, empty if none.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDCtxKey{}).(string)
+	return id
+}
+
+// requestWriter is a MetricWriter attaching the request ID the metrics were
+// reported with to the writes.
+type requestWriter interface {
+	writeMetricsOf(requestID string, metrics []Metric) error
+}
+
+// writeMetricsOf writes metrics with w on behalf of the request requestID, lost
+// unless w is a requestWriter, e.g. once queued by an AsyncWriter or the WAL.
+func writeMetricsOf(w MetricWriter, requestID string, metrics []Metric) error {
+	if rw, ok := w.(requestWriter); ok && len(requestID) != 0 {
+		return rw.writeMetricsOf(requestID, metrics)
+	}
+	return w.WriteMetrics(metrics)
+}
+
+var (
+	_ MetricWriter  = &handlerWriter{}
+	_ encodedWriter = &handlerWriter{}
+)
+
+// handlerWriter imports metrics through a VictoriaMetrics compatible `/api/v1/import` handler.
+type handlerWriter struct {
+	handler     http.HandlerFunc
+	readHandler http.HandlerFunc
+	cfg         HandlerWriterConfig
+}
+
+// HandlerWriterConfig enables the integrity checks of the writes, all off by default.
+type HandlerWriterConfig struct {
+	// Checksum sends the CRC32C of each payload in the ChecksumHeader.
+	Checksum bool
+	// VerifyRate is the fraction of the writes whose metrics are sampled and read
+	// back through ReadHandler, which serves `/api/v1/export`.
+	VerifyRate  float64
+	ReadHandler http.HandlerFunc
+	// VerifyDelay defers the read back of a sampled write, by when the
+	// timeseries db makes fresh samples searchable, so a series missing is
+	// one lost. Zero reads back within the write.
+	VerifyDelay time.Duration
+	// MaxBodySize is the max size in bytes of an import body, a larger one is
+	// split between metrics into several imports. Zero means no limit.
+	MaxBodySize int
+	// Delimiter follows each metric of an import body, "\n" if empty. It must
+	// not occur in the JSON of a metric, e.g. "\r\n".
+	Delimiter string
+	// OmitTrailingDelimiter leaves out the delimiter after the last metric of
+	// an import body.
+	OmitTrailingDelimiter bool
+	// LabelPolicy sanitizes the labels before encoding.
+	LabelPolicy LabelPolicy
+	// SortByInstance orders the metrics of an import by instance, then by
+	// series, grouping the series of each instance batched together.
+	SortByInstance bool
+}
+
+func NewHandlerWriter(handler http.HandlerFunc) MetricWriter {
+	return NewHandlerWriterWithConfig(handler, HandlerWriterConfig{})
+}
+
+func NewHandlerWriterWithConfig(handler http.HandlerFunc, cfg HandlerWriterConfig) MetricWriter {
+	if cfg.ReadHandler == nil {
+		cfg.VerifyRate = 0
+	}
+	if len(cfg.Delimiter) == 0 {
+		cfg.Delimiter = "\n"
+	}
+	return &handlerWriter{handler: handler, readHandler: cfg.ReadHandler, cfg: cfg}
+}
+
+func (w *handlerWriter) WriteMetrics(metrics []Metric) error {
+	return w.writeMetricsOf("", metrics)
+}
+
+func (w *handlerWriter) writeMetricsOf(requestID string, metrics []Metric) error {
+	bufReq := bytesP.Get()
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufReq)
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	metrics = sanitizeLabels(metrics, w.cfg.LabelPolicy)
+	if w.cfg.SortByInstance {
+		metrics = sortedByInstance(metrics)
+	}
+	if err := encodeMetricsDelimited(bufReq, metrics, w.cfg.Delimiter, w.cfg.OmitTrailingDelimiter); err != nil {
+		return err
+	}
+
+	if w.cfg.MaxBodySize > 0 && bufReq.Len() > w.cfg.MaxBodySize {
+		if err := w.postSplit(requestID, bufReq.Bytes(), bufResp, header); err != nil {
+			return err
+		}
+	} else if err := w.post(requestID, bufReq.Bytes(), bufResp, header); err != nil {
+		return err
+	}
+	if len(metrics) != 0 && sampled(w.cfg.VerifyRate) {
+		w.verifyLater(requestID, metrics)
+	}
+	return nil
+}
+
+func (w *handlerWriter) writeEncoded(requestID string, body []byte) error {
+	bufResp := bytesP.Get()
+	header := headerP.Get()
+
+	defer bytesP.Put(bufResp)
+	defer headerP.Put(header)
+
+	if w.cfg.MaxBodySize > 0 && len(body) > w.cfg.MaxBodySize {
+		return w.postSplit(requestID, body, bufResp, header)
+	}
+	return w.post(requestID, body, bufResp, header)
+}
+
+// postSplit imports payload in bodies of at most the max body size, cut
+// after the delimiters of the metrics. A metric over the limit is sent alone.
+func (w *handlerWriter) postSplit(requestID string, payload []byte, bufResp *bytes.Buffer, header http.Header) error {
+	splitImportsCounter.Inc()
+	delimiter := []byte(w.cfg.Delimiter)
+	for len(payload) != 0 {
+		end := 0
+		for end < len(payload) {
+			next := bytes.Index(payload[end:], delimiter) + len(delimiter)
+			if next < len(delimiter) {
+				next = len(payload) - end
+			}
+			if end != 0 && end+next > w.cfg.MaxBodySize {
+				break
+			}
+			end += next
+		}
+		if end > w.cfg.MaxBodySize {
+			oversizedLinesCounter.Inc()
+		}
+
+		bufResp.Reset()
+		for k := range header {
+			delete(header, k)
+		}
+		body := payload[:end]
+		if w.cfg.OmitTrailingDelimiter {
+			body = bytes.TrimSuffix(body, delimiter)
+		}
+		if err := w.post(requestID, body, bufResp, header); err != nil {
+			return err
+		}
+		payload = payload[end:]
+	}
+	return nil
+}
+
+// post sends an import body for the request requestID, if any, returning an
+// error if the backend fails or rejects it.
+func (w *handlerWriter) post(requestID string, body []byte, bufResp *bytes.Buffer, header http.Header) error {
+	if err := failpoint.Eval(FailpointHTTPPost); err != nil {
+		return err
+	}
+	respR := utils.NewRespWriter(bufResp, header)
+	req, err := http.NewRequest("POST", "/api/v1/import", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", *userAgent)
+	if len(requestID) != 0 {
+		req.Header.Set(RequestIDHeader, requestID)
+	}
+	if w.cfg.Checksum {
+		req.Header.Set(ChecksumHeader, payloadChecksum(body))
+	}
+	w.handler(&respR, req)
+
+	if statusOK := respR.Code >= 200 && respR.Code < 300; !statusOK {
+		switch {
+		case respR.Code == http.StatusTooManyRequests:
+			return fmt.Errorf("%w: timeseries db, code: %d, error: %s", ErrRateLimited, respR.Code, respR.Body.String())
+		case respR.Code >= 500:
+			return fmt.Errorf("%w: timeseries db, code: %d, error: %s", ErrBackendUnavailable, respR.Code, respR.Body.String())
+		}
+		// Rejected metrics fail the same way when retried
+		return fmt.Errorf("%w: timeseries db, code: %d, error: %s", ErrInvalidMetric, respR.Code, respR.Body.String())
+	}
+	return nil
+}
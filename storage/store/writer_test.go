@@ -0,0 +1,41 @@
+package store_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+func TestHandlerWriterFailsRejectedMetrics(t *testing.T) {
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	store.Init(store.NewHandlerWriter(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "cannot parse json line", http.StatusBadRequest)
+	}), db, nil)
+	defer store.Stop()
+
+	record := cpuTimeRecord(1632700800, 35)
+	record.Instance = "tidb-rejected:10080"
+	err = store.TopSQLRecords([]*tipb.CPUTimeRecord{record})
+	if !errors.Is(err, store.ErrInvalidMetric) {
+		t.Fatalf("got error %v, want %v", err, store.ErrInvalidMetric)
+	}
+	if store.IsRetryable(err) {
+		t.Fatalf("rejected metrics are retryable: %v", err)
+	}
+
+	// The watermark of the instance never advanced
+	for _, item := range store.DataFreshness() {
+		if item.Instance == record.Instance {
+			t.Fatalf("got watermark %+v of rejected metrics", item)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+var _ MetricWriter = &WriterSink{}
+
+// WriterSink writes the NDJSON encoded metrics to an io.Writer, e.g. stdout
+// to inspect them or a buffer to compare against golden files. The metrics of
+// a write are written in a single call, so concurrent writes do not interleave.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) WriteMetrics(metrics []Metric) error {
+	buf := bytesP.Get()
+	defer bytesP.Put(buf)
+
+	if err := encodeMetrics(buf, metrics); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.w == nil {
+		return fmt.Errorf("%w: writer sink is closed", ErrClosed)
+	}
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// Close closes the writer if it is an io.Closer, and fails the later writes.
+func (s *WriterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w := s.w
+	s.w = nil
+	if closer, ok := w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
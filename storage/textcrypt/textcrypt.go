@@ -0,0 +1,183 @@
+// Package textcrypt encrypts the SQL and plan texts at rest with AES-GCM.
+package textcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+var keyringEnv = pflag.String("storage.text-keyring-env", "", "Environment variable holding the keyring encrypting SQL and plan texts at rest, id:base64key[,id:base64key...] with the active key first and 16, 24 or 32 byte keys. Empty stores the texts in plain")
+
+// prefix marks the encrypted texts, followed by the key id, ':' and the base64 nonce and ciphertext.
+const prefix = "enc:v1:"
+
+var (
+	// ErrSearchEncrypted is returned by searches over the texts, which only match digests once encrypted.
+	ErrSearchEncrypted = errors.New("texts are encrypted at rest, so searching them is unsupported, look up SQLs by digest instead")
+	ErrUnknownKey      = errors.New("unknown key")
+)
+
+// Keyring holds the keys by id. Texts are encrypted with the active one and
+// decrypted with the one they name.
+type Keyring struct {
+	active string
+	aeads  map[string]cipher.AEAD
+}
+
+func NewKeyring(keys map[string][]byte, active string) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("%w: active key %q", ErrUnknownKey, active)
+	}
+
+	k := &Keyring{active: active, aeads: make(map[string]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if len(id) == 0 || strings.ContainsAny(id, ":,") {
+			return nil, fmt.Errorf("invalid key id %q, expect a non-empty id without ':' and ','", id)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// ParseKeyring parses id:base64key[,id:base64key...], the first key being the active one.
+func ParseKeyring(s string) (*Keyring, error) {
+	keys := make(map[string][]byte)
+	var active string
+	for i, entry := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid keyring entry %d, expect id:base64key", i)
+		}
+		key, err := base64.StdEncoding.DecodeString(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", kv[0], err)
+		}
+		if _, ok := keys[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", kv[0])
+		}
+		keys[kv[0]] = key
+		if i == 0 {
+			active = kv[0]
+		}
+	}
+	return NewKeyring(keys, active)
+}
+
+var keyring *Keyring
+
+// Init sets the keyring, nil for plain texts. It must be called before the
+// texts are read or written.
+func Init(k *Keyring) {
+	keyring = k
+}
+
+// InitFromFlags sets the keyring from the environment variable named by --storage.text-keyring-env.
+func InitFromFlags() error {
+	return InitFromEnv(*keyringEnv)
+}
+
+// InitFromEnv sets the keyring from the environment variable name, plain texts if name is empty.
+func InitFromEnv(name string) error {
+	if len(name) == 0 {
+		Init(nil)
+		return nil
+	}
+	raw := os.Getenv(name)
+	if len(raw) == 0 {
+		return fmt.Errorf("the keyring environment variable %s is empty", name)
+	}
+	k, err := ParseKeyring(raw)
+	if err != nil {
+		return err
+	}
+	Init(k)
+	return nil
+}
+
+func Enabled() bool {
+	return keyring != nil
+}
+
+// Encrypt encrypts text of the row of digest with the active key, returning
+// text as is if encryption is off. The digest is authenticated, so a text
+// copied to another row fails to decrypt.
+func Encrypt(text, digest string) (string, error) {
+	if keyring == nil {
+		return text, nil
+	}
+
+	aead := keyring.aeads[keyring.active]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(text)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(text), []byte(digest))
+	return prefix + keyring.active + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverts Encrypt. Texts stored in plain are returned as is.
+func Decrypt(stored, digest string) (string, error) {
+	if !strings.HasPrefix(stored, prefix) {
+		return stored, nil
+	}
+
+	id, sealed, err := split(stored)
+	if err != nil {
+		return "", err
+	}
+	if keyring == nil {
+		return "", fmt.Errorf("%w %q, the text is encrypted but no keyring is set", ErrUnknownKey, id)
+	}
+	aead, ok := keyring.aeads[id]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownKey, id)
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted text")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	text, err := aead.Open(nil, nonce, ciphertext, []byte(digest))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt with key %q: %w", id, err)
+	}
+	return string(text), nil
+}
+
+// IsCurrent tells whether stored is encrypted as Encrypt would now, i.e. with
+// the active key, or in plain if encryption is off.
+func IsCurrent(stored string) bool {
+	if !strings.HasPrefix(stored, prefix) {
+		return keyring == nil
+	}
+	id, _, err := split(stored)
+	return err == nil && keyring != nil && id == keyring.active
+}
+
+func split(stored string) (string, []byte, error) {
+	rest := strings.TrimPrefix(stored, prefix)
+	i := strings.IndexByte(rest, ':')
+	if i <= 0 {
+		return "", nil, errors.New("malformed encrypted text")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(rest[i+1:])
+	if err != nil {
+		return "", nil, fmt.Errorf("malformed encrypted text: %w", err)
+	}
+	return rest[:i], sealed, nil
+}
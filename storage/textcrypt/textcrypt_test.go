@@ -0,0 +1,150 @@
+package textcrypt_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/zhongzc/diag_backend/storage/textcrypt"
+)
+
+var (
+	key1 = []byte("0123456789abcdef")
+	key2 = []byte("fedcba9876543210fedcba9876543210")
+)
+
+func initKeyring(t *testing.T, keys map[string][]byte, active string) {
+	t.Helper()
+	k, err := textcrypt.NewKeyring(keys, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	textcrypt.Init(k)
+	t.Cleanup(func() { textcrypt.Init(nil) })
+}
+
+func TestRoundTrip(t *testing.T) {
+	initKeyring(t, map[string][]byte{"k1": key1}, "k1")
+	const text = "select * from t where id = ?"
+
+	stored, err := textcrypt.Encrypt(text, "5e4c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "enc:v1:k1:") || strings.Contains(stored, "select") {
+		t.Fatalf("got stored text %q, want it encrypted with k1", stored)
+	}
+	if !textcrypt.IsCurrent(stored) {
+		t.Fatalf("got %q not current", stored)
+	}
+	// Nonces are random, the same text is stored differently
+	if again, _ := textcrypt.Encrypt(text, "5e4c"); again == stored {
+		t.Fatal("got the same ciphertext twice")
+	}
+	if got, err := textcrypt.Decrypt(stored, "5e4c"); err != nil || got != text {
+		t.Fatalf("got text %q, error %v", got, err)
+	}
+	// The digest is authenticated
+	if _, err := textcrypt.Decrypt(stored, "a10b"); err == nil {
+		t.Fatal("got a text copied to another digest decrypted")
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	initKeyring(t, map[string][]byte{"k1": key1}, "k1")
+	stored, err := textcrypt.Encrypt("select 1", "5e4c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another key under the same id
+	initKeyring(t, map[string][]byte{"k1": key2}, "k1")
+	if _, err := textcrypt.Decrypt(stored, "5e4c"); err == nil || !strings.Contains(err.Error(), `key "k1"`) {
+		t.Fatalf("got error %v, want the decryption failed", err)
+	}
+
+	// A key missing in the keyring
+	initKeyring(t, map[string][]byte{"k2": key2}, "k2")
+	if _, err := textcrypt.Decrypt(stored, "5e4c"); !errors.Is(err, textcrypt.ErrUnknownKey) {
+		t.Fatalf("got error %v, want ErrUnknownKey", err)
+	}
+
+	// No keyring
+	textcrypt.Init(nil)
+	if _, err := textcrypt.Decrypt(stored, "5e4c"); !errors.Is(err, textcrypt.ErrUnknownKey) {
+		t.Fatalf("got error %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestPlainTexts(t *testing.T) {
+	// Stored as is without a keyring
+	textcrypt.Init(nil)
+	stored, err := textcrypt.Encrypt("select 1", "5e4c")
+	if err != nil || stored != "select 1" {
+		t.Fatalf("got stored text %q, error %v", stored, err)
+	}
+	if !textcrypt.IsCurrent(stored) {
+		t.Fatal("got a plain text not current without a keyring")
+	}
+
+	// The rows of before the keyring are read as is, and stale
+	initKeyring(t, map[string][]byte{"k1": key1}, "k1")
+	if got, err := textcrypt.Decrypt(stored, "5e4c"); err != nil || got != "select 1" {
+		t.Fatalf("got text %q, error %v", got, err)
+	}
+	if textcrypt.IsCurrent(stored) {
+		t.Fatal("got a plain text current with a keyring")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	initKeyring(t, map[string][]byte{"k1": key1}, "k1")
+	old, err := textcrypt.Encrypt("select 1", "5e4c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// k2 active, k1 kept to decrypt the texts of before
+	initKeyring(t, map[string][]byte{"k1": key1, "k2": key2}, "k2")
+	if textcrypt.IsCurrent(old) {
+		t.Fatal("got a text of the previous key current")
+	}
+	if got, err := textcrypt.Decrypt(old, "5e4c"); err != nil || got != "select 1" {
+		t.Fatalf("got text %q, error %v", got, err)
+	}
+	stored, err := textcrypt.Encrypt("select 1", "5e4c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "enc:v1:k2:") || !textcrypt.IsCurrent(stored) {
+		t.Fatalf("got stored text %q, want it encrypted with k2", stored)
+	}
+}
+
+func TestParseKeyring(t *testing.T) {
+	b64 := base64.StdEncoding.EncodeToString
+	k, err := textcrypt.ParseKeyring("k2:" + b64(key2) + ", k1:" + b64(key1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	textcrypt.Init(k)
+	defer textcrypt.Init(nil)
+	// The first key is the active one
+	stored, err := textcrypt.Encrypt("select 1", "5e4c")
+	if err != nil || !strings.HasPrefix(stored, "enc:v1:k2:") {
+		t.Fatalf("got stored text %q, error %v", stored, err)
+	}
+
+	for _, raw := range []string{
+		"k1",
+		"k1:not base64",
+		"k1:" + b64([]byte("short")),
+		"k1:" + b64(key1) + ",k1:" + b64(key2),
+		":" + b64(key1),
+	} {
+		if _, err := textcrypt.ParseKeyring(raw); err == nil {
+			t.Errorf("got no error of keyring %q", raw)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package utils
+
+import "math"
+
+// AddSaturating returns a+b, or the max uint64 if the sum overflows.
+func AddSaturating(a, b uint64) uint64 {
+	if sum := a + b; sum >= a {
+		return sum
+	}
+	return math.MaxUint64
+}
+
+// AddCounter returns the counter total advanced by delta. A total overflowing
+// restarts from delta instead, which backends read as a counter reset.
+func AddCounter(total, delta uint64) uint64 {
+	if sum := total + delta; sum >= total {
+		return sum
+	}
+	return delta
+}
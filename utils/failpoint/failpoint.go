@@ -0,0 +1,54 @@
+// Package failpoint injects errors at named points of the code, so tests can
+// make the boundaries with the outside fail deterministically. A disabled
+// point costs an atomic load.
+package failpoint
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	// enabled is the number of points enabled, for the fast path of Eval.
+	enabled int32
+
+	mu     sync.RWMutex
+	points = make(map[string]func() error)
+)
+
+// Enable makes Eval of name return what fn returns, replacing the previous fn.
+func Enable(name string, fn func() error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := points[name]; !ok {
+		atomic.AddInt32(&enabled, 1)
+	}
+	points[name] = fn
+}
+
+// Disable makes Eval of name return nil again.
+func Disable(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := points[name]; ok {
+		atomic.AddInt32(&enabled, -1)
+		delete(points, name)
+	}
+}
+
+// Eval returns the error injected at name, nil if not enabled.
+func Eval(name string) error {
+	if atomic.LoadInt32(&enabled) == 0 {
+		return nil
+	}
+
+	mu.RLock()
+	fn := points[name]
+	mu.RUnlock()
+	if fn == nil {
+		return nil
+	}
+	return fn()
+}
@@ -4,25 +4,56 @@ import (
 	"bytes"
 	"net/http"
 	"sync"
+	"sync/atomic"
 )
 
+// PoolStats counts the usage of a pool since start.
+type PoolStats struct {
+	Gets   uint64 `json:"gets"`
+	Allocs uint64 `json:"allocs"`
+	Puts   uint64 `json:"puts"`
+	// MaxCap is the largest capacity of the buffers put back.
+	MaxCap int64 `json:"max_cap"`
+}
+
 type BytesBufferPool struct {
-	p sync.Pool
+	// first for the 64-bit alignment of the atomics
+	stats PoolStats
+	p     sync.Pool
 }
 
 func (bbp *BytesBufferPool) Get() *bytes.Buffer {
+	atomic.AddUint64(&bbp.stats.Gets, 1)
 	bbv := bbp.p.Get()
 	if bbv == nil {
+		atomic.AddUint64(&bbp.stats.Allocs, 1)
 		return &bytes.Buffer{}
 	}
 	return bbv.(*bytes.Buffer)
 }
 
 func (bbp *BytesBufferPool) Put(bb *bytes.Buffer) {
+	atomic.AddUint64(&bbp.stats.Puts, 1)
+	for c := int64(bb.Cap()); ; {
+		max := atomic.LoadInt64(&bbp.stats.MaxCap)
+		if c <= max || atomic.CompareAndSwapInt64(&bbp.stats.MaxCap, max, c) {
+			break
+		}
+	}
 	bb.Reset()
 	bbp.p.Put(bb)
 }
 
+// Stats returns the usage of the pool. Gets minus puts is the number of buffers in use.
+func (bbp *BytesBufferPool) Stats() PoolStats {
+	return PoolStats{
+		Gets:   atomic.LoadUint64(&bbp.stats.Gets),
+		Allocs: atomic.LoadUint64(&bbp.stats.Allocs),
+		Puts:   atomic.LoadUint64(&bbp.stats.Puts),
+		MaxCap: atomic.LoadInt64(&bbp.stats.MaxCap),
+	}
+}
+
 type HeaderPool struct {
 	p sync.Pool
 }
@@ -0,0 +1,165 @@
+// Package testutil holds the doubles of the tests of the other packages.
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zhongzc/diag_backend/utils"
+)
+
+var _ utils.Clock = &FakeClock{}
+
+// FakeClock is a utils.Clock moved by hand. Its timers and tickers fire within
+// Advance, in the order of their deadlines, and like the real ones drop a tick
+// not received yet.
+type FakeClock struct {
+	mu      sync.Mutex
+	changed *sync.Cond
+	now     time.Time
+	// waiters are the armed timers and tickers.
+	waiters []*fakeTimer
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) utils.Timer {
+	return c.arm(d, 0)
+}
+
+func (c *FakeClock) NewTicker(d time.Duration) utils.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	return fakeTicker{c.arm(d, d)}
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	target := c.now.Add(d)
+	for {
+		next := c.nextLocked()
+		if next == nil || next.deadline.After(target) {
+			break
+		}
+		c.now = next.deadline
+		select {
+		case next.ch <- c.now:
+		default:
+		}
+		if next.period > 0 {
+			next.deadline = next.deadline.Add(next.period)
+		} else {
+			c.removeLocked(next)
+		}
+	}
+	c.now = target
+	c.changed.Broadcast()
+}
+
+// BlockUntil waits until n timers and tickers are armed, so a test advances
+// the clock only once the goroutine under test waits on it.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.waiters) < n {
+		c.changed.Wait()
+	}
+}
+
+// Waiters returns the number of armed timers and tickers.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters)
+}
+
+func (c *FakeClock) arm(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &fakeTimer{clock: c, ch: make(chan time.Time, 1), deadline: c.now.Add(d), period: period}
+	c.waiters = append(c.waiters, t)
+	c.changed.Broadcast()
+	return t
+}
+
+// nextLocked returns the waiter of the earliest deadline, the first armed of
+// equal ones.
+func (c *FakeClock) nextLocked() *fakeTimer {
+	var next *fakeTimer
+	for _, t := range c.waiters {
+		if next == nil || t.deadline.Before(next.deadline) {
+			next = t
+		}
+	}
+	return next
+}
+
+func (c *FakeClock) removeLocked(t *fakeTimer) bool {
+	for i, w := range c.waiters {
+		if w == t {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			c.changed.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+type fakeTimer struct {
+	clock    *FakeClock
+	ch       chan time.Time
+	deadline time.Time
+	// period is the interval of a ticker, zero for a timer.
+	period time.Duration
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+// Stop disarms t, telling whether it was armed. The tick sent already stays.
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+
+	return t.clock.removeLocked(t)
+}
+
+// Reset rearms t to fire after d, telling whether it was armed.
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	c := t.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	armed := c.removeLocked(t)
+	t.deadline = c.now.Add(d)
+	c.waiters = append(c.waiters, t)
+	c.changed.Broadcast()
+	return armed
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
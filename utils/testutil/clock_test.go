@@ -0,0 +1,141 @@
+package testutil
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+var clockStart = time.Unix(1632700800, 0)
+
+// received returns the tick sent to c, failing if none.
+func received(t *testing.T, c <-chan time.Time) time.Time {
+	t.Helper()
+	select {
+	case tick := <-c:
+		return tick
+	default:
+		t.Fatal("no tick sent")
+		return time.Time{}
+	}
+}
+
+func notReceived(t *testing.T, c <-chan time.Time) {
+	t.Helper()
+	select {
+	case tick := <-c:
+		t.Fatalf("got tick %s", tick)
+	default:
+	}
+}
+
+func TestFakeClockAdvanceFiresInOrder(t *testing.T) {
+	c := NewFakeClock(clockStart)
+	late := c.NewTimer(3 * time.Second)
+	early := c.NewTimer(time.Second)
+	ticker := c.NewTicker(2 * time.Second)
+
+	c.Advance(999 * time.Millisecond)
+	notReceived(t, early.C())
+	c.Advance(time.Millisecond)
+	// Sent the time of its deadline
+	if got := received(t, early.C()); !got.Equal(clockStart.Add(time.Second)) {
+		t.Fatalf("got tick %s of the timer of 1s", got)
+	}
+
+	c.Advance(5 * time.Second)
+	if got := received(t, late.C()); !got.Equal(clockStart.Add(3 * time.Second)) {
+		t.Fatalf("got tick %s of the timer of 3s", got)
+	}
+	// The ticks of 4s and 6s are dropped, the one of 2s not received yet
+	if got := received(t, ticker.C()); !got.Equal(clockStart.Add(2 * time.Second)) {
+		t.Fatalf("got tick %s of the ticker", got)
+	}
+	notReceived(t, ticker.C())
+	if got := c.Now(); !got.Equal(clockStart.Add(6 * time.Second)) {
+		t.Fatalf("got now %s", got)
+	}
+	// The fired timers are disarmed, the ticker stays
+	if got := c.Waiters(); got != 1 {
+		t.Fatalf("got %d waiters, want 1", got)
+	}
+
+	c.Advance(2 * time.Second)
+	if got := received(t, ticker.C()); !got.Equal(clockStart.Add(8 * time.Second)) {
+		t.Fatalf("got tick %s of the ticker", got)
+	}
+}
+
+func TestFakeClockStop(t *testing.T) {
+	c := NewFakeClock(clockStart)
+	timer := c.NewTimer(time.Second)
+	ticker := c.NewTicker(time.Second)
+
+	if !timer.Stop() {
+		t.Fatal("armed timer not stopped")
+	}
+	if timer.Stop() {
+		t.Fatal("stopped timer stopped again")
+	}
+	ticker.Stop()
+	c.Advance(time.Minute)
+	notReceived(t, timer.C())
+	notReceived(t, ticker.C())
+	if got := c.Waiters(); got != 0 {
+		t.Fatalf("got %d waiters, want 0", got)
+	}
+
+	// Rearmed relative to now
+	if timer.Reset(time.Second) {
+		t.Fatal("stopped timer reported armed")
+	}
+	c.Advance(time.Second)
+	if got := received(t, timer.C()); !got.Equal(clockStart.Add(time.Minute + time.Second)) {
+		t.Fatalf("got tick %s of the reset timer", got)
+	}
+	if timer.Stop() {
+		t.Fatal("fired timer stopped")
+	}
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	c := NewFakeClock(clockStart)
+	fired := make(chan time.Time)
+	go func() {
+		timer := c.NewTimer(time.Second)
+		fired <- <-timer.C()
+	}()
+
+	c.BlockUntil(1)
+	c.Advance(time.Second)
+	if got := <-fired; !got.Equal(clockStart.Add(time.Second)) {
+		t.Fatalf("got tick %s", got)
+	}
+}
+
+func TestFakeClockConcurrentNow(t *testing.T) {
+	c := NewFakeClock(clockStart)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			last := c.Now()
+			for j := 0; j < 1000; j++ {
+				now := c.Now()
+				if now.Before(last) {
+					t.Errorf("got now %s after %s", now, last)
+					return
+				}
+				last = now
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		c.Advance(time.Millisecond)
+	}
+	wg.Wait()
+	if got := c.Now(); !got.Equal(clockStart.Add(time.Second)) {
+		t.Fatalf("got now %s", got)
+	}
+}
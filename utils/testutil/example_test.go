@@ -0,0 +1,57 @@
+package testutil_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zhongzc/diag_backend/storage/query"
+	"github.com/zhongzc/diag_backend/storage/store"
+	"github.com/zhongzc/diag_backend/utils/testutil"
+
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// The store and the query module run in memory, from the reported records to
+// the top SQLs.
+func ExampleNewMemStore() {
+	s, err := testutil.NewMemStore()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	if err := s.SeedSQLMeta([]byte{0x5e, 0x4c}, "select * from t where id = ?"); err != nil {
+		panic(err)
+	}
+	if err := s.SeedPlanMeta([]byte{0xa1, 0x0b}, "Point_Get"); err != nil {
+		panic(err)
+	}
+	err = store.TopSQLRecords([]*tipb.CPUTimeRecord{{
+		SqlDigest:              []byte{0x5e, 0x4c},
+		PlanDigest:             []byte{0xa1, 0x0b},
+		Instance:               "tidb-0:10080",
+		Job:                    "tidb",
+		RecordListTimestampSec: []uint64{1632700800, 1632700801},
+		RecordListCpuTimeMs:    []uint32{35, 15},
+	}})
+	if err != nil {
+		panic(err)
+	}
+
+	var items []query.TopSQLItem
+	total, err := query.TopSQL(context.Background(), 1632700800, 1632700860, 60, 10, "tidb-0:10080", &items)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("total:", total)
+	for _, item := range items {
+		fmt.Printf("%s %q: %d ms\n", item.SQLDigest, item.SQLText, item.CPUTimeMillis)
+		for _, plan := range item.Plans {
+			fmt.Printf("  %s %q\n", plan.PlanDigest, plan.PlanText)
+		}
+	}
+	// Output:
+	// total: 50
+	// 5e4c "select * from t where id = ?": 50 ms
+	//   a10b "Point_Get"
+}
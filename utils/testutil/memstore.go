@@ -0,0 +1,51 @@
+package testutil
+
+import (
+	"github.com/zhongzc/diag_backend/storage/query"
+	"github.com/zhongzc/diag_backend/storage/store"
+
+	"github.com/genjidb/genji"
+	"github.com/pingcap/tipb/go-tipb"
+)
+
+// MemStore is the store and the query module initialized on a MemTSDB and an
+// in-memory document database as meta store, as both are package-level only
+// one MemStore works at a time.
+type MemStore struct {
+	TSDB *MemTSDB
+	DB   *genji.DB
+}
+
+// NewMemStore initializes the store and the query module in memory, with the
+// store config of the flags.
+func NewMemStore() (*MemStore, error) {
+	db, err := genji.Open(":memory:")
+	if err != nil {
+		return nil, err
+	}
+	tsdb := NewMemTSDB()
+	store.Init(tsdb, db, nil)
+	query.Init(tsdb.QueryHandler(), db)
+	return &MemStore{TSDB: tsdb, DB: db}, nil
+}
+
+// Close stops the store and closes the document database.
+func (s *MemStore) Close() error {
+	store.Stop()
+	return s.DB.Close()
+}
+
+// SeedInstance registers instance of job as reporting.
+func (s *MemStore) SeedInstance(instance, job string) error {
+	return store.TopSQLRecords([]*tipb.CPUTimeRecord{{Instance: instance, Job: job}})
+}
+
+// SeedSQLMeta stores the normalized sql of digest.
+func (s *MemStore) SeedSQLMeta(digest []byte, normalizedSQL string) error {
+	return store.SQLMetas([]*tipb.SQLMeta{{SqlDigest: digest, NormalizedSql: normalizedSQL}})
+}
+
+// SeedPlanMeta stores the normalized plan of digest.
+func (s *MemStore) SeedPlanMeta(digest []byte, normalizedPlan string) error {
+	return store.PlanMetas([]*tipb.PlanMeta{{PlanDigest: digest, NormalizedPlan: normalizedPlan}})
+}
@@ -0,0 +1,39 @@
+package testutil
+
+// The TopSQL records of one SQL, encoded after the protos of the agents: the
+// same two samples at 1632700800 and 1632700801, of 35ms and 120ms, with the
+// sql digest 5e4c3a1f079b228d and the plan digest a10b6c22.
+
+// ListsRecord is a tipb.CPUTimeRecord of the agent of this repo, of instance
+// tidb-0:10080 and job tidb, with a third 0ms sample at 1632700802.
+var ListsRecord = []byte{
+	0x0a, 0x08, 0x5e, 0x4c, 0x3a, 0x1f, 0x07, 0x9b, 0x22, 0x8d, 0x12, 0x04,
+	0xa1, 0x0b, 0x6c, 0x22, 0x1a, 0x0c, 0x74, 0x69, 0x64, 0x62, 0x2d, 0x30,
+	0x3a, 0x31, 0x30, 0x30, 0x38, 0x30, 0x22, 0x04, 0x74, 0x69, 0x64, 0x62,
+	0x52, 0x0f, 0x80, 0x93, 0xc4, 0x8a, 0x06, 0x81, 0x93, 0xc4, 0x8a, 0x06,
+	0x82, 0x93, 0xc4, 0x8a, 0x06, 0x5a, 0x03, 0x23, 0x00, 0x78,
+}
+
+// ItemsRecord is a TopSQLRecord of TiDB 5.3, an item per sample having the
+// statement counts and durations, executed 2 and 5 times on tikv-0:20160.
+var ItemsRecord = []byte{
+	0x0a, 0x08, 0x5e, 0x4c, 0x3a, 0x1f, 0x07, 0x9b, 0x22, 0x8d, 0x12, 0x04,
+	0xa1, 0x0b, 0x6c, 0x22, 0x1a, 0x23, 0x08, 0x80, 0x93, 0xc4, 0x8a, 0x06,
+	0x10, 0x23, 0x18, 0x02, 0x22, 0x10, 0x0a, 0x0c, 0x74, 0x69, 0x6b, 0x76,
+	0x2d, 0x30, 0x3a, 0x32, 0x30, 0x31, 0x36, 0x30, 0x10, 0x02, 0x28, 0xc0,
+	0x8d, 0xb7, 0x01, 0x30, 0x02, 0x1a, 0x23, 0x08, 0x81, 0x93, 0xc4, 0x8a,
+	0x06, 0x10, 0x78, 0x18, 0x05, 0x22, 0x10, 0x0a, 0x0c, 0x74, 0x69, 0x6b,
+	0x76, 0x2d, 0x30, 0x3a, 0x32, 0x30, 0x31, 0x36, 0x30, 0x10, 0x05, 0x28,
+	0xe0, 0xe1, 0xc9, 0x03, 0x30, 0x05,
+}
+
+// FutureItemsRecord is ItemsRecord of the first sample only, with two fields
+// unknown to TiDB 5.3: a field 7 of the item and the keyspace of the record,
+// field 4.
+var FutureItemsRecord = []byte{
+	0x0a, 0x08, 0x5e, 0x4c, 0x3a, 0x1f, 0x07, 0x9b, 0x22, 0x8d, 0x12, 0x04,
+	0xa1, 0x0b, 0x6c, 0x22, 0x1a, 0x25, 0x08, 0x80, 0x93, 0xc4, 0x8a, 0x06,
+	0x10, 0x23, 0x18, 0x02, 0x22, 0x10, 0x0a, 0x0c, 0x74, 0x69, 0x6b, 0x76,
+	0x2d, 0x30, 0x3a, 0x32, 0x30, 0x31, 0x36, 0x30, 0x10, 0x02, 0x28, 0xc0,
+	0x8d, 0xb7, 0x01, 0x30, 0x02, 0x38, 0x03, 0x22, 0x03, 0x6b, 0x73, 0x31,
+}
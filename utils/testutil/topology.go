@@ -0,0 +1,55 @@
+package testutil
+
+import (
+	"context"
+	"sync"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+)
+
+var _ store.TopologyProvider = &FakeTopology{}
+
+// FakeTopology is a store.TopologyProvider listing the nodes set by hand, or
+// failing with the error set.
+type FakeTopology struct {
+	mu    sync.Mutex
+	nodes []store.TopologyNode
+	err   error
+	calls int
+}
+
+// Set makes the topology list nodes.
+func (t *FakeTopology) Set(nodes ...store.TopologyNode) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nodes = append([]store.TopologyNode(nil), nodes...)
+	t.err = nil
+}
+
+// Fail makes the topology fail to list with err.
+func (t *FakeTopology) Fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.err = err
+}
+
+// Calls returns the number of times the topology was listed.
+func (t *FakeTopology) Calls() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.calls
+}
+
+func (t *FakeTopology) Topology(ctx context.Context) ([]store.TopologyNode, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.calls++
+	if t.err != nil {
+		return nil, t.err
+	}
+	return append([]store.TopologyNode(nil), t.nodes...), nil
+}
@@ -0,0 +1,681 @@
+package testutil
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zhongzc/diag_backend/storage/store"
+)
+
+// lookbackMillis is how far back an instant selector looks for a sample, as
+// the default of VictoriaMetrics.
+const lookbackMillis = 5 * 60 * 1000
+
+var _ store.MetricWriter = &MemTSDB{}
+
+// MemTSDB is an in-memory timeseries db recording the metrics written to it.
+// QueryHandler answers the subset of PromQL the query module sends: optionally
+// summed selectors, optionally by labels, over sum_over_time, count_over_time
+// or max_over_time and an instant selector.
+type MemTSDB struct {
+	mu     sync.Mutex
+	series map[string]*memSeries
+	// err fails the writes if set.
+	err error
+	// dropping acknowledges the writes without recording them.
+	dropping bool
+}
+
+// Sample is a sample of a series, its timestamp in milliseconds.
+type Sample struct {
+	TimestampMs uint64
+	Value       float64
+}
+
+// Series is a series written and its samples ordered by timestamp.
+type Series struct {
+	Labels  map[string]string
+	Samples []Sample
+}
+
+type memSeries struct {
+	labels  map[string]string
+	samples []Sample
+}
+
+func NewMemTSDB() *MemTSDB {
+	return &MemTSDB{series: make(map[string]*memSeries)}
+}
+
+// WriteMetrics records metrics, the later sample winning on equal timestamps.
+func (m *MemTSDB) WriteMetrics(metrics []store.Metric) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.err != nil {
+		return m.err
+	}
+	for i := range metrics {
+		metric := &metrics[i]
+		values := make([]float64, 0, len(metric.Values))
+		for _, v := range metric.Values {
+			values = append(values, float64(v))
+		}
+		m.write(metricLabels(metric), metric.Timestamps, values)
+	}
+	return nil
+}
+
+func (m *MemTSDB) write(labels map[string]string, timestamps []uint64, values []float64) {
+	if m.dropping || len(timestamps) == 0 {
+		return
+	}
+	key := seriesKey(labels)
+	s, ok := m.series[key]
+	if !ok {
+		s = &memSeries{labels: labels}
+		m.series[key] = s
+	}
+	for j, ts := range timestamps {
+		if j < len(values) {
+			s.add(Sample{TimestampMs: ts, Value: values[j]})
+		}
+	}
+}
+
+// SetError makes the writes fail with err, or succeed again if nil.
+func (m *MemTSDB) SetError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.err = err
+}
+
+// SetDropping makes the writes succeed without recording the metrics, as a
+// timeseries db losing data, or record them again if false.
+func (m *MemTSDB) SetDropping(dropping bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dropping = dropping
+}
+
+// Reset forgets all series.
+func (m *MemTSDB) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.series = make(map[string]*memSeries)
+}
+
+// Series returns the series matching selector, e.g. `cpu_time{instance="a"}`,
+// ordered by their labels.
+func (m *MemTSDB) Series(selector string) ([]Series, error) {
+	sel, err := parseSelector(selector)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var res []Series
+	for _, key := range m.sortedKeys() {
+		s := m.series[key]
+		if sel.matches(s.labels) {
+			res = append(res, Series{Labels: copyLabels(s.labels), Samples: append([]Sample(nil), s.samples...)})
+		}
+	}
+	return res, nil
+}
+
+// AssertSamples fails t unless the series matching selector have the samples
+// want in total, compared ordered by timestamp.
+func (m *MemTSDB) AssertSamples(t testing.TB, selector string, want ...Sample) {
+	t.Helper()
+
+	series, err := m.Series(selector)
+	if err != nil {
+		t.Fatalf("invalid selector %q: %v", selector, err)
+	}
+	var got []Sample
+	for _, s := range series {
+		got = append(got, s.Samples...)
+	}
+	sort.SliceStable(got, func(i, j int) bool {
+		return got[i].TimestampMs < got[j].TimestampMs
+	})
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("unexpected samples of %s\n got: %v\nwant: %v", selector, got, want)
+	}
+}
+
+// QueryHandler serves `/api/v1/query_range` and `/api/v1/query`, enforcing
+// the `extra_label` filters.
+func (m *MemTSDB) QueryHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		e, err := parseExpr(r.Form.Get("query"))
+		if err != nil {
+			writeQueryError(w, err)
+			return
+		}
+		var extra []matcher
+		for _, l := range r.Form["extra_label"] {
+			i := strings.IndexByte(l, '=')
+			if i <= 0 {
+				writeQueryError(w, fmt.Errorf("invalid extra_label %q", l))
+				return
+			}
+			extra = append(extra, matcher{name: l[:i], op: "=", value: l[i+1:]})
+		}
+		e = withMatchers(e, extra)
+
+		switch r.URL.Path {
+		case "/api/v1/query_range":
+			start, err1 := parseTime(r.Form.Get("start"))
+			end, err2 := parseTime(r.Form.Get("end"))
+			step, err3 := strconv.ParseFloat(r.Form.Get("step"), 64)
+			if err1 != nil || err2 != nil || err3 != nil || step <= 0 {
+				writeQueryError(w, fmt.Errorf("invalid range: start %q, end %q, step %q", r.Form.Get("start"), r.Form.Get("end"), r.Form.Get("step")))
+				return
+			}
+			writeQueryResult(w, "matrix", m.queryRange(e, start, end, step))
+		case "/api/v1/query":
+			at := float64(time.Now().Unix())
+			if raw := r.Form.Get("time"); len(raw) != 0 {
+				if at, err = parseTime(raw); err != nil {
+					writeQueryError(w, err)
+					return
+				}
+			}
+			writeQueryResult(w, "vector", m.query(e, at))
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+// ImportHandler serves `/api/v1/import`, the JSON lines store.NewHandlerWriter
+// posts.
+func (m *MemTSDB) ImportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		decoder := json.NewDecoder(r.Body)
+		var lines []exportedLine
+		for decoder.More() {
+			var line exportedLine
+			if err := decoder.Decode(&line); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			lines = append(lines, line)
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.err != nil {
+			http.Error(w, m.err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		for _, line := range lines {
+			for k, v := range line.Metric {
+				if len(v) == 0 {
+					delete(line.Metric, k)
+				}
+			}
+			m.write(line.Metric, line.Timestamps, line.Values)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ExportHandler serves `/api/v1/export` of the series matching a `match[]`
+// selector within [start, end] in seconds.
+func (m *MemTSDB) ExportHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sel, err1 := parseSelector(r.Form.Get("match[]"))
+		start, err2 := parseTime(r.Form.Get("start"))
+		end, err3 := parseTime(r.Form.Get("end"))
+		for _, err := range []error{err1, err2, err3} {
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		encoder := json.NewEncoder(w)
+		for _, key := range m.sortedKeys() {
+			s := m.series[key]
+			if !sel.matches(s.labels) {
+				continue
+			}
+			line := exportedLine{Metric: s.labels}
+			for _, sample := range s.window(int64(start*1000)-1, int64(end*1000)) {
+				line.Timestamps = append(line.Timestamps, sample.TimestampMs)
+				line.Values = append(line.Values, sample.Value)
+			}
+			if len(line.Timestamps) != 0 {
+				_ = encoder.Encode(&line)
+			}
+		}
+	}
+}
+
+// exportedLine is a series of the import and export JSON lines.
+type exportedLine struct {
+	Metric     map[string]string `json:"metric"`
+	Values     []float64         `json:"values"`
+	Timestamps []uint64          `json:"timestamps"`
+}
+
+type queryPoint struct {
+	labels map[string]string
+	points [][]interface{}
+}
+
+func (m *MemTSDB) queryRange(e expr, start, end, step float64) []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	byKey := make(map[string]*queryPoint)
+	var keys []string
+	for t := start; t <= end; t += step {
+		for _, v := range e.eval(m, t) {
+			key := seriesKey(v.labels)
+			p, ok := byKey[key]
+			if !ok {
+				p = &queryPoint{labels: v.labels}
+				byKey[key] = p
+				keys = append(keys, key)
+			}
+			p.points = append(p.points, []interface{}{t, formatValue(v.value)})
+		}
+	}
+	sort.Strings(keys)
+
+	res := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, map[string]interface{}{"metric": byKey[key].labels, "values": byKey[key].points})
+	}
+	return res
+}
+
+func (m *MemTSDB) query(e expr, at float64) []map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := e.eval(m, at)
+	sort.Slice(values, func(i, j int) bool {
+		return seriesKey(values[i].labels) < seriesKey(values[j].labels)
+	})
+	res := make([]map[string]interface{}, 0, len(values))
+	for _, v := range values {
+		res = append(res, map[string]interface{}{"metric": v.labels, "value": []interface{}{at, formatValue(v.value)}})
+	}
+	return res
+}
+
+func (m *MemTSDB) sortedKeys() []string {
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *memSeries) add(sample Sample) {
+	i := sort.Search(len(s.samples), func(i int) bool {
+		return s.samples[i].TimestampMs >= sample.TimestampMs
+	})
+	if i < len(s.samples) && s.samples[i].TimestampMs == sample.TimestampMs {
+		s.samples[i] = sample
+		return
+	}
+	s.samples = append(s.samples, Sample{})
+	copy(s.samples[i+1:], s.samples[i:])
+	s.samples[i] = sample
+}
+
+// window returns the samples in (fromMs, toMs].
+func (s *memSeries) window(fromMs, toMs int64) []Sample {
+	lo := sort.Search(len(s.samples), func(i int) bool {
+		return int64(s.samples[i].TimestampMs) > fromMs
+	})
+	hi := sort.Search(len(s.samples), func(i int) bool {
+		return int64(s.samples[i].TimestampMs) > toMs
+	})
+	return s.samples[lo:hi]
+}
+
+// metricLabels returns the labels of metric as stored by VictoriaMetrics,
+// without the empty ones.
+func metricLabels(metric *store.Metric) map[string]string {
+	labels := make(map[string]string)
+	for k, v := range metric.Metric.Labels {
+		labels[k] = v
+	}
+	for k, v := range map[string]string{
+		"__name__":    metric.Metric.Name,
+		"instance":    metric.Metric.Instance,
+		"job":         metric.Metric.Job,
+		"sql_digest":  metric.Metric.SQLDigest,
+		"plan_digest": metric.Metric.PlanDigest,
+	} {
+		labels[k] = v
+	}
+	for k, v := range labels {
+		if len(v) == 0 {
+			delete(labels, k)
+		}
+	}
+	return labels
+}
+
+func seriesKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(strconv.Quote(name))
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[name]))
+		sb.WriteByte(',')
+	}
+	return sb.String()
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+func parseTime(raw string) (float64, error) {
+	return strconv.ParseFloat(raw, 64)
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func writeQueryResult(w http.ResponseWriter, resultType string, result []map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"data":   map[string]interface{}{"resultType": resultType, "result": result},
+	})
+}
+
+func writeQueryError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":    "error",
+		"errorType": "bad_data",
+		"error":     err.Error(),
+	})
+}
+
+// value is a series of an expression evaluated at a time.
+type value struct {
+	labels map[string]string
+	value  float64
+}
+
+type expr interface {
+	eval(m *MemTSDB, at float64) []value
+}
+
+// selector is a series selector, e.g. `cpu_time{instance="a"}`.
+type selector struct {
+	matchers []matcher
+}
+
+type matcher struct {
+	name   string
+	op     string
+	value  string
+	regexp *regexp.Regexp
+}
+
+func (s selector) matches(labels map[string]string) bool {
+	for _, m := range s.matchers {
+		v := labels[m.name]
+		var ok bool
+		switch m.op {
+		case "=":
+			ok = v == m.value
+		case "!=":
+			ok = v != m.value
+		case "=~":
+			ok = m.regexp.MatchString(v)
+		case "!~":
+			ok = !m.regexp.MatchString(v)
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// eval returns the last sample within the lookback of each series.
+func (s selector) eval(m *MemTSDB, at float64) []value {
+	toMs := int64(at * 1000)
+	var res []value
+	for _, key := range m.sortedKeys() {
+		series := m.series[key]
+		if !s.matches(series.labels) {
+			continue
+		}
+		if samples := series.window(toMs-lookbackMillis, toMs); len(samples) != 0 {
+			res = append(res, value{labels: copyLabels(series.labels), value: samples[len(samples)-1].Value})
+		}
+	}
+	return res
+}
+
+// rangeFunc is a function over the samples within a range of each series,
+// dropping the metric name as PromQL does.
+type rangeFunc struct {
+	name      string
+	sel       selector
+	rangeSecs float64
+}
+
+func (f rangeFunc) eval(m *MemTSDB, at float64) []value {
+	toMs := int64(at * 1000)
+	fromMs := toMs - int64(f.rangeSecs*1000)
+	var res []value
+	for _, key := range m.sortedKeys() {
+		series := m.series[key]
+		if !f.sel.matches(series.labels) {
+			continue
+		}
+		samples := series.window(fromMs, toMs)
+		if len(samples) == 0 {
+			continue
+		}
+		var v float64
+		switch f.name {
+		case "sum_over_time":
+			for _, s := range samples {
+				v += s.Value
+			}
+		case "count_over_time":
+			v = float64(len(samples))
+		case "max_over_time":
+			v = math.Inf(-1)
+			for _, s := range samples {
+				v = math.Max(v, s.Value)
+			}
+		}
+		labels := copyLabels(series.labels)
+		delete(labels, "__name__")
+		res = append(res, value{labels: labels, value: v})
+	}
+	return res
+}
+
+// sum sums up the series of inner, grouped by the labels of by.
+type sum struct {
+	by    []string
+	inner expr
+}
+
+func (s sum) eval(m *MemTSDB, at float64) []value {
+	var res []value
+	groups := make(map[string]int)
+	for _, v := range s.inner.eval(m, at) {
+		labels := make(map[string]string)
+		for _, name := range s.by {
+			if lv, ok := v.labels[name]; ok {
+				labels[name] = lv
+			}
+		}
+		key := seriesKey(labels)
+		if i, ok := groups[key]; ok {
+			res[i].value += v.value
+			continue
+		}
+		groups[key] = len(res)
+		res = append(res, value{labels: labels, value: v.value})
+	}
+	return res
+}
+
+var (
+	selectorRegexp = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)?(?:\{(.*)\})?$`)
+	matcherRegexp  = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*")\s*$`)
+	rangeRegexp    = regexp.MustCompile(`^(.*)\[(\d+)([smhd]?)\]$`)
+	sumRegexp      = regexp.MustCompile(`^sum\s*(?:by\s*\(([^)]*)\)\s*)?\((.*)\)$`)
+	funcRegexp     = regexp.MustCompile(`^(sum_over_time|count_over_time|max_over_time)\s*\((.*)\)$`)
+)
+
+func parseExpr(q string) (expr, error) {
+	q = strings.TrimSpace(q)
+	if m := sumRegexp.FindStringSubmatch(q); m != nil {
+		inner, err := parseExpr(m[2])
+		if err != nil {
+			return nil, err
+		}
+		var by []string
+		for _, name := range strings.Split(m[1], ",") {
+			if name = strings.TrimSpace(name); len(name) != 0 {
+				by = append(by, name)
+			}
+		}
+		return sum{by: by, inner: inner}, nil
+	}
+	if m := funcRegexp.FindStringSubmatch(q); m != nil {
+		r := rangeRegexp.FindStringSubmatch(strings.TrimSpace(m[2]))
+		if r == nil {
+			return nil, fmt.Errorf("%s needs a range selector, got %q", m[1], m[2])
+		}
+		sel, err := parseSelector(r[1])
+		if err != nil {
+			return nil, err
+		}
+		n, _ := strconv.ParseFloat(r[2], 64)
+		unit := map[string]float64{"": 1, "s": 1, "m": 60, "h": 3600, "d": 86400}[r[3]]
+		return rangeFunc{name: m[1], sel: sel, rangeSecs: n * unit}, nil
+	}
+	return parseSelector(q)
+}
+
+// withMatchers adds matchers to the selectors of e.
+func withMatchers(e expr, matchers []matcher) expr {
+	if len(matchers) == 0 {
+		return e
+	}
+	switch e := e.(type) {
+	case selector:
+		e.matchers = append(append([]matcher(nil), e.matchers...), matchers...)
+		return e
+	case rangeFunc:
+		e.sel = withMatchers(e.sel, matchers).(selector)
+		return e
+	case sum:
+		e.inner = withMatchers(e.inner, matchers)
+		return e
+	}
+	return e
+}
+
+func parseSelector(q string) (selector, error) {
+	q = strings.TrimSpace(q)
+	m := selectorRegexp.FindStringSubmatch(q)
+	if m == nil || len(q) == 0 {
+		return selector{}, fmt.Errorf("unsupported query %q", q)
+	}
+
+	var sel selector
+	if len(m[1]) != 0 {
+		sel.matchers = append(sel.matchers, matcher{name: "__name__", op: "=", value: m[1]})
+	}
+	for _, raw := range splitMatchers(m[2]) {
+		mm := matcherRegexp.FindStringSubmatch(raw)
+		if mm == nil {
+			return selector{}, fmt.Errorf("unsupported label matcher %q", raw)
+		}
+		v, err := strconv.Unquote(mm[3])
+		if err != nil {
+			return selector{}, err
+		}
+		mt := matcher{name: mm[1], op: mm[2], value: v}
+		if mt.op == "=~" || mt.op == "!~" {
+			if mt.regexp, err = regexp.Compile("^(?:" + v + ")$"); err != nil {
+				return selector{}, err
+			}
+		}
+		sel.matchers = append(sel.matchers, mt)
+	}
+	return sel, nil
+}
+
+// splitMatchers splits the label matchers of a selector at the commas out of
+// the quoted values.
+func splitMatchers(s string) []string {
+	var res []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ',' && !quoted:
+			res = append(res, s[start:i])
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); len(rest) != 0 {
+		res = append(res, s[start:])
+	}
+	return res
+}
@@ -0,0 +1,10 @@
+package utils
+
+// Version is the version of the build, set with
+// `-ldflags "-X github.com/zhongzc/diag_backend/utils.Version=v1.2.3"`.
+var Version = "dev"
+
+// DefaultUserAgent identifies this backend in the requests it sends.
+func DefaultUserAgent() string {
+	return "diag-backend/" + Version
+}